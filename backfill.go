@@ -0,0 +1,140 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/fstab/grok_exporter/config/v2"
+	"github.com/fstab/grok_exporter/exporter"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// maxGapSteps is the maximum number of steps without events between two events. All snapshots are kept in memory
+// until the output is written, so a single wrong timestamp, like a date in 1970, must not fill millions of steps.
+const maxGapSteps = 10000
+
+// runBackfill processes all lines like runBatch, but instead of the final values it writes the values of the configured
+// metrics at each step of the resolution in OpenMetrics format. The time is taken from the 'timestamp' of the metrics.
+func runBackfill(cfg *v2.Config, patterns *exporter.Patterns, metrics []exporter.Metric, mon *selfMonitoring, outputPath string, resolution time.Duration) error {
+	if resolution <= 0 {
+		return fmt.Errorf("invalid '-resolution' %v: must be positive", resolution)
+	}
+	if !anyMetricHasTimestamp(cfg) {
+		return fmt.Errorf("'-backfill' requires at least one metric with 'timestamp'")
+	}
+	// The built-in grok_exporter metrics are not included.
+	registry := prometheus.NewRegistry()
+	for _, m := range metrics {
+		if err := registry.Register(m.Collector()); err != nil {
+			return err
+		}
+	}
+	b := &backfill{
+		gatherer:   registry,
+		resolution: resolution,
+		out:        exporter.NewOpenMetricsWriter(),
+	}
+	err := processAllLines(cfg, patterns, mon, func(line *fswatcher.Line) {
+		if eventTime, ok := lineTime(metrics, line); ok {
+			b.advance(eventTime)
+		}
+		processLine(metrics, mon, line)
+	})
+	if err != nil && err != errInterrupted {
+		return err
+	}
+	// When interrupted, the steps up to the last processed line are written, see runBatch().
+	if finishErr := b.finish(); finishErr != nil {
+		return finishErr
+	}
+	writeErr := writeOutput(outputPath, b.out.Write)
+	if err != nil {
+		return err
+	}
+	return writeErr
+}
+
+// backfill writes a snapshot of the metrics whenever the event time passes a step.
+// The snapshot for a step includes all events up to and including the step's time.
+type backfill struct {
+	gatherer   prometheus.Gatherer
+	resolution time.Duration
+	step       time.Time // zero before the first event
+	out        *exporter.OpenMetricsWriter
+	err        error
+}
+
+// advance is called before the event is processed. If the event belongs to a later step, the current values are
+// written for the current step and for all steps without events up to the event's step, so that the series don't
+// become stale in Prometheus.
+func (b *backfill) advance(eventTime time.Time) {
+	step := eventTime.Truncate(b.resolution)
+	if step.Before(eventTime) {
+		step = step.Add(b.resolution)
+	}
+	if b.step.IsZero() {
+		b.step = step
+		return
+	}
+	if !step.After(b.step) || b.err != nil {
+		return // events that are older than the current step are processed in the current step
+	}
+	if nSteps := step.Sub(b.step) / b.resolution; nSteps > maxGapSteps {
+		b.err = fmt.Errorf("event time %v is %v steps of '-resolution' %v after the previous step %v, but at most %v steps are filled between two events: check the timestamps in the logs, or use a larger '-resolution'", eventTime.Format(time.RFC3339), int64(nSteps), b.resolution, b.step.Format(time.RFC3339), maxGapSteps)
+		return
+	}
+	metricFamilies, err := b.gatherer.Gather()
+	if err != nil {
+		b.err = fmt.Errorf("failed to gather metrics: %v", err)
+		return
+	}
+	for ; b.step.Before(step); b.step = b.step.Add(b.resolution) {
+		b.out.Add(metricFamilies, b.step)
+	}
+}
+
+// finish writes the snapshot for the last step.
+func (b *backfill) finish() error {
+	if !b.step.IsZero() {
+		b.advance(b.step.Add(b.resolution))
+	}
+	return b.err
+}
+
+// lineTime returns the time of the first metric with a 'timestamp' that matches the line.
+// Times in the future are ignored, the line is processed in the current step.
+func lineTime(metrics []exporter.Metric, line *fswatcher.Line) (time.Time, bool) {
+	for _, metric := range metrics {
+		if !metric.ProcessesInput(line.Input) {
+			continue
+		}
+		// Errors are reported when the line is processed.
+		if eventTime, ok, _ := metric.EventTime(line); ok && !eventTime.After(time.Now()) {
+			return eventTime, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func anyMetricHasTimestamp(cfg *v2.Config) bool {
+	for _, metric := range cfg.Metrics {
+		if len(metric.Timestamp) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"github.com/fstab/grok_exporter/exporter"
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackfillSteps(t *testing.T) {
+	b, counter := newTestBackfill(time.Minute)
+	start := time.Date(2019, 1, 1, 10, 0, 30, 0, time.UTC)
+	event := func(offset time.Duration) {
+		b.advance(start.Add(offset))
+		counter.Inc()
+	}
+
+	event(0)                              // 10:00:30, step 10:01
+	event(30 * time.Second)               // 10:01:00, the step includes events at the step's time
+	event(-20 * time.Second)              // 10:00:10, older events are counted in the current step
+	event(2*time.Minute + 40*time.Second) // 10:03:10, step 10:04, writes 10:01, and fills 10:02 and 10:03
+	event(3*time.Minute + 30*time.Second) // 10:04:00, step 10:04
+	err := b.finish()                     // writes 10:04
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSamples(t, b,
+		"test_backfill_total 3 1546336860\n", // 10:01
+		"test_backfill_total 3 1546336920\n", // 10:02
+		"test_backfill_total 3 1546336980\n", // 10:03
+		"test_backfill_total 5 1546337040\n", // 10:04
+	)
+}
+
+func TestBackfillNoEvents(t *testing.T) {
+	b, _ := newTestBackfill(time.Minute)
+	err := b.finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSamples(t, b)
+}
+
+func TestBackfillMaxGapSteps(t *testing.T) {
+	b, counter := newTestBackfill(time.Second)
+	start := time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+	b.advance(start)
+	counter.Inc()
+	b.advance(start.Add(maxGapSteps * time.Second)) // fills exactly maxGapSteps steps
+	counter.Inc()
+	b.advance(time.Date(2019, 1, 1, 10, 0, 0, 0, time.UTC))
+	err := b.finish()
+	if err == nil || !strings.Contains(err.Error(), "at most 10000 steps are filled between two events") {
+		t.Fatalf("expected error for a gap of more than %v steps, but got %v", maxGapSteps, err)
+	}
+}
+
+func newTestBackfill(resolution time.Duration) (*backfill, prometheus.Counter) {
+	counter := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "test_backfill_total",
+		Help: "Test counter.",
+	})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(counter)
+	return &backfill{
+		gatherer:   registry,
+		resolution: resolution,
+		out:        exporter.NewOpenMetricsWriter(),
+	}, counter
+}
+
+func expectSamples(t *testing.T, b *backfill, samples ...string) {
+	var buf bytes.Buffer
+	err := b.out.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual []string
+	for _, line := range strings.SplitAfter(buf.String(), "\n") {
+		if strings.HasPrefix(line, "test_backfill_total ") {
+			actual = append(actual, line)
+		}
+	}
+	if strings.Join(actual, "") != strings.Join(samples, "") {
+		t.Fatalf("expected samples:\n%v\nbut got:\n%v", strings.Join(samples, ""), buf.String())
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/fstab/grok_exporter/config/v2"
+	"github.com/fstab/grok_exporter/exporter"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// runBatch processes all lines until the inputs reached end of file, and writes the metrics in text format
+// to outputPath, or to stdout if outputPath is empty. No ports are opened in batch mode.
+func runBatch(cfg *v2.Config, patterns *exporter.Patterns, metrics []exporter.Metric, mon *selfMonitoring, outputPath string) error {
+	// The metrics of the grok_exporter process itself are not useful when analyzing historical logs.
+	prometheus.Unregister(prometheus.NewGoCollector())
+	prometheus.Unregister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+
+	err := processAllLines(cfg, patterns, mon, func(line *fswatcher.Line) {
+		processLine(metrics, mon, line)
+	})
+	if err != nil && err != errInterrupted {
+		return err
+	}
+	// When interrupted, the metrics of the lines that were processed are written, because the position files
+	// record these lines as read. The next run continues with the remaining lines.
+	writeErr := writeOutput(outputPath, writeMetrics)
+	if err != nil {
+		return err
+	}
+	return writeErr
+}
+
+var errInterrupted = fmt.Errorf("interrupted before all log lines were processed")
+
+// processAllLines starts the tailers, and calls process for each line until the inputs reached end of file.
+// If the run is interrupted, the lines that were already read are processed, and errInterrupted is returned.
+func processAllLines(cfg *v2.Config, patterns *exporter.Patterns, mon *selfMonitoring, process func(line *fswatcher.Line)) error {
+	tail, _, err := startTailers(cfg, patterns, mon)
+	if err != nil {
+		return err
+	}
+
+	// When the run is interrupted, the lines that were already read are processed before returning,
+	// because they are recorded in the position files, see drainTailers().
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+
+	errors := tail.Errors()
+	for {
+		select {
+		case err, open := <-errors:
+			if !open {
+				errors = nil
+				continue
+			}
+			drainTailers(tail, process)
+			return readError(err)
+		case line, open := <-tail.Lines():
+			if !open {
+				tail.Close()
+				return nil
+			}
+			process(line)
+		case <-shutdown:
+			drainTailers(tail, process)
+			return errInterrupted
+		}
+	}
+}
+
+// writeMetrics writes the metrics in the Prometheus text exposition format.
+func writeMetrics(w io.Writer) error {
+	metricFamilies, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics: %v", err)
+	}
+	for _, metricFamily := range metricFamilies {
+		if _, err = expfmt.MetricFamilyToText(w, metricFamily); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeOutput calls write with a writer for outputPath, or for stdout if outputPath is empty.
+func writeOutput(outputPath string, write func(w io.Writer) error) error {
+	var err error
+	out := os.Stdout
+	if len(outputPath) > 0 {
+		out, err = os.Create(outputPath)
+		if err != nil {
+			return fmt.Errorf("failed to write metrics: %v", err)
+		}
+	}
+	w := bufio.NewWriter(out)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if out != os.Stdout {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write metrics: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/fstab/grok_exporter/config"
+	"github.com/fstab/grok_exporter/config/v2"
+	"github.com/fstab/grok_exporter/exporter"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const batchConfig = `
+global:
+    config_version: 2
+input:
+    type: file
+    path: {{LOGFILE}}
+    readall: true
+    mode: batch
+grok:
+    additional_patterns:
+    - 'WORD \b\w+\b'
+metrics:
+    - type: counter
+      name: test_batch_lines_total
+      help: Lines by level.
+      match: '%{WORD:level}: .*'
+      labels:
+          level: '{{.level}}'
+`
+
+func TestBatchTextOutput(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	logfile := writeFile(t, dir, "test.log", "error: a\ninfo: b\nerror: c") // the last line has no trailing newline
+	output := filepath.Join(dir, "metrics.txt")
+
+	cfg, patterns, metrics := loadTestConfig(t, strings.Replace(batchConfig, "{{LOGFILE}}", logfile, 1))
+	defer unregisterAll(metrics)
+	err := runBatch(cfg, patterns, metrics, testSelfMonitoring(cfg, metrics), output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"# TYPE test_batch_lines_total counter\n",
+		"test_batch_lines_total{level=\"error\"} 2\n",
+		"test_batch_lines_total{level=\"info\"} 1\n",
+	} {
+		if !strings.Contains(string(result), expected) {
+			t.Fatalf("expected %q in the output, but got:\n%v", expected, string(result))
+		}
+	}
+}
+
+func TestBatchMissingFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "metrics.txt")
+
+	cfg, patterns, metrics := loadTestConfig(t, strings.Replace(batchConfig, "{{LOGFILE}}", filepath.Join(dir, "missing.log"), 1))
+	defer unregisterAll(metrics)
+	err := runBatch(cfg, patterns, metrics, testSelfMonitoring(cfg, metrics), output)
+	if err == nil || !strings.Contains(err.Error(), "no such file") {
+		t.Fatalf("expected 'no such file' error, but got %v", err)
+	}
+	if _, err = os.Stat(output); !os.IsNotExist(err) {
+		t.Fatalf("the output must not be written if reading the input failed")
+	}
+}
+
+func TestBatchWriteOutputErrors(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	err := writeOutput(filepath.Join(dir, "no-such-dir", "metrics.txt"), writeMetrics)
+	if err == nil || !strings.HasPrefix(err.Error(), "failed to write metrics") {
+		t.Fatalf("expected error for output in a missing directory, but got %v", err)
+	}
+	err = writeOutput(filepath.Join(dir, "metrics.txt"), func(w io.Writer) error {
+		return fmt.Errorf("test error")
+	})
+	if err == nil || !strings.Contains(err.Error(), "test error") {
+		t.Fatalf("expected the error of the write function, but got %v", err)
+	}
+}
+
+const drainConfig = `
+global:
+    config_version: 2
+input:
+    type: file
+    path: {{LOGFILE}}
+    readall: true
+    position_file: {{POSITIONS}}
+    multiline:
+        mode: start
+        pattern: '^start'
+        flush_timeout: 1h
+grok:
+    additional_patterns:
+    - 'WORD \b\w+\b'
+metrics:
+    - type: counter
+      name: test_drain_events_total
+      help: Multiline events.
+      match: 'start'
+`
+
+func TestDrainTailersProcessesPendingEvents(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	logfile := writeFile(t, dir, "test.log", "start a\ncont a\nstart b\ncont b\n")
+	positions := filepath.Join(dir, "positions.json")
+
+	cfgString := strings.NewReplacer("{{LOGFILE}}", logfile, "{{POSITIONS}}", positions).Replace(drainConfig)
+	cfg, patterns, metrics := loadTestConfig(t, cfgString)
+	defer unregisterAll(metrics)
+	tail, _, err := startTailers(cfg, patterns, testSelfMonitoring(cfg, metrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first event is complete when 'start b' is read, the second event is pending until the flush timeout.
+	if line := <-tail.Lines(); line.Line != "start a\ncont a" {
+		t.Fatalf("unexpected line %q", line.Line)
+	}
+	var drained []string
+	drainTailers(tail, func(line *fswatcher.Line) {
+		drained = append(drained, line.Line)
+	})
+	if len(drained) != 1 || drained[0] != "start b\ncont b" {
+		t.Fatalf("expected the pending event to be processed, but got %q", drained)
+	}
+	if _, err := os.Stat(positions); err != nil {
+		t.Fatalf("position file not written: %v", err)
+	}
+}
+
+// loadTestConfig creates and registers the metrics for the configuration.
+func loadTestConfig(t *testing.T, cfgString string) (*v2.Config, *exporter.Patterns, []exporter.Metric) {
+	cfg, _, err := config.LoadConfigString([]byte(cfgString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	patterns, err := initPatterns(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, err := createMetrics(cfg, patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range metrics {
+		prometheus.MustRegister(m.Collector())
+	}
+	return cfg, patterns, metrics
+}
+
+func unregisterAll(metrics []exporter.Metric) {
+	for _, m := range metrics {
+		prometheus.Unregister(m.Collector())
+	}
+}
+
+var (
+	testMon     *selfMonitoring
+	testMonOnce sync.Once
+)
+
+// testSelfMonitoring returns the self-monitoring metrics. They are registered only once, because they are
+// registered with the default registry.
+func testSelfMonitoring(cfg *v2.Config, metrics []exporter.Metric) *selfMonitoring {
+	testMonOnce.Do(func() {
+		testMon = initSelfMonitoring(cfg, metrics)
+	})
+	testMon.initLabels(cfg, metrics)
+	return testMon
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "grok_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
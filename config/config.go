@@ -19,6 +19,7 @@ import (
 	"github.com/fstab/grok_exporter/config/v1"
 	"github.com/fstab/grok_exporter/config/v2"
 	"io/ioutil"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -31,22 +32,56 @@ func LoadConfigFile(filename string) (*v2.Config, string, error) {
 	if err != nil {
 		return nil, "", fmt.Errorf("Failed to load %v: %v", filename, err.Error())
 	}
-	cfg, warn, err := LoadConfigString(content)
+	cfg, warn, err := loadConfig(content, filepath.Dir(filename))
 	if err != nil {
 		return nil, warn, fmt.Errorf("Failed to load %v: %v", filename, err.Error())
 	}
 	return cfg, warn, nil
 }
 
+// Relative paths of included files and ${file:...} references are resolved relative to the current working directory.
 func LoadConfigString(content []byte) (*v2.Config, string, error) {
+	return loadConfig(content, "")
+}
+
+func loadConfig(content []byte, baseDir string) (*v2.Config, string, error) {
+	content, errs := v2.ExpandVariables(content, baseDir)
+	if len(errs) > 0 {
+		return nil, "", errs[0]
+	}
 	version, warn, err := findVersion(string(content))
 	if err != nil {
 		return nil, warn, err
 	}
-	cfg, err := unmarshal(content, version)
+	cfg, err := unmarshal(content, version, baseDir)
 	return cfg, warn, err
 }
 
+// ValidateConfigFile is like LoadConfigFile, but reports all errors instead of stopping at the first error.
+// The returned config is nil if the file cannot be parsed at all.
+// Config files with 'config_version: 1' are not validated in detail, only the first error is reported.
+func ValidateConfigFile(filename string) (*v2.Config, string, []*v2.ValidationError) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, "", []*v2.ValidationError{{Err: fmt.Errorf("Failed to load %v: %v", filename, err.Error())}}
+	}
+	// Undefined variables are replaced with the empty string, so we can continue to look for more errors.
+	content, expandErrs := v2.ExpandVariables(content, filepath.Dir(filename))
+	version, warn, err := findVersion(string(content))
+	if err != nil {
+		return nil, warn, append(expandErrs, &v2.ValidationError{Err: err})
+	}
+	if version != 2 {
+		cfg, err := unmarshal(content, version, "")
+		if err != nil {
+			return nil, warn, append(expandErrs, &v2.ValidationError{Err: err})
+		}
+		return cfg, warn, expandErrs
+	}
+	cfg, errs := v2.Validate(content, filepath.Dir(filename))
+	return cfg, warn, append(expandErrs, errs...)
+}
+
 func findVersion(content string) (int, string, error) {
 	versionExpr := regexp.MustCompile(`"?global"?:\s*"?config_version"?:[\t\f ]*(\S+)`)
 	versionInfo := versionExpr.FindStringSubmatch(content)
@@ -70,12 +105,12 @@ func findVersion(content string) (int, string, error) {
 	}
 }
 
-func unmarshal(content []byte, version int) (*v2.Config, error) {
+func unmarshal(content []byte, version int, baseDir string) (*v2.Config, error) {
 	switch version {
 	case 1:
 		return v1.Unmarshal(content)
 	case 2:
-		return v2.Unmarshal(content)
+		return v2.UnmarshalWithBaseDir(content, baseDir)
 	default:
 		return nil, fmt.Errorf("global.config_version %v is not supported.", version)
 	}
@@ -15,6 +15,11 @@
 package config
 
 import (
+	"github.com/fstab/grok_exporter/config/v2"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -66,3 +71,117 @@ func expectVersion(t *testing.T, config string, expectedVersion int, warningExpe
 		t.Fatalf("expected version %v, but found %v", expectedVersion, version)
 	}
 }
+
+func TestVariableExpansion(t *testing.T) {
+	secret, err := ioutil.TempFile("", "grok_exporter_secret")
+	if err != nil {
+		t.Fatalf("failed to create secret file: %v", err)
+	}
+	defer os.Remove(secret.Name())
+	secret.WriteString("/path/from/secret\n")
+	secret.Close()
+	os.Setenv("GROK_EXPORTER_TEST_VERSION", "2")
+	os.Setenv("GROK_EXPORTER_TEST_PORT", "2222")
+	defer os.Unsetenv("GROK_EXPORTER_TEST_VERSION")
+	defer os.Unsetenv("GROK_EXPORTER_TEST_PORT")
+	os.Unsetenv("GROK_EXPORTER_TEST_UNDEFINED")
+	cfgString := exampleConfig
+	cfgString = strings.Replace(cfgString, "config_version: 2", "config_version: ${GROK_EXPORTER_TEST_VERSION}", 1)
+	cfgString = strings.Replace(cfgString, "port: 1111", "port: ${GROK_EXPORTER_TEST_PORT}", 1)
+	cfgString = strings.Replace(cfgString, "patterns_dir: b/c", "patterns_dir: ${GROK_EXPORTER_TEST_UNDEFINED:-b/d}", 1)
+	cfgString = strings.Replace(cfgString, "path: x/x/x", "path: ${file:"+secret.Name()+"}", 1)
+	cfgString = strings.Replace(cfgString, "Some text here", "Some $${text} here", 1)
+	cfg, _, err := LoadConfigString([]byte(cfgString))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Global.ConfigVersion != 2 || cfg.Server.Port != 2222 || cfg.Grok.PatternsDir != "b/d" || cfg.Input.Path != "/path/from/secret" {
+		t.Fatalf("variables not expanded correctly:\n%v", cfg)
+	}
+	if cfg.Metrics[0].Match != "Some ${text} here, then a %{DATE}." {
+		t.Fatalf("escaped variable not handled correctly: %v", cfg.Metrics[0].Match)
+	}
+	cfgString = strings.Replace(exampleConfig, "port: 1111", "port: ${GROK_EXPORTER_TEST_UNDEFINED}", 1)
+	_, _, err = LoadConfigString([]byte(cfgString))
+	if err == nil || !strings.Contains(err.Error(), "line 17:") || !strings.Contains(err.Error(), "'GROK_EXPORTER_TEST_UNDEFINED' is not defined") {
+		t.Fatalf("expected error for undefined variable, but got %v", err)
+	}
+}
+
+func TestVariableExpansionYamlSpecialCharacters(t *testing.T) {
+	os.Setenv("GROK_EXPORTER_TEST_COLON", "a: b")
+	os.Setenv("GROK_EXPORTER_TEST_HASH", "a #b")
+	os.Setenv("GROK_EXPORTER_TEST_QUOTES", `x" 'y' \z`)
+	os.Setenv("GROK_EXPORTER_TEST_NEWLINE", "line 1\nevil: true")
+	os.Setenv("GROK_EXPORTER_TEST_FLOW", "a, b]")
+	os.Setenv("GROK_EXPORTER_TEST_PORT", "2222")
+	for _, name := range []string{"COLON", "HASH", "QUOTES", "NEWLINE", "FLOW", "PORT"} {
+		defer os.Unsetenv("GROK_EXPORTER_TEST_" + name)
+	}
+	os.Unsetenv("GROK_EXPORTER_TEST_UNDEFINED")
+	for _, test := range []struct {
+		yaml        string
+		expected    interface{}
+		expectedErr string
+	}{
+		{
+			yaml:     "key: ${GROK_EXPORTER_TEST_COLON}\nother: x\n",
+			expected: map[interface{}]interface{}{"key": "a: b", "other": "x"},
+		},
+		{
+			yaml:     "key: ${GROK_EXPORTER_TEST_HASH} # ${GROK_EXPORTER_TEST_UNDEFINED}\n# ${GROK_EXPORTER_TEST_UNDEFINED}\n",
+			expected: map[interface{}]interface{}{"key": "a #b"},
+		},
+		{
+			yaml:     "- ${GROK_EXPORTER_TEST_NEWLINE}\n- ${GROK_EXPORTER_TEST_PORT}\n",
+			expected: []interface{}{"line 1\nevil: true", 2222},
+		},
+		{
+			yaml:     "key: \"${GROK_EXPORTER_TEST_QUOTES} ${GROK_EXPORTER_TEST_NEWLINE}\"\n",
+			expected: map[interface{}]interface{}{"key": "x\" 'y' \\z line 1\nevil: true"},
+		},
+		{
+			yaml:     "key: '${GROK_EXPORTER_TEST_QUOTES}: ${GROK_EXPORTER_TEST_COLON}'\n",
+			expected: map[interface{}]interface{}{"key": "x\" 'y' \\z: a: b"},
+		},
+		{
+			yaml:     "key: |\n    ${GROK_EXPORTER_TEST_NEWLINE}\n    # no comment\nother: x\n",
+			expected: map[interface{}]interface{}{"key": "line 1\nevil: true\n# no comment\n", "other": "x"},
+		},
+		{
+			yaml:     "- key: |\n    ${GROK_EXPORTER_TEST_PORT}\n  other: ${GROK_EXPORTER_TEST_NEWLINE}\n",
+			expected: []interface{}{map[interface{}]interface{}{"key": "2222\n", "other": "line 1\nevil: true"}},
+		},
+		{
+			yaml:     "key: [${GROK_EXPORTER_TEST_FLOW}, ${GROK_EXPORTER_TEST_PORT}]\nport: ${GROK_EXPORTER_TEST_PORT}\n",
+			expected: map[interface{}]interface{}{"key": []interface{}{"a, b]", 2222}, "port": 2222},
+		},
+		{
+			yaml:        "key: ${GROK_EXPORTER_TEST_COLON}/suffix\n",
+			expectedErr: "the value of ${GROK_EXPORTER_TEST_COLON} contains characters with a special meaning in YAML",
+		},
+		{
+			yaml:        "key: '${GROK_EXPORTER_TEST_NEWLINE}'\n",
+			expectedErr: "the value of ${GROK_EXPORTER_TEST_NEWLINE} contains a line break",
+		},
+	} {
+		content, errs := v2.ExpandVariables([]byte(test.yaml), "")
+		if len(test.expectedErr) > 0 {
+			if len(errs) != 1 || !strings.Contains(errs[0].Error(), test.expectedErr) {
+				t.Fatalf("%q: expected error %q, but got %v", test.yaml, test.expectedErr, errs)
+			}
+			continue
+		}
+		if len(errs) > 0 {
+			t.Fatalf("%q: unexpected error: %v", test.yaml, errs[0])
+		}
+		var actual interface{}
+		err := yaml.Unmarshal(content, &actual)
+		if err != nil {
+			t.Fatalf("%q: expanded YAML is invalid: %v\n%s", test.yaml, err, content)
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Fatalf("%q: expected %#v, but got %#v\n%s", test.yaml, test.expected, actual, content)
+		}
+	}
+}
@@ -16,26 +16,70 @@ package v2
 
 import (
 	"fmt"
+	"github.com/fstab/grok_exporter/tailer/charset"
+	"github.com/fstab/grok_exporter/tailer/glob"
+	"github.com/fstab/grok_exporter/tailer/jsonpath"
 	"github.com/fstab/grok_exporter/template"
+	"github.com/prometheus/common/model"
 	"gopkg.in/yaml.v2"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
 const (
-	defaultRetentionCheckInterval = 53 * time.Second
-	inputTypeStdin                = "stdin"
-	inputTypeFile                 = "file"
-	inputTypeWebhook              = "webhook"
+	defaultRetentionCheckInterval   = 53 * time.Second
+	inputTypeStdin                  = "stdin"
+	inputTypeFile                   = "file"
+	inputTypeWebhook                = "webhook"
+	inputTypeSyslog                 = "syslog"
+	inputTypeCommand                = "command"
+	defaultInputName                = "default"
+	inputModeTail                   = "tail"
+	inputModeBatch                  = "batch"
+	defaultMultilineMaxLines        = 500
+	defaultMultilineFlushTimeout    = 5 * time.Second
+	defaultPositionFlushInterval    = 10 * time.Second
+	defaultMaxLineAction            = "truncate"
+	defaultCommandRestart           = "always"
+	defaultCommandRestartDelay      = time.Second
+	defaultCommandRestartMaxDelay   = time.Minute
+	defaultWebhookPath              = "/webhook"
+	defaultWebhookFormat            = "text_single"
+	defaultWebhookJsonSelector      = ".message"
+	defaultFluentBitJsonSelector    = ".log" // Fluent Bit's tail input stores the line in the 'log' field
+	defaultWebhookTextBulkSeparator = "\n\n"
+	defaultWebhookMaxBodySize       = 10 * 1024 * 1024
+	defaultWebhookQueueSize         = 100
+	defaultTimestampPolicy          = "update"
+	defaultTimestampMaxFuture       = 5 * time.Minute
+	defaultBufferOverflowPolicy     = "drop_all"
+	defaultBufferSpillThreshold     = 10000
+	defaultBufferSpillSegmentBytes  = 16 * 1024 * 1024
 )
 
 func Unmarshal(config []byte) (*Config, error) {
+	return UnmarshalWithBaseDir(config, "")
+}
+
+// UnmarshalWithBaseDir is like Unmarshal, but relative paths in 'global.include' and 'global.metrics_dir'
+// are resolved relative to baseDir. Usually, baseDir is the directory of the config file.
+// Like Validate(), it is strict: Unknown keys and duplicate keys are errors.
+func UnmarshalWithBaseDir(config []byte, baseDir string) (*Config, error) {
 	cfg := &Config{}
-	err := yaml.Unmarshal(config, cfg)
+	err := yaml.UnmarshalStrict(config, cfg)
 	if err != nil {
 		return nil, fmt.Errorf("invalid configuration: %v. make sure to use 'single quotes' around strings with special characters (like match patterns or label templates), and make sure to use '-' only for lists (metrics) but not for maps (labels).", err.Error())
 	}
+	cfg.Metrics.setLineNumbers(config)
+	errs := cfg.addIncludes(baseDir, true)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
 	err = AddDefaultsAndValidate(cfg)
 	if err != nil {
 		return nil, err
@@ -46,6 +90,7 @@ func Unmarshal(config []byte) (*Config, error) {
 type Config struct {
 	Global  GlobalConfig  `yaml:",omitempty"`
 	Input   InputConfig   `yaml:",omitempty"`
+	Inputs  InputsConfig  `yaml:",omitempty"`
 	Grok    GrokConfig    `yaml:",omitempty"`
 	Metrics MetricsConfig `yaml:",omitempty"`
 	Server  ServerConfig  `yaml:",omitempty"`
@@ -54,44 +99,150 @@ type Config struct {
 type GlobalConfig struct {
 	ConfigVersion          int           `yaml:"config_version,omitempty"`
 	RetentionCheckInterval time.Duration `yaml:"retention_check_interval,omitempty"` // implicitly parsed with time.ParseDuration()
+	Include                []string      `yaml:",omitempty"`                         // glob patterns of files with additional metrics
+	MetricsDir             string        `yaml:"metrics_dir,omitempty"`              // directory with *.yml files with additional metrics
+	BufferSpill            *SpillConfig  `yaml:"buffer_spill,omitempty"`
+}
+
+// SpillConfig configures writing lines to disk when the in-memory line buffer is full.
+type SpillConfig struct {
+	Dir          string `yaml:",omitempty"`
+	Threshold    int    `yaml:",omitempty"`              // number of lines in memory before lines are written to disk
+	SegmentBytes int    `yaml:"segment_bytes,omitempty"` // size of a segment file before a new one is started
 }
 
 type InputConfig struct {
-	Type                       string        `yaml:",omitempty"`
-	Path                       string        `yaml:",omitempty"`
-	FailOnMissingLogfileString string        `yaml:"fail_on_missing_logfile,omitempty"` // cannot use bool directly, because yaml.v2 doesn't support true as default value.
-	FailOnMissingLogfile       bool          `yaml:"-"`
-	Readall                    bool          `yaml:",omitempty"`
-	PollIntervalSeconds        string        `yaml:"poll_interval_seconds,omitempty"` // TODO: Use time.Duration directly
-	PollInterval               time.Duration `yaml:"-"`                               // parsed version of PollIntervalSeconds
-	MaxLinesInBuffer           int           `yaml:"max_lines_in_buffer,omitempty"`
-	WebhookPath                string        `yaml:"webhook_path,omitempty"`
-	WebhookFormat              string        `yaml:"webhook_format,omitempty"`
-	WebhookJsonSelector        string        `yaml:"webhook_json_selector,omitempty"`
-	WebhookTextBulkSeparator   string        `yaml:"webhook_text_bulk_separator,omitempty"`
+	Name                       string            `yaml:",omitempty"`
+	Type                       string            `yaml:",omitempty"`
+	Path                       string            `yaml:",omitempty"`
+	Paths                      []PathConfig      `yaml:",omitempty"`                        // alternative to Path for watching multiple globs
+	FailOnMissingLogfileString string            `yaml:"fail_on_missing_logfile,omitempty"` // cannot use bool directly, because yaml.v2 doesn't support true as default value.
+	FailOnMissingLogfile       bool              `yaml:"-"`
+	Readall                    bool              `yaml:",omitempty"`
+	PollIntervalSeconds        string            `yaml:"poll_interval_seconds,omitempty"` // TODO: Use time.Duration directly
+	PollInterval               time.Duration     `yaml:"-"`                               // parsed version of PollIntervalSeconds
+	MaxLinesInBuffer           int               `yaml:"max_lines_in_buffer,omitempty"`
+	BufferOverflowPolicy       string            `yaml:"buffer_overflow_policy,omitempty"` // drop_all, drop_oldest, drop_newest, or block
+	PositionFile               string            `yaml:"position_file,omitempty"`
+	PositionFlushInterval      time.Duration     `yaml:"position_flush_interval,omitempty"` // implicitly parsed with time.ParseDuration()
+	MaxLineBytes               int               `yaml:"max_line_bytes,omitempty"`          // 0 means unlimited
+	MaxLineAction              string            `yaml:"max_line_action,omitempty"`         // truncate or skip
+	InvalidUtf8                string            `yaml:"invalid_utf8,omitempty"`            // replace or reject, empty means lines are not checked
+	Encoding                   string            `yaml:",omitempty"`                        // character encoding, empty means UTF-8
+	Mode                       string            `yaml:",omitempty"`                        // tail or batch
+	WebhookPath                string            `yaml:"webhook_path,omitempty"`
+	WebhookFormat              string            `yaml:"webhook_format,omitempty"`
+	WebhookJsonSelector        string            `yaml:"webhook_json_selector,omitempty"`
+	WebhookTextBulkSeparator   string            `yaml:"webhook_text_bulk_separator,omitempty"`
+	WebhookJsonFields          map[string]string `yaml:"webhook_json_fields,omitempty"` // metadata field name -> selector
+	WebhookBasicAuthUsername   string            `yaml:"webhook_basic_auth_username,omitempty"`
+	WebhookBasicAuthPassword   string            `yaml:"webhook_basic_auth_password,omitempty"`
+	WebhookBearerTokenFile     string            `yaml:"webhook_bearer_token_file,omitempty"`
+	WebhookSignature           string            `yaml:"webhook_signature,omitempty"` // github or slack
+	WebhookSignatureSecret     string            `yaml:"webhook_signature_secret,omitempty"`
+	WebhookMaxBodySize         int               `yaml:"webhook_max_body_size,omitempty"` // bytes
+	WebhookRateLimit           float64           `yaml:"webhook_rate_limit,omitempty"`    // requests per second per client, 0 means unlimited
+	WebhookRateLimitBurst      int               `yaml:"webhook_rate_limit_burst,omitempty"`
+	WebhookQueueSize           int               `yaml:"webhook_queue_size,omitempty"` // number of requests
+	SyslogUdpAddress           string            `yaml:"syslog_udp_address,omitempty"`
+	SyslogTcpAddress           string            `yaml:"syslog_tcp_address,omitempty"`
+	SyslogUnixSocket           string            `yaml:"syslog_unix_socket,omitempty"`
+	SyslogTlsCert              string            `yaml:"syslog_tls_cert,omitempty"`
+	SyslogTlsKey               string            `yaml:"syslog_tls_key,omitempty"`
+	Command                    []string          `yaml:"command,omitempty"`     // executable and arguments
+	CommandEnv                 map[string]string `yaml:"command_env,omitempty"` // added to grok_exporter's environment
+	CommandDir                 string            `yaml:"command_dir,omitempty"`
+	CommandRestart             string            `yaml:"command_restart,omitempty"`           // always, on_failure, or never
+	CommandRestartDelay        time.Duration     `yaml:"command_restart_delay,omitempty"`     // implicitly parsed with time.ParseDuration()
+	CommandRestartMaxDelay     time.Duration     `yaml:"command_restart_max_delay,omitempty"` // implicitly parsed with time.ParseDuration()
+	Multiline                  *MultilineConfig  `yaml:",omitempty"`
+}
+
+// PathConfig is an entry in 'input.paths'. It is either a plain glob, or a glob with
+// options overriding 'input.readall' and 'input.fail_on_missing_logfile'.
+type PathConfig struct {
+	Path                 string `yaml:",omitempty"`
+	Readall              *bool  `yaml:",omitempty"`                        // nil means use 'input.readall'
+	FailOnMissingLogfile *bool  `yaml:"fail_on_missing_logfile,omitempty"` // nil means use 'input.fail_on_missing_logfile'
+}
+
+type MultilineConfig struct {
+	Mode         string        `yaml:",omitempty"` // start, continuation, or end
+	Pattern      string        `yaml:",omitempty"`
+	MaxLines     int           `yaml:"max_lines,omitempty"`
+	MaxBytes     int           `yaml:"max_bytes,omitempty"`
+	FlushTimeout time.Duration `yaml:"flush_timeout,omitempty"` // implicitly parsed with time.ParseDuration()
 }
 
+type InputsConfig []InputConfig
+
 type GrokConfig struct {
 	PatternsDir        string   `yaml:"patterns_dir,omitempty"`
 	AdditionalPatterns []string `yaml:"additional_patterns,omitempty"`
+	nIncludedPatterns  int      // number of AdditionalPatterns that were read from included files
 }
 
 type MetricConfig struct {
-	Type                 string              `yaml:",omitempty"`
-	Name                 string              `yaml:",omitempty"`
-	Help                 string              `yaml:",omitempty"`
-	Match                string              `yaml:",omitempty"`
-	Retention            time.Duration       `yaml:",omitempty"` // implicitly parsed with time.ParseDuration()
-	Value                string              `yaml:",omitempty"`
-	Cumulative           bool                `yaml:",omitempty"`
-	Buckets              []float64           `yaml:",flow,omitempty"`
-	Quantiles            map[float64]float64 `yaml:",flow,omitempty"`
-	Labels               map[string]string   `yaml:",omitempty"`
-	LabelTemplates       []template.Template `yaml:"-"` // parsed version of Labels, will not be serialized to yaml.
-	ValueTemplate        template.Template   `yaml:"-"` // parsed version of Value, will not be serialized to yaml.
-	DeleteMatch          string              `yaml:"delete_match,omitempty"`
-	DeleteLabels         map[string]string   `yaml:"delete_labels,omitempty"` // TODO: Make sure that DeleteMatch is not nil if DeleteLabels are used.
-	DeleteLabelTemplates []template.Template `yaml:"-"`                       // parsed version of DeleteLabels, will not be serialized to yaml.
+	Type                 string                `yaml:",omitempty"`
+	Name                 string                `yaml:",omitempty"`
+	Help                 string                `yaml:",omitempty"`
+	Match                string                `yaml:",omitempty"`
+	Json                 *JsonMatchConfig      `yaml:",omitempty"`
+	Logfmt               *LogfmtMatchConfig    `yaml:",omitempty"`
+	Delimited            *DelimitedMatchConfig `yaml:",omitempty"`
+	Inputs               []string              `yaml:",flow,omitempty"` // names of the inputs this metric applies to, empty means all inputs
+	Retention            time.Duration         `yaml:",omitempty"`      // implicitly parsed with time.ParseDuration()
+	Value                string                `yaml:",omitempty"`
+	Cumulative           bool                  `yaml:",omitempty"`
+	Timestamp            string                `yaml:",omitempty"`                     // event time in seconds since the epoch, empty means the samples have no timestamp
+	TimestampPolicy      string                `yaml:"timestamp_policy,omitempty"`     // update or drop
+	TimestampMaxFuture   time.Duration         `yaml:"timestamp_max_future,omitempty"` // implicitly parsed with time.ParseDuration()
+	TimestampTemplate    template.Template     `yaml:"-"`                              // parsed version of Timestamp, will not be serialized to yaml.
+	Buckets              []float64             `yaml:",flow,omitempty"`
+	Quantiles            map[float64]float64   `yaml:",flow,omitempty"`
+	Labels               map[string]string     `yaml:",omitempty"`
+	LabelTemplates       []template.Template   `yaml:"-"` // parsed version of Labels, will not be serialized to yaml.
+	ValueTemplate        template.Template     `yaml:"-"` // parsed version of Value, will not be serialized to yaml.
+	DeleteMatch          string                `yaml:"delete_match,omitempty"`
+	DeleteLabels         map[string]string     `yaml:"delete_labels,omitempty"` // TODO: Make sure that DeleteMatch is not nil if DeleteLabels are used.
+	DeleteLabelTemplates []template.Template   `yaml:"-"`                       // parsed version of DeleteLabels, will not be serialized to yaml.
+	Line                 int                   `yaml:"-"`                       // line number in the config file, used in error messages. 0 if unknown.
+	File                 string                `yaml:"-"`                       // included file where the metric is defined, empty for the main config file.
+}
+
+// JsonMatchConfig configures a metric for lines containing a JSON object. The 'match' pattern is optional,
+// if present it is applied to the string value selected by GrokField.
+type JsonMatchConfig struct {
+	Conditions []FieldConditionConfig `yaml:",omitempty"` // all conditions must be true for the line to match
+	Fields     map[string]string      `yaml:",omitempty"` // template field name -> JSON path, like '.request.method'
+	GrokField  string                 `yaml:"grok_field,omitempty"`
+}
+
+// LogfmtMatchConfig configures a metric for logfmt lines like 'level=info method=GET'. All keys can be used
+// in templates. The 'match' pattern is optional, if present it is applied to the value of the key GrokField.
+type LogfmtMatchConfig struct {
+	Conditions []FieldConditionConfig `yaml:",omitempty"` // all conditions must be true for the line to match
+	GrokField  string                 `yaml:"grok_field,omitempty"`
+}
+
+// DelimitedMatchConfig configures a metric for CSV, TSV, or W3C extended log lines. The column names are taken
+// from the last '#Fields:' directive in the same file, or from Columns if the file has no '#Fields:' directive.
+type DelimitedMatchConfig struct {
+	Delimiter  string                 `yaml:",omitempty"` // single character, empty means ','
+	Quote      string                 `yaml:",omitempty"` // single character, empty means '"'
+	Columns    []string               `yaml:",flow,omitempty"`
+	Conditions []FieldConditionConfig `yaml:",omitempty"` // all conditions must be true for the line to match
+	GrokField  string                 `yaml:"grok_field,omitempty"`
+}
+
+// FieldConditionConfig is true if the field exists and the value is equal to Equals and matches the regular
+// expression Matches, if these are set. If Exists is false, the condition is true if the field does not exist.
+// The Field is a JSON path for 'json', a key for 'logfmt', and a column name for 'delimited'.
+type FieldConditionConfig struct {
+	Field   string `yaml:",omitempty"`
+	Equals  string `yaml:",omitempty"`
+	Matches string `yaml:",omitempty"`
+	Exists  *bool  `yaml:",omitempty"`
 }
 
 type MetricsConfig []MetricConfig
@@ -107,7 +258,14 @@ type ServerConfig struct {
 
 func (cfg *Config) addDefaults() {
 	cfg.Global.addDefaults()
-	cfg.Input.addDefaults()
+	if len(cfg.Inputs) == 0 {
+		cfg.Input.addDefaults()
+		if cfg.Input.Name == "" {
+			cfg.Input.Name = defaultInputName
+		}
+	} else {
+		cfg.Inputs.addDefaults()
+	}
 	cfg.Grok.addDefaults()
 	if cfg.Metrics == nil {
 		cfg.Metrics = MetricsConfig(make([]MetricConfig, 0))
@@ -123,6 +281,14 @@ func (c *GlobalConfig) addDefaults() {
 	if c.RetentionCheckInterval == 0 {
 		c.RetentionCheckInterval = defaultRetentionCheckInterval
 	}
+	if c.BufferSpill != nil {
+		if c.BufferSpill.Threshold == 0 {
+			c.BufferSpill.Threshold = defaultBufferSpillThreshold
+		}
+		if c.BufferSpill.SegmentBytes == 0 {
+			c.BufferSpill.SegmentBytes = defaultBufferSpillSegmentBytes
+		}
+	}
 }
 
 func (c *InputConfig) addDefaults() {
@@ -132,25 +298,102 @@ func (c *InputConfig) addDefaults() {
 	if c.Type == inputTypeFile && len(c.FailOnMissingLogfileString) == 0 {
 		c.FailOnMissingLogfileString = "true"
 	}
+	if (c.Type == inputTypeFile || c.Type == inputTypeStdin) && len(c.Mode) == 0 {
+		c.Mode = inputModeTail
+	}
+	if c.PositionFile != "" && c.PositionFlushInterval == 0 {
+		c.PositionFlushInterval = defaultPositionFlushInterval
+	}
+	if c.MaxLinesInBuffer > 0 && len(c.BufferOverflowPolicy) == 0 {
+		c.BufferOverflowPolicy = defaultBufferOverflowPolicy
+	}
+	if c.MaxLineBytes > 0 && len(c.MaxLineAction) == 0 {
+		c.MaxLineAction = defaultMaxLineAction
+	}
+	if c.Type == inputTypeCommand {
+		if len(c.CommandRestart) == 0 {
+			c.CommandRestart = defaultCommandRestart
+		}
+		if c.CommandRestartDelay == 0 {
+			c.CommandRestartDelay = defaultCommandRestartDelay
+		}
+		if c.CommandRestartMaxDelay == 0 {
+			c.CommandRestartMaxDelay = defaultCommandRestartMaxDelay
+		}
+	}
 	if c.Type == inputTypeWebhook {
 		if len(c.WebhookPath) == 0 {
-			c.WebhookPath = "/webhook"
+			c.WebhookPath = defaultWebhookPath
 		}
 		if len(c.WebhookFormat) == 0 {
-			c.WebhookFormat = "text_single"
+			c.WebhookFormat = defaultWebhookFormat
 		}
 		if len(c.WebhookJsonSelector) == 0 {
-			c.WebhookJsonSelector = ".message"
+			c.WebhookJsonSelector = defaultWebhookJsonSelectorFor(c.WebhookFormat)
 		}
 		if len(c.WebhookTextBulkSeparator) == 0 {
-			c.WebhookTextBulkSeparator = "\n\n"
+			c.WebhookTextBulkSeparator = defaultWebhookTextBulkSeparator
 		}
+		if c.WebhookMaxBodySize == 0 {
+			c.WebhookMaxBodySize = defaultWebhookMaxBodySize
+		}
+		if c.WebhookQueueSize == 0 {
+			c.WebhookQueueSize = defaultWebhookQueueSize
+		}
+		if c.WebhookRateLimit > 0 && c.WebhookRateLimitBurst == 0 {
+			c.WebhookRateLimitBurst = defaultWebhookRateLimitBurst(c.WebhookRateLimit)
+		}
+	}
+	if c.Multiline != nil {
+		c.Multiline.addDefaults()
+	}
+}
+
+func defaultWebhookJsonSelectorFor(format string) string {
+	if format == "fluentbit" {
+		return defaultFluentBitJsonSelector
+	}
+	return defaultWebhookJsonSelector
+}
+
+// The default burst allows one second worth of requests, but at least one request.
+func defaultWebhookRateLimitBurst(rate float64) int {
+	return int(math.Max(1, math.Ceil(rate)))
+}
+
+func (c *MultilineConfig) addDefaults() {
+	if c.MaxLines == 0 {
+		c.MaxLines = defaultMultilineMaxLines
+	}
+	if c.FlushTimeout == 0 {
+		c.FlushTimeout = defaultMultilineFlushTimeout
+	}
+}
+
+func (c *InputsConfig) addDefaults() {
+	for i := range *c {
+		(*c)[i].addDefaults()
 	}
 }
 
 func (c *GrokConfig) addDefaults() {}
 
-func (c *MetricsConfig) addDefaults() {}
+func (c *MetricsConfig) addDefaults() {
+	for i := range *c {
+		(*c)[i].addDefaults()
+	}
+}
+
+func (c *MetricConfig) addDefaults() {
+	if len(c.Timestamp) > 0 {
+		if len(c.TimestampPolicy) == 0 {
+			c.TimestampPolicy = defaultTimestampPolicy
+		}
+		if c.TimestampMaxFuture == 0 {
+			c.TimestampMaxFuture = defaultTimestampMaxFuture
+		}
+	}
+}
 
 func (c *ServerConfig) addDefaults() {
 	if c.Protocol == "" {
@@ -165,21 +408,95 @@ func (c *ServerConfig) addDefaults() {
 }
 
 func (cfg *Config) validate() error {
-	err := cfg.Input.validate()
-	if err != nil {
-		return err
+	errs := cfg.validationErrors()
+	if len(errs) > 0 {
+		return errs[0]
 	}
-	err = cfg.Grok.validate()
+	return nil
+}
+
+// validationErrors returns all errors found in the configuration.
+// The first error is the one that validate() reports.
+func (cfg *Config) validationErrors() []*ValidationError {
+	var (
+		result []*ValidationError
+		err    error
+	)
+	err = cfg.Global.validate()
 	if err != nil {
-		return err
+		result = append(result, &ValidationError{Err: err})
+	}
+	if len(cfg.Inputs) == 0 {
+		err = cfg.Input.validate()
+	} else if !reflect.DeepEqual(cfg.Input, InputConfig{}) {
+		err = fmt.Errorf("invalid input configuration: 'input' and 'inputs' cannot be used at the same time")
+	} else {
+		err = cfg.Inputs.validate()
 	}
-	err = cfg.Metrics.validate()
 	if err != nil {
-		return err
+		result = append(result, &ValidationError{Err: err})
+	}
+	if cfg.usesGrokPatterns() {
+		err = cfg.Grok.validate()
+		if err != nil {
+			result = append(result, &ValidationError{Err: err})
+		}
 	}
+	result = append(result, cfg.Metrics.validationErrors()...)
+	result = append(result, cfg.metricInputsValidationErrors()...)
 	err = cfg.Server.validate()
 	if err != nil {
-		return err
+		result = append(result, &ValidationError{Err: err})
+	}
+	return result
+}
+
+// Make sure that the 'inputs' referenced by the metrics are defined in the input configuration.
+func (cfg *Config) metricInputsValidationErrors() []*ValidationError {
+	var result []*ValidationError
+	for _, metric := range cfg.Metrics {
+		for _, inputName := range metric.Inputs {
+			found := false
+			for _, input := range cfg.InputConfigs() {
+				if input.Name == inputName {
+					found = true
+					break
+				}
+			}
+			if !found {
+				result = append(result, metric.validationError(fmt.Errorf("Invalid metric configuration: metric '%v' references input '%v', but there is no input with that name.", metric.Name, inputName)))
+			}
+		}
+	}
+	return result
+}
+
+func (c *PathConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if unmarshal(&c.Path) == nil {
+		return nil
+	}
+	type plain PathConfig // type without the UnmarshalYAML() method
+	return unmarshal((*plain)(c))
+}
+
+func (c PathConfig) MarshalYAML() (interface{}, error) {
+	if c.Readall == nil && c.FailOnMissingLogfile == nil {
+		return c.Path, nil
+	}
+	type plain PathConfig
+	return plain(c), nil
+}
+
+func (c *GlobalConfig) validate() error {
+	if c.BufferSpill != nil {
+		switch {
+		case c.BufferSpill.Dir == "":
+			return fmt.Errorf("invalid global configuration: 'global.buffer_spill.dir' must not be empty")
+		case c.BufferSpill.Threshold < 0:
+			return fmt.Errorf("invalid global configuration: 'global.buffer_spill.threshold' must not be negative")
+		case c.BufferSpill.SegmentBytes <= 0:
+			return fmt.Errorf("invalid global configuration: 'global.buffer_spill.segment_bytes' must be positive")
+		}
 	}
 	return nil
 }
@@ -191,6 +508,9 @@ func (c *InputConfig) validate() error {
 		if c.Path != "" {
 			return fmt.Errorf("invalid input configuration: cannot use 'input.path' when 'input.type' is stdin")
 		}
+		if len(c.Paths) > 0 {
+			return fmt.Errorf("invalid input configuration: cannot use 'input.paths' when 'input.type' is stdin")
+		}
 		if c.Readall {
 			return fmt.Errorf("invalid input configuration: cannot use 'input.readall' when 'input.type' is stdin")
 		}
@@ -198,8 +518,22 @@ func (c *InputConfig) validate() error {
 			return fmt.Errorf("invalid input configuration: cannot use 'input.poll_interval_seconds' when 'input.type' is stdin")
 		}
 	case c.Type == inputTypeFile:
-		if c.Path == "" {
-			return fmt.Errorf("invalid input configuration: 'input.path' is required for input type \"file\"")
+		if c.Path == "" && len(c.Paths) == 0 {
+			return fmt.Errorf("invalid input configuration: 'input.path' or 'input.paths' is required for input type \"file\"")
+		}
+		if c.Path != "" && len(c.Paths) > 0 {
+			return fmt.Errorf("invalid input configuration: 'input.path' and 'input.paths' cannot be used together")
+		}
+		if c.Path != "" && !glob.IsPatternValid(c.Path) {
+			return fmt.Errorf("invalid input configuration: '%v' is not a valid glob pattern in 'input.path'", c.Path)
+		}
+		for _, path := range c.Paths {
+			if path.Path == "" {
+				return fmt.Errorf("invalid input configuration: 'input.paths' must not contain empty paths")
+			}
+			if !glob.IsPatternValid(path.Path) {
+				return fmt.Errorf("invalid input configuration: '%v' is not a valid glob pattern in 'input.paths'", path.Path)
+			}
 		}
 		if len(c.PollIntervalSeconds) > 0 { // TODO: Use duration directly, as with other durations in the config file
 			nSeconds, err := strconv.Atoi(c.PollIntervalSeconds)
@@ -220,23 +554,260 @@ func (c *InputConfig) validate() error {
 		} else if c.WebhookPath[0] != '/' {
 			return fmt.Errorf("invalid input configuration: 'input.webhook_path' must start with \"/\"")
 		}
-		if c.WebhookFormat != "text_single" && c.WebhookFormat != "text_bulk" && c.WebhookFormat != "json_single" && c.WebhookFormat != "json_bulk" {
-			return fmt.Errorf("invalid input configuration: 'input.webhook_format' must be \"text_single|text_bulk|json_single|json_bulk\"")
+		switch c.WebhookFormat {
+		case "text_single", "text_bulk", "json_single", "json_bulk", "ndjson", "loki", "elasticsearch_bulk", "fluentbit":
+		default:
+			return fmt.Errorf("invalid input configuration: 'input.webhook_format' must be \"text_single|text_bulk|json_single|json_bulk|ndjson|loki|elasticsearch_bulk|fluentbit\"")
 		}
 		if c.WebhookJsonSelector == "" {
 			return fmt.Errorf("invalid input configuration: 'input.webhook_json_selector' is required for input type \"webhook\"")
 		} else if c.WebhookJsonSelector[0] != '.' {
 			return fmt.Errorf("invalid input configuration: 'input.webhook_json_selector' must start with \".\"")
+		} else if _, err := jsonpath.Parse(c.WebhookJsonSelector); err != nil {
+			return fmt.Errorf("invalid input configuration: 'input.webhook_json_selector': %v", err)
+		}
+		if len(c.WebhookJsonFields) > 0 && !strings.HasPrefix(c.WebhookFormat, "json_") && c.WebhookFormat != "ndjson" {
+			return fmt.Errorf("invalid input configuration: 'input.webhook_json_fields' can only be used with webhook_format \"json_single|json_bulk|ndjson\"")
+		}
+		for name, selector := range c.WebhookJsonFields {
+			if !model.LabelName(name).IsValid() {
+				return fmt.Errorf("invalid input configuration: 'input.webhook_json_fields': %v is not a valid field name", name)
+			}
+			if _, err := jsonpath.Parse(selector); err != nil {
+				return fmt.Errorf("invalid input configuration: 'input.webhook_json_fields': %v", err)
+			}
 		}
 		if c.WebhookFormat == "text_bulk" && c.WebhookTextBulkSeparator == "" {
 			return fmt.Errorf("invalid input configuration: 'input.webhook_text_bulk_separator' is required for input type \"webhook\" and webhook_format \"text_bulk\"")
 		}
+		if (c.WebhookBasicAuthUsername == "") != (c.WebhookBasicAuthPassword == "") {
+			return fmt.Errorf("invalid input configuration: 'input.webhook_basic_auth_username' and 'input.webhook_basic_auth_password' must be used together")
+		}
+		if c.WebhookBasicAuthUsername != "" && c.WebhookBearerTokenFile != "" {
+			return fmt.Errorf("invalid input configuration: 'input.webhook_basic_auth_username' and 'input.webhook_bearer_token_file' cannot be used together")
+		}
+		if c.WebhookSignature != "" && c.WebhookSignature != "github" && c.WebhookSignature != "slack" {
+			return fmt.Errorf("invalid input configuration: 'input.webhook_signature' must be \"github|slack\"")
+		}
+		if (c.WebhookSignature == "") != (c.WebhookSignatureSecret == "") {
+			return fmt.Errorf("invalid input configuration: 'input.webhook_signature' and 'input.webhook_signature_secret' must be used together")
+		}
+		if c.WebhookMaxBodySize <= 0 {
+			return fmt.Errorf("invalid input configuration: 'input.webhook_max_body_size' must be positive")
+		}
+		if c.WebhookRateLimit < 0 {
+			return fmt.Errorf("invalid input configuration: 'input.webhook_rate_limit' must not be negative")
+		}
+		if c.WebhookRateLimitBurst < 0 {
+			return fmt.Errorf("invalid input configuration: 'input.webhook_rate_limit_burst' must not be negative")
+		}
+		if c.WebhookQueueSize <= 0 {
+			return fmt.Errorf("invalid input configuration: 'input.webhook_queue_size' must be positive")
+		}
+	case c.Type == inputTypeSyslog:
+		if c.SyslogUdpAddress == "" && c.SyslogTcpAddress == "" && c.SyslogUnixSocket == "" {
+			return fmt.Errorf("invalid input configuration: one of 'input.syslog_udp_address', 'input.syslog_tcp_address', and 'input.syslog_unix_socket' is required for input type \"syslog\"")
+		}
+		if (c.SyslogTlsCert == "") != (c.SyslogTlsKey == "") {
+			return fmt.Errorf("invalid input configuration: 'input.syslog_tls_cert' and 'input.syslog_tls_key' must be used together")
+		}
+		if c.SyslogTlsCert != "" && c.SyslogTcpAddress == "" {
+			return fmt.Errorf("invalid input configuration: 'input.syslog_tls_cert' and 'input.syslog_tls_key' can only be used with 'input.syslog_tcp_address'")
+		}
+	case c.Type == inputTypeCommand:
+		if len(c.Command) == 0 || c.Command[0] == "" {
+			return fmt.Errorf("invalid input configuration: 'input.command' is required for input type \"command\"")
+		}
+		if c.CommandRestart != "always" && c.CommandRestart != "on_failure" && c.CommandRestart != "never" {
+			return fmt.Errorf("invalid input configuration: 'input.command_restart' must be \"always|on_failure|never\"")
+		}
+		if c.CommandRestartDelay < 0 {
+			return fmt.Errorf("invalid input configuration: 'input.command_restart_delay' must not be negative")
+		}
+		if c.CommandRestartMaxDelay < c.CommandRestartDelay {
+			return fmt.Errorf("invalid input configuration: 'input.command_restart_max_delay' must not be less than 'input.command_restart_delay'")
+		}
 	default:
 		return fmt.Errorf("unsupported 'input.type': %v", c.Type)
 	}
+	if (len(c.Command) > 0 || len(c.CommandEnv) > 0 || c.CommandDir != "") && c.Type != inputTypeCommand {
+		return fmt.Errorf("invalid input configuration: 'input.command', 'input.command_env', and 'input.command_dir' can only be used with input type \"command\"")
+	}
+	if c.PositionFile != "" && c.Type != inputTypeFile {
+		return fmt.Errorf("invalid input configuration: 'input.position_file' can only be used with input type \"file\"")
+	}
+	if c.Encoding != "" {
+		if c.Type != inputTypeFile && c.Type != inputTypeStdin && c.Type != inputTypeCommand {
+			return fmt.Errorf("invalid input configuration: 'input.encoding' can only be used with input types \"file\", \"stdin\", and \"command\"")
+		}
+		if _, err := charset.Get(c.Encoding); err != nil {
+			return fmt.Errorf("invalid input configuration: 'input.encoding': %v", err)
+		}
+	}
+	if c.Mode != "" {
+		if c.Type != inputTypeFile && c.Type != inputTypeStdin {
+			return fmt.Errorf("invalid input configuration: 'input.mode' can only be used with input types \"file\" and \"stdin\"")
+		}
+		if c.Mode != inputModeTail && c.Mode != inputModeBatch {
+			return fmt.Errorf("invalid input configuration: 'input.mode' must be \"tail|batch\"")
+		}
+		if c.Mode == inputModeBatch && c.Type == inputTypeFile && !c.readsAll() {
+			return fmt.Errorf("invalid input configuration: 'input.mode' batch can only be used with 'input.readall: true'")
+		}
+	}
+	if c.MaxLineBytes < 0 {
+		return fmt.Errorf("invalid input configuration: 'input.max_line_bytes' must not be negative")
+	}
+	if c.MaxLineAction != "" {
+		if c.MaxLineBytes == 0 {
+			return fmt.Errorf("invalid input configuration: 'input.max_line_action' can only be used with 'input.max_line_bytes'")
+		}
+		if c.MaxLineAction != "truncate" && c.MaxLineAction != "skip" {
+			return fmt.Errorf("invalid input configuration: 'input.max_line_action' must be \"truncate|skip\"")
+		}
+	}
+	if c.InvalidUtf8 != "" && c.InvalidUtf8 != "replace" && c.InvalidUtf8 != "reject" {
+		return fmt.Errorf("invalid input configuration: 'input.invalid_utf8' must be \"replace|reject\"")
+	}
+	if c.PositionFlushInterval < 0 {
+		return fmt.Errorf("invalid input configuration: 'input.position_flush_interval' must not be negative")
+	}
+	if c.MaxLinesInBuffer < 0 {
+		return fmt.Errorf("invalid input configuration: 'input.max_lines_in_buffer' must not be negative")
+	}
+	if c.BufferOverflowPolicy != "" {
+		if c.MaxLinesInBuffer == 0 {
+			return fmt.Errorf("invalid input configuration: 'input.buffer_overflow_policy' can only be used with 'input.max_lines_in_buffer'")
+		}
+		switch c.BufferOverflowPolicy {
+		case "drop_all", "drop_oldest", "drop_newest", "block":
+		default:
+			return fmt.Errorf("invalid input configuration: 'input.buffer_overflow_policy' must be \"drop_all|drop_oldest|drop_newest|block\"")
+		}
+	}
+	if c.Multiline != nil {
+		return c.Multiline.validate()
+	}
+	return nil
+}
+
+func (c *MultilineConfig) validate() error {
+	switch {
+	case c.Mode != "start" && c.Mode != "continuation" && c.Mode != "end":
+		return fmt.Errorf("invalid input configuration: 'input.multiline.mode' must be \"start|continuation|end\"")
+	case c.Pattern == "":
+		return fmt.Errorf("invalid input configuration: 'input.multiline.pattern' must not be empty")
+	case c.MaxLines < 0:
+		return fmt.Errorf("invalid input configuration: 'input.multiline.max_lines' must not be negative")
+	case c.MaxBytes < 0:
+		return fmt.Errorf("invalid input configuration: 'input.multiline.max_bytes' must not be negative")
+	case c.FlushTimeout < 0:
+		return fmt.Errorf("invalid input configuration: 'input.multiline.flush_timeout' must not be negative")
+	}
+	return nil
+}
+
+// readsAll is true if all files of a file input are read from the beginning.
+func (c *InputConfig) readsAll() bool {
+	for _, path := range c.Paths {
+		if path.Readall != nil && !*path.Readall || path.Readall == nil && !c.Readall {
+			return false
+		}
+	}
+	return len(c.Paths) > 0 || c.Readall
+}
+
+func (c *InputsConfig) validate() error {
+	inputNames := make(map[string]bool)
+	webhookPaths := make(map[string]bool)
+	positionFiles := make(map[string]bool)
+	nStdin := 0
+	nBatch := 0
+	bufferOverflowPolicy := ""
+	for i := range *c {
+		input := &(*c)[i]
+		if input.Name == "" {
+			return fmt.Errorf("invalid input configuration: 'inputs.name' must not be empty.")
+		}
+		if inputNames[input.Name] {
+			return fmt.Errorf("invalid input configuration: input '%v' defined twice.", input.Name)
+		}
+		inputNames[input.Name] = true
+		err := input.validate()
+		if err != nil {
+			return fmt.Errorf("%v (input '%v')", err.Error(), input.Name)
+		}
+		switch input.Type {
+		case inputTypeStdin:
+			nStdin++
+			if nStdin > 1 {
+				return fmt.Errorf("invalid input configuration: there can only be one input of type \"stdin\".")
+			}
+		case inputTypeWebhook:
+			if webhookPaths[input.WebhookPath] {
+				return fmt.Errorf("invalid input configuration: 'webhook_path' %v is used by more than one input.", input.WebhookPath)
+			}
+			webhookPaths[input.WebhookPath] = true
+		}
+		if input.PositionFile != "" {
+			if positionFiles[input.PositionFile] {
+				return fmt.Errorf("invalid input configuration: 'position_file' %v is used by more than one input.", input.PositionFile)
+			}
+			positionFiles[input.PositionFile] = true
+		}
+		if input.Mode == inputModeBatch {
+			nBatch++
+		}
+		if input.BufferOverflowPolicy != "" {
+			// The lines of all inputs share a single buffer.
+			if bufferOverflowPolicy != "" && bufferOverflowPolicy != input.BufferOverflowPolicy {
+				return fmt.Errorf("invalid input configuration: all inputs must use the same 'buffer_overflow_policy'.")
+			}
+			bufferOverflowPolicy = input.BufferOverflowPolicy
+		}
+	}
+	if nBatch > 0 && nBatch < len(*c) {
+		return fmt.Errorf("invalid input configuration: 'mode: batch' must be used for all inputs or for none of them.")
+	}
 	return nil
 }
 
+// IsBatchMode is true if the inputs are read until end of file, and grok_exporter terminates
+// when all lines are processed instead of serving the metrics via HTTP.
+func (cfg *Config) IsBatchMode() bool {
+	for _, input := range cfg.InputConfigs() {
+		if input.Mode != inputModeBatch {
+			return false
+		}
+	}
+	return true
+}
+
+// SetBatchMode sets 'mode: batch' for all inputs. This is used for the '-once' command line flag.
+// An error is returned if an input does not support batch mode.
+func (cfg *Config) SetBatchMode() error {
+	for _, input := range cfg.InputConfigs() {
+		input.Mode = inputModeBatch
+	}
+	return cfg.validate()
+}
+
+// usesGrokPatterns is false if all metrics use 'json', 'logfmt', or 'delimited' without 'match', so that the grok
+// section may be omitted.
+func (cfg *Config) usesGrokPatterns() bool {
+	for _, input := range cfg.InputConfigs() {
+		if input.Multiline != nil {
+			return true
+		}
+	}
+	for _, m := range cfg.Metrics {
+		if !m.HasFieldMatcher() || m.Match != "" || m.DeleteMatch != "" {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *GrokConfig) validate() error {
 	if c.PatternsDir == "" && len(c.AdditionalPatterns) == 0 {
 		return fmt.Errorf("Invalid grok configuration: no patterns defined: one of 'grok.patterns_dir' and 'grok.additional_patterns' must be configured.")
@@ -244,23 +815,24 @@ func (c *GrokConfig) validate() error {
 	return nil
 }
 
-func (c *MetricsConfig) validate() error {
+func (c *MetricsConfig) validationErrors() []*ValidationError {
 	if len(*c) == 0 {
-		return fmt.Errorf("Invalid metrics configuration: 'metrics' must not be empty.")
+		return []*ValidationError{{Err: fmt.Errorf("Invalid metrics configuration: 'metrics' must not be empty.")}}
 	}
+	var result []*ValidationError
 	metricNames := make(map[string]bool)
 	for _, metric := range *c {
 		err := metric.validate()
 		if err != nil {
-			return err
+			result = append(result, metric.validationError(err))
 		}
 		_, exists := metricNames[metric.Name]
 		if exists {
-			return fmt.Errorf("Invalid metric configuration: metric '%v' defined twice.", metric.Name)
+			result = append(result, metric.validationError(fmt.Errorf("Invalid metric configuration: metric '%v' defined twice.", metric.Name)))
 		}
 		metricNames[metric.Name] = true
 	}
-	return nil
+	return result
 }
 
 func (c *MetricConfig) validate() error {
@@ -271,8 +843,35 @@ func (c *MetricConfig) validate() error {
 		return fmt.Errorf("Invalid metric configuration: 'metrics.name' must not be empty.")
 	case c.Help == "":
 		return fmt.Errorf("Invalid metric configuration: 'metrics.help' must not be empty.")
-	case c.Match == "":
+	case c.Match == "" && !c.HasFieldMatcher():
 		return fmt.Errorf("Invalid metric configuration: 'metrics.match' must not be empty.")
+	case c.fieldMatchers() > 1:
+		return fmt.Errorf("Invalid metric configuration: only one of 'metrics.json', 'metrics.logfmt', and 'metrics.delimited' can be used.")
+	case !model.IsValidMetricName(model.LabelValue(c.Name)):
+		return fmt.Errorf("Invalid metric configuration: '%v' is not a valid Prometheus metric name.", c.Name)
+	}
+	for _, labelName := range sortedKeys(c.Labels) {
+		if !model.LabelName(labelName).IsValid() || strings.HasPrefix(labelName, "__") {
+			return fmt.Errorf("Invalid metric configuration: '%v' is not a valid Prometheus label name.", labelName)
+		}
+	}
+	if c.Json != nil {
+		err := c.Json.validate(c.Match)
+		if err != nil {
+			return err
+		}
+	}
+	if c.Logfmt != nil {
+		err := c.Logfmt.validate(c.Match)
+		if err != nil {
+			return err
+		}
+	}
+	if c.Delimited != nil {
+		err := c.Delimited.validate(c.Match)
+		if err != nil {
+			return err
+		}
 	}
 	var hasValue, cumulativeAllowed, bucketsAllowed, quantilesAllowed bool
 	switch c.Type {
@@ -308,6 +907,17 @@ func (c *MetricConfig) validate() error {
 	if c.Retention > 0 && len(c.Labels) == 0 {
 		return fmt.Errorf("Invalid metric configuration: 'metrics.retention' is only supported for metrics with labels.")
 	}
+	if len(c.Timestamp) == 0 && (len(c.TimestampPolicy) > 0 || c.TimestampMaxFuture != 0) {
+		return fmt.Errorf("Invalid metric configuration: 'metrics.timestamp_policy' and 'metrics.timestamp_max_future' can only be used when 'metrics.timestamp' is present.")
+	}
+	if len(c.Timestamp) > 0 {
+		if c.TimestampPolicy != "update" && c.TimestampPolicy != "drop" {
+			return fmt.Errorf("Invalid metric configuration: 'metrics.timestamp_policy' must be \"update|drop\".")
+		}
+		if c.TimestampMaxFuture < 0 {
+			return fmt.Errorf("Invalid metric configuration: 'metrics.timestamp_max_future' must not be negative.")
+		}
+	}
 	for _, deleteLabelTemplate := range c.DeleteLabelTemplates {
 		found := false
 		for _, labelTemplate := range c.LabelTemplates {
@@ -324,6 +934,111 @@ func (c *MetricConfig) validate() error {
 	return nil
 }
 
+// HasFieldMatcher is true if the metric parses the line with 'json', 'logfmt', or 'delimited'.
+// In that case, 'match' is optional.
+func (c *MetricConfig) HasFieldMatcher() bool {
+	return c.fieldMatchers() > 0
+}
+
+func (c *MetricConfig) fieldMatchers() int {
+	result := 0
+	for _, configured := range []bool{c.Json != nil, c.Logfmt != nil, c.Delimited != nil} {
+		if configured {
+			result++
+		}
+	}
+	return result
+}
+
+func (c *JsonMatchConfig) validate(match string) error {
+	err := validateConditions("json", c.Conditions, func(field string) error {
+		_, err := jsonpath.Parse(field)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range sortedKeys(c.Fields) {
+		if !model.LabelName(name).IsValid() {
+			return fmt.Errorf("Invalid metric configuration: 'metrics.json.fields': '%v' is not a valid field name.", name)
+		}
+		if _, err := jsonpath.Parse(c.Fields[name]); err != nil {
+			return fmt.Errorf("Invalid metric configuration: 'metrics.json.fields': %v", err)
+		}
+	}
+	err = validateGrokField("json", c.GrokField, match)
+	if err == nil && c.GrokField != "" {
+		if _, err = jsonpath.Parse(c.GrokField); err != nil {
+			return fmt.Errorf("Invalid metric configuration: 'metrics.json.grok_field': %v", err)
+		}
+	}
+	return err
+}
+
+func (c *LogfmtMatchConfig) validate(match string) error {
+	err := validateConditions("logfmt", c.Conditions, func(field string) error {
+		if field == "" {
+			return fmt.Errorf("must not be empty")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return validateGrokField("logfmt", c.GrokField, match)
+}
+
+func (c *DelimitedMatchConfig) validate(match string) error {
+	switch {
+	case len(c.Delimiter) > 1:
+		return fmt.Errorf("Invalid metric configuration: 'metrics.delimited.delimiter' must be a single character.")
+	case len(c.Quote) > 1:
+		return fmt.Errorf("Invalid metric configuration: 'metrics.delimited.quote' must be a single character.")
+	case c.Delimiter != "" && c.Delimiter == c.Quote:
+		return fmt.Errorf("Invalid metric configuration: 'metrics.delimited.delimiter' and 'metrics.delimited.quote' must be different.")
+	}
+	for _, column := range c.Columns {
+		if column == "" {
+			return fmt.Errorf("Invalid metric configuration: 'metrics.delimited.columns' must not contain empty names.")
+		}
+	}
+	err := validateConditions("delimited", c.Conditions, func(field string) error {
+		if field == "" {
+			return fmt.Errorf("must not be empty")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return validateGrokField("delimited", c.GrokField, match)
+}
+
+func validateConditions(matcher string, conditions []FieldConditionConfig, validateField func(string) error) error {
+	for _, condition := range conditions {
+		if err := validateField(condition.Field); err != nil {
+			return fmt.Errorf("Invalid metric configuration: 'metrics.%v.conditions.field': %v", matcher, err)
+		}
+		if _, err := regexp.Compile(condition.Matches); err != nil {
+			return fmt.Errorf("Invalid metric configuration: 'metrics.%v.conditions.matches': %v", matcher, err)
+		}
+		if condition.Exists != nil && !*condition.Exists && (condition.Equals != "" || condition.Matches != "") {
+			return fmt.Errorf("Invalid metric configuration: 'metrics.%v.conditions.exists: false' cannot be combined with 'equals' or 'matches'.", matcher)
+		}
+	}
+	return nil
+}
+
+func validateGrokField(matcher, grokField, match string) error {
+	switch {
+	case match != "" && grokField == "":
+		return fmt.Errorf("Invalid metric configuration: 'metrics.%v.grok_field' must be set if 'metrics.match' is used with 'metrics.%v'.", matcher, matcher)
+	case match == "" && grokField != "":
+		return fmt.Errorf("Invalid metric configuration: 'metrics.%v.grok_field' can only be used with 'metrics.match'.", matcher)
+	}
+	return nil
+}
+
 func (c *ServerConfig) validate() error {
 	switch {
 	case c.Protocol != "https" && c.Protocol != "http":
@@ -360,6 +1075,19 @@ func AddDefaultsAndValidate(cfg *Config) error {
 	return cfg.validate()
 }
 
+// InputConfigs returns the list of inputs, regardless of whether the config file
+// uses a single 'input' section or a list of 'inputs'.
+func (cfg *Config) InputConfigs() []*InputConfig {
+	if len(cfg.Inputs) == 0 {
+		return []*InputConfig{&cfg.Input}
+	}
+	result := make([]*InputConfig, 0, len(cfg.Inputs))
+	for i := range cfg.Inputs {
+		result = append(result, &cfg.Inputs[i])
+	}
+	return result
+}
+
 // Made this public so MetricConfig can be initialized in tests.
 func (metric *MetricConfig) InitTemplates() error {
 	var (
@@ -396,17 +1124,113 @@ func (metric *MetricConfig) InitTemplates() error {
 			return fmt.Errorf(msg, "value", metric.Name, err.Error())
 		}
 	}
+	if len(metric.Timestamp) > 0 {
+		metric.TimestampTemplate, err = template.New("__timestamp__", metric.Timestamp)
+		if err != nil {
+			return fmt.Errorf(msg, metric.Name, "timestamp", err.Error())
+		}
+	}
 	return nil
 }
 
-// YAML representation, does not include default values.
+func sortedKeys(m map[string]string) []string {
+	result := make([]string, 0, len(m))
+	for key := range m {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// YAML representation, does not include default values and does not include the content of included files.
 func (cfg *Config) String() string {
 	stripped := cfg.copy()
+	stripped.Metrics = stripped.Metrics[:0]
+	for _, metric := range cfg.Metrics {
+		if metric.File == "" {
+			if metric.TimestampPolicy == defaultTimestampPolicy {
+				metric.TimestampPolicy = ""
+			}
+			if metric.TimestampMaxFuture == defaultTimestampMaxFuture {
+				metric.TimestampMaxFuture = 0
+			}
+			stripped.Metrics = append(stripped.Metrics, metric)
+		}
+	}
+	nPatterns := len(stripped.Grok.AdditionalPatterns) - cfg.Grok.nIncludedPatterns
+	stripped.Grok.AdditionalPatterns = stripped.Grok.AdditionalPatterns[:nPatterns]
 	if stripped.Global.RetentionCheckInterval == defaultRetentionCheckInterval {
 		stripped.Global.RetentionCheckInterval = 0
 	}
-	if stripped.Input.FailOnMissingLogfileString == "true" {
-		stripped.Input.FailOnMissingLogfileString = ""
+	if stripped.Global.BufferSpill != nil {
+		if stripped.Global.BufferSpill.Threshold == defaultBufferSpillThreshold {
+			stripped.Global.BufferSpill.Threshold = 0
+		}
+		if stripped.Global.BufferSpill.SegmentBytes == defaultBufferSpillSegmentBytes {
+			stripped.Global.BufferSpill.SegmentBytes = 0
+		}
+	}
+	if stripped.Input.Name == defaultInputName {
+		stripped.Input.Name = ""
+	}
+	for _, input := range stripped.InputConfigs() {
+		if input.FailOnMissingLogfileString == "true" {
+			input.FailOnMissingLogfileString = ""
+		}
+		if input.Mode == inputModeTail {
+			input.Mode = ""
+		}
+		if input.PositionFlushInterval == defaultPositionFlushInterval {
+			input.PositionFlushInterval = 0
+		}
+		if input.BufferOverflowPolicy == defaultBufferOverflowPolicy {
+			input.BufferOverflowPolicy = ""
+		}
+		if input.MaxLineAction == defaultMaxLineAction {
+			input.MaxLineAction = ""
+		}
+		if input.Type == inputTypeCommand {
+			if input.CommandRestart == defaultCommandRestart {
+				input.CommandRestart = ""
+			}
+			if input.CommandRestartDelay == defaultCommandRestartDelay {
+				input.CommandRestartDelay = 0
+			}
+			if input.CommandRestartMaxDelay == defaultCommandRestartMaxDelay {
+				input.CommandRestartMaxDelay = 0
+			}
+		}
+		if input.Type == inputTypeWebhook {
+			if input.WebhookPath == defaultWebhookPath {
+				input.WebhookPath = ""
+			}
+			if input.WebhookJsonSelector == defaultWebhookJsonSelectorFor(input.WebhookFormat) {
+				input.WebhookJsonSelector = ""
+			}
+			if input.WebhookFormat == defaultWebhookFormat {
+				input.WebhookFormat = ""
+			}
+			if input.WebhookTextBulkSeparator == defaultWebhookTextBulkSeparator {
+				input.WebhookTextBulkSeparator = ""
+			}
+			if input.WebhookMaxBodySize == defaultWebhookMaxBodySize {
+				input.WebhookMaxBodySize = 0
+			}
+			if input.WebhookQueueSize == defaultWebhookQueueSize {
+				input.WebhookQueueSize = 0
+			}
+			if input.WebhookRateLimit > 0 && input.WebhookRateLimitBurst == defaultWebhookRateLimitBurst(input.WebhookRateLimit) {
+				input.WebhookRateLimitBurst = 0
+			}
+		}
+		if input.Multiline != nil {
+			if input.Multiline.MaxLines == defaultMultilineMaxLines {
+				input.Multiline.MaxLines = 0
+			}
+			if input.Multiline.FlushTimeout == defaultMultilineFlushTimeout {
+				input.Multiline.FlushTimeout = 0
+			}
+		}
 	}
 	if stripped.Server.Path == "/metrics" {
 		stripped.Server.Path = ""
@@ -414,8 +1238,10 @@ func (cfg *Config) String() string {
 	return stripped.marshalToString()
 }
 
+// The copy is not validated, and included files are not read again.
 func (cfg *Config) copy() *Config {
-	result, _ := Unmarshal([]byte(cfg.marshalToString()))
+	result := &Config{}
+	yaml.Unmarshal([]byte(cfg.marshalToString()), result)
 	return result
 }
 
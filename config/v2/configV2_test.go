@@ -15,6 +15,10 @@
 package v2
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -145,6 +149,28 @@ server:
     port: 9144
 `
 
+const multiple_inputs_config = `
+global:
+    config_version: 2
+inputs:
+    - name: access
+      type: file
+      path: /var/log/access.log
+    - name: console
+      type: stdin
+grok:
+    patterns_dir: b/c
+metrics:
+    - type: counter
+      name: test_count_total
+      help: Dummy help message.
+      match: Some text here, then a %{DATE}.
+      inputs: [access]
+server:
+    protocol: http
+    port: 9144
+`
+
 func TestCounterValidConfig(t *testing.T) {
 	loadOrFail(t, counter_config)
 }
@@ -255,6 +281,966 @@ func TestRetentionInvalidConfig(t *testing.T) {
 	}
 }
 
+func TestMultipleInputsConfig(t *testing.T) {
+	cfg := loadOrFail(t, multiple_inputs_config)
+	inputs := cfg.InputConfigs()
+	if len(inputs) != 2 || inputs[0].Name != "access" || inputs[1].Name != "console" {
+		t.Fatalf("Expected inputs 'access' and 'console', but got %v", inputs)
+	}
+	if !inputs[0].FailOnMissingLogfile {
+		t.Fatal("Expected 'fail_on_missing_logfile' to default to true.")
+	}
+	if len(cfg.Metrics[0].Inputs) != 1 || cfg.Metrics[0].Inputs[0] != "access" {
+		t.Fatalf("Expected metric to reference input 'access', but got %v", cfg.Metrics[0].Inputs)
+	}
+}
+
+func TestSingleInputDefaultName(t *testing.T) {
+	cfg := loadOrFail(t, counter_config)
+	inputs := cfg.InputConfigs()
+	if len(inputs) != 1 || inputs[0].Name != "default" {
+		t.Fatalf("Expected a single input named 'default', but got %v", inputs)
+	}
+}
+
+func TestMultipleInputsInvalidConfig(t *testing.T) {
+	for _, test := range []struct {
+		cfg         string
+		expectedErr string
+	}{
+		{
+			cfg:         strings.Replace(multiple_inputs_config, "inputs: [access]", "inputs: [error]", 1),
+			expectedErr: "no input with that name",
+		},
+		{
+			cfg:         strings.Replace(multiple_inputs_config, "name: console", "name: access", 1),
+			expectedErr: "input 'access' defined twice",
+		},
+		{
+			cfg:         strings.Replace(multiple_inputs_config, "    - name: access\n      type: file\n", "    - type: file\n", 1),
+			expectedErr: "'inputs.name' must not be empty",
+		},
+		{
+			cfg:         strings.Replace(multiple_inputs_config, "inputs:\n", "input:\n    type: stdin\ninputs:\n", 1),
+			expectedErr: "'input' and 'inputs' cannot be used at the same time",
+		},
+	} {
+		_, err := Unmarshal([]byte(test.cfg))
+		if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+			t.Fatalf("Expected error containing %q, but got %v", test.expectedErr, err)
+		}
+	}
+}
+
+func TestUnknownAndDuplicateKeys(t *testing.T) {
+	for _, test := range []struct {
+		cfg         string
+		expectedErr string
+	}{
+		{
+			cfg:         strings.Replace(multiple_inputs_config, "      path: /var/log/access.log\n", "      pth: /var/log/access.log\n", 1),
+			expectedErr: "field pth not found",
+		},
+		{
+			cfg:         strings.Replace(multiple_inputs_config, "      inputs: [access]\n", "      inputs: [access]\n      inputs: [console]\n", 1),
+			expectedErr: "already set",
+		},
+	} {
+		_, err := Unmarshal([]byte(test.cfg))
+		if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+			t.Fatalf("Expected error containing %q, but got %v", test.expectedErr, err)
+		}
+	}
+}
+
+func TestPositionFileConfig(t *testing.T) {
+	withPositionFile := strings.Replace(multiple_inputs_config, "path: /var/log/access.log\n", "path: /var/log/access.log\n      position_file: /var/lib/grok_exporter/access.json\n", 1)
+	cfg := loadOrFail(t, withPositionFile)
+	if cfg.Inputs[0].PositionFlushInterval != 10*time.Second {
+		t.Fatalf("Expected 'position_flush_interval' to default to 10s, but got %v", cfg.Inputs[0].PositionFlushInterval)
+	}
+	for _, test := range []struct {
+		cfg         string
+		expectedErr string
+	}{
+		{
+			cfg:         strings.Replace(withPositionFile, "type: stdin\n", "type: stdin\n      position_file: /var/lib/grok_exporter/console.json\n", 1),
+			expectedErr: "'input.position_file' can only be used with input type \"file\"",
+		},
+		{
+			cfg:         strings.Replace(withPositionFile, "type: stdin\n", "type: file\n      path: /var/log/other.log\n      position_file: /var/lib/grok_exporter/access.json\n", 1),
+			expectedErr: "'position_file' /var/lib/grok_exporter/access.json is used by more than one input",
+		},
+	} {
+		_, err := Unmarshal([]byte(test.cfg))
+		if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+			t.Fatalf("Expected error containing %q, but got %v", test.expectedErr, err)
+		}
+	}
+}
+
+func TestMaxLineBytesConfig(t *testing.T) {
+	cfg := loadOrFail(t, multiple_inputs_config)
+	for _, input := range cfg.Inputs {
+		if input.MaxLineBytes != 0 || input.MaxLineAction != "" || input.InvalidUtf8 != "" {
+			t.Fatalf("Expected no limits for long lines and invalid UTF-8 by default, but got %v, %v, %v", input.MaxLineBytes, input.MaxLineAction, input.InvalidUtf8)
+		}
+	}
+	withLimits := strings.Replace(multiple_inputs_config, "path: /var/log/access.log\n", "path: /var/log/access.log\n      max_line_bytes: 4096\n      max_line_action: skip\n      invalid_utf8: reject\n", 1)
+	cfg = loadOrFail(t, withLimits)
+	if cfg.Inputs[0].MaxLineBytes != 4096 || cfg.Inputs[0].MaxLineAction != "skip" || cfg.Inputs[0].InvalidUtf8 != "reject" {
+		t.Fatalf("Unexpected config for long lines and invalid UTF-8: %v, %v, %v", cfg.Inputs[0].MaxLineBytes, cfg.Inputs[0].MaxLineAction, cfg.Inputs[0].InvalidUtf8)
+	}
+	// The limits can be used with all input types, and max_line_action defaults to truncate.
+	cfg = loadOrFail(t, strings.Replace(withLimits, "type: stdin\n", "type: stdin\n      max_line_bytes: 4096\n      invalid_utf8: replace\n", 1))
+	if cfg.Inputs[1].MaxLineBytes != 4096 || cfg.Inputs[1].MaxLineAction != "truncate" || cfg.Inputs[1].InvalidUtf8 != "replace" {
+		t.Fatalf("Unexpected config for long lines and invalid UTF-8 of stdin: %v, %v, %v", cfg.Inputs[1].MaxLineBytes, cfg.Inputs[1].MaxLineAction, cfg.Inputs[1].InvalidUtf8)
+	}
+	for _, test := range []struct {
+		cfg         string
+		expectedErr string
+	}{
+		{
+			cfg:         strings.Replace(withLimits, "max_line_bytes: 4096", "max_line_bytes: -1", 1),
+			expectedErr: "'input.max_line_bytes' must not be negative",
+		},
+		{
+			cfg:         strings.Replace(withLimits, "max_line_action: skip", "max_line_action: drop", 1),
+			expectedErr: "'input.max_line_action' must be \"truncate|skip\"",
+		},
+		{
+			cfg:         strings.Replace(withLimits, "invalid_utf8: reject", "invalid_utf8: ignore", 1),
+			expectedErr: "'input.invalid_utf8' must be \"replace|reject\"",
+		},
+		{
+			cfg:         strings.Replace(withLimits, "      max_line_bytes: 4096\n", "", 1),
+			expectedErr: "'input.max_line_action' can only be used with 'input.max_line_bytes'",
+		},
+	} {
+		_, err := Unmarshal([]byte(test.cfg))
+		if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+			t.Fatalf("Expected error containing %q, but got %v", test.expectedErr, err)
+		}
+	}
+}
+
+func TestEncodingConfig(t *testing.T) {
+	withEncoding := strings.Replace(multiple_inputs_config, "path: /var/log/access.log\n", "path: /var/log/access.log\n      encoding: utf-16le\n", 1)
+	withEncoding = strings.Replace(withEncoding, "type: stdin\n", "type: stdin\n      encoding: shift_jis\n", 1)
+	cfg := loadOrFail(t, withEncoding)
+	if cfg.Inputs[0].Encoding != "utf-16le" || cfg.Inputs[1].Encoding != "shift_jis" {
+		t.Fatalf("Unexpected encodings %v and %v", cfg.Inputs[0].Encoding, cfg.Inputs[1].Encoding)
+	}
+	for _, test := range []struct {
+		cfg         string
+		expectedErr string
+	}{
+		{
+			cfg:         strings.Replace(withEncoding, "encoding: utf-16le", "encoding: ebcdic", 1),
+			expectedErr: "'input.encoding': unsupported encoding 'ebcdic'",
+		},
+		{
+			cfg:         strings.Replace(withEncoding, "type: stdin\n      encoding: shift_jis\n", "type: syslog\n      syslog_udp_address: 127.0.0.1:5514\n      encoding: shift_jis\n", 1),
+			expectedErr: "'input.encoding' can only be used with input types \"file\", \"stdin\", and \"command\"",
+		},
+	} {
+		_, err := Unmarshal([]byte(test.cfg))
+		if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+			t.Fatalf("Expected error containing %q, but got %v", test.expectedErr, err)
+		}
+	}
+}
+
+func TestBatchModeConfig(t *testing.T) {
+	cfg := loadOrFail(t, multiple_inputs_config)
+	if cfg.Inputs[0].Mode != "tail" || cfg.Inputs[1].Mode != "tail" || cfg.IsBatchMode() {
+		t.Fatalf("Expected default mode tail, but got %v and %v", cfg.Inputs[0].Mode, cfg.Inputs[1].Mode)
+	}
+	if strings.Contains(cfg.String(), "mode") {
+		t.Fatalf("Expected default mode to be omitted in %v", cfg.String())
+	}
+	withBatch := strings.Replace(multiple_inputs_config, "path: /var/log/access.log\n", "path: /var/log/access.log\n      readall: true\n      mode: batch\n", 1)
+	withBatch = strings.Replace(withBatch, "type: stdin\n", "type: stdin\n      mode: batch\n", 1)
+	cfg = loadOrFail(t, withBatch)
+	if !cfg.IsBatchMode() {
+		t.Fatalf("Expected batch mode")
+	}
+	cfg = loadOrFail(t, strings.Replace(multiple_inputs_config, "path: /var/log/access.log\n", "path: /var/log/access.log\n      readall: true\n", 1))
+	if err := cfg.SetBatchMode(); err != nil || !cfg.IsBatchMode() {
+		t.Fatalf("Expected batch mode, but got error %v", err)
+	}
+	cfg = loadOrFail(t, multiple_inputs_config)
+	if err := cfg.SetBatchMode(); err == nil || !strings.Contains(err.Error(), "'input.readall: true'") {
+		t.Fatalf("Expected error for batch mode without readall, but got %v", err)
+	}
+	for _, test := range []struct {
+		cfg         string
+		expectedErr string
+	}{
+		{
+			cfg:         strings.Replace(withBatch, "mode: batch", "mode: once", 1),
+			expectedErr: "'input.mode' must be \"tail|batch\"",
+		},
+		{
+			cfg:         strings.Replace(withBatch, "      readall: true\n", "", 1),
+			expectedErr: "'input.mode' batch can only be used with 'input.readall: true'",
+		},
+		{
+			cfg:         strings.Replace(withBatch, "type: stdin\n      mode: batch\n", "type: stdin\n", 1),
+			expectedErr: "'mode: batch' must be used for all inputs or for none of them",
+		},
+		{
+			cfg:         strings.Replace(withBatch, "type: stdin\n", "type: syslog\n      syslog_udp_address: 127.0.0.1:5514\n", 1),
+			expectedErr: "'input.mode' can only be used with input types \"file\" and \"stdin\"",
+		},
+	} {
+		_, err := Unmarshal([]byte(test.cfg))
+		if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+			t.Fatalf("Expected error containing %q, but got %v", test.expectedErr, err)
+		}
+	}
+}
+
+func TestBufferOverflowPolicyConfig(t *testing.T) {
+	withLimit := strings.Replace(multiple_inputs_config, "path: /var/log/access.log\n", "path: /var/log/access.log\n      max_lines_in_buffer: 1000\n", 1)
+	cfg := loadOrFail(t, withLimit)
+	if cfg.Inputs[0].BufferOverflowPolicy != "drop_all" || cfg.Inputs[1].BufferOverflowPolicy != "" {
+		t.Fatalf("Expected default buffer_overflow_policy drop_all, but got %q and %q", cfg.Inputs[0].BufferOverflowPolicy, cfg.Inputs[1].BufferOverflowPolicy)
+	}
+	if strings.Contains(cfg.String(), "buffer_overflow_policy") {
+		t.Fatalf("Expected default buffer_overflow_policy to be omitted in %v", cfg.String())
+	}
+	withPolicy := strings.Replace(withLimit, "max_lines_in_buffer: 1000\n", "max_lines_in_buffer: 1000\n      buffer_overflow_policy: block\n", 1)
+	cfg = loadOrFail(t, withPolicy)
+	if cfg.Inputs[0].BufferOverflowPolicy != "block" || !strings.Contains(cfg.String(), "buffer_overflow_policy: block") {
+		t.Fatalf("Expected buffer_overflow_policy block, but got %q", cfg.Inputs[0].BufferOverflowPolicy)
+	}
+	for _, test := range []struct {
+		cfg         string
+		expectedErr string
+	}{
+		{
+			cfg:         strings.Replace(withPolicy, "policy: block", "policy: drop", 1),
+			expectedErr: "'input.buffer_overflow_policy' must be \"drop_all|drop_oldest|drop_newest|block\"",
+		},
+		{
+			cfg:         strings.Replace(withPolicy, "      max_lines_in_buffer: 1000\n", "", 1),
+			expectedErr: "'input.buffer_overflow_policy' can only be used with 'input.max_lines_in_buffer'",
+		},
+		{
+			cfg:         strings.Replace(withLimit, "max_lines_in_buffer: 1000", "max_lines_in_buffer: -1", 1),
+			expectedErr: "'input.max_lines_in_buffer' must not be negative",
+		},
+		{
+			cfg:         strings.Replace(withPolicy, "type: stdin\n", "type: stdin\n      max_lines_in_buffer: 10\n      buffer_overflow_policy: drop_oldest\n", 1),
+			expectedErr: "all inputs must use the same 'buffer_overflow_policy'",
+		},
+	} {
+		_, err := Unmarshal([]byte(test.cfg))
+		if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+			t.Fatalf("Expected error containing %q, but got %v", test.expectedErr, err)
+		}
+	}
+}
+
+func TestBufferSpillConfig(t *testing.T) {
+	withSpill := strings.Replace(multiple_inputs_config, "config_version: 2\n", "config_version: 2\n    buffer_spill:\n        dir: /var/lib/grok_exporter/spill\n", 1)
+	cfg := loadOrFail(t, withSpill)
+	spill := cfg.Global.BufferSpill
+	if spill == nil || spill.Dir != "/var/lib/grok_exporter/spill" || spill.Threshold != 10000 || spill.SegmentBytes != 16*1024*1024 {
+		t.Fatalf("Unexpected buffer_spill %#v", spill)
+	}
+	if strings.Contains(cfg.String(), "threshold") || strings.Contains(cfg.String(), "segment_bytes") || !strings.Contains(cfg.String(), "dir: /var/lib/grok_exporter/spill") {
+		t.Fatalf("Expected default buffer_spill values to be omitted in %v", cfg.String())
+	}
+	if cfg.Global.BufferSpill.Threshold != 10000 {
+		t.Fatalf("String() must not modify the configuration")
+	}
+	for _, test := range []struct {
+		cfg         string
+		expectedErr string
+	}{
+		{
+			cfg:         strings.Replace(withSpill, "dir: /var/lib/grok_exporter/spill", "threshold: 100", 1),
+			expectedErr: "'global.buffer_spill.dir' must not be empty",
+		},
+		{
+			cfg:         strings.Replace(withSpill, "dir: /var/lib/grok_exporter/spill\n", "dir: /var/lib/grok_exporter/spill\n        threshold: -1\n", 1),
+			expectedErr: "'global.buffer_spill.threshold' must not be negative",
+		},
+		{
+			cfg:         strings.Replace(withSpill, "dir: /var/lib/grok_exporter/spill\n", "dir: /var/lib/grok_exporter/spill\n        segment_bytes: -1\n", 1),
+			expectedErr: "'global.buffer_spill.segment_bytes' must be positive",
+		},
+	} {
+		_, err := Unmarshal([]byte(test.cfg))
+		if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+			t.Fatalf("Expected error containing %q, but got %v", test.expectedErr, err)
+		}
+	}
+}
+
+func TestPathsConfig(t *testing.T) {
+	withPaths := strings.Replace(multiple_inputs_config, "path: /var/log/access.log\n", `paths:
+        - /var/log/*/app.log
+        - path: /srv/**/access.log
+          readall: true
+          fail_on_missing_logfile: false
+`, 1)
+	cfg := loadOrFail(t, withPaths)
+	paths := cfg.Inputs[0].Paths
+	if len(paths) != 2 || paths[0].Path != "/var/log/*/app.log" || paths[0].Readall != nil || paths[0].FailOnMissingLogfile != nil {
+		t.Fatalf("Unexpected first path %#v", paths[0])
+	}
+	if paths[1].Path != "/srv/**/access.log" || !*paths[1].Readall || *paths[1].FailOnMissingLogfile {
+		t.Fatalf("Unexpected second path %#v", paths[1])
+	}
+	for _, test := range []struct {
+		cfg         string
+		expectedErr string
+	}{
+		{
+			cfg:         strings.Replace(withPaths, "paths:\n", "path: /var/log/access.log\n      paths:\n", 1),
+			expectedErr: "'input.path' and 'input.paths' cannot be used together",
+		},
+		{
+			cfg:         strings.Replace(withPaths, "- /var/log/*/app.log", "- /var/log/[/app.log", 1),
+			expectedErr: "'/var/log/[/app.log' is not a valid glob pattern in 'input.paths'",
+		},
+		{
+			cfg:         strings.Replace(withPaths, "type: stdin\n", "type: stdin\n      paths: [/var/log/other.log]\n", 1),
+			expectedErr: "cannot use 'input.paths' when 'input.type' is stdin",
+		},
+		{
+			cfg:         strings.Replace(multiple_inputs_config, "      path: /var/log/access.log\n", "", 1),
+			expectedErr: "'input.path' or 'input.paths' is required for input type \"file\"",
+		},
+	} {
+		_, err := Unmarshal([]byte(test.cfg))
+		if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+			t.Fatalf("Expected error containing %q, but got %v", test.expectedErr, err)
+		}
+	}
+}
+
+func TestInvalidPrometheusNames(t *testing.T) {
+	for _, test := range []struct {
+		cfg         string
+		expectedErr string
+	}{
+		{
+			cfg:         strings.Replace(counter_config, "name: test_count_total", "name: test-count-total", 1),
+			expectedErr: "'test-count-total' is not a valid Prometheus metric name",
+		},
+		{
+			cfg:         strings.Replace(counter_config, "label_b:", "label-b:", 1),
+			expectedErr: "'label-b' is not a valid Prometheus label name",
+		},
+		{
+			cfg:         strings.Replace(counter_config, "label_b:", "__label_b:", 1),
+			expectedErr: "'__label_b' is not a valid Prometheus label name",
+		},
+	} {
+		_, err := Unmarshal([]byte(test.cfg))
+		if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+			t.Fatalf("Expected error containing %q, but got %v", test.expectedErr, err)
+		}
+	}
+}
+
+func TestValidateReportsAllErrors(t *testing.T) {
+	cfgString := counter_config
+	cfgString = strings.Replace(cfgString, "readall: true", "readall: true\n    unknown_key: true", 1)
+	cfgString = strings.Replace(cfgString, "label_b:", "label_a:", 1)
+	cfgString = strings.Replace(cfgString, "      help: Dummy help message.\n", "", 1)
+	cfgString = strings.Replace(cfgString, "port: 1111", "port: -1", 1)
+	cfg, errs := Validate([]byte(cfgString), "")
+	if cfg == nil {
+		t.Fatalf("Expected config to be returned.")
+	}
+	expected := []string{
+		"line 9: unknown configuration key 'unknown_key'",
+		"line 18: metric 'test_count_total': 'label_a' is defined twice",
+		"line 13: metric 'test_count_total': Invalid metric configuration: 'metrics.help' must not be empty.",
+		"Invalid 'server.port': '-1'.",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %v errors, but got %v: %v", len(expected), len(errs), errs)
+	}
+	for i := range expected {
+		if errs[i].Error() != expected[i] {
+			t.Errorf("Expected error %q, but got %q", expected[i], errs[i].Error())
+		}
+	}
+}
+
+func TestValidateSyntaxError(t *testing.T) {
+	_, errs := Validate([]byte("global:\n    config_version: 2\nmetrics:\n  - type: counter\n   name: x\n"), "")
+	if len(errs) != 1 || errs[0].Line != 4 {
+		t.Fatalf("Expected one error in line 4, but got %v", errs)
+	}
+}
+
+const multiline_config = `
+global:
+    config_version: 2
+input:
+    type: stdin
+    multiline:
+        mode: start
+        pattern: '^%{TIMESTAMP_ISO8601} '
+        max_bytes: 65536
+grok:
+    patterns_dir: b/c
+metrics:
+    - type: counter
+      name: exceptions_total
+      help: Number of exceptions.
+      match: '^%{JAVACLASS:exception}: '
+server:
+    protocol: http
+    port: 9144
+`
+
+func TestMultilineConfig(t *testing.T) {
+	cfg := loadOrFail(t, multiline_config)
+	if cfg.Input.Multiline.MaxLines != 500 || cfg.Input.Multiline.FlushTimeout != 5*time.Second {
+		t.Fatalf("multiline defaults not set: %#v", cfg.Input.Multiline)
+	}
+	for _, test := range []struct {
+		cfg         string
+		expectedErr string
+	}{
+		{
+			cfg:         strings.Replace(multiline_config, "mode: start", "mode: first", 1),
+			expectedErr: "'input.multiline.mode' must be",
+		},
+		{
+			cfg:         strings.Replace(multiline_config, "max_bytes: 65536", "max_bytes: -1", 1),
+			expectedErr: "'input.multiline.max_bytes' must not be negative",
+		},
+	} {
+		_, err := Unmarshal([]byte(test.cfg))
+		if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+			t.Fatalf("Expected error containing %q, but got %v", test.expectedErr, err)
+		}
+	}
+}
+
+const syslog_config = `
+global:
+    config_version: 2
+input:
+    type: syslog
+    syslog_udp_address: 0.0.0.0:514
+    syslog_tcp_address: 0.0.0.0:6514
+    syslog_tls_cert: /etc/grok_exporter/syslog.crt
+    syslog_tls_key: /etc/grok_exporter/syslog.key
+grok:
+    patterns_dir: b/c
+metrics:
+    - type: counter
+      name: ssh_failed_logins_total
+      help: Failed ssh logins.
+      match: Failed password for %{USER:user}
+      labels:
+          host: '{{.syslog_hostname}}'
+server:
+    protocol: http
+    port: 9144
+`
+
+func TestSyslogConfig(t *testing.T) {
+	loadOrFail(t, syslog_config)
+	for _, test := range []struct {
+		cfg         string
+		expectedErr string
+	}{
+		{
+			cfg:         strings.Replace(strings.Replace(syslog_config, "syslog_udp_address: 0.0.0.0:514", "", 1), "syslog_tcp_address: 0.0.0.0:6514", "", 1),
+			expectedErr: "is required for input type \"syslog\"",
+		},
+		{
+			cfg:         strings.Replace(syslog_config, "syslog_tls_key: /etc/grok_exporter/syslog.key", "", 1),
+			expectedErr: "must be used together",
+		},
+		{
+			cfg:         strings.Replace(syslog_config, "syslog_tcp_address: 0.0.0.0:6514", "", 1),
+			expectedErr: "can only be used with 'input.syslog_tcp_address'",
+		},
+	} {
+		_, err := Unmarshal([]byte(test.cfg))
+		if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+			t.Fatalf("Expected error containing %q, but got %v", test.expectedErr, err)
+		}
+	}
+}
+
+const command_config = `
+global:
+    config_version: 2
+input:
+    type: command
+    command:
+    - journalctl
+    - -f
+    - -o
+    - cat
+    command_env:
+        SYSTEMD_COLORS: "false"
+    command_dir: /tmp
+    command_restart: on_failure
+    command_restart_delay: 5s
+grok:
+    patterns_dir: b/c
+metrics:
+    - type: counter
+      name: test_count_total
+      help: Dummy help message.
+      match: Some text here, then a %{DATE}.
+server:
+    protocol: http
+    port: 9144
+`
+
+func TestCommandConfig(t *testing.T) {
+	cfg := loadOrFail(t, command_config)
+	if cfg.Input.CommandRestartMaxDelay != time.Minute {
+		t.Fatalf("Expected 'command_restart_max_delay' to default to 1m, but got %v", cfg.Input.CommandRestartMaxDelay)
+	}
+	if cfg.Input.CommandEnv["SYSTEMD_COLORS"] != "false" {
+		t.Fatalf("Expected 'command_env' to contain SYSTEMD_COLORS, but got %v", cfg.Input.CommandEnv)
+	}
+	for _, test := range []struct {
+		cfg         string
+		expectedErr string
+	}{
+		{
+			cfg:         strings.Replace(command_config, "    command:\n    - journalctl\n    - -f\n    - -o\n    - cat\n", "", 1),
+			expectedErr: "'input.command' is required for input type \"command\"",
+		},
+		{
+			cfg:         strings.Replace(command_config, "command_restart: on_failure", "command_restart: sometimes", 1),
+			expectedErr: "'input.command_restart' must be \"always|on_failure|never\"",
+		},
+		{
+			cfg:         strings.Replace(command_config, "command_restart_delay: 5s", "command_restart_delay: 5s\n    command_restart_max_delay: 1s", 1),
+			expectedErr: "'input.command_restart_max_delay' must not be less than 'input.command_restart_delay'",
+		},
+		{
+			cfg:         strings.Replace(multiple_inputs_config, "type: stdin\n", "type: stdin\n      command: [cat]\n", 1),
+			expectedErr: "can only be used with input type \"command\"",
+		},
+	} {
+		_, err := Unmarshal([]byte(test.cfg))
+		if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+			t.Fatalf("Expected error containing %q, but got %v", test.expectedErr, err)
+		}
+	}
+}
+
+const webhook_config = `
+global:
+    config_version: 2
+input:
+    type: webhook
+    webhook_path: /events
+    webhook_json_selector: .records[*].message
+    webhook_basic_auth_username: alice
+    webhook_basic_auth_password: secret
+    webhook_signature: github
+    webhook_signature_secret: s3cr3t
+    webhook_rate_limit: 2.5
+grok:
+    patterns_dir: b/c
+metrics:
+    - type: counter
+      name: test_count_total
+      help: Dummy help message.
+      match: Some text here, then a %{DATE}.
+server:
+    protocol: http
+    port: 9144
+`
+
+func TestWebhookConfig(t *testing.T) {
+	cfg := loadOrFail(t, webhook_config)
+	if cfg.Input.WebhookMaxBodySize != 10*1024*1024 {
+		t.Fatalf("Expected 'webhook_max_body_size' to default to 10 MiB, but got %v", cfg.Input.WebhookMaxBodySize)
+	}
+	fluentBit := loadOrFail(t, strings.Replace(webhook_config, "webhook_json_selector: .records[*].message", "webhook_format: fluentbit", 1))
+	if fluentBit.Input.WebhookJsonSelector != ".log" {
+		t.Fatalf("Expected 'webhook_json_selector' to default to .log for fluentbit, but got %v", fluentBit.Input.WebhookJsonSelector)
+	}
+	if cfg.Input.WebhookQueueSize != 100 {
+		t.Fatalf("Expected 'webhook_queue_size' to default to 100, but got %v", cfg.Input.WebhookQueueSize)
+	}
+	if cfg.Input.WebhookRateLimitBurst != 3 {
+		t.Fatalf("Expected 'webhook_rate_limit_burst' to default to 3, but got %v", cfg.Input.WebhookRateLimitBurst)
+	}
+	for _, test := range []struct {
+		cfg         string
+		expectedErr string
+	}{
+		{
+			cfg:         strings.Replace(webhook_config, "    webhook_basic_auth_password: secret\n", "", 1),
+			expectedErr: "'input.webhook_basic_auth_username' and 'input.webhook_basic_auth_password' must be used together",
+		},
+		{
+			cfg:         strings.Replace(webhook_config, "webhook_path: /events", "webhook_path: /events\n    webhook_bearer_token_file: /etc/token", 1),
+			expectedErr: "'input.webhook_basic_auth_username' and 'input.webhook_bearer_token_file' cannot be used together",
+		},
+		{
+			cfg:         strings.Replace(webhook_config, "webhook_signature: github", "webhook_signature: gitlab", 1),
+			expectedErr: "'input.webhook_signature' must be \"github|slack\"",
+		},
+		{
+			cfg:         strings.Replace(webhook_config, "    webhook_signature_secret: s3cr3t\n", "", 1),
+			expectedErr: "'input.webhook_signature' and 'input.webhook_signature_secret' must be used together",
+		},
+		{
+			cfg:         strings.Replace(webhook_config, "webhook_path: /events", "webhook_path: /events\n    webhook_max_body_size: -1", 1),
+			expectedErr: "'input.webhook_max_body_size' must be positive",
+		},
+		{
+			cfg:         strings.Replace(webhook_config, "webhook_rate_limit: 2.5", "webhook_rate_limit: -1", 1),
+			expectedErr: "'input.webhook_rate_limit' must not be negative",
+		},
+		{
+			cfg:         strings.Replace(webhook_config, "webhook_json_selector: .records[*].message", "webhook_json_selector: .records[x].message", 1),
+			expectedErr: "'input.webhook_json_selector': .records[x].message: invalid array index \"x\"",
+		},
+		{
+			cfg:         strings.Replace(webhook_config, "webhook_path: /events", "webhook_path: /events\n    webhook_json_fields:\n        host: .host", 1),
+			expectedErr: "'input.webhook_json_fields' can only be used with webhook_format \"json_single|json_bulk|ndjson\"",
+		},
+		{
+			cfg:         strings.Replace(webhook_config, "webhook_path: /events", "webhook_path: /events\n    webhook_format: json_bulk\n    webhook_json_fields:\n        host-name: .host", 1),
+			expectedErr: "'input.webhook_json_fields': host-name is not a valid field name",
+		},
+		{
+			cfg:         strings.Replace(webhook_config, "webhook_path: /events", "webhook_path: /events\n    webhook_queue_size: -1", 1),
+			expectedErr: "'input.webhook_queue_size' must be positive",
+		},
+	} {
+		_, err := Unmarshal([]byte(test.cfg))
+		if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+			t.Fatalf("Expected error containing %q, but got %v", test.expectedErr, err)
+		}
+	}
+}
+
+const json_config = `
+global:
+    config_version: 2
+input:
+    type: stdin
+grok:
+    patterns_dir: b/c
+metrics:
+    - type: counter
+      name: http_requests_total
+      help: Dummy help message.
+      match: '%{WORD:method} %{URIPATH:path}'
+      json:
+        conditions:
+            - field: .level
+              equals: info
+            - field: .msg
+              matches: ^GET
+            - field: .error
+              exists: false
+        fields:
+            status: .response.status
+        grok_field: .msg
+      labels:
+        method: '{{.method}}'
+        status: '{{.status}}'
+server:
+    protocol: http
+    port: 9144
+`
+
+func TestJsonConfig(t *testing.T) {
+	cfg := loadOrFail(t, json_config)
+	if len(cfg.Metrics[0].Json.Conditions) != 3 || *cfg.Metrics[0].Json.Conditions[2].Exists {
+		t.Fatalf("Expected 3 conditions, the last one with 'exists: false', but got %v", cfg.Metrics[0].Json.Conditions)
+	}
+	withoutGrok := strings.Replace(json_config, "      match: '%{WORD:method} %{URIPATH:path}'\n", "", 1)
+	withoutGrok = strings.Replace(withoutGrok, "        grok_field: .msg\n", "", 1)
+	loadOrFail(t, strings.Replace(withoutGrok, "grok:\n    patterns_dir: b/c\n", "", 1)) // no grok patterns needed
+	for _, test := range []struct {
+		cfg         string
+		expectedErr string
+	}{
+		{
+			cfg:         strings.Replace(json_config, "        grok_field: .msg\n", "", 1),
+			expectedErr: "'metrics.json.grok_field' must be set if 'metrics.match' is used with 'metrics.json'",
+		},
+		{
+			cfg:         strings.Replace(json_config, "      match: '%{WORD:method} %{URIPATH:path}'\n", "", 1),
+			expectedErr: "'metrics.json.grok_field' can only be used with 'metrics.match'",
+		},
+		{
+			cfg:         strings.Replace(json_config, "field: .level", "field: level", 1),
+			expectedErr: "'metrics.json.conditions.field': level: path must start with \".\"",
+		},
+		{
+			cfg:         strings.Replace(json_config, "matches: ^GET", "matches: ^(GET", 1),
+			expectedErr: "'metrics.json.conditions.matches': error parsing regexp",
+		},
+		{
+			cfg:         strings.Replace(json_config, "field: .error", "field: .error\n              equals: timeout", 1),
+			expectedErr: "'metrics.json.conditions.exists: false' cannot be combined with 'equals' or 'matches'",
+		},
+		{
+			cfg:         strings.Replace(json_config, "status: .response.status", "http-status: .response.status", 1),
+			expectedErr: "'metrics.json.fields': 'http-status' is not a valid field name",
+		},
+		{
+			cfg:         strings.Replace(json_config, "status: .response.status", "status: .response[", 1),
+			expectedErr: "'metrics.json.fields': .response[: missing \"]\"",
+		},
+	} {
+		_, err := Unmarshal([]byte(test.cfg))
+		if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+			t.Fatalf("Expected error containing %q, but got %v", test.expectedErr, err)
+		}
+	}
+}
+
+const logfmt_config = `
+global:
+    config_version: 2
+input:
+    type: stdin
+metrics:
+    - type: counter
+      name: http_requests_total
+      help: Dummy help message.
+      logfmt:
+        conditions:
+            - field: level
+              equals: error
+      labels:
+        method: '{{.method}}'
+server:
+    protocol: http
+    port: 9144
+`
+
+func TestLogfmtConfig(t *testing.T) {
+	loadOrFail(t, logfmt_config)
+	for _, test := range []struct {
+		cfg         string
+		expectedErr string
+	}{
+		{
+			cfg:         strings.Replace(logfmt_config, "field: level", "field: ''", 1),
+			expectedErr: "'metrics.logfmt.conditions.field': must not be empty",
+		},
+		{
+			cfg:         strings.Replace(logfmt_config, "              equals: error\n", "              equals: error\n        grok_field: msg\n", 1),
+			expectedErr: "'metrics.logfmt.grok_field' can only be used with 'metrics.match'",
+		},
+		{
+			cfg:         strings.Replace(logfmt_config, "      logfmt:\n", "      json: {}\n      logfmt:\n", 1),
+			expectedErr: "only one of 'metrics.json', 'metrics.logfmt', and 'metrics.delimited' can be used",
+		},
+	} {
+		_, err := Unmarshal([]byte(test.cfg))
+		if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+			t.Fatalf("Expected error containing %q, but got %v", test.expectedErr, err)
+		}
+	}
+}
+
+const delimited_config = `
+global:
+    config_version: 2
+input:
+    type: stdin
+metrics:
+    - type: counter
+      name: http_requests_total
+      help: Dummy help message.
+      delimited:
+        delimiter: "\t"
+        columns: [date, time, cs-method, sc-status]
+        conditions:
+            - field: sc-status
+              matches: ^5
+      labels:
+        method: '{{.cs_method}}'
+server:
+    protocol: http
+    port: 9144
+`
+
+func TestDelimitedConfig(t *testing.T) {
+	cfg := loadOrFail(t, delimited_config)
+	if cfg.Metrics[0].Delimited.Delimiter != "\t" {
+		t.Fatalf("Expected tab as delimiter, but got %q", cfg.Metrics[0].Delimited.Delimiter)
+	}
+	for _, test := range []struct {
+		cfg         string
+		expectedErr string
+	}{
+		{
+			cfg:         strings.Replace(delimited_config, `delimiter: "\t"`, "delimiter: ';;'", 1),
+			expectedErr: "'metrics.delimited.delimiter' must be a single character",
+		},
+		{
+			cfg:         strings.Replace(delimited_config, `delimiter: "\t"`, "delimiter: \"'\"\n        quote: \"'\"", 1),
+			expectedErr: "'metrics.delimited.delimiter' and 'metrics.delimited.quote' must be different",
+		},
+		{
+			cfg:         strings.Replace(delimited_config, "columns: [date, time,", "columns: ['', time,", 1),
+			expectedErr: "'metrics.delimited.columns' must not contain empty names",
+		},
+		{
+			cfg:         strings.Replace(delimited_config, "      delimited:\n", "      match: '%{NUMBER}'\n      delimited:\n", 1) + "grok:\n    patterns_dir: b/c\n",
+			expectedErr: "'metrics.delimited.grok_field' must be set if 'metrics.match' is used with 'metrics.delimited'",
+		},
+	} {
+		_, err := Unmarshal([]byte(test.cfg))
+		if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+			t.Fatalf("Expected error containing %q, but got %v", test.expectedErr, err)
+		}
+	}
+}
+
+const include_config = `
+global:
+    config_version: 2
+    include:
+        - team_a/*.yml
+    metrics_dir: team_b
+input:
+    type: stdin
+grok:
+    additional_patterns:
+    - MAIN [a-z]+
+metrics:
+    - type: counter
+      name: main_total
+      help: Metric in the main config file.
+      match: '%{MAIN}'
+server:
+    protocol: http
+    port: 9144
+`
+
+const included_metrics = `
+grok:
+    additional_patterns:
+    - 'TEAM_%v [a-z]+'
+metrics:
+    - type: counter
+      name: team_%v_total
+      help: Metric in an included file.
+      match: '%%{TEAM_%v}'
+`
+
+func TestTimestampConfig(t *testing.T) {
+	withTimestamp := strings.Replace(counter_config, "      labels:\n", "      timestamp: '{{timestamp \"2006-01-02\" .date}}'\n      labels:\n", 1)
+	cfg := loadOrFail(t, withTimestamp)
+	if cfg.Metrics[0].TimestampTemplate == nil || cfg.Metrics[0].TimestampPolicy != "update" || cfg.Metrics[0].TimestampMaxFuture != 5*time.Minute {
+		t.Fatalf("Unexpected timestamp config: %v, %v", cfg.Metrics[0].TimestampPolicy, cfg.Metrics[0].TimestampMaxFuture)
+	}
+	if strings.Contains(cfg.String(), "timestamp_") {
+		t.Fatalf("Expected default timestamp_policy and timestamp_max_future to be omitted in %v", cfg.String())
+	}
+	cfg = loadOrFail(t, counter_config)
+	if cfg.Metrics[0].TimestampTemplate != nil || cfg.Metrics[0].TimestampPolicy != "" {
+		t.Fatalf("Expected no timestamp defaults for metrics without timestamp")
+	}
+	for _, test := range []struct {
+		cfg         string
+		expectedErr string
+	}{
+		{
+			cfg:         strings.Replace(withTimestamp, "      labels:\n", "      timestamp_policy: ignore\n      labels:\n", 1),
+			expectedErr: "'metrics.timestamp_policy' must be \"update|drop\"",
+		},
+		{
+			cfg:         strings.Replace(withTimestamp, "      labels:\n", "      timestamp_max_future: -1m\n      labels:\n", 1),
+			expectedErr: "'metrics.timestamp_max_future' must not be negative",
+		},
+		{
+			cfg:         strings.Replace(counter_config, "      labels:\n", "      timestamp_policy: drop\n      labels:\n", 1),
+			expectedErr: "can only be used when 'metrics.timestamp' is present",
+		},
+		{
+			cfg:         strings.Replace(withTimestamp, "{{timestamp", "{{timestmp", 1),
+			expectedErr: "error parsing timestamp template",
+		},
+	} {
+		_, err := Unmarshal([]byte(test.cfg))
+		if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+			t.Fatalf("Expected error containing %q, but got %v", test.expectedErr, err)
+		}
+	}
+}
+
+func TestIncludes(t *testing.T) {
+	dir := createIncludeDir(t)
+	defer os.RemoveAll(dir)
+	cfg, err := UnmarshalWithBaseDir([]byte(include_config), dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.Metrics) != 3 || cfg.Metrics[1].Name != "team_a_total" || cfg.Metrics[2].Name != "team_b_total" {
+		t.Fatalf("included metrics not found: %v", cfg.Metrics)
+	}
+	if cfg.Metrics[0].File != "" || cfg.Metrics[2].File != filepath.Join(dir, "team_b", "metrics.yml") {
+		t.Fatalf("unexpected file names %q and %q", cfg.Metrics[0].File, cfg.Metrics[2].File)
+	}
+	if len(cfg.Grok.AdditionalPatterns) != 3 {
+		t.Fatalf("included patterns not found: %v", cfg.Grok.AdditionalPatterns)
+	}
+	// String() shows the main config file only
+	if !equalsIgnoreIndentation(cfg.String(), include_config) {
+		t.Fatalf("Expected:\n%v\nActual:\n%v", include_config, cfg)
+	}
+}
+
+func TestIncludesInvalidConfig(t *testing.T) {
+	dir := createIncludeDir(t)
+	defer os.RemoveAll(dir)
+	writeFileOrFail(t, filepath.Join(dir, "team_a", "duplicate.yml"), fmt.Sprintf(included_metrics, "b", "b", "b"))
+	_, err := UnmarshalWithBaseDir([]byte(include_config), dir)
+	if err == nil || !strings.Contains(err.Error(), filepath.Join("team_b", "metrics.yml")+":6: metric 'team_b_total'") || !strings.Contains(err.Error(), "defined twice") {
+		t.Fatalf("Expected duplicate metric error naming the file, but got %v", err)
+	}
+	_, err = UnmarshalWithBaseDir([]byte(strings.Replace(include_config, "team_a/*.yml", "team_c.yml", 1)), dir)
+	if err == nil || !strings.Contains(err.Error(), "team_c.yml: file not found") {
+		t.Fatalf("Expected file not found error, but got %v", err)
+	}
+}
+
+func createIncludeDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "grok_exporter_config")
+	if err != nil {
+		t.Fatalf("failed to create test directory: %v", err)
+	}
+	for _, team := range []string{"a", "b"} {
+		err = os.Mkdir(filepath.Join(dir, "team_"+team), 0755)
+		if err != nil {
+			t.Fatalf("failed to create test directory: %v", err)
+		}
+		writeFileOrFail(t, filepath.Join(dir, "team_"+team, "metrics.yml"), fmt.Sprintf(included_metrics, strings.ToUpper(team), team, strings.ToUpper(team)))
+	}
+	return dir
+}
+
+func writeFileOrFail(t *testing.T, path string, content string) {
+	err := ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("failed to write %v: %v", path, err)
+	}
+}
+
 func loadOrFail(t *testing.T, cfgString string) *Config {
 	cfg, err := Unmarshal([]byte(cfgString))
 	if err != nil {
@@ -0,0 +1,130 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// includedConfig is the content of a file referenced by 'global.include' or 'global.metrics_dir'.
+type includedConfig struct {
+	Grok    includedGrokConfig `yaml:",omitempty"`
+	Metrics MetricsConfig      `yaml:",omitempty"`
+}
+
+type includedGrokConfig struct {
+	AdditionalPatterns []string `yaml:"additional_patterns,omitempty"`
+}
+
+// addIncludes reads the files referenced by 'global.include' and 'global.metrics_dir',
+// and appends their metrics and additional patterns to cfg.
+// Relative paths are resolved relative to baseDir.
+// If strict is true, unknown keys and duplicate keys in the included files are reported as errors.
+func (cfg *Config) addIncludes(baseDir string, strict bool) []*ValidationError {
+	files, err := cfg.Global.includedFiles(baseDir)
+	if err != nil {
+		return []*ValidationError{{Err: err}}
+	}
+	var result []*ValidationError
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			result = append(result, &ValidationError{File: file, Err: fmt.Errorf("failed to read included file: %v", err.Error())})
+			continue
+		}
+		content, expandErrs := ExpandVariables(content, filepath.Dir(file))
+		for _, e := range expandErrs {
+			e.File = file
+			result = append(result, e)
+		}
+		if len(expandErrs) > 0 && !strict {
+			continue
+		}
+		included := &includedConfig{}
+		if strict {
+			err = yaml.UnmarshalStrict(content, included)
+		} else {
+			err = yaml.Unmarshal(content, included)
+		}
+		metricsEnd := included.Metrics.setLineNumbers(content)
+		for i := range included.Metrics {
+			included.Metrics[i].File = file
+		}
+		if err != nil {
+			typeErr, ok := err.(*yaml.TypeError)
+			if !ok || !strict {
+				result = append(result, &ValidationError{File: file, Err: fmt.Errorf("invalid configuration: %v", err.Error())})
+				continue
+			}
+			result = append(result, included.Metrics.yamlValidationErrors(typeErr, metricsEnd, file)...)
+		}
+		cfg.Metrics = append(cfg.Metrics, included.Metrics...)
+		cfg.Grok.AdditionalPatterns = append(cfg.Grok.AdditionalPatterns, included.Grok.AdditionalPatterns...)
+		cfg.Grok.nIncludedPatterns += len(included.Grok.AdditionalPatterns)
+	}
+	return result
+}
+
+// includedFiles returns the files referenced by 'include' and 'metrics_dir', without duplicates.
+func (c *GlobalConfig) includedFiles(baseDir string) ([]string, error) {
+	var (
+		result []string
+		seen   = make(map[string]bool)
+	)
+	add := func(file string) {
+		if !seen[file] {
+			seen[file] = true
+			result = append(result, file)
+		}
+	}
+	for _, pattern := range c.Include {
+		pattern = resolvePath(baseDir, pattern)
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'global.include': %v: %v", pattern, err.Error())
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return nil, fmt.Errorf("invalid 'global.include': %v: file not found", pattern)
+		}
+		for _, match := range matches {
+			add(match)
+		}
+	}
+	if len(c.MetricsDir) > 0 {
+		dir := resolvePath(baseDir, c.MetricsDir)
+		fileInfos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'global.metrics_dir': %v", err.Error())
+		}
+		for _, fileInfo := range fileInfos {
+			ext := filepath.Ext(fileInfo.Name())
+			if !fileInfo.IsDir() && (ext == ".yml" || ext == ".yaml") {
+				add(filepath.Join(dir, fileInfo.Name()))
+			}
+		}
+	}
+	return result, nil
+}
+
+func resolvePath(baseDir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(baseDir, path)
+}
@@ -0,0 +1,185 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ValidationError is an error in the config file, as reported by Validate().
+type ValidationError struct {
+	File   string // included config file, empty if the error is in the main config file
+	Line   int    // line number in the config file, 0 if unknown
+	Metric string // name of the metric, empty if the error is not related to a metric
+	Err    error
+}
+
+func (e *ValidationError) Error() string {
+	var sb strings.Builder
+	switch {
+	case len(e.File) > 0 && e.Line > 0:
+		sb.WriteString(fmt.Sprintf("%v:%v: ", e.File, e.Line))
+	case len(e.File) > 0:
+		sb.WriteString(fmt.Sprintf("%v: ", e.File))
+	case e.Line > 0:
+		sb.WriteString(fmt.Sprintf("line %v: ", e.Line))
+	}
+	if len(e.Metric) > 0 {
+		sb.WriteString(fmt.Sprintf("metric '%v': ", e.Metric))
+	}
+	sb.WriteString(e.Err.Error())
+	return sb.String()
+}
+
+func (metric *MetricConfig) validationError(err error) *ValidationError {
+	return &ValidationError{
+		File:   metric.File,
+		Line:   metric.Line,
+		Metric: metric.Name,
+		Err:    err,
+	}
+}
+
+var (
+	yamlErrorLineExpr    = regexp.MustCompile(`^(?:yaml: )?line ([0-9]+): (.*)$`)
+	yamlUnknownFieldExpr = regexp.MustCompile(`^field (\S+) not found in type \S+$`)
+	yamlDuplicateKeyExpr = regexp.MustCompile(`^(?:key|field) "?([^"]+?)"? already set in (?:map|type \S+)$`)
+	yamlListItemExpr     = regexp.MustCompile(`^-(\s|$)`)
+	yamlTopLevelKeyExpr  = regexp.MustCompile(`^"?([A-Za-z_]+)"?\s*:`)
+	yamlBlankLineExpr    = regexp.MustCompile(`^\s*(#.*)?$`)
+)
+
+// Validate is like UnmarshalWithBaseDir(), but it does not stop at the first error.
+// It returns all errors found in the configuration, and it is strict:
+// Unknown keys and duplicate keys (like duplicate label names) are reported as errors.
+// The returned config is nil if the YAML cannot be parsed at all.
+func Validate(config []byte, baseDir string) (*Config, []*ValidationError) {
+	var result []*ValidationError
+	cfg := &Config{}
+	err := yaml.UnmarshalStrict(config, cfg)
+	if err != nil {
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok {
+			// Syntax error, the config cannot be parsed.
+			return nil, []*ValidationError{yamlValidationError(err.Error())}
+		}
+		// The YAML could be parsed, yaml.v2 continues after type errors.
+		metricsEnd := cfg.Metrics.setLineNumbers(config)
+		result = append(result, cfg.Metrics.yamlValidationErrors(typeErr, metricsEnd, "")...)
+	} else {
+		cfg.Metrics.setLineNumbers(config)
+	}
+	result = append(result, cfg.addIncludes(baseDir, true)...)
+	cfg.addDefaults()
+	for i := range cfg.Metrics {
+		err = cfg.Metrics[i].InitTemplates()
+		if err != nil {
+			result = append(result, cfg.Metrics[i].validationError(err))
+		}
+	}
+	result = append(result, cfg.validationErrors()...)
+	return cfg, result
+}
+
+// yamlValidationErrors converts the errors reported by yaml.v2 and assigns them to the metrics where they occurred.
+func (c *MetricsConfig) yamlValidationErrors(typeErr *yaml.TypeError, metricsEnd int, file string) []*ValidationError {
+	result := make([]*ValidationError, 0, len(typeErr.Errors))
+	for _, msg := range typeErr.Errors {
+		e := yamlValidationError(msg)
+		e.File = file
+		if metric := c.findByLine(e.Line); metric != nil && e.Line < metricsEnd {
+			e.Metric = metric.Name
+		}
+		result = append(result, e)
+	}
+	return result
+}
+
+func yamlValidationError(msg string) *ValidationError {
+	result := &ValidationError{
+		Err: errors.New(msg),
+	}
+	if match := yamlErrorLineExpr.FindStringSubmatch(msg); match != nil {
+		result.Line, _ = strconv.Atoi(match[1])
+		msg = match[2]
+		result.Err = errors.New(msg)
+	}
+	if match := yamlUnknownFieldExpr.FindStringSubmatch(msg); match != nil {
+		result.Err = fmt.Errorf("unknown configuration key '%v'", match[1])
+	} else if match := yamlDuplicateKeyExpr.FindStringSubmatch(msg); match != nil {
+		result.Err = fmt.Errorf("'%v' is defined twice", match[1])
+	}
+	return result
+}
+
+// setLineNumbers finds the line numbers of the metric definitions in the config file.
+// yaml.v2 does not provide line numbers, so we look for the list items in the top level 'metrics' section.
+// If the metrics are not written as a block sequence, the line numbers remain 0.
+// The return value is the first line after the 'metrics' section.
+func (c *MetricsConfig) setLineNumbers(config []byte) int {
+	var (
+		lines       = strings.Split(string(config), "\n")
+		lineNumbers []int
+		inMetrics   bool
+		itemIndent  = -1
+		end         = len(lines) + 1
+	)
+	for i, line := range lines {
+		if yamlBlankLineExpr.MatchString(line) {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		trimmed := line[indent:]
+		if indent == 0 && !yamlListItemExpr.MatchString(trimmed) {
+			if inMetrics {
+				end = i + 1
+				break
+			}
+			match := yamlTopLevelKeyExpr.FindStringSubmatch(trimmed)
+			inMetrics = match != nil && match[1] == "metrics"
+			continue
+		}
+		if inMetrics && yamlListItemExpr.MatchString(trimmed) {
+			if itemIndent < 0 {
+				itemIndent = indent
+			}
+			if indent == itemIndent {
+				lineNumbers = append(lineNumbers, i+1)
+			}
+		}
+	}
+	if len(lineNumbers) == len(*c) {
+		for i := range *c {
+			(*c)[i].Line = lineNumbers[i]
+		}
+	}
+	return end
+}
+
+// findByLine returns the metric defined at the given line, or nil if the line is not part of a metric definition.
+func (c *MetricsConfig) findByLine(line int) *MetricConfig {
+	var result *MetricConfig
+	for i := range *c {
+		if (*c)[i].Line > 0 && (*c)[i].Line <= line {
+			result = &(*c)[i]
+		}
+	}
+	return result
+}
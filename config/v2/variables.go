@@ -0,0 +1,384 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// variableExpr matches the following references:
+//
+// * ${VAR}             - value of the environment variable VAR
+// * ${VAR:-default}    - value of VAR, or 'default' if VAR is undefined or empty
+// * ${file:/some/path} - content of the file /some/path, without trailing newline
+//
+// A reference with two leading dollar signs like $${VAR} is not expanded, it is replaced with ${VAR}.
+var variableExpr = regexp.MustCompile(`\$(\$?)\{(?:file:([^}]+)|([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?)\}`)
+
+// ContainsVariables returns true if the config contains references that are replaced by ExpandVariables().
+func ContainsVariables(config []byte) bool {
+	return variableExpr.Match(config)
+}
+
+// ExpandVariables replaces references to environment variables and files, see variableExpr above.
+// Relative file paths are resolved relative to baseDir.
+// Undefined variables without default value are reported as errors and replaced with the empty string.
+//
+// The values are inserted so that they cannot change the structure of the YAML document:
+//
+//   - References in comments are not expanded.
+//   - In double-quoted and single-quoted strings, the value is escaped.
+//   - In literal (|) and folded (>) block scalars, lines of the value are indented like the line of the reference.
+//   - In unquoted values, the value is inserted as it is if it has no special meaning in YAML, so that numbers
+//     like ${PORT} keep working. Otherwise, it is inserted as a double-quoted string if the reference is the
+//     entire value, and it is an error if the reference is only a part of the value.
+func ExpandVariables(config []byte, baseDir string) ([]byte, []*ValidationError) {
+	var (
+		result  []byte
+		errs    []*ValidationError
+		last    = 0
+		scanner = newYamlScanner(config)
+	)
+	for _, match := range variableExpr.FindAllSubmatchIndex(config, -1) {
+		result = append(result, config[last:match[0]]...)
+		last = match[1]
+		scanner.advance(match[0])
+		pos := scanner.position(match[1])
+		scanner.skip(match[1])
+		if pos.context == commentContext {
+			result = append(result, config[match[0]:match[1]]...)
+			continue
+		}
+		group := func(i int) string {
+			if match[2*i] < 0 {
+				return ""
+			}
+			return string(config[match[2*i]:match[2*i+1]])
+		}
+		if len(group(1)) > 0 { // escaped with $$
+			result = append(result, config[match[0]+1:match[1]]...)
+			continue
+		}
+		line := bytes.Count(config[:match[0]], []byte("\n")) + 1
+		value, err := lookupVariable(group(2), group(3), match[8] >= 0, group(5), baseDir)
+		if err == nil {
+			value, err = escapeValue(value, pos, string(config[match[0]:match[1]]))
+		}
+		if err != nil {
+			errs = append(errs, &ValidationError{
+				Line: line,
+				Err:  err,
+			})
+		}
+		result = append(result, value...)
+	}
+	result = append(result, config[last:]...)
+	return result, errs
+}
+
+// escapeValue makes sure the value cannot change the structure of the YAML document, see ExpandVariables().
+func escapeValue(value string, pos valuePosition, reference string) (string, error) {
+	switch pos.context {
+	case doubleQuotedContext:
+		quoted := strconv.Quote(value)
+		return quoted[1 : len(quoted)-1], nil
+	case singleQuotedContext:
+		if strings.ContainsAny(value, "\r\n") {
+			return "", fmt.Errorf("invalid configuration: the value of %v contains a line break, which cannot be used in a single-quoted string. use a double-quoted string instead.", reference)
+		}
+		return strings.Replace(value, "'", "''", -1), nil
+	case blockContext:
+		return strings.Replace(value, "\n", "\n"+strings.Repeat(" ", pos.indent), -1), nil
+	default:
+		if isPlainValue(value, pos.scalarStart, pos.inFlow) {
+			return value, nil
+		}
+		if pos.wholeScalar {
+			return strconv.Quote(value), nil
+		}
+		return "", fmt.Errorf("invalid configuration: the value of %v contains characters with a special meaning in YAML. put the value in double quotes.", reference)
+	}
+}
+
+// isPlainValue tells whether the value can be inserted into an unquoted YAML value without changing its meaning.
+// atScalarStart means that the value is inserted at the beginning of the unquoted value.
+func isPlainValue(value string, atScalarStart bool, inFlow bool) bool {
+	if len(value) == 0 {
+		return true
+	}
+	if strings.ContainsAny(value, "\r\n") || strings.Contains(value, ": ") || strings.Contains(value, ":\t") || strings.Contains(value, " #") || strings.Contains(value, "\t#") {
+		return false
+	}
+	if strings.Trim(value, " \t") != value || strings.HasSuffix(value, ":") {
+		return false
+	}
+	if inFlow && strings.ContainsAny(value, ",[]{}") {
+		return false
+	}
+	if atScalarStart {
+		if strings.IndexByte(",[]{}#&*!|>'\"%@`", value[0]) >= 0 {
+			return false
+		}
+		if strings.IndexByte("-?:", value[0]) >= 0 && (len(value) == 1 || value[1] == ' ' || value[1] == '\t') {
+			return false
+		}
+	}
+	return true
+}
+
+// yamlContext is the syntactical context of a position in a YAML document.
+type yamlContext int
+
+const (
+	plainContext        yamlContext = iota // unquoted values, keys, and indicators
+	doubleQuotedContext                    // "..."
+	singleQuotedContext                    // '...'
+	blockContext                           // the lines of a literal (|) or folded (>) block scalar
+	commentContext                         // # ...
+)
+
+// valuePosition describes where a variable reference is found in a YAML document.
+type valuePosition struct {
+	context     yamlContext
+	indent      int  // indentation of the line
+	scalarStart bool // the reference is at the beginning of an unquoted value
+	wholeScalar bool // the reference is an entire unquoted value
+	inFlow      bool // the reference is inside [...] or {...}
+}
+
+// yamlScanner reads a YAML document from beginning to end and keeps track of the context.
+// It knows just enough YAML to find comments, quoted strings, and block scalars. It does not validate the document.
+type yamlScanner struct {
+	doc          []byte
+	pos          int // next character to be read
+	context      yamlContext
+	prev         byte // previous character
+	atLineStart  bool // only indentation was read on the current line
+	lineStart    int  // position of the first character of the current line
+	indent       int  // indentation of the current line
+	scalarStart  bool // the next non-space character starts a new value or key, like after "key: " or "- "
+	flowDepth    int  // nesting of [...] and {...}
+	nodeColumn   int  // column where the current key or value started
+	parentColumn int  // column of the last key or "- " on the current line, -1 if none
+	blockHeader  bool // a block scalar indicator | or > was read on the current line
+	blockIndent  int  // lines of the current block scalar are indented more than blockIndent
+}
+
+func newYamlScanner(doc []byte) *yamlScanner {
+	return &yamlScanner{
+		doc:          doc,
+		prev:         '\n',
+		atLineStart:  true,
+		scalarStart:  true,
+		parentColumn: -1,
+	}
+}
+
+// advance reads the document up to position to.
+func (s *yamlScanner) advance(to int) {
+	for s.pos < to {
+		s.next()
+	}
+}
+
+// position returns the context of a reference that starts at the current position and ends at end.
+func (s *yamlScanner) position(end int) valuePosition {
+	if s.atLineStart {
+		s.endBlock()
+	}
+	return valuePosition{
+		context:     s.context,
+		indent:      s.indent,
+		scalarStart: s.context == plainContext && s.scalarStart,
+		wholeScalar: s.context == plainContext && s.scalarStart && s.endsScalar(end),
+		inFlow:      s.flowDepth > 0,
+	}
+}
+
+// skip continues after a variable reference. The reference is treated like a part of a value.
+func (s *yamlScanner) skip(to int) {
+	if s.atLineStart {
+		s.endBlock()
+		s.atLineStart = false
+	}
+	if s.context == plainContext {
+		if s.scalarStart {
+			s.nodeColumn = s.pos - s.lineStart
+		}
+		s.scalarStart = false
+		s.prev = '}'
+	}
+	s.pos = to
+}
+
+// endBlock is called for the first character after the indentation. A block scalar ends with the first line
+// that is not indented more than the key or "- " it belongs to.
+func (s *yamlScanner) endBlock() {
+	if s.context == blockContext && s.indent <= s.blockIndent {
+		s.context = plainContext
+		s.scalarStart = true
+	}
+}
+
+// endsScalar tells whether an unquoted value ends at position pos, i.e. if it is followed by the end of the line,
+// a comment, or the end of a [...] or {...} element.
+func (s *yamlScanner) endsScalar(pos int) bool {
+	start := pos
+	for pos < len(s.doc) && (s.doc[pos] == ' ' || s.doc[pos] == '\t') {
+		pos++
+	}
+	if pos == len(s.doc) {
+		return true
+	}
+	switch c := s.doc[pos]; {
+	case c == '\n' || c == '\r':
+		return true
+	case c == '#':
+		return pos > start
+	case s.flowDepth > 0:
+		return c == ',' || c == ']' || c == '}'
+	}
+	return false
+}
+
+func (s *yamlScanner) next() {
+	c := s.doc[s.pos]
+	s.pos++
+	if c == '\n' {
+		s.newline()
+		return
+	}
+	if s.atLineStart {
+		if c == ' ' {
+			s.indent++
+			return
+		}
+		s.atLineStart = false
+		if c != '\r' {
+			s.endBlock()
+		}
+	}
+	switch s.context {
+	case doubleQuotedContext:
+		if c == '\\' && s.pos < len(s.doc) && s.doc[s.pos] != '\n' {
+			s.pos++ // skip the escaped character
+		} else if c == '"' {
+			s.context = plainContext
+		}
+	case singleQuotedContext:
+		if c == '\'' {
+			if s.pos < len(s.doc) && s.doc[s.pos] == '\'' {
+				s.pos++ // '' is an escaped single quote
+			} else {
+				s.context = plainContext
+			}
+		}
+	case plainContext:
+		s.nextPlain(c, s.pos-1-s.lineStart)
+	}
+	s.prev = c
+}
+
+func (s *yamlScanner) nextPlain(c byte, column int) {
+	if c == ' ' || c == '\t' || c == '\r' {
+		return
+	}
+	if c == '#' && (s.prev == ' ' || s.prev == '\t' || s.prev == '\n') {
+		s.context = commentContext
+		return
+	}
+	isIndicator := func() bool {
+		next := byte(0)
+		if s.pos < len(s.doc) {
+			next = s.doc[s.pos]
+		}
+		return next == 0 || next == ' ' || next == '\t' || next == '\r' || next == '\n' ||
+			(s.flowDepth > 0 && strings.IndexByte(",[]{}", next) >= 0)
+	}
+	if s.scalarStart {
+		s.nodeColumn = column
+	}
+	switch {
+	case s.scalarStart && c == '"':
+		s.context = doubleQuotedContext
+		s.scalarStart = false
+	case s.scalarStart && c == '\'':
+		s.context = singleQuotedContext
+		s.scalarStart = false
+	case s.scalarStart && (c == '|' || c == '>') && s.flowDepth == 0:
+		s.blockHeader = true
+		s.scalarStart = false
+	case s.scalarStart && (c == '[' || c == '{'):
+		s.flowDepth++
+	case s.flowDepth > 0 && (c == ']' || c == '}'):
+		s.flowDepth--
+		s.scalarStart = false
+	case s.flowDepth > 0 && c == ',':
+		s.scalarStart = true
+	case s.scalarStart && (c == '-' || c == '?') && isIndicator():
+		s.parentColumn = column
+	case c == ':' && isIndicator():
+		s.parentColumn = s.nodeColumn
+		s.scalarStart = true
+	default:
+		s.scalarStart = false
+	}
+}
+
+func (s *yamlScanner) newline() {
+	if s.context == commentContext {
+		s.context = plainContext
+	}
+	if s.blockHeader {
+		s.context = blockContext
+		s.blockIndent = s.parentColumn
+		s.blockHeader = false
+	}
+	s.prev = '\n'
+	s.atLineStart = true
+	s.lineStart = s.pos
+	s.indent = 0
+	s.parentColumn = -1
+	if s.context == plainContext {
+		s.scalarStart = true
+	}
+}
+
+func lookupVariable(path, name string, hasDefault bool, defaultValue string, baseDir string) (string, error) {
+	if len(path) > 0 {
+		content, err := ioutil.ReadFile(resolvePath(baseDir, path))
+		if err != nil {
+			return "", fmt.Errorf("invalid configuration: failed to read ${file:%v}: %v", path, err.Error())
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+	value := os.Getenv(name)
+	if len(value) > 0 {
+		return value, nil
+	}
+	if hasDefault {
+		return defaultValue, nil
+	}
+	if _, isSet := os.LookupEnv(name); isSet {
+		return "", nil
+	}
+	return "", fmt.Errorf("invalid configuration: environment variable '%v' is not defined. use ${%v:-default} to specify a default value.", name, name)
+}
@@ -25,6 +25,8 @@ type bufferLoadMetric struct {
 	min15s, min30s, min45s, min60s int64
 	max15s, max30s, max45s, max60s int64
 	bufferLoad                     *prometheus.GaugeVec
+	spillBytes                     int64
+	spillBytesGauge                prometheus.Gauge
 	mutex                          *sync.Cond
 	tick                           *time.Ticker
 	log                            logrus.FieldLogger
@@ -55,6 +57,14 @@ func (m *bufferLoadMetric) start(ticker *time.Ticker, tickProcessed chan struct{
 	prometheus.MustRegister(m.bufferLoad)
 	m.bufferLoad.With(minLabel).Set(0)
 	m.bufferLoad.With(maxLabel).Set(0)
+	m.mutex.L.Lock()
+	m.spillBytesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "grok_exporter_line_buffer_spill_bytes",
+		Help: "Size of the segment files with lines that did not fit into the in-memory line buffer.",
+	})
+	m.spillBytesGauge.Set(float64(m.spillBytes))
+	m.mutex.L.Unlock()
+	prometheus.MustRegister(m.spillBytesGauge)
 	go func() {
 		var ticksSinceLastLog = 0
 		for range m.tick.C {
@@ -96,6 +106,7 @@ func (m *bufferLoadMetric) start(ticker *time.Ticker, tickProcessed chan struct{
 func (m *bufferLoadMetric) Stop() {
 	m.tick.Stop()
 	prometheus.Unregister(m.bufferLoad)
+	prometheus.Unregister(m.spillBytesGauge)
 }
 
 func (m *bufferLoadMetric) Inc() {
@@ -149,3 +160,13 @@ func (m *bufferLoadMetric) Set(value int64) {
 	m.updateMin()
 	m.updateMax()
 }
+
+// SetSpillBytes may be called before Start(), the value is exposed when the metric is registered.
+func (m *bufferLoadMetric) SetSpillBytes(bytes int64) {
+	m.mutex.L.Lock()
+	defer m.mutex.L.Unlock()
+	m.spillBytes = bytes
+	if m.spillBytesGauge != nil {
+		m.spillBytesGauge.Set(float64(bytes))
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"errors"
+	"github.com/fstab/grok_exporter/config/v2"
+	"github.com/fstab/grok_exporter/oniguruma"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"strings"
+	"sync"
+)
+
+const fieldsDirective = "#Fields:"
+
+// delimitedMatcher matches CSV, TSV, and W3C extended log lines, like IIS or CloudFront access logs.
+// Lines starting with '#' are directives. They don't match, but a '#Fields:' directive defines the column names
+// for the following lines of the same file. Files without '#Fields:' directive use the configured columns.
+// Lines with a different number of values than columns don't match. Column names are used in templates like keys
+// in the logfmt matcher, so the column 'cs-method' is '{{.cs_method}}'.
+type delimitedMatcher struct {
+	delimiter  byte
+	quote      byte
+	columns    []string // configured column names, may be empty
+	conditions []delimitedCondition
+	grokField  string
+	regex      *oniguruma.Regex // nil if there is no grok pattern
+
+	lock         sync.Mutex
+	fileToHeader map[string][]string // column names from the last '#Fields:' directive of each file
+}
+
+type delimitedCondition struct {
+	fieldCondition
+	column string
+}
+
+type delimitedFields struct {
+	values     map[string]string // template field name -> value
+	grokFields Fields            // nil if there is no grok pattern
+}
+
+func newDelimitedMatcher(cfg *v2.DelimitedMatchConfig, regex *oniguruma.Regex) (*delimitedMatcher, error) {
+	result := &delimitedMatcher{
+		delimiter:    ',',
+		quote:        '"',
+		columns:      normalizeColumns(cfg.Columns),
+		grokField:    templateFieldName(cfg.GrokField),
+		regex:        regex,
+		fileToHeader: make(map[string][]string),
+	}
+	if len(cfg.Delimiter) > 0 {
+		result.delimiter = cfg.Delimiter[0]
+	}
+	if len(cfg.Quote) > 0 {
+		result.quote = cfg.Quote[0]
+	}
+	for _, c := range cfg.Conditions {
+		condition, err := newFieldCondition(c)
+		if err != nil {
+			return nil, err
+		}
+		result.conditions = append(result.conditions, delimitedCondition{fieldCondition: condition, column: templateFieldName(c.Field)})
+	}
+	return result, nil
+}
+
+func normalizeColumns(columns []string) []string {
+	result := make([]string, 0, len(columns))
+	for _, column := range columns {
+		result = append(result, templateFieldName(column))
+	}
+	return result
+}
+
+func (m *delimitedMatcher) Match(line *fswatcher.Line) (Fields, error) {
+	if strings.HasPrefix(line.Line, "#") {
+		if strings.HasPrefix(line.Line, fieldsDirective) {
+			m.lock.Lock()
+			m.fileToHeader[line.File] = normalizeColumns(strings.Fields(line.Line[len(fieldsDirective):]))
+			m.lock.Unlock()
+		}
+		return nil, nil
+	}
+	columns := m.columnsFor(line.File)
+	values, err := splitDelimited(line.Line, m.delimiter, m.quote)
+	if err != nil || len(columns) == 0 || len(values) != len(columns) {
+		return nil, nil
+	}
+	result := &delimitedFields{values: make(map[string]string, len(columns))}
+	for i, column := range columns {
+		result.values[column] = values[i]
+	}
+	for _, condition := range m.conditions {
+		var conditionValues []string
+		if value, exists := result.values[condition.column]; exists {
+			conditionValues = []string{value}
+		}
+		if !condition.isTrue(conditionValues) {
+			return nil, nil
+		}
+	}
+	if m.regex != nil {
+		value, exists := result.values[m.grokField]
+		if !exists {
+			return nil, nil
+		}
+		if result.grokFields, err = grokMatch(m.regex, value); err != nil || result.grokFields == nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (m *delimitedMatcher) columnsFor(file string) []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if header, exists := m.fileToHeader[file]; exists {
+		return header
+	}
+	return m.columns
+}
+
+// If columns are configured, templates may only use these columns. Otherwise, the column names are not known
+// before the '#Fields:' directive is read, so all fields are accepted.
+func (m *delimitedMatcher) HasField(name string) bool {
+	if len(m.columns) == 0 {
+		return true
+	}
+	if m.regex != nil && m.regex.HasCaptureGroup(name) {
+		return true
+	}
+	for _, column := range m.columns {
+		if column == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *delimitedMatcher) Free() {
+	if m.regex != nil {
+		m.regex.Free()
+	}
+}
+
+func (f *delimitedFields) Get(name string) (string, bool) {
+	if f.grokFields != nil {
+		if value, exists := f.grokFields.Get(name); exists {
+			return value, true
+		}
+	}
+	return f.values[name], true
+}
+
+func (f *delimitedFields) Free() {
+	if f.grokFields != nil {
+		f.grokFields.Free()
+	}
+}
+
+// splitDelimited splits a line into values. A value may be enclosed in quotes, a quote within a
+// quoted value is written as two quotes, like "say ""hello""".
+func splitDelimited(line string, delimiter, quote byte) ([]string, error) {
+	var (
+		result []string
+		value  []byte
+		i      = 0
+	)
+	for {
+		value = value[:0]
+		if i < len(line) && line[i] == quote {
+			for i++; ; i++ {
+				if i >= len(line) {
+					return nil, errors.New("unterminated quoted value")
+				}
+				if line[i] == quote {
+					if i+1 < len(line) && line[i+1] == quote {
+						i++
+					} else {
+						i++
+						break
+					}
+				}
+				value = append(value, line[i])
+			}
+			if i < len(line) && line[i] != delimiter {
+				return nil, errors.New("unexpected character after quoted value")
+			}
+		} else {
+			for ; i < len(line) && line[i] != delimiter; i++ {
+				value = append(value, line[i])
+			}
+		}
+		result = append(result, string(value))
+		if i >= len(line) {
+			return result, nil
+		}
+		i++ // skip delimiter
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	configuration "github.com/fstab/grok_exporter/config/v2"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_model/go"
+	"reflect"
+	"testing"
+)
+
+func TestSplitDelimited(t *testing.T) {
+	for _, test := range []struct {
+		line      string
+		delimiter byte
+		expected  []string
+	}{
+		{`a,b,c`, ',', []string{"a", "b", "c"}},
+		{`a,,c,`, ',', []string{"a", "", "c", ""}},
+		{`"a,b","say ""hello""",c`, ',', []string{"a,b", `say "hello"`, "c"}},
+		{"2019-10-11\t18:23:58\tGET", '\t', []string{"2019-10-11", "18:23:58", "GET"}},
+		{``, ',', []string{""}},
+	} {
+		values, err := splitDelimited(test.line, test.delimiter, '"')
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", test.line, err)
+		}
+		if !reflect.DeepEqual(values, test.expected) {
+			t.Fatalf("%q: expected %q, but got %q", test.line, test.expected, values)
+		}
+	}
+	for _, line := range []string{`"unterminated,b`, `"a"b,c`} {
+		if _, err := splitDelimited(line, ',', '"'); err == nil {
+			t.Fatalf("%q: expected error", line)
+		}
+	}
+}
+
+func TestDelimitedMatcherW3C(t *testing.T) {
+	cfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name: "iis_requests_total",
+		Delimited: &configuration.DelimitedMatchConfig{
+			Delimiter:  " ",
+			Conditions: []configuration.FieldConditionConfig{{Field: "cs-method", Equals: "GET"}},
+		},
+		Labels: map[string]string{
+			"uri":    "{{.cs_uri_stem}}",
+			"status": "{{.sc_status}}",
+		},
+	})
+	matcher, err := NewMatcher(cfg, loadPatternDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer matcher.Free()
+	counter := NewCounterMetric(cfg, matcher, nil)
+	for _, line := range []*fswatcher.Line{
+		{File: "a.log", Line: "#Software: Microsoft Internet Information Services 10.0"},
+		{File: "a.log", Line: "#Fields: date time cs-method cs-uri-stem sc-status"},
+		{File: "a.log", Line: "2019-10-11 18:23:58 GET /index.html 200"},
+		{File: "a.log", Line: "2019-10-11 18:23:59 POST /login 302"},     // condition is false
+		{File: "b.log", Line: "2019-10-11 18:24:00 GET /index.html 200"}, // no header in b.log
+		{File: "a.log", Line: "#Fields: date time cs-method sc-status cs-uri-stem"},
+		{File: "a.log", Line: "2019-10-11 18:24:01 GET 404 /missing"},
+		{File: "a.log", Line: "2019-10-11 18:24:02 GET 404"}, // missing column
+	} {
+		if _, err = counter.ProcessMatch(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := counter.Collector().(*prometheus.CounterVec)
+	for _, expected := range []struct {
+		uri, status string
+		count       float64
+	}{{"/index.html", "200", 1}, {"/missing", "404", 1}, {"/login", "302", 0}} {
+		m := io_prometheus_client.Metric{}
+		c.With(prometheus.Labels{"uri": expected.uri, "status": expected.status}).Write(&m)
+		if *m.Counter.Value != expected.count {
+			t.Errorf("Expected %v matches for %v, but got %v", expected.count, expected.uri, *m.Counter.Value)
+		}
+	}
+}
+
+func TestDelimitedMatcherColumns(t *testing.T) {
+	cfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name:  "query_duration_seconds",
+		Match: "%{NUMBER:ms}ms",
+		Delimited: &configuration.DelimitedMatchConfig{
+			Columns:   []string{"user", "query", "duration"},
+			GrokField: "duration",
+		},
+		Value:  "{{divide .ms 1000}}",
+		Labels: map[string]string{"user": "{{.user}}"},
+	})
+	matcher, err := NewMatcher(cfg, loadPatternDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer matcher.Free()
+	if err = VerifyFieldNames(cfg, matcher, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if matcher.HasField("usr") {
+		t.Fatalf("Expected only configured columns and grok fields to be accepted")
+	}
+	gauge := NewGaugeMetric(cfg, matcher, nil)
+	if _, err = gauge.ProcessMatch(&fswatcher.Line{Line: `alice,"SELECT a, b FROM t",250ms`}); err != nil {
+		t.Fatal(err)
+	}
+	m := io_prometheus_client.Metric{}
+	gauge.Collector().(*prometheus.GaugeVec).With(prometheus.Labels{"user": "alice"}).Write(&m)
+	if *m.Gauge.Value != 0.25 {
+		t.Errorf("Expected 0.25, but got %v", *m.Gauge.Value)
+	}
+}
@@ -25,7 +25,7 @@ import (
 
 // Compile a grok pattern string into a regular expression.
 func Compile(pattern string, patterns *Patterns) (*oniguruma.Regex, error) {
-	regex, err := expand(pattern, patterns)
+	regex, err := Expand(pattern, patterns)
 	if err != nil {
 		return nil, err
 	}
@@ -36,39 +36,65 @@ func Compile(pattern string, patterns *Patterns) (*oniguruma.Regex, error) {
 	return result, nil
 }
 
-func VerifyFieldNames(m *v2.MetricConfig, regex, deleteRegex *oniguruma.Regex) error {
+// VerifyFieldNames makes sure that all fields referenced in the templates are either provided by the matcher,
+// like the grok fields defined in the match pattern, or are metadataFields provided by the inputs, or are reserved
+// variables. The metadata field "*" allows any field name.
+func VerifyFieldNames(m *v2.MetricConfig, matcher, deleteMatcher Matcher, metadataFields []string) error {
+	errs := FieldNameErrors(m, matcher, deleteMatcher, metadataFields)
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// FieldNameErrors is like VerifyFieldNames, but returns all errors instead of only the first one.
+func FieldNameErrors(m *v2.MetricConfig, matcher, deleteMatcher Matcher, metadataFields []string) []error {
+	var result []error
 	for _, template := range m.LabelTemplates {
-		err := verifyFieldName(m.Name, template, regex)
+		err := verifyFieldName(m.Name, template, matcher, metadataFields)
 		if err != nil {
-			return err
+			result = append(result, err)
 		}
 	}
 	for _, template := range m.DeleteLabelTemplates {
-		err := verifyFieldName(m.Name, template, deleteRegex)
+		err := verifyFieldName(m.Name, template, deleteMatcher, metadataFields)
 		if err != nil {
-			return err
+			result = append(result, err)
 		}
 	}
 	if m.ValueTemplate != nil {
-		err := verifyFieldName(m.Name, m.ValueTemplate, regex)
+		err := verifyFieldName(m.Name, m.ValueTemplate, matcher, metadataFields)
 		if err != nil {
-			return err
+			result = append(result, err)
 		}
 	}
-	return nil
+	if m.TimestampTemplate != nil {
+		err := verifyFieldName(m.Name, m.TimestampTemplate, matcher, metadataFields)
+		if err != nil {
+			result = append(result, err)
+		}
+	}
+	return result
 }
 
-func verifyFieldName(metricName string, template template.Template, regex *oniguruma.Regex) error {
+func verifyFieldName(metricName string, template template.Template, matcher Matcher, metadataFields []string) error {
 	if template != nil {
 		for _, grokFieldName := range template.ReferencedGrokFields() {
-			if !regex.HasCaptureGroup(grokFieldName) {
-				return fmt.Errorf("%v: grok field %v not found in match pattern", metricName, grokFieldName)
+			if !matcher.HasField(grokFieldName) && !containsString(metadataFields, grokFieldName) && !containsString(metadataFields, "*") && !isReservedVariable(grokFieldName) {
+				return missingFieldError(metricName, grokFieldName, matcher)
 			}
 		}
 	}
 	return nil
 }
 
+func missingFieldError(metricName, field string, matcher Matcher) error {
+	if _, isGrok := matcher.(*grokMatcher); isGrok {
+		return fmt.Errorf("%v: grok field %v not found in match pattern", metricName, field)
+	}
+	return fmt.Errorf("%v: field %v not found in match pattern or fields", metricName, field)
+}
+
 // PATTERN_RE matches the %{..} patterns. There are three possibilities:
 // 1) %{USER}               - grok pattern
 // 2) %{IP:clientip}        - grok pattern with name
@@ -76,7 +102,7 @@ func verifyFieldName(metricName string, template template.Template, regex *onigu
 const PATTERN_RE = `%{(.+?)}`
 
 // Expand recursively resolves all grok patterns %{..} and returns a regular expression.
-func expand(pattern string, patterns *Patterns) (string, error) {
+func Expand(pattern string, patterns *Patterns) (string, error) {
 	result := pattern
 	for i := 0; i < 1000; i++ { // After 1000 replacements, we assume this is an infinite loop and abort.
 		match := regexp.MustCompile(PATTERN_RE).FindStringSubmatch(result)
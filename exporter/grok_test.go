@@ -36,6 +36,9 @@ func TestGrok(t *testing.T) {
 	t.Run("verify capture group", func(t *testing.T) {
 		testVerifyCaptureGroup(t, patterns)
 	})
+	t.Run("verify metadata fields", func(t *testing.T) {
+		testVerifyMetadataFields(t, patterns)
+	})
 }
 
 func testCompileAllPatterns(t *testing.T, patterns *Patterns) {
@@ -87,6 +90,30 @@ func testVerifyCaptureGroup(t *testing.T, patterns *Patterns) {
 	regex.Free()
 }
 
+func testVerifyMetadataFields(t *testing.T, patterns *Patterns) {
+	regex, err := Compile("user %{USER:user}", patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := `
+            name: test
+            labels:
+              user: '{{.user}}'
+              host: '{{.syslog_hostname}}'`
+	expectWithMetadata(t, regex, config, nil, true)
+	expectWithMetadata(t, regex, config, []string{"syslog_hostname"}, false)
+	expectWithMetadata(t, regex, config, []string{"*"}, false) // any field, like the labels of a Loki stream
+	expectOK(t, regex, `
+            name: test
+            value: '{{.line_number}}'
+            labels:
+              file: '{{.filename}}'
+              path: '{{.filepath}}'
+              input: '{{.input}}'
+              received: '{{.receive_timestamp}}'`)
+	regex.Free()
+}
+
 func expectOK(t *testing.T, regex *oniguruma.Regex, config string) {
 	expect(t, regex, config, false)
 }
@@ -96,6 +123,10 @@ func expectError(t *testing.T, regex *oniguruma.Regex, config string) {
 }
 
 func expect(t *testing.T, regex *oniguruma.Regex, config string, isErrorExpected bool) {
+	expectWithMetadata(t, regex, config, nil, isErrorExpected)
+}
+
+func expectWithMetadata(t *testing.T, regex *oniguruma.Regex, config string, metadataFields []string, isErrorExpected bool) {
 	cfg := &configuration.MetricConfig{}
 	err := yaml.Unmarshal([]byte(config), cfg)
 	if err != nil {
@@ -105,7 +136,7 @@ func expect(t *testing.T, regex *oniguruma.Regex, config string, isErrorExpected
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = VerifyFieldNames(cfg, regex, nil)
+	err = VerifyFieldNames(cfg, NewGrokMatcher(regex), nil, metadataFields)
 	if isErrorExpected && err == nil {
 		t.Fatal("Expected error, but got no error.")
 	}
@@ -0,0 +1,139 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"github.com/fstab/grok_exporter/config/v2"
+	"github.com/fstab/grok_exporter/oniguruma"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/fstab/grok_exporter/tailer/jsonpath"
+)
+
+// jsonMatcher matches lines containing a JSON object. Lines that are not valid JSON don't match.
+// The template fields are the configured JSON paths and, if there is a grok pattern, the grok fields
+// of the pattern applied to the grok_field. Grok fields take precedence over JSON fields with the same name.
+type jsonMatcher struct {
+	conditions []jsonCondition
+	fields     map[string]jsonpath.Path
+	grokField  jsonpath.Path
+	regex      *oniguruma.Regex // nil if there is no grok pattern
+}
+
+type jsonCondition struct {
+	fieldCondition
+	path jsonpath.Path
+}
+
+type jsonFields struct {
+	doc        interface{}
+	fields     map[string]jsonpath.Path
+	grokFields Fields // nil if there is no grok pattern
+}
+
+func newJsonMatcher(cfg *v2.JsonMatchConfig, regex *oniguruma.Regex) (*jsonMatcher, error) {
+	// The paths and regular expressions were validated when the config was loaded.
+	result := &jsonMatcher{
+		fields: make(map[string]jsonpath.Path, len(cfg.Fields)),
+		regex:  regex,
+	}
+	var err error
+	for _, c := range cfg.Conditions {
+		condition := jsonCondition{}
+		if condition.fieldCondition, err = newFieldCondition(c); err != nil {
+			return nil, err
+		}
+		if condition.path, err = jsonpath.Parse(c.Field); err != nil {
+			return nil, err
+		}
+		result.conditions = append(result.conditions, condition)
+	}
+	for name, path := range cfg.Fields {
+		if result.fields[name], err = jsonpath.Parse(path); err != nil {
+			return nil, err
+		}
+	}
+	if regex != nil {
+		if result.grokField, err = jsonpath.Parse(cfg.GrokField); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (m *jsonMatcher) Match(line *fswatcher.Line) (Fields, error) {
+	doc, err := jsonpath.Unmarshal([]byte(line.Line))
+	if err != nil {
+		return nil, nil
+	}
+	for _, condition := range m.conditions {
+		if !condition.isTrue(doc) {
+			return nil, nil
+		}
+	}
+	result := &jsonFields{doc: doc, fields: m.fields}
+	if m.regex != nil {
+		value, exists := m.grokField.FindFirst(doc)
+		s, isString := value.(string)
+		if !exists || !isString {
+			return nil, nil
+		}
+		if result.grokFields, err = grokMatch(m.regex, s); err != nil || result.grokFields == nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (c *jsonCondition) isTrue(doc interface{}) bool {
+	matches := c.path.Find(doc)
+	values := make([]string, 0, len(matches))
+	for _, match := range matches {
+		values = append(values, jsonpath.String(match.Value))
+	}
+	return c.fieldCondition.isTrue(values)
+}
+
+func (m *jsonMatcher) HasField(name string) bool {
+	if _, exists := m.fields[name]; exists {
+		return true
+	}
+	return m.regex != nil && m.regex.HasCaptureGroup(name)
+}
+
+func (m *jsonMatcher) Free() {
+	if m.regex != nil {
+		m.regex.Free()
+	}
+}
+
+func (f *jsonFields) Get(name string) (string, bool) {
+	if f.grokFields != nil {
+		if value, exists := f.grokFields.Get(name); exists {
+			return value, true
+		}
+	}
+	path, exists := f.fields[name]
+	if !exists {
+		return "", false
+	}
+	value, _ := path.FindFirst(f.doc)
+	return jsonpath.String(value), true
+}
+
+func (f *jsonFields) Free() {
+	if f.grokFields != nil {
+		f.grokFields.Free()
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	configuration "github.com/fstab/grok_exporter/config/v2"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_model/go"
+	"testing"
+)
+
+func TestJsonMatcher(t *testing.T) {
+	absent := false
+	cfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name:  "http_request_duration_seconds",
+		Value: "{{.duration}}",
+		Json: &configuration.JsonMatchConfig{
+			Conditions: []configuration.FieldConditionConfig{
+				{Field: ".level", Equals: "info"},
+				{Field: ".request.method", Matches: "^(GET|POST)$"},
+				{Field: ".error", Exists: &absent},
+			},
+			Fields: map[string]string{
+				"duration": ".duration",
+				"method":   ".request.method",
+				"status":   ".response.status",
+			},
+		},
+		Labels: map[string]string{
+			"method": "{{.method}}",
+			"status": "{{.status}}",
+		},
+	})
+	matcher, err := NewMatcher(cfg, loadPatternDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer matcher.Free()
+	if err = VerifyFieldNames(cfg, matcher, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	gauge := NewGaugeMetric(cfg, matcher, nil)
+	for _, line := range []string{
+		`{"level": "info", "request": {"method": "GET"}, "response": {"status": 200}, "duration": 0.25}`,
+		`{"level": "info", "request": {"method": "POST"}, "response": {"status": 500}, "duration": 1.5}`,
+		`{"level": "debug", "request": {"method": "GET"}, "response": {"status": 200}, "duration": 3}`, // wrong level
+		`{"level": "info", "request": {"method": "PUT"}, "response": {"status": 200}, "duration": 3}`,  // method doesn't match
+		`{"level": "info", "request": {"method": "GET"}, "error": "timeout", "duration": 3}`,           // error exists
+		`level=info method=GET status=200 duration=3`,                                                  // not JSON
+	} {
+		if _, err = gauge.ProcessMatch(&fswatcher.Line{Line: line}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := gauge.Collector().(*prometheus.GaugeVec)
+	for _, expected := range []struct {
+		method, status string
+		value          float64
+	}{{"GET", "200", 0.25}, {"POST", "500", 1.5}} {
+		m := io_prometheus_client.Metric{}
+		c.With(prometheus.Labels{"method": expected.method, "status": expected.status}).Write(&m)
+		if *m.Gauge.Value != expected.value {
+			t.Errorf("Expected %v for %v %v, but got %v", expected.value, expected.method, expected.status, *m.Gauge.Value)
+		}
+	}
+	m := io_prometheus_client.Metric{}
+	c.With(prometheus.Labels{"method": "PUT", "status": "200"}).Write(&m)
+	if *m.Gauge.Value != 0 {
+		t.Errorf("Expected the line with method PUT to be ignored")
+	}
+}
+
+func TestJsonMatcherWithGrok(t *testing.T) {
+	cfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name:  "exim_rejected_rcpt_total",
+		Match: "rejected RCPT <%{EMAILADDRESS}>: %{GREEDYDATA:message}",
+		Json: &configuration.JsonMatchConfig{
+			Fields:    map[string]string{"host": ".host"},
+			GrokField: ".msg",
+		},
+		Labels: map[string]string{
+			"message": "{{.message}}",
+			"host":    "{{.host}}",
+		},
+	})
+	matcher, err := NewMatcher(cfg, loadPatternDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer matcher.Free()
+	if !matcher.HasField("message") || !matcher.HasField("host") || matcher.HasField("msg") {
+		t.Fatalf("Expected the grok fields and the JSON fields to be available in templates")
+	}
+	counter := NewCounterMetric(cfg, matcher, nil)
+	for _, line := range []string{
+		`{"host": "mx1", "msg": "rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted"}`,
+		`{"host": "mx1", "msg": "accepted RCPT <alan.a168@msa.hinet.net>"}`, // grok pattern doesn't match
+		`{"host": "mx1", "msg": 42}`, // grok_field is not a string
+		`{"host": "mx1"}`,            // grok_field is missing
+	} {
+		if _, err = counter.ProcessMatch(&fswatcher.Line{Line: line}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := io_prometheus_client.Metric{}
+	counter.Collector().(*prometheus.CounterVec).With(prometheus.Labels{"message": "relay not permitted", "host": "mx1"}).Write(&m)
+	if *m.Counter.Value != 1 {
+		t.Errorf("Expected 1 match, but got %v", *m.Counter.Value)
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"errors"
+	"github.com/fstab/grok_exporter/config/v2"
+	"github.com/fstab/grok_exporter/oniguruma"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"strconv"
+	"strings"
+)
+
+// logfmtMatcher matches lines with key/value pairs like 'level=info msg="hello world" duration=12ms'.
+// Lines without any key=value pair or with an invalid quoted value don't match.
+// All keys can be used in templates. Characters that are not allowed in template field names are replaced
+// with '_', so the key 'request-id' is '{{.request_id}}'. Grok fields take precedence over keys with the same name.
+type logfmtMatcher struct {
+	conditions []logfmtCondition
+	grokField  string
+	regex      *oniguruma.Regex // nil if there is no grok pattern
+}
+
+type logfmtCondition struct {
+	fieldCondition
+	key string
+}
+
+type logfmtFields struct {
+	values     map[string]string // template field name -> value
+	grokFields Fields            // nil if there is no grok pattern
+}
+
+func newLogfmtMatcher(cfg *v2.LogfmtMatchConfig, regex *oniguruma.Regex) (*logfmtMatcher, error) {
+	result := &logfmtMatcher{
+		grokField: cfg.GrokField,
+		regex:     regex,
+	}
+	for _, c := range cfg.Conditions {
+		condition, err := newFieldCondition(c)
+		if err != nil {
+			return nil, err
+		}
+		result.conditions = append(result.conditions, logfmtCondition{fieldCondition: condition, key: c.Field})
+	}
+	return result, nil
+}
+
+func (m *logfmtMatcher) Match(line *fswatcher.Line) (Fields, error) {
+	pairs, err := parseLogfmt(line.Line)
+	if err != nil {
+		return nil, nil
+	}
+	for _, condition := range m.conditions {
+		var values []string
+		for _, p := range pairs {
+			if p.key == condition.key {
+				values = append(values, p.value)
+			}
+		}
+		if !condition.isTrue(values) {
+			return nil, nil
+		}
+	}
+	result := &logfmtFields{values: make(map[string]string, len(pairs))}
+	for _, p := range pairs {
+		result.values[templateFieldName(p.key)] = p.value
+	}
+	if m.regex != nil {
+		value, exists := "", false
+		for _, p := range pairs {
+			if p.key == m.grokField {
+				value, exists = p.value, true
+			}
+		}
+		if !exists {
+			return nil, nil
+		}
+		if result.grokFields, err = grokMatch(m.regex, value); err != nil || result.grokFields == nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Any key may be present in a line, so all fields are accepted. Missing keys are empty strings.
+func (m *logfmtMatcher) HasField(name string) bool {
+	return true
+}
+
+func (m *logfmtMatcher) Free() {
+	if m.regex != nil {
+		m.regex.Free()
+	}
+}
+
+func (f *logfmtFields) Get(name string) (string, bool) {
+	if f.grokFields != nil {
+		if value, exists := f.grokFields.Get(name); exists {
+			return value, true
+		}
+	}
+	return f.values[name], true
+}
+
+func (f *logfmtFields) Free() {
+	if f.grokFields != nil {
+		f.grokFields.Free()
+	}
+}
+
+type logfmtPair struct {
+	key   string
+	value string
+}
+
+// parseLogfmt splits a line into key/value pairs. Values may be quoted with Go escape sequences,
+// like msg="say \"hello\"". A key without '=' has an empty value. If a key occurs more than once,
+// all pairs are returned, the last one is used in templates. Lines without any key=value pair are an error,
+// because they are most likely plain text.
+func parseLogfmt(line string) ([]logfmtPair, error) {
+	var (
+		result   []logfmtPair
+		hasValue bool
+		rest     = line
+	)
+	for {
+		rest = strings.TrimLeft(rest, " \t")
+		if len(rest) == 0 {
+			if !hasValue {
+				return nil, errors.New("no key=value pair")
+			}
+			return result, nil
+		}
+		end := strings.IndexAny(rest, "= \t")
+		if end < 0 {
+			end = len(rest)
+		}
+		if end == 0 {
+			return nil, errors.New("missing key before '='")
+		}
+		pair := logfmtPair{key: rest[:end]}
+		rest = rest[end:]
+		if strings.HasPrefix(rest, "=") {
+			hasValue = true
+			rest = rest[1:]
+			if strings.HasPrefix(rest, `"`) {
+				end = quotedValueEnd(rest)
+				if end < 0 {
+					return nil, errors.New("unterminated quoted value")
+				}
+				value, err := strconv.Unquote(rest[:end])
+				if err != nil {
+					return nil, err
+				}
+				pair.value = value
+			} else {
+				end = strings.IndexAny(rest, " \t")
+				if end < 0 {
+					end = len(rest)
+				}
+				pair.value = rest[:end]
+			}
+			rest = rest[end:]
+		}
+		result = append(result, pair)
+	}
+}
+
+// quotedValueEnd returns the position after the closing quote, or -1 if there is none.
+func quotedValueEnd(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return -1
+}
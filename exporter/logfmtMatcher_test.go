@@ -0,0 +1,129 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	configuration "github.com/fstab/grok_exporter/config/v2"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_model/go"
+	"reflect"
+	"testing"
+)
+
+func TestParseLogfmt(t *testing.T) {
+	for _, test := range []struct {
+		line     string
+		expected []logfmtPair
+	}{
+		{`level=info method=GET status=200 duration=12ms`, []logfmtPair{{"level", "info"}, {"method", "GET"}, {"status", "200"}, {"duration", "12ms"}}},
+		{`  msg="hello \"world\"" path=/a?b=c	empty= flag`, []logfmtPair{{"msg", `hello "world"`}, {"path", "/a?b=c"}, {"empty", ""}, {"flag", ""}}},
+		{`at=info code=H12 desc="Request timeout" at=error`, []logfmtPair{{"at", "info"}, {"code", "H12"}, {"desc", "Request timeout"}, {"at", "error"}}},
+	} {
+		pairs, err := parseLogfmt(test.line)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", test.line, err)
+		}
+		if !reflect.DeepEqual(pairs, test.expected) {
+			t.Fatalf("%v: expected %v, but got %v", test.line, test.expected, pairs)
+		}
+	}
+	for _, line := range []string{``, `plain text`, `msg="unterminated`, `=value`, `msg="invalid \q escape"`} {
+		if _, err := parseLogfmt(line); err == nil {
+			t.Fatalf("%q: expected error", line)
+		}
+	}
+}
+
+func TestLogfmtMatcher(t *testing.T) {
+	cfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name: "http_requests_total",
+		Logfmt: &configuration.LogfmtMatchConfig{
+			Conditions: []configuration.FieldConditionConfig{
+				{Field: "level", Equals: "info"},
+				{Field: "status", Matches: "^[45]"},
+			},
+		},
+		Labels: map[string]string{
+			"method":     "{{.method}}",
+			"status":     "{{.status}}",
+			"request_id": "{{.request_id}}",
+		},
+	})
+	matcher, err := NewMatcher(cfg, loadPatternDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer matcher.Free()
+	if err = VerifyFieldNames(cfg, matcher, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	counter := NewCounterMetric(cfg, matcher, nil)
+	for _, line := range []string{
+		`level=info method=GET status=404 request-id=abc`,
+		`status=500 method="POST" level=info`, // keys in a different order
+		`level=info method=GET status=200`,    // status doesn't match
+		`level=debug method=GET status=404`,   // wrong level
+		`GET /missing 404`,                    // not logfmt
+	} {
+		if _, err = counter.ProcessMatch(&fswatcher.Line{Line: line}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := counter.Collector().(*prometheus.CounterVec)
+	for _, labels := range []prometheus.Labels{
+		{"method": "GET", "status": "404", "request_id": "abc"},
+		{"method": "POST", "status": "500", "request_id": ""},
+	} {
+		m := io_prometheus_client.Metric{}
+		c.With(labels).Write(&m)
+		if *m.Counter.Value != 1 {
+			t.Errorf("Expected 1 match for %v, but got %v", labels, *m.Counter.Value)
+		}
+	}
+}
+
+func TestLogfmtMatcherWithGrok(t *testing.T) {
+	cfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name:   "request_duration_milliseconds",
+		Match:  "%{NUMBER:ms}ms",
+		Logfmt: &configuration.LogfmtMatchConfig{GrokField: "duration"},
+		Value:  "{{.ms}}",
+		Labels: map[string]string{"method": "{{.method}}"},
+	})
+	matcher, err := NewMatcher(cfg, loadPatternDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer matcher.Free()
+	gauge := NewGaugeMetric(cfg, matcher, nil)
+	for _, line := range []string{
+		`method=GET duration=12ms`,
+		`method=POST duration=1.5s`, // grok pattern doesn't match
+		`method=PUT`,                // grok_field is missing
+	} {
+		if _, err = gauge.ProcessMatch(&fswatcher.Line{Line: line}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := gauge.Collector().(*prometheus.GaugeVec)
+	for method, expected := range map[string]float64{"GET": 12, "POST": 0, "PUT": 0} {
+		m := io_prometheus_client.Metric{}
+		c.With(prometheus.Labels{"method": method}).Write(&m)
+		if *m.Gauge.Value != expected {
+			t.Errorf("Expected %v for %v, but got %v", expected, method, *m.Gauge.Value)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"github.com/fstab/grok_exporter/config/v2"
+	"github.com/fstab/grok_exporter/oniguruma"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"regexp"
+)
+
+// Matcher decides if a metric processes a line, and provides the fields that can be used in the metric's templates.
+type Matcher interface {
+	// Match returns nil if the line does not match. The result must be freed.
+	Match(line *fswatcher.Line) (Fields, error)
+	// HasField is true if the matcher provides the field. It is used to verify the templates when the config is loaded.
+	HasField(name string) bool
+	Free()
+}
+
+// Fields are the values extracted from a matching line, like grok fields.
+type Fields interface {
+	// Get returns false if the matcher does not provide the field.
+	Get(name string) (string, bool)
+	Free()
+}
+
+// NewMatcher creates the matcher for the metric's 'match', 'json', 'logfmt', and 'delimited' configuration.
+func NewMatcher(m *v2.MetricConfig, patterns *Patterns) (Matcher, error) {
+	var regex *oniguruma.Regex
+	if len(m.Match) > 0 {
+		var err error
+		regex, err = Compile(m.Match, patterns)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var (
+		matcher Matcher
+		err     error
+	)
+	switch {
+	case m.Json != nil:
+		matcher, err = newJsonMatcher(m.Json, regex)
+	case m.Logfmt != nil:
+		matcher, err = newLogfmtMatcher(m.Logfmt, regex)
+	case m.Delimited != nil:
+		matcher, err = newDelimitedMatcher(m.Delimited, regex)
+	default:
+		return NewGrokMatcher(regex), nil
+	}
+	if err != nil {
+		if regex != nil {
+			regex.Free()
+		}
+		return nil, err
+	}
+	return matcher, nil
+}
+
+// NewGrokMatcher applies a grok pattern to the line. It returns nil if regex is nil.
+func NewGrokMatcher(regex *oniguruma.Regex) Matcher {
+	if regex == nil {
+		return nil
+	}
+	return &grokMatcher{regex: regex}
+}
+
+type grokMatcher struct {
+	regex *oniguruma.Regex
+}
+
+type grokFields struct {
+	searchResult *oniguruma.SearchResult
+}
+
+func (m *grokMatcher) Match(line *fswatcher.Line) (Fields, error) {
+	return grokMatch(m.regex, line.Line)
+}
+
+func grokMatch(regex *oniguruma.Regex, s string) (Fields, error) {
+	searchResult, err := regex.Search(s)
+	if err != nil {
+		return nil, err
+	}
+	if !searchResult.IsMatch() {
+		searchResult.Free()
+		return nil, nil
+	}
+	return &grokFields{searchResult: searchResult}, nil
+}
+
+func (m *grokMatcher) HasField(name string) bool {
+	return m.regex.HasCaptureGroup(name)
+}
+
+func (m *grokMatcher) Free() {
+	m.regex.Free()
+}
+
+func (f *grokFields) Get(name string) (string, bool) {
+	value, err := f.searchResult.GetCaptureGroupByName(name)
+	return value, err == nil
+}
+
+func (f *grokFields) Free() {
+	f.searchResult.Free()
+}
+
+// fieldCondition is a condition of the 'json', 'logfmt', or 'delimited' matcher.
+type fieldCondition struct {
+	equals  string
+	matches *regexp.Regexp // nil if there is no regular expression
+	absent  bool
+}
+
+func newFieldCondition(cfg v2.FieldConditionConfig) (fieldCondition, error) {
+	var err error
+	result := fieldCondition{equals: cfg.Equals, absent: cfg.Exists != nil && !*cfg.Exists}
+	if cfg.Matches != "" {
+		result.matches, err = regexp.Compile(cfg.Matches)
+	}
+	return result, err
+}
+
+// isTrue is called with the values of the field, which is empty if the field does not exist.
+// The condition is true if any of the values satisfies the condition.
+func (c *fieldCondition) isTrue(values []string) bool {
+	if c.absent {
+		return len(values) == 0
+	}
+	for _, value := range values {
+		if (c.equals == "" || value == c.equals) && (c.matches == nil || c.matches.MatchString(value)) {
+			return true
+		}
+	}
+	return false
+}
+
+// templateFieldName replaces characters that are not allowed in template field names with '_'.
+func templateFieldName(key string) string {
+	result := []byte(key)
+	for i, c := range result {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' && i > 0) {
+			result[i] = '_'
+		}
+	}
+	return string(result)
+}
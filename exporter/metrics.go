@@ -17,9 +17,10 @@ package exporter
 import (
 	"fmt"
 	configuration "github.com/fstab/grok_exporter/config/v2"
-	"github.com/fstab/grok_exporter/oniguruma"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
 	"github.com/fstab/grok_exporter/template"
 	"github.com/prometheus/client_golang/prometheus"
+	"math"
 	"strconv"
 	"time"
 )
@@ -27,26 +28,39 @@ import (
 type Match struct {
 	Labels map[string]string
 	Value  float64
+	// OutOfRangeTimestamp is TimestampOutOfOrder or TimestampInFuture if the 'timestamp_policy' was applied, empty otherwise.
+	OutOfRangeTimestamp string
 }
 
 type Metric interface {
 	Name() string
 	Collector() prometheus.Collector
+	// Returns true if the metric processes lines from the input with the given name.
+	ProcessesInput(inputName string) bool
 
 	// Returns the match if the line matched, and nil if the line didn't match.
-	ProcessMatch(line string) (*Match, error)
+	ProcessMatch(line *fswatcher.Line) (*Match, error)
 	// Returns the match if the delete pattern matched, nil otherwise.
-	ProcessDeleteMatch(line string) (*Match, error)
+	ProcessDeleteMatch(line *fswatcher.Line) (*Match, error)
 	// Remove old metrics
 	ProcessRetention() error
+	// Returns the time from the 'timestamp' template without updating the metric,
+	// false if the metric has no timestamp or the line didn't match.
+	EventTime(line *fswatcher.Line) (time.Time, bool, error)
+	// Frees the regular expressions. The metric must not be used afterwards.
+	Free()
 }
 
 // Common values for incMetric and observeMetric
 type metric struct {
-	name        string
-	regex       *oniguruma.Regex
-	deleteRegex *oniguruma.Regex
-	retention   time.Duration
+	name              string
+	matcher           Matcher
+	deleteMatcher     Matcher // nil if there is no delete_match
+	retention         time.Duration
+	inputs            []string // empty means all inputs
+	collector         prometheus.Collector
+	timestampTemplate template.Template   // nil if there is no timestamp
+	timestamps        *timestampCollector // nil if there is no timestamp
 }
 
 type observeMetric struct {
@@ -116,124 +130,137 @@ func (m *metric) Name() string {
 	return m.name
 }
 
-func (m *counterMetric) Collector() prometheus.Collector {
-	return m.counter
+func (m *metric) ProcessesInput(inputName string) bool {
+	return len(m.inputs) == 0 || containsString(m.inputs, inputName)
 }
 
-func (m *counterVecMetric) Collector() prometheus.Collector {
-	return m.counterVec
+func (m *metric) Collector() prometheus.Collector {
+	return m.collector
 }
 
-func (m *gaugeMetric) Collector() prometheus.Collector {
-	return m.gauge
-}
-
-func (m *gaugeVecMetric) Collector() prometheus.Collector {
-	return m.gaugeVec
-}
-
-func (m *histogramMetric) Collector() prometheus.Collector {
-	return m.histogram
-}
-
-func (m *histogramVecMetric) Collector() prometheus.Collector {
-	return m.histogramVec
-}
-
-func (m *summaryMetric) Collector() prometheus.Collector {
-	return m.summary
-}
-
-func (m *summaryVecMetric) Collector() prometheus.Collector {
-	return m.summaryVec
+func (m *metric) Free() {
+	m.matcher.Free()
+	if m.deleteMatcher != nil {
+		m.deleteMatcher.Free()
+	}
 }
 
-func (m *metric) processMatch(line string, cb func()) (*Match, error) {
-	searchResult, err := m.regex.Search(line)
+func (m *metric) processMatch(line *fswatcher.Line, cb func()) (*Match, error) {
+	fields, err := m.matcher.Match(line)
 	if err != nil {
 		return nil, fmt.Errorf("error processing metric %v: %v", m.Name(), err.Error())
 	}
-	defer searchResult.Free()
-	if searchResult.IsMatch() {
-		cb()
-		return &Match{
+	if fields != nil {
+		defer fields.Free()
+		return m.update(fields, line, &Match{
 			Value: 1.0,
-		}, nil
+		}, cb)
 	} else {
 		return nil, nil
 	}
 }
 
-func (m *observeMetric) processMatch(line string, cb func(value float64)) (*Match, error) {
-	searchResult, err := m.regex.Search(line)
+func (m *observeMetric) processMatch(line *fswatcher.Line, cb func(value float64)) (*Match, error) {
+	fields, err := m.matcher.Match(line)
 	if err != nil {
 		return nil, fmt.Errorf("error processing metric %v: %v", m.Name(), err.Error())
 	}
-	defer searchResult.Free()
-	if searchResult.IsMatch() {
-		floatVal, err := floatValue(m.Name(), searchResult, m.valueTemplate)
+	if fields != nil {
+		defer fields.Free()
+		floatVal, err := floatValue(m.Name(), fields, m.valueTemplate, line)
 		if err != nil {
 			return nil, err
 		}
-		cb(floatVal)
-		return &Match{
+		return m.update(fields, line, &Match{
 			Value: floatVal,
-		}, nil
+		}, func() {
+			cb(floatVal)
+		})
 	} else {
 		return nil, nil
 	}
 }
 
-func (m *metricWithLabels) processMatch(line string, cb func(labels map[string]string)) (*Match, error) {
-	searchResult, err := m.regex.Search(line)
+func (m *metricWithLabels) processMatch(line *fswatcher.Line, cb func(labels map[string]string)) (*Match, error) {
+	fields, err := m.matcher.Match(line)
 	if err != nil {
 		return nil, fmt.Errorf("error while processing metric %v: %v", m.Name(), err.Error())
 	}
-	defer searchResult.Free()
-	if searchResult.IsMatch() {
-		labels, err := labelValues(m.Name(), searchResult, m.labelTemplates)
+	if fields != nil {
+		defer fields.Free()
+		labels, err := labelValues(m.Name(), fields, m.labelTemplates, line)
 		if err != nil {
 			return nil, err
 		}
-		m.labelValueTracker.Observe(labels)
-		cb(labels)
-		return &Match{
+		return m.update(fields, line, &Match{
 			Value:  1.0,
 			Labels: labels,
-		}, nil
+		}, func() {
+			m.labelValueTracker.Observe(labels)
+			cb(labels)
+		})
 	} else {
 		return nil, nil
 	}
 }
 
-func (m *observeMetricWithLabels) processMatch(line string, cb func(value float64, labels map[string]string)) (*Match, error) {
-	searchResult, err := m.regex.Search(line)
+func (m *observeMetricWithLabels) processMatch(line *fswatcher.Line, cb func(value float64, labels map[string]string)) (*Match, error) {
+	fields, err := m.matcher.Match(line)
 	if err != nil {
 		return nil, fmt.Errorf("error processing metric %v: %v", m.Name(), err.Error())
 	}
-	defer searchResult.Free()
-	if searchResult.IsMatch() {
-		floatVal, err := floatValue(m.Name(), searchResult, m.valueTemplate)
+	if fields != nil {
+		defer fields.Free()
+		floatVal, err := floatValue(m.Name(), fields, m.valueTemplate, line)
 		if err != nil {
 			return nil, err
 		}
-		labels, err := labelValues(m.Name(), searchResult, m.labelTemplates)
+		labels, err := labelValues(m.Name(), fields, m.labelTemplates, line)
 		if err != nil {
 			return nil, err
 		}
-		m.labelValueTracker.Observe(labels)
-		cb(floatVal, labels)
-		return &Match{
+		return m.update(fields, line, &Match{
 			Value:  floatVal,
 			Labels: labels,
-		}, nil
+		}, func() {
+			m.labelValueTracker.Observe(labels)
+			cb(floatVal, labels)
+		})
 	} else {
 		return nil, nil
 	}
 }
 
-func (m *metric) ProcessDeleteMatch(line string) (*Match, error) {
-	if m.deleteRegex == nil {
+// update calls apply to update the metric. If the metric has a timestamp, the event time is evaluated
+// and the 'timestamp_policy' decides if the event is applied.
+func (m *metric) update(fields Fields, line *fswatcher.Line, match *Match, apply func()) (*Match, error) {
+	if m.timestamps == nil {
+		apply()
+		return match, nil
+	}
+	eventTime, err := eventTime(m.Name(), fields, m.timestampTemplate, line)
+	if err != nil {
+		return nil, err
+	}
+	match.OutOfRangeTimestamp = m.timestamps.update(match.Labels, eventTime, apply)
+	return match, nil
+}
+
+func (m *metric) EventTime(line *fswatcher.Line) (time.Time, bool, error) {
+	if m.timestampTemplate == nil {
+		return time.Time{}, false, nil
+	}
+	fields, err := m.matcher.Match(line)
+	if err != nil || fields == nil {
+		return time.Time{}, false, err
+	}
+	defer fields.Free()
+	result, err := eventTime(m.Name(), fields, m.timestampTemplate, line)
+	return result, err == nil, err
+}
+
+func (m *metric) ProcessDeleteMatch(line *fswatcher.Line) (*Match, error) {
+	if m.deleteMatcher == nil {
 		return nil, nil
 	}
 	return nil, fmt.Errorf("error processing metric %v: delete_match is currently only supported for metrics with labels.", m.Name())
@@ -246,17 +273,17 @@ func (m *metric) ProcessRetention() error {
 	return fmt.Errorf("error processing metric %v: retention is currently only supported for metrics with labels.", m.Name())
 }
 
-func (m *metricWithLabels) processDeleteMatch(line string, vec deleterMetric) (*Match, error) {
-	if m.deleteRegex == nil {
+func (m *metricWithLabels) processDeleteMatch(line *fswatcher.Line, vec deleterMetric) (*Match, error) {
+	if m.deleteMatcher == nil {
 		return nil, nil
 	}
-	searchResult, err := m.deleteRegex.Search(line)
+	fields, err := m.deleteMatcher.Match(line)
 	if err != nil {
 		return nil, fmt.Errorf("error processing metric %v: %v", m.name, err.Error())
 	}
-	defer searchResult.Free()
-	if searchResult.IsMatch() {
-		deleteLabels, err := labelValues(m.Name(), searchResult, m.deleteLabelTemplates)
+	if fields != nil {
+		defer fields.Free()
+		deleteLabels, err := labelValues(m.Name(), fields, m.deleteLabelTemplates, line)
 		if err != nil {
 			return nil, err
 		}
@@ -265,7 +292,7 @@ func (m *metricWithLabels) processDeleteMatch(line string, vec deleterMetric) (*
 			return nil, err
 		}
 		for _, matchingLabel := range matchingLabels {
-			vec.Delete(matchingLabel)
+			m.delete(vec, matchingLabel)
 		}
 		return &Match{
 			Labels: deleteLabels,
@@ -278,25 +305,32 @@ func (m *metricWithLabels) processDeleteMatch(line string, vec deleterMetric) (*
 func (m *metricWithLabels) processRetention(vec deleterMetric) error {
 	if m.retention != 0 {
 		for _, label := range m.labelValueTracker.DeleteByRetention(m.retention) {
-			vec.Delete(label)
+			m.delete(vec, label)
 		}
 	}
 	return nil
 }
 
-func (m *counterMetric) ProcessMatch(line string) (*Match, error) {
+func (m *metricWithLabels) delete(vec deleterMetric, labels map[string]string) {
+	vec.Delete(labels)
+	if m.timestamps != nil {
+		m.timestamps.delete(labels)
+	}
+}
+
+func (m *counterMetric) ProcessMatch(line *fswatcher.Line) (*Match, error) {
 	return m.processMatch(line, func() {
 		m.counter.Inc()
 	})
 }
 
-func (m *counterVecMetric) ProcessMatch(line string) (*Match, error) {
+func (m *counterVecMetric) ProcessMatch(line *fswatcher.Line) (*Match, error) {
 	return m.processMatch(line, func(labels map[string]string) {
 		m.counterVec.With(labels).Inc()
 	})
 }
 
-func (m *counterVecMetric) ProcessDeleteMatch(line string) (*Match, error) {
+func (m *counterVecMetric) ProcessDeleteMatch(line *fswatcher.Line) (*Match, error) {
 	return m.processDeleteMatch(line, m.counterVec)
 }
 
@@ -304,7 +338,7 @@ func (m *counterVecMetric) ProcessRetention() error {
 	return m.processRetention(m.counterVec)
 }
 
-func (m *gaugeMetric) ProcessMatch(line string) (*Match, error) {
+func (m *gaugeMetric) ProcessMatch(line *fswatcher.Line) (*Match, error) {
 	return m.processMatch(line, func(value float64) {
 		if m.cumulative {
 			m.gauge.Add(value)
@@ -314,7 +348,7 @@ func (m *gaugeMetric) ProcessMatch(line string) (*Match, error) {
 	})
 }
 
-func (m *gaugeVecMetric) ProcessMatch(line string) (*Match, error) {
+func (m *gaugeVecMetric) ProcessMatch(line *fswatcher.Line) (*Match, error) {
 	return m.processMatch(line, func(value float64, labels map[string]string) {
 		if m.cumulative {
 			m.gaugeVec.With(labels).Add(value)
@@ -324,7 +358,7 @@ func (m *gaugeVecMetric) ProcessMatch(line string) (*Match, error) {
 	})
 }
 
-func (m *gaugeVecMetric) ProcessDeleteMatch(line string) (*Match, error) {
+func (m *gaugeVecMetric) ProcessDeleteMatch(line *fswatcher.Line) (*Match, error) {
 	return m.processDeleteMatch(line, m.gaugeVec)
 }
 
@@ -332,19 +366,19 @@ func (m *gaugeVecMetric) ProcessRetention() error {
 	return m.processRetention(m.gaugeVec)
 }
 
-func (m *histogramMetric) ProcessMatch(line string) (*Match, error) {
+func (m *histogramMetric) ProcessMatch(line *fswatcher.Line) (*Match, error) {
 	return m.processMatch(line, func(value float64) {
 		m.histogram.Observe(value)
 	})
 }
 
-func (m *histogramVecMetric) ProcessMatch(line string) (*Match, error) {
+func (m *histogramVecMetric) ProcessMatch(line *fswatcher.Line) (*Match, error) {
 	return m.processMatch(line, func(value float64, labels map[string]string) {
 		m.histogramVec.With(labels).Observe(value)
 	})
 }
 
-func (m *histogramVecMetric) ProcessDeleteMatch(line string) (*Match, error) {
+func (m *histogramVecMetric) ProcessDeleteMatch(line *fswatcher.Line) (*Match, error) {
 	return m.processDeleteMatch(line, m.histogramVec)
 }
 
@@ -352,19 +386,19 @@ func (m *histogramVecMetric) ProcessRetention() error {
 	return m.processRetention(m.histogramVec)
 }
 
-func (m *summaryMetric) ProcessMatch(line string) (*Match, error) {
+func (m *summaryMetric) ProcessMatch(line *fswatcher.Line) (*Match, error) {
 	return m.processMatch(line, func(value float64) {
 		m.summary.Observe(value)
 	})
 }
 
-func (m *summaryVecMetric) ProcessMatch(line string) (*Match, error) {
+func (m *summaryVecMetric) ProcessMatch(line *fswatcher.Line) (*Match, error) {
 	return m.processMatch(line, func(value float64, labels map[string]string) {
 		m.summaryVec.With(labels).Observe(value)
 	})
 }
 
-func (m *summaryVecMetric) ProcessDeleteMatch(line string) (*Match, error) {
+func (m *summaryVecMetric) ProcessDeleteMatch(line *fswatcher.Line) (*Match, error) {
 	return m.processDeleteMatch(line, m.summaryVec)
 }
 
@@ -372,77 +406,90 @@ func (m *summaryVecMetric) ProcessRetention() error {
 	return m.processRetention(m.summaryVec)
 }
 
-func newMetric(cfg *configuration.MetricConfig, regex, deleteRegex *oniguruma.Regex) metric {
-	return metric{
-		name:        cfg.Name,
-		regex:       regex,
-		deleteRegex: deleteRegex,
-		retention:   cfg.Retention,
+// The collector is wrapped in a timestampCollector if the metric has a timestamp.
+func newMetric(cfg *configuration.MetricConfig, matcher, deleteMatcher Matcher, collector prometheus.Collector) metric {
+	result := metric{
+		name:          cfg.Name,
+		matcher:       matcher,
+		deleteMatcher: deleteMatcher,
+		retention:     cfg.Retention,
+		inputs:        cfg.Inputs,
+		collector:     collector,
+	}
+	if cfg.TimestampTemplate != nil {
+		result.timestampTemplate = cfg.TimestampTemplate
+		result.timestamps = newTimestampCollector(cfg, collector)
+		result.collector = result.timestamps
 	}
+	return result
 }
 
-func newMetricWithLabels(cfg *configuration.MetricConfig, regex, deleteRegex *oniguruma.Regex) metricWithLabels {
+func newMetricWithLabels(cfg *configuration.MetricConfig, matcher, deleteMatcher Matcher, collector prometheus.Collector) metricWithLabels {
 	return metricWithLabels{
-		metric:               newMetric(cfg, regex, deleteRegex),
+		metric:               newMetric(cfg, matcher, deleteMatcher, collector),
 		labelTemplates:       cfg.LabelTemplates,
 		deleteLabelTemplates: cfg.DeleteLabelTemplates,
 		labelValueTracker:    NewLabelValueTracker(prometheusLabels(cfg.LabelTemplates)),
 	}
 }
 
-func newObserveMetric(cfg *configuration.MetricConfig, regex, deleteRegex *oniguruma.Regex) observeMetric {
+func newObserveMetric(cfg *configuration.MetricConfig, matcher, deleteMatcher Matcher, collector prometheus.Collector) observeMetric {
 	return observeMetric{
-		metric:        newMetric(cfg, regex, deleteRegex),
+		metric:        newMetric(cfg, matcher, deleteMatcher, collector),
 		valueTemplate: cfg.ValueTemplate,
 	}
 }
 
-func newObserveMetricWithLabels(cfg *configuration.MetricConfig, regex, deleteRegex *oniguruma.Regex) observeMetricWithLabels {
+func newObserveMetricWithLabels(cfg *configuration.MetricConfig, matcher, deleteMatcher Matcher, collector prometheus.Collector) observeMetricWithLabels {
 	return observeMetricWithLabels{
-		metricWithLabels: newMetricWithLabels(cfg, regex, deleteRegex),
+		metricWithLabels: newMetricWithLabels(cfg, matcher, deleteMatcher, collector),
 		valueTemplate:    cfg.ValueTemplate,
 	}
 }
 
-func NewCounterMetric(cfg *configuration.MetricConfig, regex *oniguruma.Regex, deleteRegex *oniguruma.Regex) Metric {
+func NewCounterMetric(cfg *configuration.MetricConfig, matcher, deleteMatcher Matcher) Metric {
 	counterOpts := prometheus.CounterOpts{
 		Name: cfg.Name,
 		Help: cfg.Help,
 	}
 	if len(cfg.Labels) == 0 {
+		counter := prometheus.NewCounter(counterOpts)
 		return &counterMetric{
-			metric:  newMetric(cfg, regex, deleteRegex),
-			counter: prometheus.NewCounter(counterOpts),
+			metric:  newMetric(cfg, matcher, deleteMatcher, counter),
+			counter: counter,
 		}
 	} else {
+		counterVec := prometheus.NewCounterVec(counterOpts, prometheusLabels(cfg.LabelTemplates))
 		return &counterVecMetric{
-			metricWithLabels: newMetricWithLabels(cfg, regex, deleteRegex),
-			counterVec:       prometheus.NewCounterVec(counterOpts, prometheusLabels(cfg.LabelTemplates)),
+			metricWithLabels: newMetricWithLabels(cfg, matcher, deleteMatcher, counterVec),
+			counterVec:       counterVec,
 		}
 	}
 }
 
-func NewGaugeMetric(cfg *configuration.MetricConfig, regex *oniguruma.Regex, deleteRegex *oniguruma.Regex) Metric {
+func NewGaugeMetric(cfg *configuration.MetricConfig, matcher, deleteMatcher Matcher) Metric {
 	gaugeOpts := prometheus.GaugeOpts{
 		Name: cfg.Name,
 		Help: cfg.Help,
 	}
 	if len(cfg.Labels) == 0 {
+		gauge := prometheus.NewGauge(gaugeOpts)
 		return &gaugeMetric{
-			observeMetric: newObserveMetric(cfg, regex, deleteRegex),
+			observeMetric: newObserveMetric(cfg, matcher, deleteMatcher, gauge),
 			cumulative:    cfg.Cumulative,
-			gauge:         prometheus.NewGauge(gaugeOpts),
+			gauge:         gauge,
 		}
 	} else {
+		gaugeVec := prometheus.NewGaugeVec(gaugeOpts, prometheusLabels(cfg.LabelTemplates))
 		return &gaugeVecMetric{
-			observeMetricWithLabels: newObserveMetricWithLabels(cfg, regex, deleteRegex),
+			observeMetricWithLabels: newObserveMetricWithLabels(cfg, matcher, deleteMatcher, gaugeVec),
 			cumulative:              cfg.Cumulative,
-			gaugeVec:                prometheus.NewGaugeVec(gaugeOpts, prometheusLabels(cfg.LabelTemplates)),
+			gaugeVec:                gaugeVec,
 		}
 	}
 }
 
-func NewHistogramMetric(cfg *configuration.MetricConfig, regex *oniguruma.Regex, deleteRegex *oniguruma.Regex) Metric {
+func NewHistogramMetric(cfg *configuration.MetricConfig, matcher, deleteMatcher Matcher) Metric {
 	histogramOpts := prometheus.HistogramOpts{
 		Name: cfg.Name,
 		Help: cfg.Help,
@@ -451,19 +498,21 @@ func NewHistogramMetric(cfg *configuration.MetricConfig, regex *oniguruma.Regex,
 		histogramOpts.Buckets = cfg.Buckets
 	}
 	if len(cfg.Labels) == 0 {
+		histogram := prometheus.NewHistogram(histogramOpts)
 		return &histogramMetric{
-			observeMetric: newObserveMetric(cfg, regex, deleteRegex),
-			histogram:     prometheus.NewHistogram(histogramOpts),
+			observeMetric: newObserveMetric(cfg, matcher, deleteMatcher, histogram),
+			histogram:     histogram,
 		}
 	} else {
+		histogramVec := prometheus.NewHistogramVec(histogramOpts, prometheusLabels(cfg.LabelTemplates))
 		return &histogramVecMetric{
-			observeMetricWithLabels: newObserveMetricWithLabels(cfg, regex, deleteRegex),
-			histogramVec:            prometheus.NewHistogramVec(histogramOpts, prometheusLabels(cfg.LabelTemplates)),
+			observeMetricWithLabels: newObserveMetricWithLabels(cfg, matcher, deleteMatcher, histogramVec),
+			histogramVec:            histogramVec,
 		}
 	}
 }
 
-func NewSummaryMetric(cfg *configuration.MetricConfig, regex *oniguruma.Regex, deleteRegex *oniguruma.Regex) Metric {
+func NewSummaryMetric(cfg *configuration.MetricConfig, matcher, deleteMatcher Matcher) Metric {
 	summaryOpts := prometheus.SummaryOpts{
 		Name: cfg.Name,
 		Help: cfg.Help,
@@ -472,22 +521,24 @@ func NewSummaryMetric(cfg *configuration.MetricConfig, regex *oniguruma.Regex, d
 		summaryOpts.Objectives = cfg.Quantiles
 	}
 	if len(cfg.Labels) == 0 {
+		summary := prometheus.NewSummary(summaryOpts)
 		return &summaryMetric{
-			observeMetric: newObserveMetric(cfg, regex, deleteRegex),
-			summary:       prometheus.NewSummary(summaryOpts),
+			observeMetric: newObserveMetric(cfg, matcher, deleteMatcher, summary),
+			summary:       summary,
 		}
 	} else {
+		summaryVec := prometheus.NewSummaryVec(summaryOpts, prometheusLabels(cfg.LabelTemplates))
 		return &summaryVecMetric{
-			observeMetricWithLabels: newObserveMetricWithLabels(cfg, regex, deleteRegex),
-			summaryVec:              prometheus.NewSummaryVec(summaryOpts, prometheusLabels(cfg.LabelTemplates)),
+			observeMetricWithLabels: newObserveMetricWithLabels(cfg, matcher, deleteMatcher, summaryVec),
+			summaryVec:              summaryVec,
 		}
 	}
 }
 
-func labelValues(metricName string, searchResult *oniguruma.SearchResult, templates []template.Template) (map[string]string, error) {
+func labelValues(metricName string, fields Fields, templates []template.Template, line *fswatcher.Line) (map[string]string, error) {
 	result := make(map[string]string, len(templates))
 	for _, t := range templates {
-		value, err := evalTemplate(searchResult, t)
+		value, err := evalTemplate(fields, t, line)
 		if err != nil {
 			return nil, fmt.Errorf("error processing metric %v: %v", metricName, err.Error())
 		}
@@ -496,8 +547,8 @@ func labelValues(metricName string, searchResult *oniguruma.SearchResult, templa
 	return result, nil
 }
 
-func floatValue(metricName string, searchResult *oniguruma.SearchResult, valueTemplate template.Template) (float64, error) {
-	stringVal, err := evalTemplate(searchResult, valueTemplate)
+func floatValue(metricName string, fields Fields, valueTemplate template.Template, line *fswatcher.Line) (float64, error) {
+	stringVal, err := evalTemplate(fields, valueTemplate, line)
 	if err != nil {
 		return 0, fmt.Errorf("error processing metric %v: %v", metricName, err.Error())
 	}
@@ -508,16 +559,27 @@ func floatValue(metricName string, searchResult *oniguruma.SearchResult, valueTe
 	return floatVal, nil
 }
 
-func evalTemplate(searchResult *oniguruma.SearchResult, t template.Template) (string, error) {
-	grokValues := make(map[string]string, len(t.ReferencedGrokFields()))
+// eventTime evaluates the timestamp template, which yields seconds since the epoch, like the 'timestamp' template function.
+func eventTime(metricName string, fields Fields, timestampTemplate template.Template, line *fswatcher.Line) (time.Time, error) {
+	stringVal, err := evalTemplate(fields, timestampTemplate, line)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error processing metric %v: %v", metricName, err.Error())
+	}
+	seconds, err := strconv.ParseFloat(stringVal, 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return time.Time{}, fmt.Errorf("error processing metric %v: timestamp matches '%v', which is not a valid number of seconds since the epoch.", metricName, stringVal)
+	}
+	integer, fraction := math.Modf(seconds)
+	return time.Unix(int64(integer), int64(fraction*float64(time.Second))), nil
+}
+
+// The template may reference grok fields, the metadata fields provided by the input, and reserved variables.
+func evalTemplate(fields Fields, t template.Template, line *fswatcher.Line) (string, error) {
+	values := make(map[string]string, len(t.ReferencedGrokFields()))
 	for _, field := range t.ReferencedGrokFields() {
-		value, err := searchResult.GetCaptureGroupByName(field)
-		if err != nil {
-			return "", err
-		}
-		grokValues[field] = value
+		values[field] = templateValue(field, fields, line)
 	}
-	return t.Execute(grokValues)
+	return t.Execute(values)
 }
 
 func prometheusLabels(templates []template.Template) []string {
@@ -17,10 +17,14 @@ package exporter
 import (
 	configuration "github.com/fstab/grok_exporter/config/v2"
 	"github.com/fstab/grok_exporter/oniguruma"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/fstab/grok_exporter/template"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_model/go"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCounterVec(t *testing.T) {
@@ -31,11 +35,11 @@ func TestCounterVec(t *testing.T) {
 			"error_message": "{{.message}}",
 		},
 	})
-	counter := NewCounterMetric(counterCfg, regex, nil)
-	counter.ProcessMatch("some unrelated line")
-	counter.ProcessMatch("2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted")
-	counter.ProcessMatch("2016-04-26 12:31:39 H=(186-90-8-31.genericrev.cantv.net) [186.90.8.31] F=<Hans.Krause9@cantv.net> rejected RCPT <ug2seeng-admin@example.com>: Unrouteable address")
-	counter.ProcessMatch("2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted")
+	counter := NewCounterMetric(counterCfg, NewGrokMatcher(regex), nil)
+	counter.ProcessMatch(&fswatcher.Line{Line: "some unrelated line"})
+	counter.ProcessMatch(&fswatcher.Line{Line: "2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted"})
+	counter.ProcessMatch(&fswatcher.Line{Line: "2016-04-26 12:31:39 H=(186-90-8-31.genericrev.cantv.net) [186.90.8.31] F=<Hans.Krause9@cantv.net> rejected RCPT <ug2seeng-admin@example.com>: Unrouteable address"})
+	counter.ProcessMatch(&fswatcher.Line{Line: "2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted"})
 
 	switch c := counter.Collector().(type) {
 	case *prometheus.CounterVec:
@@ -53,17 +57,88 @@ func TestCounterVec(t *testing.T) {
 	}
 }
 
+func TestCounterVecWithMetadata(t *testing.T) {
+	regex := initCounterRegex(t)
+	counterCfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name: "exim_rejected_rcpt_total",
+		Labels: map[string]string{
+			"error_message": "{{.message}}",
+			"host":          "{{.syslog_hostname}}",
+		},
+	})
+	counter := NewCounterMetric(counterCfg, NewGrokMatcher(regex), nil)
+	line := "2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted"
+	counter.ProcessMatch(&fswatcher.Line{Line: line, Metadata: map[string]string{"syslog_hostname": "mx1"}})
+	counter.ProcessMatch(&fswatcher.Line{Line: line, Metadata: map[string]string{"syslog_hostname": "mx2"}})
+	counter.ProcessMatch(&fswatcher.Line{Line: line, Metadata: map[string]string{"syslog_hostname": "mx2"}})
+	counter.ProcessMatch(&fswatcher.Line{Line: line}) // no metadata, label value is empty
+
+	c := counter.Collector().(*prometheus.CounterVec)
+	for _, expected := range []struct {
+		host  string
+		count float64
+	}{{"mx1", 1}, {"mx2", 2}, {"", 1}} {
+		m := io_prometheus_client.Metric{}
+		c.With(prometheus.Labels{"error_message": "relay not permitted", "host": expected.host}).Write(&m) // label order is random
+		if *m.Counter.Value != expected.count {
+			t.Errorf("Expected %v matches for host %q, but got %v matches.", expected.count, expected.host, *m.Counter.Value)
+		}
+	}
+}
+
+func TestCounterVecWithReservedVariables(t *testing.T) {
+	regex := initCounterRegex(t)
+	counterCfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name: "exim_rejected_rcpt_total",
+		Labels: map[string]string{
+			"filename": "{{.filename}}",
+			"filepath": "{{.filepath}}",
+			"input":    "{{.input}}",
+			"line":     "{{.line_number}}",
+			"received": "{{.receive_timestamp}}",
+		},
+	})
+	counter := NewCounterMetric(counterCfg, NewGrokMatcher(regex), nil)
+	line := "2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted"
+	counter.ProcessMatch(&fswatcher.Line{Line: line, File: "/var/log/exim/main.log", Input: "exim", LineNumber: 42, Time: time.Unix(1570818238, 123000000)})
+	counter.ProcessMatch(&fswatcher.Line{Line: line}) // not from a file, the variables are empty
+
+	c := counter.Collector().(*prometheus.CounterVec)
+	for _, labels := range []prometheus.Labels{
+		{"filename": "main.log", "filepath": "/var/log/exim/main.log", "input": "exim", "line": "42", "received": "1570818238.123"},
+		{"filename": "", "filepath": "", "input": "", "line": "", "received": ""},
+	} {
+		m := io_prometheus_client.Metric{}
+		c.With(labels).Write(&m)
+		if *m.Counter.Value != 1 {
+			t.Errorf("Expected 1 match for %v, but got %v matches.", labels, *m.Counter.Value)
+		}
+	}
+
+	// Metadata fields take precedence over reserved variables.
+	counter = NewCounterMetric(newMetricConfig(t, &configuration.MetricConfig{
+		Name:   "exim_rejected_rcpt_total",
+		Labels: map[string]string{"filename": "{{.filename}}"},
+	}), NewGrokMatcher(regex), nil)
+	counter.ProcessMatch(&fswatcher.Line{Line: line, File: "/var/log/exim/main.log", Metadata: map[string]string{"filename": "/from/promtail.log"}})
+	m := io_prometheus_client.Metric{}
+	counter.Collector().(*prometheus.CounterVec).With(prometheus.Labels{"filename": "/from/promtail.log"}).Write(&m)
+	if *m.Counter.Value != 1 {
+		t.Errorf("Expected the metadata field to take precedence over the reserved variable.")
+	}
+}
+
 func TestCounter(t *testing.T) {
 	regex := initCounterRegex(t)
 	counterCfg := newMetricConfig(t, &configuration.MetricConfig{
 		Name: "exim_rejected_rcpt_total",
 	})
-	counter := NewCounterMetric(counterCfg, regex, nil)
+	counter := NewCounterMetric(counterCfg, NewGrokMatcher(regex), nil)
 
-	counter.ProcessMatch("some unrelated line")
-	counter.ProcessMatch("2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted")
-	counter.ProcessMatch("2016-04-26 12:31:39 H=(186-90-8-31.genericrev.cantv.net) [186.90.8.31] F=<Hans.Krause9@cantv.net> rejected RCPT <ug2seeng-admin@example.com>: Unrouteable address")
-	counter.ProcessMatch("2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted")
+	counter.ProcessMatch(&fswatcher.Line{Line: "some unrelated line"})
+	counter.ProcessMatch(&fswatcher.Line{Line: "2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted"})
+	counter.ProcessMatch(&fswatcher.Line{Line: "2016-04-26 12:31:39 H=(186-90-8-31.genericrev.cantv.net) [186.90.8.31] F=<Hans.Krause9@cantv.net> rejected RCPT <ug2seeng-admin@example.com>: Unrouteable address"})
+	counter.ProcessMatch(&fswatcher.Line{Line: "2016-04-26 10:19:57 H=(85.214.241.101) [36.224.138.227] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted"})
 
 	switch c := counter.Collector().(type) {
 	case prometheus.Counter:
@@ -96,10 +171,10 @@ func TestGauge(t *testing.T) {
 		Name:  "temperature",
 		Value: "{{.temperature}}",
 	})
-	gauge := NewGaugeMetric(gaugeCfg, regex, nil)
+	gauge := NewGaugeMetric(gaugeCfg, NewGrokMatcher(regex), nil)
 
-	gauge.ProcessMatch("Temperature in Berlin: 32")
-	gauge.ProcessMatch("Temperature in Moscow: -5")
+	gauge.ProcessMatch(&fswatcher.Line{Line: "Temperature in Berlin: 32"})
+	gauge.ProcessMatch(&fswatcher.Line{Line: "Temperature in Moscow: -5"})
 
 	switch c := gauge.Collector().(type) {
 	case prometheus.Gauge:
@@ -120,10 +195,10 @@ func TestGaugeCumulative(t *testing.T) {
 		Value:      "{{.temperature}}",
 		Cumulative: true,
 	})
-	gauge := NewGaugeMetric(gaugeCfg, regex, nil)
+	gauge := NewGaugeMetric(gaugeCfg, NewGrokMatcher(regex), nil)
 
-	gauge.ProcessMatch("Temperature in Berlin: 32")
-	gauge.ProcessMatch("Temperature in Moscow: -5")
+	gauge.ProcessMatch(&fswatcher.Line{Line: "Temperature in Berlin: 32"})
+	gauge.ProcessMatch(&fswatcher.Line{Line: "Temperature in Moscow: -5"})
 
 	switch c := gauge.Collector().(type) {
 	case prometheus.Gauge:
@@ -146,11 +221,11 @@ func TestGaugeVec(t *testing.T) {
 			"city": "{{.city}}",
 		},
 	})
-	gauge := NewGaugeMetric(gaugeCfg, regex, nil)
+	gauge := NewGaugeMetric(gaugeCfg, NewGrokMatcher(regex), nil)
 
-	gauge.ProcessMatch("Temperature in Berlin: 32")
-	gauge.ProcessMatch("Temperature in Moscow: -5")
-	gauge.ProcessMatch("Temperature in Berlin: 31")
+	gauge.ProcessMatch(&fswatcher.Line{Line: "Temperature in Berlin: 32"})
+	gauge.ProcessMatch(&fswatcher.Line{Line: "Temperature in Moscow: -5"})
+	gauge.ProcessMatch(&fswatcher.Line{Line: "Temperature in Berlin: 31"})
 
 	switch c := gauge.Collector().(type) {
 	case *prometheus.GaugeVec:
@@ -168,6 +243,110 @@ func TestGaugeVec(t *testing.T) {
 	}
 }
 
+func TestGaugeVecWithTimestamp(t *testing.T) {
+	for _, policy := range []string{"update", "drop"} {
+		regex := initTimestampRegex(t)
+		gaugeCfg := newMetricConfig(t, &configuration.MetricConfig{
+			Name:  "temperature",
+			Value: "{{.temperature}}",
+			Labels: map[string]string{
+				"city": "{{.city}}",
+			},
+			Timestamp:          `{{timestamp "2006-01-02 15:04:05" .time}}`,
+			TimestampPolicy:    policy,
+			TimestampMaxFuture: time.Minute,
+		})
+		gauge := NewGaugeMetric(gaugeCfg, NewGrokMatcher(regex), nil)
+		gauge.(*gaugeVecMetric).timestamps.now = func() time.Time { return time.Date(2019, 10, 12, 12, 0, 0, 0, time.UTC) }
+
+		for _, test := range []struct {
+			line                string
+			outOfRangeTimestamp string
+		}{
+			{"2019-10-12 10:00:00 Temperature in Berlin: 32", ""},
+			{"2019-10-12 10:00:05 Temperature in Moscow: -5", ""},
+			{"2019-10-12 09:59:00 Temperature in Berlin: 30", TimestampOutOfOrder},
+			{"2019-10-12 12:05:00 Temperature in Moscow: -4", TimestampInFuture},
+		} {
+			match, err := gauge.ProcessMatch(&fswatcher.Line{Line: test.line})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if match.OutOfRangeTimestamp != test.outOfRangeTimestamp {
+				t.Fatalf("%v: expected out of range timestamp %q for %q, but got %q", policy, test.outOfRangeTimestamp, test.line, match.OutOfRangeTimestamp)
+			}
+		}
+
+		type sample struct {
+			value       float64
+			timestampMs int64
+		}
+		expected := map[string]sample{
+			"Berlin": {30, 1570874400000}, // value updated, timestamp 10:00:00 kept
+			"Moscow": {-4, 1570881600000}, // future timestamp replaced with the current time 12:00:00
+		}
+		if policy == "drop" {
+			expected["Berlin"] = sample{32, 1570874400000}
+			expected["Moscow"] = sample{-5, 1570874405000}
+		}
+		for _, m := range collect(gauge.Collector()) {
+			city := m.Label[0].GetValue()
+			if actual := (sample{m.GetGauge().GetValue(), m.GetTimestampMs()}); actual != expected[city] {
+				t.Errorf("%v: expected %v for %v, but got %v", policy, expected[city], city, actual)
+			}
+		}
+	}
+}
+
+func TestCounterWithTimestamp(t *testing.T) {
+	regex := initTimestampRegex(t)
+	counterCfg := newMetricConfig(t, &configuration.MetricConfig{
+		Name:               "temperature_reports_total",
+		Timestamp:          `{{timestamp "2006-01-02 15:04:05" .time}}`,
+		TimestampPolicy:    "update",
+		TimestampMaxFuture: time.Minute,
+	})
+	counter := NewCounterMetric(counterCfg, NewGrokMatcher(regex), nil)
+	if m := collect(counter.Collector()); len(m) != 1 || m[0].TimestampMs != nil {
+		t.Fatalf("Expected a single sample without timestamp before the first event, but got %v", m)
+	}
+	counter.ProcessMatch(&fswatcher.Line{Line: "2019-10-12 10:00:00 Temperature in Berlin: 32"})
+	if m := collect(counter.Collector()); m[0].GetTimestampMs() != 1570874400000 || m[0].GetCounter().GetValue() != 1 {
+		t.Fatalf("Expected value 1 with timestamp 1570874400000, but got %v", m[0])
+	}
+
+	counterCfg.TimestampTemplate, _ = template.New("__timestamp__", "{{.city}}")
+	counter = NewCounterMetric(counterCfg, NewGrokMatcher(initTimestampRegex(t)), nil)
+	_, err := counter.ProcessMatch(&fswatcher.Line{Line: "2019-10-12 10:00:00 Temperature in Berlin: 32"})
+	if err == nil || !strings.Contains(err.Error(), "'Berlin', which is not a valid number") {
+		t.Fatalf("Expected error for invalid timestamp, but got %v", err)
+	}
+}
+
+func initTimestampRegex(t *testing.T) *oniguruma.Regex {
+	patterns := loadPatternDir(t)
+	regex, err := Compile("(?<time>%{TIMESTAMP_ISO8601}) Temperature in %{WORD:city}: %{INT:temperature}", patterns)
+	if err != nil {
+		t.Error(err)
+	}
+	return regex
+}
+
+func collect(collector prometheus.Collector) []*io_prometheus_client.Metric {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		collector.Collect(ch)
+		close(ch)
+	}()
+	var result []*io_prometheus_client.Metric
+	for metric := range ch {
+		m := &io_prometheus_client.Metric{}
+		metric.Write(m)
+		result = append(result, m)
+	}
+	return result
+}
+
 func initGaugeRegex(t *testing.T) *oniguruma.Regex {
 	patterns := loadPatternDir(t)
 	regex, err := Compile("Temperature in %{WORD:city}: %{INT:temperature}", patterns)
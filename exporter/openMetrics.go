@@ -0,0 +1,183 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"bufio"
+	"fmt"
+	dto "github.com/prometheus/client_model/go"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OpenMetricsWriter collects snapshots of the metrics, and writes them as timestamped samples in the OpenMetrics
+// text format, as read by 'promtool tsdb create-blocks-from openmetrics'. OpenMetrics does not allow interleaving
+// metric families or series, so all samples are kept in memory until Write is called.
+type OpenMetricsWriter struct {
+	families map[string]*openMetricsFamily
+}
+
+type openMetricsFamily struct {
+	header      string
+	series      map[string]*strings.Builder // label set -> samples
+	seriesOrder []string                    // label sets in the order of their first snapshot
+}
+
+func NewOpenMetricsWriter() *OpenMetricsWriter {
+	return &OpenMetricsWriter{
+		families: make(map[string]*openMetricsFamily),
+	}
+}
+
+// Add appends the current values of the metric families with the given timestamp.
+// Timestamps must be increasing between calls.
+func (w *OpenMetricsWriter) Add(metricFamilies []*dto.MetricFamily, timestamp time.Time) {
+	ts := strconv.FormatFloat(float64(timestamp.UnixNano())/float64(time.Second), 'f', -1, 64)
+	for _, mf := range metricFamilies {
+		name, typ := openMetricsFamilyName(mf)
+		family, exists := w.families[name]
+		if !exists {
+			family = &openMetricsFamily{
+				header: fmt.Sprintf("# TYPE %v %v\n# HELP %v %v\n", name, typ, name, escape(mf.GetHelp())),
+				series: make(map[string]*strings.Builder),
+			}
+			w.families[name] = family
+		}
+		for _, m := range mf.Metric {
+			labels := labelPairs(m.Label)
+			samples, exists := family.series[labels]
+			if !exists {
+				samples = &strings.Builder{}
+				family.series[labels] = samples
+				family.seriesOrder = append(family.seriesOrder, labels)
+			}
+			writeMetricPoint(samples, mf, m, ts)
+		}
+	}
+}
+
+// Write writes all samples, followed by the '# EOF' marker.
+func (w *OpenMetricsWriter) Write(out io.Writer) error {
+	names := make([]string, 0, len(w.families))
+	for name := range w.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf := bufio.NewWriter(out)
+	for _, name := range names {
+		family := w.families[name]
+		buf.WriteString(family.header)
+		for _, labels := range family.seriesOrder {
+			buf.WriteString(family.series[labels].String())
+		}
+	}
+	buf.WriteString("# EOF\n")
+	return buf.Flush()
+}
+
+// In OpenMetrics, the name of a counter family does not include the '_total' suffix of the samples.
+// Counters without that suffix are written as 'unknown', so that the series names are the same as on the /metrics endpoint.
+func openMetricsFamilyName(mf *dto.MetricFamily) (string, string) {
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		if strings.HasSuffix(mf.GetName(), "_total") {
+			return strings.TrimSuffix(mf.GetName(), "_total"), "counter"
+		}
+		return mf.GetName(), "unknown"
+	case dto.MetricType_GAUGE:
+		return mf.GetName(), "gauge"
+	case dto.MetricType_HISTOGRAM:
+		return mf.GetName(), "histogram"
+	case dto.MetricType_SUMMARY:
+		return mf.GetName(), "summary"
+	default:
+		return mf.GetName(), "unknown"
+	}
+}
+
+func writeMetricPoint(w *strings.Builder, mf *dto.MetricFamily, m *dto.Metric, ts string) {
+	name := mf.GetName()
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		writeSample(w, name, m.Label, "", "", m.GetCounter().GetValue(), ts)
+	case dto.MetricType_GAUGE:
+		writeSample(w, name, m.Label, "", "", m.GetGauge().GetValue(), ts)
+	case dto.MetricType_UNTYPED:
+		writeSample(w, name, m.Label, "", "", m.GetUntyped().GetValue(), ts)
+	case dto.MetricType_HISTOGRAM:
+		h := m.GetHistogram()
+		for _, b := range h.Bucket {
+			writeSample(w, name+"_bucket", m.Label, "le", formatFloat(b.GetUpperBound()), float64(b.GetCumulativeCount()), ts)
+		}
+		writeSample(w, name+"_bucket", m.Label, "le", "+Inf", float64(h.GetSampleCount()), ts)
+		writeSample(w, name+"_sum", m.Label, "", "", h.GetSampleSum(), ts)
+		writeSample(w, name+"_count", m.Label, "", "", float64(h.GetSampleCount()), ts)
+	case dto.MetricType_SUMMARY:
+		s := m.GetSummary()
+		for _, q := range s.Quantile {
+			writeSample(w, name, m.Label, "quantile", formatFloat(q.GetQuantile()), q.GetValue(), ts)
+		}
+		writeSample(w, name+"_sum", m.Label, "", "", s.GetSampleSum(), ts)
+		writeSample(w, name+"_count", m.Label, "", "", float64(s.GetSampleCount()), ts)
+	}
+}
+
+// writeSample writes a line like 'name{a="b",le="0.5"} 3 1570874400', the additional label is omitted if extraName is empty.
+func writeSample(w *strings.Builder, name string, labels []*dto.LabelPair, extraName, extraValue string, value float64, ts string) {
+	w.WriteString(name)
+	pairs := labelPairs(labels)
+	if extraName != "" {
+		if pairs != "" {
+			pairs += ","
+		}
+		pairs += fmt.Sprintf("%v=\"%v\"", extraName, extraValue)
+	}
+	if pairs != "" {
+		w.WriteString("{" + pairs + "}")
+	}
+	w.WriteString(" " + formatFloat(value) + " " + ts + "\n")
+}
+
+func labelPairs(labels []*dto.LabelPair) string {
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		pairs = append(pairs, fmt.Sprintf("%v=\"%v\"", l.GetName(), escape(l.GetValue())))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
+
+// In OpenMetrics, label values and HELP texts use the same escaping.
+var openMetricsEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escape(s string) string {
+	return openMetricsEscaper.Replace(s)
+}
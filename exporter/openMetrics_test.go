@@ -0,0 +1,100 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"bytes"
+	"github.com/prometheus/client_golang/prometheus"
+	"testing"
+	"time"
+)
+
+func TestOpenMetricsWriter(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "logins_total",
+		Help: "Number of \"logins\".",
+	}, []string{"user"})
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "duration_seconds",
+		Help:    "Duration.",
+		Buckets: []float64{0.5, 1},
+	})
+	registry.MustRegister(counter, histogram)
+	w := NewOpenMetricsWriter()
+
+	counter.WithLabelValues("alice").Inc()
+	histogram.Observe(0.7)
+	gather(t, registry, w, time.Unix(1577872800, 0))
+
+	counter.WithLabelValues("bob\n").Inc()
+	counter.WithLabelValues("alice").Inc()
+	gather(t, registry, w, time.Unix(1577872860, 500000000))
+
+	var out bytes.Buffer
+	if err := w.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# TYPE duration_seconds histogram
+# HELP duration_seconds Duration.
+duration_seconds_bucket{le="0.5"} 0 1577872800
+duration_seconds_bucket{le="1"} 1 1577872800
+duration_seconds_bucket{le="+Inf"} 1 1577872800
+duration_seconds_sum 0.7 1577872800
+duration_seconds_count 1 1577872800
+duration_seconds_bucket{le="0.5"} 0 1577872860.5
+duration_seconds_bucket{le="1"} 1 1577872860.5
+duration_seconds_bucket{le="+Inf"} 1 1577872860.5
+duration_seconds_sum 0.7 1577872860.5
+duration_seconds_count 1 1577872860.5
+# TYPE logins counter
+# HELP logins Number of \"logins\".
+logins_total{user="alice"} 1 1577872800
+logins_total{user="alice"} 2 1577872860.5
+logins_total{user="bob\n"} 1 1577872860.5
+# EOF
+`
+	if out.String() != expected {
+		t.Fatalf("Expected:\n%v\nActual:\n%v", expected, out.String())
+	}
+}
+
+func TestOpenMetricsCounterWithoutTotal(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "logins",
+		Help: "Number of logins.",
+	})
+	registry.MustRegister(counter)
+	w := NewOpenMetricsWriter()
+	gather(t, registry, w, time.Unix(1577872800, 0))
+
+	var out bytes.Buffer
+	if err := w.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	expected := "# TYPE logins unknown\n# HELP logins Number of logins.\nlogins 0 1577872800\n# EOF\n"
+	if out.String() != expected {
+		t.Fatalf("Expected:\n%v\nActual:\n%v", expected, out.String())
+	}
+}
+
+func gather(t *testing.T, registry *prometheus.Registry, w *OpenMetricsWriter, timestamp time.Time) {
+	metricFamilies, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Add(metricFamilies, timestamp)
+}
@@ -0,0 +1,72 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"path/filepath"
+	"strconv"
+)
+
+// Reserved template variables are available in all label and value templates, in addition to the grok fields
+// and the metadata fields provided by the input. If a grok field or metadata field has the same name,
+// the field takes precedence, so existing configs referencing a grok field like 'filename' keep working.
+var reservedVariables = map[string]func(line *fswatcher.Line) string{
+	"filepath": func(line *fswatcher.Line) string {
+		return line.File
+	},
+	"filename": func(line *fswatcher.Line) string {
+		if line.File == "" {
+			return ""
+		}
+		return filepath.Base(line.File)
+	},
+	"input": func(line *fswatcher.Line) string {
+		return line.Input
+	},
+	"line_number": func(line *fswatcher.Line) string {
+		if line.LineNumber <= 0 {
+			return ""
+		}
+		return strconv.FormatInt(line.LineNumber, 10)
+	},
+	"receive_timestamp": func(line *fswatcher.Line) string {
+		if line.Time.IsZero() {
+			return ""
+		}
+		return strconv.FormatFloat(float64(line.Time.UnixNano())/1e9, 'f', 3, 64)
+	},
+}
+
+func isReservedVariable(name string) bool {
+	_, exists := reservedVariables[name]
+	return exists
+}
+
+// templateValue returns the value of a field referenced in a template: The field provided by the matcher,
+// like a grok field, otherwise the input's metadata field, otherwise the reserved variable.
+// VerifyFieldNames() made sure that the name is one of these.
+func templateValue(field string, fields Fields, line *fswatcher.Line) string {
+	if value, exists := fields.Get(field); exists {
+		return value
+	}
+	if value, exists := line.Metadata[field]; exists {
+		return value
+	}
+	if variable, exists := reservedVariables[field]; exists {
+		return variable(line)
+	}
+	return "" // metadata field not provided by the input the line came from
+}
@@ -0,0 +1,135 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package exporter
+
+import (
+	configuration "github.com/fstab/grok_exporter/config/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reasons why the timestamp of an event was not used, see Match.OutOfRangeTimestamp.
+const (
+	TimestampOutOfOrder = "out_of_order" // the event is older than the last event of the series
+	TimestampInFuture   = "future"       // the event is more than 'timestamp_max_future' ahead of the current time
+)
+
+// labelValuesSeparator cannot occur in valid UTF-8, so the joined label values are unique.
+const labelValuesSeparator = "\xff"
+
+// timestampCollector wraps the collector of a metric with a 'timestamp' template. Each series is exposed with
+// the timestamp of the last event that updated it. Series that were never updated, like a counter without labels
+// before the first match, are exposed without timestamp.
+type timestampCollector struct {
+	collector  prometheus.Collector
+	labelNames []string
+	drop       bool // 'timestamp_policy: drop'
+	maxFuture  time.Duration
+	mutex      sync.Mutex
+	timestamps map[string]time.Time // label values joined with labelValuesSeparator -> time of the last event
+	now        func() time.Time     // replaced in tests
+}
+
+func newTimestampCollector(cfg *configuration.MetricConfig, collector prometheus.Collector) *timestampCollector {
+	return &timestampCollector{
+		collector:  collector,
+		labelNames: prometheusLabels(cfg.LabelTemplates),
+		drop:       cfg.TimestampPolicy == "drop",
+		maxFuture:  cfg.TimestampMaxFuture,
+		timestamps: make(map[string]time.Time),
+		now:        time.Now,
+	}
+}
+
+// update calls apply to update the series with the given labels, unless the event is dropped by the timestamp policy.
+// The result is TimestampOutOfOrder or TimestampInFuture if the policy was applied, or empty if the event time was used.
+// The timestamp of a series never decreases, because Prometheus rejects out-of-order samples.
+func (c *timestampCollector) update(labels map[string]string, eventTime time.Time, apply func()) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var (
+		now            = c.now()
+		key            = c.key(labels)
+		last, hasLast  = c.timestamps[key]
+		outOfRangeTime string
+	)
+	switch {
+	case eventTime.After(now.Add(c.maxFuture)):
+		outOfRangeTime, eventTime = TimestampInFuture, now
+	case hasLast && eventTime.Before(last):
+		outOfRangeTime = TimestampOutOfOrder
+	}
+	if outOfRangeTime != "" && c.drop {
+		return outOfRangeTime
+	}
+	apply()
+	if !hasLast || eventTime.After(last) {
+		c.timestamps[key] = eventTime
+	}
+	return outOfRangeTime
+}
+
+// delete must be called when the series is deleted, so that a new series with the same labels starts without timestamp.
+func (c *timestampCollector) delete(labels map[string]string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.timestamps, c.key(labels))
+}
+
+func (c *timestampCollector) key(labels map[string]string) string {
+	values := make([]string, len(c.labelNames))
+	for i, name := range c.labelNames {
+		values[i] = labels[name]
+	}
+	return strings.Join(values, labelValuesSeparator)
+}
+
+func (c *timestampCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.collector.Describe(ch)
+}
+
+// Collect holds the lock while the wrapped collector is collected, so that values and timestamps are consistent.
+func (c *timestampCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		c.collector.Collect(metrics)
+		close(metrics)
+	}()
+	for m := range metrics {
+		if key, ok := c.metricKey(m); ok {
+			if timestamp, exists := c.timestamps[key]; exists {
+				m = prometheus.NewMetricWithTimestamp(timestamp, m)
+			}
+		}
+		ch <- m
+	}
+}
+
+func (c *timestampCollector) metricKey(m prometheus.Metric) (string, bool) {
+	var pb dto.Metric
+	if err := m.Write(&pb); err != nil {
+		return "", false
+	}
+	labels := make(map[string]string, len(pb.Label))
+	for _, pair := range pb.Label {
+		labels[pair.GetName()] = pair.GetValue()
+	}
+	return c.key(labels), true
+}
@@ -1,10 +1,10 @@
 module github.com/fstab/grok_exporter
 
 require (
-	github.com/bitly/go-simplejson v0.5.0
 	github.com/prometheus/client_golang v0.9.4
 	github.com/prometheus/client_model v0.0.0-20190129233127-fd36f4220a90
 	github.com/prometheus/common v0.4.1
 	github.com/sirupsen/logrus v1.4.2
+	golang.org/x/text v0.3.2
 	gopkg.in/yaml.v2 v2.2.2
 )
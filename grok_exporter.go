@@ -22,19 +22,30 @@ import (
 	"github.com/fstab/grok_exporter/exporter"
 	"github.com/fstab/grok_exporter/oniguruma"
 	"github.com/fstab/grok_exporter/tailer"
+	"github.com/fstab/grok_exporter/tailer/charset"
 	"github.com/fstab/grok_exporter/tailer/fswatcher"
 	"github.com/fstab/grok_exporter/tailer/glob"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"io/ioutil"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 var (
-	printVersion = flag.Bool("version", false, "Print the grok_exporter version.")
-	configPath   = flag.String("config", "", "Path to the config file. Try '-config ./example/config.yml' to get started.")
-	showConfig   = flag.Bool("showconfig", false, "Print the current configuration to the console. Example: 'grok_exporter -showconfig -config ./example/config.yml'")
+	printVersion    = flag.Bool("version", false, "Print the grok_exporter version.")
+	configPath      = flag.String("config", "", "Path to the config file. Try '-config ./example/config.yml' to get started.")
+	showConfig      = flag.Bool("showconfig", false, "Print the current configuration to the console. Example: 'grok_exporter -showconfig -config ./example/config.yml'")
+	validateConfig  = flag.Bool("validate", false, "Check the config file and print all errors without reading any logs or opening any ports. Example: 'grok_exporter -validate -config ./example/config.yml'")
+	once            = flag.Bool("once", false, "Batch mode: Read all inputs until end of file, write the metrics, and exit without opening any ports. Same as 'mode: batch' for all inputs. Example: 'cat sample.log | grok_exporter -once -config ./example/config.yml'")
+	backfillMode    = flag.Bool("backfill", false, "Like '-once', but write the metrics at each step of '-resolution' as timestamped samples in OpenMetrics format for 'promtool tsdb create-blocks-from openmetrics'. The time is taken from the 'timestamp' of the metrics. Example: 'grok_exporter -backfill -output metrics.om -config ./example/config.yml'")
+	resolution      = flag.Duration("resolution", time.Minute, "Time between two samples with '-backfill'.")
+	outputPath      = flag.String("output", "", "File for the metrics in batch mode and with '-backfill'. Default is stdout.")
+	enableLifecycle = flag.Bool("web.enable-lifecycle", false, "Enable reloading the configuration with an HTTP POST request to '/-/reload'. The configuration can always be reloaded with SIGHUP.")
 )
 
 const (
@@ -49,37 +60,72 @@ func main() {
 		return
 	}
 	validateCommandLineOrExit()
+	if *validateConfig {
+		if !validateConfigFile(*configPath) {
+			os.Exit(-1)
+		}
+		return
+	}
 	cfg, warn, err := config.LoadConfigFile(*configPath)
 	if len(warn) > 0 && !*showConfig {
 		// warning is suppressed when '-showconfig' is used
 		fmt.Fprintf(os.Stderr, "%v\n", warn)
 	}
 	exitOnError(err)
+	if *once || *backfillMode {
+		exitOnError(cfg.SetBatchMode())
+	}
 	if *showConfig {
-		fmt.Printf("%v\n", cfg)
+		fmt.Printf("%v\n", showConfigString(cfg))
 		return
 	}
 	patterns, err := initPatterns(cfg)
 	exitOnError(err)
 	metrics, err := createMetrics(cfg, patterns)
 	exitOnError(err)
+	fingerprints, err := metricFingerprints(cfg, patterns)
+	exitOnError(err)
 	for _, m := range metrics {
 		prometheus.MustRegister(m.Collector())
 	}
-	nLinesTotal, nMatchesByMetric, procTimeMicrosecondsByMetric, nErrorsByMetric := initSelfMonitoring(metrics)
+	mon := initSelfMonitoring(cfg, metrics)
 
-	tail, err := startTailer(cfg)
-	exitOnError(err)
+	if *backfillMode {
+		exitOnError(runBackfill(cfg, patterns, metrics, mon, *outputPath, *resolution))
+		return
+	}
+	if cfg.IsBatchMode() {
+		exitOnError(runBatch(cfg, patterns, metrics, mon, *outputPath))
+		return
+	}
 
 	// gather up the handlers with which to start the webserver
+	reloadRequests := make(chan chan error)
 	httpHandlers := []exporter.HttpServerPathHandler{}
 	httpHandlers = append(httpHandlers, exporter.HttpServerPathHandler{
 		Path:    cfg.Server.Path,
 		Handler: prometheus.Handler()})
-	if cfg.Input.Type == "webhook" {
+	if *enableLifecycle {
 		httpHandlers = append(httpHandlers, exporter.HttpServerPathHandler{
-			Path:    cfg.Input.WebhookPath,
-			Handler: tailer.WebhookHandler()})
+			Path:    reloadPath,
+			Handler: &reloadHandler{requests: reloadRequests}})
+	}
+
+	tail, webhookHandlers, err := startTailers(cfg, patterns, mon)
+	exitOnError(err)
+	webhooks := newWebhookDispatcher(webhookHandlers, mon.webhookRequests)
+	for _, webhookHandler := range webhookHandlers {
+		httpHandlers = append(httpHandlers, exporter.HttpServerPathHandler{
+			Path:    webhookHandler.Path,
+			Handler: webhooks})
+	}
+
+	s := &state{
+		cfg:          cfg,
+		metrics:      metrics,
+		fingerprints: fingerprints,
+		patterns:     patterns,
+		tail:         tail,
 	}
 
 	fmt.Print(startMsg(cfg, httpHandlers))
@@ -87,54 +133,110 @@ func main() {
 
 	retentionTicker := time.NewTicker(cfg.Global.RetentionCheckInterval)
 
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	// On shutdown, the lines that were already read are processed before grok_exporter terminates, see drainTailers().
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+
+	// closedTail is the tailer whose lines channel was closed. Its channels are not read anymore,
+	// but grok_exporter keeps serving the metrics. Batch mode, where grok_exporter terminates at end of file, is handled in runBatch().
+	var closedTail *inputTailers
+
 	for {
+		lines, tailErrors := s.tail.Lines(), s.tail.Errors()
+		if s.tail == closedTail {
+			lines, tailErrors = nil, nil
+		}
 		select {
 		case err := <-serverErrors:
 			exitOnError(fmt.Errorf("server error: %v", err.Error()))
-		case err := <-tail.Errors():
-			if os.IsNotExist(err.Cause()) {
-				exitOnError(fmt.Errorf("error reading log lines: %v: use 'fail_on_missing_logfile: false' in the input configuration if you want grok_exporter to start even though the logfile is missing", err))
-			} else {
-				exitOnError(fmt.Errorf("error reading log lines: %v", err.Error()))
+		case err, open := <-tailErrors:
+			if open {
+				exitOnError(readError(err))
 			}
-		case line := <-tail.Lines():
-			matched := false
-			for _, metric := range metrics {
-				start := time.Now()
-				match, err := metric.ProcessMatch(line.Line)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "WARNING: skipping log line: %v\n", err.Error())
-					fmt.Fprintf(os.Stderr, "%v\n", line.Line)
-					nErrorsByMetric.WithLabelValues(metric.Name()).Inc()
-				}
-				if match != nil {
-					nMatchesByMetric.WithLabelValues(metric.Name()).Inc()
-					procTimeMicrosecondsByMetric.WithLabelValues(metric.Name()).Add(float64(time.Since(start).Nanoseconds() / int64(1000)))
-					matched = true
-				}
-				_, err = metric.ProcessDeleteMatch(line.Line)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "WARNING: skipping log line: %v\n", err.Error())
-					fmt.Fprintf(os.Stderr, "%v\n", line.Line)
-					nErrorsByMetric.WithLabelValues(metric.Name()).Inc()
-				}
-				// TODO: create metric to monitor number of matching delete_patterns
-			}
-			if matched {
-				nLinesTotal.WithLabelValues(number_of_lines_matched_label).Inc()
-			} else {
-				nLinesTotal.WithLabelValues(number_of_lines_ignored_label).Inc()
+		case line, open := <-lines:
+			if !open {
+				// All inputs reached end of file, like stdin after 'cat sample.log | grok_exporter' finished.
+				fmt.Fprintf(os.Stderr, "WARNING: all inputs are closed, no more log lines will be read. grok_exporter keeps serving the current metrics. Use 'mode: batch' or '-once' to terminate at end of file.\n")
+				closedTail = s.tail
+				continue
 			}
+			processLine(s.metrics, mon, line)
 		case <-retentionTicker.C:
-			for _, metric := range metrics {
+			for _, metric := range s.metrics {
 				err = metric.ProcessRetention()
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "WARNING: error while processing retention on metric %v: %v", metric.Name(), err)
-					nErrorsByMetric.WithLabelValues(metric.Name()).Inc()
+					mon.nErrorsByMetric.WithLabelValues(metric.Name()).Inc()
 				}
 			}
 			// TODO: create metric to monitor number of metrics cleaned up via retention
+		case <-shutdown:
+			drainTailers(s.tail, func(line *fswatcher.Line) {
+				processLine(s.metrics, mon, line)
+			})
+			os.Exit(0)
+		case <-sighup:
+			err = reloadConfig(s, mon, webhooks)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: failed to reload configuration, keeping the current configuration: %v\n", err)
+			}
+			retentionTicker.Stop()
+			retentionTicker = time.NewTicker(s.cfg.Global.RetentionCheckInterval)
+		case result := <-reloadRequests:
+			err = reloadConfig(s, mon, webhooks)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "WARNING: failed to reload configuration, keeping the current configuration: %v\n", err)
+			}
+			retentionTicker.Stop()
+			retentionTicker = time.NewTicker(s.cfg.Global.RetentionCheckInterval)
+			result <- err
+		}
+	}
+}
+
+func readError(err fswatcher.Error) error {
+	if os.IsNotExist(err.Cause()) {
+		return fmt.Errorf("error reading log lines: %v: use 'fail_on_missing_logfile: false' in the input configuration if you want grok_exporter to start even though the logfile is missing", err)
+	}
+	return fmt.Errorf("error reading log lines: %v", err.Error())
+}
+
+func processLine(metrics []exporter.Metric, mon *selfMonitoring, line *fswatcher.Line) {
+	matched := false
+	for _, metric := range metrics {
+		if !metric.ProcessesInput(line.Input) {
+			continue
+		}
+		start := time.Now()
+		match, err := metric.ProcessMatch(line)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: skipping log line: %v\n", err.Error())
+			fmt.Fprintf(os.Stderr, "%v\n", line.Line)
+			mon.nErrorsByMetric.WithLabelValues(metric.Name()).Inc()
+		}
+		if match != nil {
+			if match.OutOfRangeTimestamp != "" {
+				mon.outOfRangeTimestamps.WithLabelValues(metric.Name(), match.OutOfRangeTimestamp).Inc()
+			}
+			mon.nMatchesByMetric.WithLabelValues(metric.Name(), line.Input).Inc()
+			mon.procTimeMicrosecondsByMetric.WithLabelValues(metric.Name()).Add(float64(time.Since(start).Nanoseconds() / int64(1000)))
+			matched = true
+		}
+		_, err = metric.ProcessDeleteMatch(line)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: skipping log line: %v\n", err.Error())
+			fmt.Fprintf(os.Stderr, "%v\n", line.Line)
+			mon.nErrorsByMetric.WithLabelValues(metric.Name()).Inc()
 		}
+		// TODO: create metric to monitor number of matching delete_patterns
+	}
+	if matched {
+		mon.nLinesTotal.WithLabelValues(number_of_lines_matched_label, line.Input).Inc()
+	} else {
+		mon.nLinesTotal.WithLabelValues(number_of_lines_ignored_label, line.Input).Inc()
 	}
 }
 
@@ -159,6 +261,16 @@ func startMsg(cfg *v2.Config, httpHandlers []exporter.HttpServerPathHandler) str
 	return sb.String()
 }
 
+// If the config file contains ${...} references, we show the file as it is,
+// because the expanded configuration may contain secrets.
+func showConfigString(cfg *v2.Config) string {
+	content, err := ioutil.ReadFile(*configPath)
+	if err == nil && v2.ContainsVariables(content) {
+		return strings.TrimRight(string(content), "\n")
+	}
+	return cfg.String()
+}
+
 func exitOnError(err error) {
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err.Error())
@@ -170,6 +282,8 @@ func validateCommandLineOrExit() {
 	if len(*configPath) == 0 {
 		if *showConfig {
 			fmt.Fprint(os.Stderr, "Usage: grok_exporter -showconfig -config <path>\n")
+		} else if *validateConfig {
+			fmt.Fprint(os.Stderr, "Usage: grok_exporter -validate -config <path>\n")
 		} else {
 			fmt.Fprint(os.Stderr, "Usage: grok_exporter -config <path>\n")
 		}
@@ -196,79 +310,311 @@ func initPatterns(cfg *v2.Config) (*exporter.Patterns, error) {
 
 func createMetrics(cfg *v2.Config, patterns *exporter.Patterns) ([]exporter.Metric, error) {
 	result := make([]exporter.Metric, 0, len(cfg.Metrics))
-	for _, m := range cfg.Metrics {
-		var (
-			regex, deleteRegex *oniguruma.Regex
-			err                error
-		)
-		regex, err = exporter.Compile(m.Match, patterns)
+	for i := range cfg.Metrics {
+		metric, err := createMetric(&cfg.Metrics[i], patterns, metadataFields(cfg, &cfg.Metrics[i]))
 		if err != nil {
-			return nil, fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
-		}
-		if len(m.DeleteMatch) > 0 {
-			deleteRegex, err = exporter.Compile(m.DeleteMatch, patterns)
-			if err != nil {
-				return nil, fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
-			}
+			return nil, err
 		}
-		err = exporter.VerifyFieldNames(&m, regex, deleteRegex)
+		result = append(result, metric)
+	}
+	return result, nil
+}
+
+func createMetric(m *v2.MetricConfig, patterns *exporter.Patterns, metadataFields []string) (exporter.Metric, error) {
+	var deleteMatcher exporter.Matcher
+	matcher, err := exporter.NewMatcher(m, patterns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize metric %v: %v", metricDescription(m), err.Error())
+	}
+	if len(m.DeleteMatch) > 0 {
+		deleteRegex, err := exporter.Compile(m.DeleteMatch, patterns)
 		if err != nil {
-			return nil, fmt.Errorf("failed to initialize metric %v: %v", m.Name, err.Error())
-		}
-		switch m.Type {
-		case "counter":
-			result = append(result, exporter.NewCounterMetric(&m, regex, deleteRegex))
-		case "gauge":
-			result = append(result, exporter.NewGaugeMetric(&m, regex, deleteRegex))
-		case "histogram":
-			result = append(result, exporter.NewHistogramMetric(&m, regex, deleteRegex))
-		case "summary":
-			result = append(result, exporter.NewSummaryMetric(&m, regex, deleteRegex))
-		default:
-			return nil, fmt.Errorf("Failed to initialize metrics: Metric type %v is not supported.", m.Type)
+			return nil, fmt.Errorf("failed to initialize metric %v: %v", metricDescription(m), err.Error())
 		}
+		deleteMatcher = exporter.NewGrokMatcher(deleteRegex)
 	}
-	return result, nil
+	err = exporter.VerifyFieldNames(m, matcher, deleteMatcher, metadataFields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize metric %v: %v", metricDescription(m), err.Error())
+	}
+	switch m.Type {
+	case "counter":
+		return exporter.NewCounterMetric(m, matcher, deleteMatcher), nil
+	case "gauge":
+		return exporter.NewGaugeMetric(m, matcher, deleteMatcher), nil
+	case "histogram":
+		return exporter.NewHistogramMetric(m, matcher, deleteMatcher), nil
+	case "summary":
+		return exporter.NewSummaryMetric(m, matcher, deleteMatcher), nil
+	default:
+		return nil, fmt.Errorf("Failed to initialize metrics: Metric type %v is not supported.", m.Type)
+	}
+}
+
+// metadataFields returns the metadata fields provided by the inputs that are processed by the metric.
+// Label templates may reference these fields in addition to the grok fields.
+func metadataFields(cfg *v2.Config, m *v2.MetricConfig) []string {
+	var result []string
+	for _, input := range cfg.InputConfigs() {
+		processesInput := len(m.Inputs) == 0
+		for _, name := range m.Inputs {
+			processesInput = processesInput || name == input.Name
+		}
+		if processesInput {
+			result = append(result, tailer.MetadataFields(input)...)
+		}
+	}
+	return result
 }
 
-func initSelfMonitoring(metrics []exporter.Metric) (*prometheus.CounterVec, *prometheus.CounterVec, *prometheus.CounterVec, *prometheus.CounterVec) {
+// metricDescription returns the metric name, and the file name if the metric is defined in an included file.
+func metricDescription(m *v2.MetricConfig) string {
+	if len(m.File) > 0 {
+		return fmt.Sprintf("%v (defined in %v)", m.Name, m.File)
+	}
+	return m.Name
+}
+
+type selfMonitoring struct {
+	nLinesTotal                  *prometheus.CounterVec
+	nMatchesByMetric             *prometheus.CounterVec
+	procTimeMicrosecondsByMetric *prometheus.CounterVec
+	nErrorsByMetric              *prometheus.CounterVec
+	lastReloadSuccessful         prometheus.Gauge
+	webhookRequests              *prometheus.CounterVec
+	longLines                    *prometheus.CounterVec
+	invalidUtf8Lines             *prometheus.CounterVec
+	outOfRangeTimestamps         *prometheus.CounterVec
+	linesDropped                 *prometheus.CounterVec
+	webhookQueues                *webhookQueueCollector
+	commands                     *commandCollector
+}
+
+func initSelfMonitoring(cfg *v2.Config, metrics []exporter.Metric) *selfMonitoring {
 	buildInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "grok_exporter_build_info",
 		Help: "A metric with a constant '1' value labeled by version, builddate, branch, revision, goversion, and platform on which grok_exporter was built.",
 	}, []string{"version", "builddate", "branch", "revision", "goversion", "platform"})
-	nLinesTotal := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "grok_exporter_lines_total",
-		Help: "Total number of log lines processed by grok_exporter.",
-	}, []string{"status"})
-	nMatchesByMetric := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "grok_exporter_lines_matching_total",
-		Help: "Number of lines matched for each metric. Note that one line can be matched by multiple metrics.",
-	}, []string{"metric"})
-	procTimeMicrosecondsByMetric := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "grok_exporter_lines_processing_time_microseconds_total",
-		Help: "Processing time in microseconds for each metric. Divide by grok_exporter_lines_matching_total to get the averge processing time for one log line.",
-	}, []string{"metric"})
-	nErrorsByMetric := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "grok_exporter_line_processing_errors_total",
-		Help: "Number of errors for each metric. If this is > 0 there is an error in the configuration file. Check grok_exporter's console output.",
-	}, []string{"metric"})
+	mon := &selfMonitoring{
+		nLinesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grok_exporter_lines_total",
+			Help: "Total number of log lines processed by grok_exporter.",
+		}, []string{"status", "input"}),
+		nMatchesByMetric: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grok_exporter_lines_matching_total",
+			Help: "Number of lines matched for each metric. Note that one line can be matched by multiple metrics.",
+		}, []string{"metric", "input"}),
+		procTimeMicrosecondsByMetric: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grok_exporter_lines_processing_time_microseconds_total",
+			Help: "Processing time in microseconds for each metric. Divide by grok_exporter_lines_matching_total to get the averge processing time for one log line.",
+		}, []string{"metric"}),
+		nErrorsByMetric: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grok_exporter_line_processing_errors_total",
+			Help: "Number of errors for each metric. If this is > 0 there is an error in the configuration file. Check grok_exporter's console output.",
+		}, []string{"metric"}),
+		lastReloadSuccessful: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "grok_exporter_config_last_reload_successful",
+			Help: "Whether the last configuration reload attempt was successful.",
+		}),
+		webhookRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grok_exporter_webhook_requests_total",
+			Help: "Number of requests received on the webhook paths by HTTP status code.",
+		}, []string{"code"}),
+		longLines: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grok_exporter_long_lines_total",
+			Help: "Number of lines that were longer than max_line_bytes, by action truncate or skip.",
+		}, []string{"input", "action"}),
+		invalidUtf8Lines: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grok_exporter_invalid_utf8_lines_total",
+			Help: "Number of lines that were not valid UTF-8, by action replace or reject.",
+		}, []string{"input", "action"}),
+		outOfRangeTimestamps: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grok_exporter_out_of_range_timestamps_total",
+			Help: "Number of events of metrics with a timestamp that were older than the last event of the series or too far in the future, handled according to timestamp_policy.",
+		}, []string{"metric", "reason"}),
+		linesDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grok_exporter_lines_dropped_total",
+			Help: "Number of lines that were read but not processed, for example because the line buffer reached max_lines_in_buffer.",
+		}, []string{"reason"}),
+		webhookQueues: newWebhookQueueCollector(),
+		commands:      newCommandCollector(),
+	}
 
 	prometheus.MustRegister(buildInfo)
-	prometheus.MustRegister(nLinesTotal)
-	prometheus.MustRegister(nMatchesByMetric)
-	prometheus.MustRegister(procTimeMicrosecondsByMetric)
-	prometheus.MustRegister(nErrorsByMetric)
+	prometheus.MustRegister(mon.nLinesTotal)
+	prometheus.MustRegister(mon.nMatchesByMetric)
+	prometheus.MustRegister(mon.procTimeMicrosecondsByMetric)
+	prometheus.MustRegister(mon.nErrorsByMetric)
+	prometheus.MustRegister(mon.lastReloadSuccessful)
+	prometheus.MustRegister(mon.webhookRequests)
+	prometheus.MustRegister(mon.longLines)
+	prometheus.MustRegister(mon.invalidUtf8Lines)
+	prometheus.MustRegister(mon.outOfRangeTimestamps)
+	prometheus.MustRegister(mon.linesDropped)
+	prometheus.MustRegister(mon.webhookQueues)
+	prometheus.MustRegister(mon.commands)
 
 	buildInfo.WithLabelValues(exporter.Version, exporter.BuildDate, exporter.Branch, exporter.Revision, exporter.GoVersion, exporter.Platform).Set(1)
-	// Initializing a value with zero makes the label appear. Otherwise the label is not shown until the first value is observed.
-	nLinesTotal.WithLabelValues(number_of_lines_matched_label).Add(0)
-	nLinesTotal.WithLabelValues(number_of_lines_ignored_label).Add(0)
+	mon.lastReloadSuccessful.Set(1)
+	mon.linesDropped.WithLabelValues(tailer.DroppedBufferFull).Add(0)
+	mon.initLabels(cfg, metrics)
+	return mon
+}
+
+// webhookQueueCollector exposes the request queues of the webhook inputs.
+// The values are read from the webhook tailers when the metrics are scraped.
+type webhookQueueCollector struct {
+	lock        sync.Mutex
+	tailers     map[string]*tailer.WebhookTailer // input name -> tailer
+	queueLength *prometheus.Desc
+	rejected    *prometheus.Desc
+}
+
+func newWebhookQueueCollector() *webhookQueueCollector {
+	return &webhookQueueCollector{
+		tailers: make(map[string]*tailer.WebhookTailer),
+		queueLength: prometheus.NewDesc("grok_exporter_webhook_queue_length",
+			"Number of accepted webhook requests waiting to be processed.", []string{"input"}, nil),
+		rejected: prometheus.NewDesc("grok_exporter_webhook_queue_rejected_total",
+			"Number of webhook requests rejected with 503 because the queue was full.", []string{"input"}, nil),
+	}
+}
+
+// set replaces the tailers when the inputs are re-started after a configuration reload.
+func (c *webhookQueueCollector) set(tailers map[string]*tailer.WebhookTailer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.tailers = tailers
+}
+
+func (c *webhookQueueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.queueLength
+	ch <- c.rejected
+}
+
+func (c *webhookQueueCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for input, t := range c.tailers {
+		stats := t.Stats()
+		ch <- prometheus.MustNewConstMetric(c.queueLength, prometheus.GaugeValue, float64(stats.QueueLength), input)
+		ch <- prometheus.MustNewConstMetric(c.rejected, prometheus.CounterValue, float64(stats.Rejected), input)
+	}
+}
+
+// commandCollector exposes the process state of the command inputs.
+// The values are read from the command tailers when the metrics are scraped.
+type commandCollector struct {
+	lock          sync.Mutex
+	tailers       map[string]*tailer.CommandTailer // input name -> tailer
+	restarts      *prometheus.Desc
+	lastExitCode  *prometheus.Desc
+	uptimeSeconds *prometheus.Desc
+}
+
+func newCommandCollector() *commandCollector {
+	return &commandCollector{
+		tailers: make(map[string]*tailer.CommandTailer),
+		restarts: prometheus.NewDesc("grok_exporter_command_restarts_total",
+			"Number of times the command of a command input was restarted.", []string{"input"}, nil),
+		lastExitCode: prometheus.NewDesc("grok_exporter_command_last_exit_code",
+			"Exit code of the last terminated process of a command input, -1 if the process was killed by a signal or could not be started.", []string{"input"}, nil),
+		uptimeSeconds: prometheus.NewDesc("grok_exporter_command_uptime_seconds",
+			"Seconds since the running process of a command input was started, 0 if the command is not running.", []string{"input"}, nil),
+	}
+}
+
+// set replaces the tailers when the inputs are re-started after a configuration reload.
+func (c *commandCollector) set(tailers map[string]*tailer.CommandTailer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.tailers = tailers
+}
+
+func (c *commandCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.restarts
+	ch <- c.lastExitCode
+	ch <- c.uptimeSeconds
+}
+
+func (c *commandCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for input, t := range c.tailers {
+		stats := t.Stats()
+		ch <- prometheus.MustNewConstMetric(c.restarts, prometheus.CounterValue, float64(stats.Restarts), input)
+		if stats.Exited {
+			ch <- prometheus.MustNewConstMetric(c.lastExitCode, prometheus.GaugeValue, float64(stats.LastExitCode), input)
+		}
+		ch <- prometheus.MustNewConstMetric(c.uptimeSeconds, prometheus.GaugeValue, stats.Uptime.Seconds(), input)
+	}
+}
+
+// Initializing a value with zero makes the label appear. Otherwise the label is not shown until the first value is observed.
+func (mon *selfMonitoring) initLabels(cfg *v2.Config, metrics []exporter.Metric) {
+	for _, input := range cfg.InputConfigs() {
+		mon.nLinesTotal.WithLabelValues(number_of_lines_matched_label, input.Name).Add(0)
+		mon.nLinesTotal.WithLabelValues(number_of_lines_ignored_label, input.Name).Add(0)
+		if input.MaxLineBytes > 0 {
+			mon.longLines.WithLabelValues(input.Name, input.MaxLineAction).Add(0)
+		}
+		if input.InvalidUtf8 != "" {
+			mon.invalidUtf8Lines.WithLabelValues(input.Name, input.InvalidUtf8).Add(0)
+		}
+		for _, metric := range metrics {
+			if metric.ProcessesInput(input.Name) {
+				mon.nMatchesByMetric.WithLabelValues(metric.Name(), input.Name).Add(0)
+			}
+		}
+	}
 	for _, metric := range metrics {
-		nMatchesByMetric.WithLabelValues(metric.Name()).Add(0)
-		procTimeMicrosecondsByMetric.WithLabelValues(metric.Name()).Add(0)
-		nErrorsByMetric.WithLabelValues(metric.Name()).Add(0)
+		mon.procTimeMicrosecondsByMetric.WithLabelValues(metric.Name()).Add(0)
+		mon.nErrorsByMetric.WithLabelValues(metric.Name()).Add(0)
+	}
+	if cfg.Global.BufferSpill != nil {
+		mon.linesDropped.WithLabelValues(tailer.DroppedSpillError).Add(0)
+		mon.linesDropped.WithLabelValues(tailer.DroppedSpillLeftover).Add(0)
+	}
+	for _, metric := range cfg.Metrics {
+		if len(metric.Timestamp) > 0 {
+			mon.outOfRangeTimestamps.WithLabelValues(metric.Name, exporter.TimestampOutOfOrder).Add(0)
+			mon.outOfRangeTimestamps.WithLabelValues(metric.Name, exporter.TimestampInFuture).Add(0)
+		}
+	}
+}
+
+// Removes the labels of metrics and inputs that are no longer present after a configuration reload.
+func (mon *selfMonitoring) removeLabels(cfg *v2.Config, metrics []exporter.Metric, newCfg *v2.Config, newMetrics []exporter.Metric) {
+	for _, input := range cfg.InputConfigs() {
+		if !hasInput(newCfg, input.Name) {
+			mon.nLinesTotal.DeleteLabelValues(number_of_lines_matched_label, input.Name)
+			mon.nLinesTotal.DeleteLabelValues(number_of_lines_ignored_label, input.Name)
+		}
+		newInput := findInput(newCfg, input.Name)
+		if newInput == nil || newInput.MaxLineAction != input.MaxLineAction {
+			mon.longLines.DeleteLabelValues(input.Name, input.MaxLineAction)
+		}
+		if newInput == nil || newInput.InvalidUtf8 != input.InvalidUtf8 {
+			mon.invalidUtf8Lines.DeleteLabelValues(input.Name, input.InvalidUtf8)
+		}
+		for _, metric := range metrics {
+			if !hasInput(newCfg, input.Name) || !anyMetricProcessesInput(newMetrics, metric.Name(), input.Name) {
+				mon.nMatchesByMetric.DeleteLabelValues(metric.Name(), input.Name)
+			}
+		}
+	}
+	for _, metric := range metrics {
+		if !hasMetric(newMetrics, metric.Name()) {
+			mon.procTimeMicrosecondsByMetric.DeleteLabelValues(metric.Name())
+			mon.nErrorsByMetric.DeleteLabelValues(metric.Name())
+		}
+	}
+	for _, metric := range cfg.Metrics {
+		if len(metric.Timestamp) > 0 && !hasTimestamp(newCfg, metric.Name) {
+			mon.outOfRangeTimestamps.DeleteLabelValues(metric.Name, exporter.TimestampOutOfOrder)
+			mon.outOfRangeTimestamps.DeleteLabelValues(metric.Name, exporter.TimestampInFuture)
+		}
 	}
-	return nLinesTotal, nMatchesByMetric, procTimeMicrosecondsByMetric, nErrorsByMetric
 }
 
 func startServer(cfg v2.ServerConfig, httpHandlers []exporter.HttpServerPathHandler) chan error {
@@ -291,28 +637,235 @@ func startServer(cfg v2.ServerConfig, httpHandlers []exporter.HttpServerPathHand
 	return serverErrors
 }
 
-func startTailer(cfg *v2.Config) (fswatcher.FileTailer, error) {
+// Starts one tailer for each input, and merges them into a single tailer.
+// For webhook inputs, the returned handlers must be registered with the HTTP server.
+// The process state of command inputs is exposed via mon.
+func startTailers(cfg *v2.Config, patterns *exporter.Patterns, mon *selfMonitoring) (*inputTailers, []exporter.HttpServerPathHandler, error) {
 	logger := logrus.New()
 	logger.Level = logrus.WarnLevel
-	var tail fswatcher.FileTailer
-	g, err := glob.FromPath(cfg.Input.Path)
+	tailers := make(map[string]fswatcher.FileTailer)
+	inputs := make([]fswatcher.FileTailer, 0, len(cfg.InputConfigs()))
+	commandTailers := make(map[string]*tailer.CommandTailer)
+	webhookTailers := make(map[string]*tailer.WebhookTailer)
+	webhookHandlers := []exporter.HttpServerPathHandler{}
+	maxLinesInBuffer := 0
+	bufferOverflowPolicy := ""
+	for i, input := range cfg.InputConfigs() {
+		lineLimits := mon.lineLimits(input)
+		tail, err := startTailer(input, lineLimits, logger)
+		if err != nil {
+			for _, t := range tailers {
+				t.Close()
+			}
+			return nil, nil, err
+		}
+		inputs = append(inputs, tail)
+		if webhookTailer, ok := tail.(*tailer.WebhookTailer); ok {
+			webhookHandlers = append(webhookHandlers, exporter.HttpServerPathHandler{
+				Path:    input.WebhookPath,
+				Handler: webhookTailer})
+			webhookTailers[input.Name] = webhookTailer
+		}
+		if commandTailer, ok := tail.(*tailer.CommandTailer); ok {
+			commandTailers[input.Name] = commandTailer
+		}
+		// File and command inputs apply the limits while reading, other inputs apply them to each line they receive.
+		if input.Type != "file" && input.Type != "command" && (lineLimits.MaxLineBytes > 0 || lineLimits.ValidateUtf8) {
+			tail = tailer.LineLimitTailer(tail, lineLimits)
+		}
+		if input.Multiline != nil {
+			regex, err := exporter.Compile(input.Multiline.Pattern, patterns)
+			if err != nil {
+				tail.Close()
+				for _, t := range tailers {
+					t.Close()
+				}
+				return nil, nil, fmt.Errorf("invalid multiline pattern for input %v: %v", input.Name, err.Error())
+			}
+			tail = tailer.MultilineTailer(tail, input.Multiline, multilineMatcher(regex), regex.Free)
+		}
+		tailers[input.Name] = tail
+		// The lines of all inputs share a single buffer. The limit is unlimited if any input is unlimited.
+		if i == 0 || (maxLinesInBuffer > 0 && input.MaxLinesInBuffer > 0) {
+			maxLinesInBuffer += input.MaxLinesInBuffer
+		} else {
+			maxLinesInBuffer = 0
+		}
+		if input.BufferOverflowPolicy != "" {
+			bufferOverflowPolicy = input.BufferOverflowPolicy // all inputs use the same policy, see config validation
+		}
+	}
+	mon.commands.set(commandTailers)
+	mon.webhookQueues.set(webhookTailers)
+	bufferLoadMetric := exporter.NewBufferLoadMetric(logger, maxLinesInBuffer > 0)
+	bufferLimits := tailer.BufferLimits{
+		MaxLines:       maxLinesInBuffer,
+		OverflowPolicy: bufferOverflowPolicy,
+		OnDrop:         func(reason string, n int) { mon.linesDropped.WithLabelValues(reason).Add(float64(n)) },
+	}
+	if spill := cfg.Global.BufferSpill; spill != nil {
+		bufferLimits.SpillDir = spill.Dir
+		bufferLimits.SpillThreshold = spill.Threshold
+		bufferLimits.SpillSegmentBytes = int64(spill.SegmentBytes)
+	}
+	multiTailer := tailer.MultiTailer(tailers)
+	bufferedTailer, err := tailer.BufferedTailerWithMetrics(multiTailer, bufferLoadMetric, logger, bufferLimits)
 	if err != nil {
-		return nil, err
+		multiTailer.Close()
+		return nil, nil, err
 	}
+	return &inputTailers{FileTailer: bufferedTailer, inputs: inputs}, webhookHandlers, nil
+}
+
+// inputTailers is the tailer created by startTailers(). It merges the lines of all inputs into a single line buffer.
+type inputTailers struct {
+	fswatcher.FileTailer
+	inputs []fswatcher.FileTailer // the inputs without the multiline and line limit tailers
+}
+
+// Stop closes the inputs, which writes the position files. Unlike Close(), Stop() does not drop the lines that were
+// already read: Pending multiline events are flushed, and the lines in the line buffer, including the lines
+// spilled to disk, are still delivered. The lines channel is closed when all lines are delivered.
+// Close() must not be called after Stop().
+func (t *inputTailers) Stop() {
+	for _, input := range t.inputs {
+		input.Close()
+	}
+}
+
+// drainTailers stops the inputs and processes the lines that were already read, so that no line is
+// recorded in a position file without being processed. It returns when all lines are processed.
+func drainTailers(tail *inputTailers, process func(line *fswatcher.Line)) {
+	tail.Stop()
+	errors := tail.Errors()
+	for {
+		select {
+		case line, open := <-tail.Lines():
+			if !open {
+				return
+			}
+			process(line)
+		case <-errors:
+			// Errors after stopping the inputs are ignored, but they must be read so that the tailers can shut down.
+		}
+	}
+}
+
+// multilineMatcher is called in the go-routine of the multiline tailer, while the metrics use Oniguruma in the main
+// go-routine. This is safe, because each multiline tailer compiles its own regex and is the only one using it:
+// Oniguruma is initialized once in the oniguruma package, and after that a regex object may be used in any thread
+// as long as it is not used by multiple threads at the same time. The regex is freed when the tailer's go-routine terminates.
+func multilineMatcher(regex *oniguruma.Regex) func(string) bool {
+	return func(line string) bool {
+		searchResult, err := regex.Search(line)
+		if err != nil {
+			return false
+		}
+		defer searchResult.Free()
+		return searchResult.IsMatch()
+	}
+}
+
+// lineLimits defines how an input handles long lines and invalid UTF-8, and counts these lines.
+func (mon *selfMonitoring) lineLimits(input *v2.InputConfig) fswatcher.LineLimits {
+	limits := fswatcher.LineLimits{
+		MaxLineBytes:      input.MaxLineBytes,
+		SkipLongLines:     input.MaxLineAction == "skip",
+		ValidateUtf8:      input.InvalidUtf8 != "",
+		RejectInvalidUtf8: input.InvalidUtf8 == "reject",
+	}
+	if limits.MaxLineBytes > 0 {
+		limits.OnLongLine = mon.longLines.WithLabelValues(input.Name, input.MaxLineAction).Inc
+	}
+	if limits.ValidateUtf8 {
+		limits.OnInvalidUtf8 = mon.invalidUtf8Lines.WithLabelValues(input.Name, input.InvalidUtf8).Inc
+	}
+	return limits
+}
+
+func startTailer(input *v2.InputConfig, lineLimits fswatcher.LineLimits, logger logrus.FieldLogger) (fswatcher.FileTailer, error) {
+	var (
+		tail fswatcher.FileTailer
+		err  error
+	)
 	switch {
-	case cfg.Input.Type == "file":
-		if cfg.Input.PollInterval == 0 {
-			tail, err = fswatcher.RunFileTailer([]glob.Glob{g}, cfg.Input.Readall, cfg.Input.FailOnMissingLogfile, logger)
-		} else {
-			tail, err = fswatcher.RunPollingFileTailer([]glob.Glob{g}, cfg.Input.Readall, cfg.Input.FailOnMissingLogfile, cfg.Input.PollInterval, logger)
+	case input.Type == "file":
+		var globs []fswatcher.WatchedGlob
+		globs, err = watchedGlobs(input, lineLimits)
+		if err != nil {
+			return nil, err
+		}
+		var positions *fswatcher.PositionFile
+		if len(input.PositionFile) > 0 {
+			positions, err = fswatcher.OpenPositionFile(input.PositionFile, input.PositionFlushInterval, logger)
+			if err != nil {
+				return nil, err
+			}
+		}
+		switch {
+		case input.Mode == "batch":
+			tail, err = fswatcher.RunBatchFileTailer(globs, positions, logger)
+		case input.PollInterval == 0:
+			tail, err = fswatcher.RunFileTailer(globs, positions, logger)
+		default:
+			tail, err = fswatcher.RunPollingFileTailer(globs, input.PollInterval, positions, logger)
+		}
+		if err != nil && positions != nil {
+			positions.Close()
+		}
+	case input.Type == "stdin":
+		tail, err = tailer.RunStdinTailer(input)
+	case input.Type == "webhook":
+		var webhookTailer *tailer.WebhookTailer
+		webhookTailer, err = tailer.InitWebhookTailer(input)
+		if err == nil {
+			tail = webhookTailer
+		}
+	case input.Type == "syslog":
+		tail, err = tailer.RunSyslogTailer(input, logger)
+	case input.Type == "command":
+		var commandTailer *tailer.CommandTailer
+		commandTailer, err = tailer.RunCommandTailer(input, lineLimits, logger)
+		if err == nil {
+			tail = commandTailer
 		}
-	case cfg.Input.Type == "stdin":
-		tail = tailer.RunStdinTailer()
-	case cfg.Input.Type == "webhook":
-		tail = tailer.InitWebhookTailer(&cfg.Input)
 	default:
-		return nil, fmt.Errorf("Config error: Input type '%v' unknown.", cfg.Input.Type)
+		return nil, fmt.Errorf("Config error: Input type '%v' unknown.", input.Type)
+	}
+	return tail, err
+}
+
+// watchedGlobs returns the globs from 'input.path' or 'input.paths'.
+// Options that are not set for an individual path are taken from the input.
+func watchedGlobs(input *v2.InputConfig, lineLimits fswatcher.LineLimits) ([]fswatcher.WatchedGlob, error) {
+	paths := input.Paths
+	if len(input.Path) > 0 {
+		paths = []v2.PathConfig{{Path: input.Path}}
+	}
+	cs, err := charset.Get(input.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]fswatcher.WatchedGlob, 0, len(paths))
+	for _, path := range paths {
+		g, err := glob.Parse(path.Path)
+		if err != nil {
+			return nil, err
+		}
+		watchedGlob := fswatcher.WatchedGlob{
+			Glob:              g,
+			Readall:           input.Readall,
+			FailOnMissingFile: input.FailOnMissingLogfile,
+			LineLimits:        lineLimits,
+			Charset:           cs,
+		}
+		if path.Readall != nil {
+			watchedGlob.Readall = *path.Readall
+		}
+		if path.FailOnMissingLogfile != nil {
+			watchedGlob.FailOnMissingFile = *path.FailOnMissingLogfile
+		}
+		result = append(result, watchedGlob)
 	}
-	bufferLoadMetric := exporter.NewBufferLoadMetric(logger, cfg.Input.MaxLinesInBuffer > 0)
-	return tailer.BufferedTailerWithMetrics(tail, bufferLoadMetric, logger, cfg.Input.MaxLinesInBuffer), nil
+	return result, nil
 }
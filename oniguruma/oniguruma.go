@@ -30,7 +30,7 @@ import (
 	"unsafe"
 )
 
-// TODO: This is the encoding of the logfile. Should be configurable and default to the system encoding.
+// Lines are converted to UTF-8 by the tailers, see 'input.encoding'.
 var encoding = &C.OnigEncodingUTF8 // See the #define statements in oniguruma.h
 
 type Regex struct {
@@ -45,7 +45,8 @@ type SearchResult struct {
 	input  string
 }
 
-// Warning: The Oniguruma library is not thread save, it should be used in a single thread.
+// Warning: The Oniguruma library is initialized once here. After that, different Regex objects may be used
+// in different threads, but a Regex is not thread save and must not be used in multiple threads at the same time.
 func init() {
 	encodings := []C.OnigEncoding{
 		encoding,
@@ -0,0 +1,332 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/fstab/grok_exporter/config"
+	"github.com/fstab/grok_exporter/config/v2"
+	"github.com/fstab/grok_exporter/exporter"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v2"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+const reloadPath = "/-/reload"
+
+// The parts of grok_exporter that may be replaced when the configuration is reloaded.
+type state struct {
+	cfg          *v2.Config
+	metrics      []exporter.Metric
+	fingerprints map[string]string // metric name -> fingerprint, see metricFingerprints()
+	patterns     *exporter.Patterns
+	tail         *inputTailers
+}
+
+// Handles POST requests to /-/reload.
+// The reload is performed in the main loop, the handler waits for the result.
+type reloadHandler struct {
+	requests chan chan error
+}
+
+func (h *reloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST requests allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	result := make(chan error)
+	h.requests <- result
+	err := <-result
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to reload configuration: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// The HTTP server does not support removing handlers. Therefore, the webhook paths are registered once on startup,
+// and the webhookDispatcher forwards the requests to the webhook tailer of the current configuration.
+// The webhookDispatcher also counts the requests by HTTP status code.
+type webhookDispatcher struct {
+	lock       sync.RWMutex
+	registered map[string]bool // paths registered with the HTTP server
+	handlers   map[string]http.Handler
+	requests   *prometheus.CounterVec
+}
+
+func newWebhookDispatcher(handlers []exporter.HttpServerPathHandler, requests *prometheus.CounterVec) *webhookDispatcher {
+	result := &webhookDispatcher{
+		registered: make(map[string]bool),
+		requests:   requests,
+	}
+	for _, handler := range handlers {
+		result.registered[handler.Path] = true
+	}
+	result.set(handlers)
+	return result
+}
+
+func (d *webhookDispatcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.lock.RLock()
+	handler, exists := d.handlers[r.URL.Path]
+	d.lock.RUnlock()
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	if !exists {
+		http.NotFound(recorder, r)
+	} else {
+		handler.ServeHTTP(recorder, r)
+	}
+	d.requests.WithLabelValues(strconv.Itoa(recorder.status)).Inc()
+}
+
+// statusRecorder remembers the status code written by an http.Handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (d *webhookDispatcher) set(handlers []exporter.HttpServerPathHandler) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.handlers = make(map[string]http.Handler, len(handlers))
+	for _, handler := range handlers {
+		d.handlers[handler.Path] = handler.Handler
+	}
+}
+
+func (d *webhookDispatcher) canServe(path string) bool {
+	return d.registered[path]
+}
+
+// reloadConfig reads the config file again and applies the changes:
+//
+// * Metrics with an unchanged definition keep their collectors and label values.
+// * Added, removed, and changed metrics are registered or unregistered.
+// * The tailers are restarted only if the input or 'buffer_spill' configuration changed. This is rejected for stdin inputs.
+// * The regular expressions of metrics that are no longer used are freed.
+//
+// If the new configuration is invalid, the current configuration remains untouched.
+func reloadConfig(s *state, mon *selfMonitoring, webhooks *webhookDispatcher) error {
+	err := applyConfig(s, mon, webhooks)
+	if err != nil {
+		mon.lastReloadSuccessful.Set(0)
+		return err
+	}
+	mon.lastReloadSuccessful.Set(1)
+	fmt.Printf("Reloaded configuration from %v\n", *configPath)
+	return nil
+}
+
+func applyConfig(s *state, mon *selfMonitoring, webhooks *webhookDispatcher) error {
+	newCfg, warn, err := config.LoadConfigFile(*configPath)
+	if len(warn) > 0 {
+		fmt.Fprintf(os.Stderr, "%v\n", warn)
+	}
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(s.cfg.Server, newCfg.Server) {
+		return fmt.Errorf("changing the 'server' configuration requires a restart")
+	}
+	patterns, err := initPatterns(newCfg)
+	if err != nil {
+		return err
+	}
+	newFingerprints, err := metricFingerprints(newCfg, patterns)
+	if err != nil {
+		return err
+	}
+
+	// Create the new list of metrics, keeping the unchanged metrics.
+	var (
+		oldMetrics = make(map[string]exporter.Metric, len(s.metrics))
+		newMetrics = make([]exporter.Metric, 0, len(newCfg.Metrics))
+		added      = make([]exporter.Metric, 0)
+		removed    = make([]exporter.Metric, 0)
+		success    = false
+	)
+	defer func() {
+		// Free the regular expressions of the metrics that are no longer used.
+		discarded := added
+		if success {
+			discarded = removed
+		}
+		for _, m := range discarded {
+			m.Free()
+		}
+	}()
+	for _, m := range s.metrics {
+		oldMetrics[m.Name()] = m
+	}
+	for i, m := range newCfg.Metrics {
+		if old, exists := oldMetrics[m.Name]; exists && s.fingerprints[m.Name] == newFingerprints[m.Name] {
+			newMetrics = append(newMetrics, old)
+			delete(oldMetrics, m.Name)
+			continue
+		}
+		metric, err := createMetric(&newCfg.Metrics[i], patterns, metadataFields(newCfg, &newCfg.Metrics[i]))
+		if err != nil {
+			return err
+		}
+		newMetrics = append(newMetrics, metric)
+		added = append(added, metric)
+	}
+	for _, m := range s.metrics {
+		if _, isRemoved := oldMetrics[m.Name()]; isRemoved {
+			removed = append(removed, m)
+		}
+	}
+
+	// The line buffer is part of the tailers, so they are restarted if the buffer configuration changed.
+	inputsChanged := !equalYaml(s.cfg.InputConfigs(), newCfg.InputConfigs()) || !equalYaml(s.cfg.Global.BufferSpill, newCfg.Global.BufferSpill)
+	if inputsChanged {
+		// A read on stdin cannot be interrupted, so the old stdin tailer would compete with the new one for the input.
+		for _, input := range s.cfg.InputConfigs() {
+			if input.Type == "stdin" {
+				return fmt.Errorf("changing the inputs or 'global.buffer_spill' requires a restart when reading from stdin")
+			}
+		}
+		for _, input := range newCfg.InputConfigs() {
+			if input.Type == "webhook" && !webhooks.canServe(input.WebhookPath) {
+				return fmt.Errorf("adding the new 'webhook_path' %v requires a restart", input.WebhookPath)
+			}
+		}
+	}
+
+	// Apply the changes. If anything fails, roll back.
+	for _, m := range removed {
+		prometheus.Unregister(m.Collector())
+	}
+	rollback := func(nRegistered int) {
+		for _, m := range added[:nRegistered] {
+			prometheus.Unregister(m.Collector())
+		}
+		for _, m := range removed {
+			prometheus.MustRegister(m.Collector())
+		}
+	}
+	for i, m := range added {
+		err = prometheus.Register(m.Collector())
+		if err != nil {
+			rollback(i)
+			return fmt.Errorf("failed to register metric %v: %v", m.Name(), err)
+		}
+	}
+	if inputsChanged {
+		// The lines that were read by the old tailer are processed with the old metrics.
+		drainTailers(s.tail, func(line *fswatcher.Line) {
+			processLine(s.metrics, mon, line)
+		})
+		tail, webhookHandlers, err := startTailers(newCfg, patterns, mon)
+		if err != nil {
+			rollback(len(added))
+			// The old tailer was shut down, so we must start it again.
+			tail, webhookHandlers, restartErr := startTailers(s.cfg, s.patterns, mon)
+			exitOnError(restartErr)
+			s.tail = tail
+			webhooks.set(webhookHandlers)
+			return err
+		}
+		s.tail = tail
+		webhooks.set(webhookHandlers)
+	}
+	mon.removeLabels(s.cfg, s.metrics, newCfg, newMetrics)
+	mon.initLabels(newCfg, newMetrics)
+	s.cfg = newCfg
+	s.metrics = newMetrics
+	s.fingerprints = newFingerprints
+	s.patterns = patterns
+	success = true
+	return nil
+}
+
+// The fingerprint of a metric includes the metric configuration, the expanded regular expressions, and the
+// metadata fields of the inputs processed by the metric, because the label templates are verified against these fields.
+// If the fingerprint does not change, the metric can be kept when the configuration is reloaded.
+// Other input settings do not affect the metric. They are applied by restarting the tailers, see applyConfig().
+func metricFingerprints(cfg *v2.Config, patterns *exporter.Patterns) (map[string]string, error) {
+	result := make(map[string]string, len(cfg.Metrics))
+	for i, m := range cfg.Metrics {
+		metricYaml, err := yaml.Marshal(m)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize metric %v: %v", metricDescription(&m), err.Error())
+		}
+		regex, err := exporter.Expand(m.Match, patterns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize metric %v: %v", metricDescription(&m), err.Error())
+		}
+		deleteRegex, err := exporter.Expand(m.DeleteMatch, patterns)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize metric %v: %v", metricDescription(&m), err.Error())
+		}
+		result[m.Name] = fmt.Sprintf("%s\n%v\n%v\n%v", metricYaml, regex, deleteRegex, metadataFields(cfg, &cfg.Metrics[i]))
+	}
+	return result, nil
+}
+
+func equalYaml(a, b interface{}) bool {
+	aYaml, aErr := yaml.Marshal(a)
+	bYaml, bErr := yaml.Marshal(b)
+	return aErr == nil && bErr == nil && string(aYaml) == string(bYaml)
+}
+
+func hasInput(cfg *v2.Config, name string) bool {
+	return findInput(cfg, name) != nil
+}
+
+// findInput returns nil if there is no input with that name.
+func findInput(cfg *v2.Config, name string) *v2.InputConfig {
+	for _, input := range cfg.InputConfigs() {
+		if input.Name == name {
+			return input
+		}
+	}
+	return nil
+}
+
+func hasMetric(metrics []exporter.Metric, name string) bool {
+	for _, metric := range metrics {
+		if metric.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+func anyMetricProcessesInput(metrics []exporter.Metric, name string, input string) bool {
+	for _, metric := range metrics {
+		if metric.Name() == name && metric.ProcessesInput(input) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasTimestamp(cfg *v2.Config, metricName string) bool {
+	for _, metric := range cfg.Metrics {
+		if metric.Name == metricName {
+			return len(metric.Timestamp) > 0
+		}
+	}
+	return false
+}
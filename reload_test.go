@@ -0,0 +1,273 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/fstab/grok_exporter/config"
+	"github.com/fstab/grok_exporter/exporter"
+	"github.com/prometheus/client_golang/prometheus"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const reloadConfigTemplate = `
+global:
+    config_version: 2
+input:
+    type: file
+    path: {{LOGFILE}}
+grok:
+    additional_patterns:
+    - 'WORD \b\w+\b'
+metrics:
+{{METRICS}}
+`
+
+const (
+	reloadMetricA = `
+    - type: counter
+      name: test_reload_a_total
+      help: Metric a.
+      match: 'a'
+`
+	reloadMetricAChanged = `
+    - type: counter
+      name: test_reload_a_total
+      help: Metric a.
+      match: 'a %{WORD}'
+`
+	reloadMetricB = `
+    - type: counter
+      name: test_reload_b_total
+      help: Metric b.
+      match: 'b'
+`
+	reloadMetricC = `
+    - type: counter
+      name: test_reload_c_total
+      help: Metric c.
+      match: 'c'
+`
+)
+
+func TestReloadAddMetric(t *testing.T) {
+	r := startReloadTest(t, reloadMetricA)
+	defer r.close()
+	a := r.metric(t, "test_reload_a_total")
+
+	r.apply(t, reloadMetricA+reloadMetricB)
+	if len(r.s.metrics) != 2 {
+		t.Fatalf("expected 2 metrics, but got %v", len(r.s.metrics))
+	}
+	if r.metric(t, "test_reload_a_total") != a {
+		t.Fatalf("unchanged metric was replaced")
+	}
+	if !isRegistered(r.metric(t, "test_reload_b_total")) {
+		t.Fatalf("added metric was not registered")
+	}
+}
+
+func TestReloadRemoveMetric(t *testing.T) {
+	r := startReloadTest(t, reloadMetricA+reloadMetricB)
+	defer r.close()
+	a := r.metric(t, "test_reload_a_total")
+	b := r.metric(t, "test_reload_b_total")
+
+	r.apply(t, reloadMetricA)
+	if len(r.s.metrics) != 1 || r.s.metrics[0] != a {
+		t.Fatalf("expected the unchanged metric a only")
+	}
+	if isRegistered(b) {
+		t.Fatalf("removed metric is still registered")
+	}
+}
+
+func TestReloadChangeMetric(t *testing.T) {
+	r := startReloadTest(t, reloadMetricA)
+	defer r.close()
+	a := r.metric(t, "test_reload_a_total")
+
+	r.apply(t, reloadMetricAChanged)
+	changed := r.metric(t, "test_reload_a_total")
+	if changed == a {
+		t.Fatalf("changed metric was not replaced")
+	}
+	if !isRegistered(changed) {
+		t.Fatalf("changed metric was not registered")
+	}
+}
+
+func TestReloadRegistrationFails(t *testing.T) {
+	r := startReloadTest(t, reloadMetricA)
+	defer r.close()
+	a := r.metric(t, "test_reload_a_total")
+	oldCfg := r.s.cfg
+
+	// A collector with the same name, but a different help text, makes the registration of metric c fail.
+	// The registry remembers the help text even after a metric is unregistered, so metric c is not used in other tests.
+	conflict := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_reload_c_total", Help: "Conflict."})
+	prometheus.MustRegister(conflict)
+	defer prometheus.Unregister(conflict)
+
+	writeReloadConfig(t, r.dir, r.logfile, reloadMetricC)
+	err := applyConfig(r.s, r.mon, r.webhooks)
+	if err == nil || !strings.Contains(err.Error(), "failed to register metric test_reload_c_total") {
+		t.Fatalf("expected registration error, but got %v", err)
+	}
+	if r.s.cfg != oldCfg || len(r.s.metrics) != 1 || r.s.metrics[0] != a {
+		t.Fatalf("the state was modified even though the reload failed")
+	}
+	if !isRegistered(a) {
+		t.Fatalf("removed metric was not registered again after the reload failed")
+	}
+}
+
+func TestReloadStdinInputChanged(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	stdinConfig := strings.Replace(reloadConfigString("", reloadMetricA), "type: file\n    path: \n", "type: stdin\n", 1)
+	cfg, patterns, metrics := loadTestConfig(t, stdinConfig)
+	defer unregisterAll(metrics)
+	fingerprints, err := metricFingerprints(cfg, patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &state{
+		cfg:          cfg,
+		metrics:      metrics,
+		fingerprints: fingerprints,
+		patterns:     patterns,
+	}
+	mon := testSelfMonitoring(cfg, metrics)
+
+	// The stdin tailer cannot be restarted, so the reload fails before the tailer is touched.
+	*configPath = writeReloadConfig(t, dir, filepath.Join(dir, "test.log"), reloadMetricA)
+	err = applyConfig(s, mon, newWebhookDispatcher(nil, mon.webhookRequests))
+	if err == nil || !strings.Contains(err.Error(), "requires a restart when reading from stdin") {
+		t.Fatalf("expected error when changing the inputs while reading from stdin, but got %v", err)
+	}
+	if s.cfg != cfg {
+		t.Fatalf("the state was modified even though the reload failed")
+	}
+}
+
+func TestReloadFingerprintIncludesMetadataFields(t *testing.T) {
+	fingerprint := func(input string) string {
+		cfgString := strings.Replace(reloadConfigString("/tmp/test.log", reloadMetricA), "input:\n    type: file\n    path: /tmp/test.log\n", input, 1)
+		cfg, _, err := config.LoadConfigString([]byte(cfgString))
+		if err != nil {
+			t.Fatal(err)
+		}
+		patterns, err := initPatterns(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fingerprints, err := metricFingerprints(cfg, patterns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fingerprints["test_reload_a_total"]
+	}
+	file := fingerprint("input:\n    type: file\n    path: /tmp/test.log\n")
+	otherFile := fingerprint("input:\n    type: file\n    path: /tmp/other.log\n")
+	syslog := fingerprint("input:\n    type: syslog\n    syslog_udp_address: localhost:5514\n")
+	if file != otherFile {
+		t.Fatalf("changing the path of a file input must not change the metric")
+	}
+	if file == syslog {
+		t.Fatalf("the syslog metadata fields must change the metric")
+	}
+}
+
+type reloadTest struct {
+	dir      string
+	logfile  string
+	s        *state
+	mon      *selfMonitoring
+	webhooks *webhookDispatcher
+}
+
+func startReloadTest(t *testing.T, metrics string) *reloadTest {
+	dir := tempDir(t)
+	logfile := writeFile(t, dir, "test.log", "")
+	*configPath = writeReloadConfig(t, dir, logfile, metrics)
+	cfg, patterns, registeredMetrics := loadTestConfig(t, reloadConfigString(logfile, metrics))
+	fingerprints, err := metricFingerprints(cfg, patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mon := testSelfMonitoring(cfg, registeredMetrics)
+	tail, _, err := startTailers(cfg, patterns, mon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &reloadTest{
+		dir:     dir,
+		logfile: logfile,
+		s: &state{
+			cfg:          cfg,
+			metrics:      registeredMetrics,
+			fingerprints: fingerprints,
+			patterns:     patterns,
+			tail:         tail,
+		},
+		mon:      mon,
+		webhooks: newWebhookDispatcher(nil, mon.webhookRequests),
+	}
+}
+
+func (r *reloadTest) apply(t *testing.T, metrics string) {
+	writeReloadConfig(t, r.dir, r.logfile, metrics)
+	err := applyConfig(r.s, r.mon, r.webhooks)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (r *reloadTest) metric(t *testing.T, name string) exporter.Metric {
+	for _, m := range r.s.metrics {
+		if m.Name() == name {
+			return m
+		}
+	}
+	t.Fatalf("%v: metric not found", name)
+	return nil
+}
+
+func (r *reloadTest) close() {
+	r.s.tail.Close()
+	unregisterAll(r.s.metrics)
+	os.RemoveAll(r.dir)
+}
+
+func writeReloadConfig(t *testing.T, dir, logfile, metrics string) string {
+	return writeFile(t, dir, "config.yml", reloadConfigString(logfile, metrics))
+}
+
+func reloadConfigString(logfile, metrics string) string {
+	return strings.NewReplacer("{{LOGFILE}}", logfile, "{{METRICS}}", metrics).Replace(reloadConfigTemplate)
+}
+
+func isRegistered(m exporter.Metric) bool {
+	err := prometheus.Register(m.Collector())
+	if err == nil {
+		prometheus.Unregister(m.Collector())
+		return false
+	}
+	_, isAlreadyRegistered := err.(prometheus.AlreadyRegisteredError)
+	return isAlreadyRegistered
+}
@@ -17,13 +17,15 @@ package tailer
 import (
 	"github.com/fstab/grok_exporter/tailer/fswatcher"
 	"github.com/sirupsen/logrus"
+	"time"
 )
 
 // implements fswatcher.FileTailer
 type bufferedTailer struct {
-	out  chan *fswatcher.Line
-	orig fswatcher.FileTailer
-	done chan struct{}
+	out     chan *fswatcher.Line
+	orig    fswatcher.FileTailer
+	done    chan struct{}
+	stopped chan struct{} // closed when the producer terminated and the buffer load metric is unregistered
 }
 
 func (b *bufferedTailer) Lines() chan *fswatcher.Line {
@@ -34,13 +36,45 @@ func (b *bufferedTailer) Errors() chan fswatcher.Error {
 	return b.orig.Errors()
 }
 
+// Close closes the original tailer and drops the buffered lines. Close returns when the buffer load metric
+// is unregistered, so that a new buffered tailer can register its metric right away.
+// The original tailer must close its lines channel when it is closed.
 func (b *bufferedTailer) Close() {
 	b.orig.Close()
 	close(b.done)
+	<-b.stopped
 }
 
 func BufferedTailer(orig fswatcher.FileTailer) fswatcher.FileTailer {
-	return BufferedTailerWithMetrics(orig, &noopMetric{}, logrus.New(), 0)
+	result, _ := BufferedTailerWithMetrics(orig, &noopMetric{}, logrus.New(), BufferLimits{}) // no error without SpillDir
+	return result
+}
+
+// Policies for when the line buffer reaches BufferLimits.MaxLines.
+const (
+	DropAll    = "drop_all"    // remove all lines from the buffer
+	DropOldest = "drop_oldest" // remove the oldest line from the buffer
+	DropNewest = "drop_newest" // discard the new line
+	Block      = "block"       // stop reading from the input until the consumer has processed a line
+)
+
+// Reasons for dropping lines, see BufferLimits.OnDrop.
+const (
+	DroppedBufferFull    = "buffer_full"    // dropped according to the OverflowPolicy
+	DroppedSpillError    = "spill_error"    // failed to write or read a spill segment
+	DroppedSpillLeftover = "spill_leftover" // spill segment left over from a previous run
+)
+
+// BufferLimits defines the maximum number of lines in the buffer, and what happens when the buffer is full.
+// If SpillDir is set, lines exceeding SpillThreshold are kept in segment files on disk instead of in memory.
+// MaxLines includes the lines on disk.
+type BufferLimits struct {
+	MaxLines          int    // 0 means unlimited
+	OverflowPolicy    string // one of DropAll, DropOldest, DropNewest, Block. Empty means DropAll.
+	OnDrop            func(reason string, n int)
+	SpillDir          string
+	SpillThreshold    int   // number of lines in memory
+	SpillSegmentBytes int64 // a new segment file is started when a segment reaches this size
 }
 
 // Wrapper around a tailer that consumes the lines channel quickly.
@@ -102,27 +136,69 @@ func BufferedTailer(orig fswatcher.FileTailer) fswatcher.FileTailer {
 //
 // To minimize the risk, use the buffered tailer to make sure file system events are handled
 // as quickly as possible without waiting for the grok patterns to be processed.
-func BufferedTailerWithMetrics(orig fswatcher.FileTailer, bufferLoadMetric BufferLoadMetric, log logrus.FieldLogger, maxLinesInBuffer int) fswatcher.FileTailer {
+//
+// If the buffer reaches limits.MaxLines, lines are dropped or the input is paused according to limits.OverflowPolicy.
+func BufferedTailerWithMetrics(orig fswatcher.FileTailer, bufferLoadMetric BufferLoadMetric, log logrus.FieldLogger, limits BufferLimits) (fswatcher.FileTailer, error) {
+	if limits.OnDrop == nil {
+		limits.OnDrop = func(string, int) {}
+	}
 	buffer := NewLineBuffer()
+	if len(limits.SpillDir) > 0 {
+		spillBuffer, err := newSpillBuffer(limits, bufferLoadMetric.SetSpillBytes, log)
+		if err != nil {
+			return nil, err
+		}
+		buffer = spillBuffer
+	}
 	out := make(chan *fswatcher.Line)
 	done := make(chan struct{})
+	stopped := make(chan struct{})
+	onDrop := func(n int) {
+		limits.OnDrop(DroppedBufferFull, n)
+	}
 
 	// producer
 	go func() {
+		defer close(stopped)
 		bufferLoadMetric.Start()
+		full := false // log only once until the buffer has space again
 		for {
 			line, ok := <-orig.Lines()
 			if ok {
-				if maxLinesInBuffer > 0 && buffer.Len() > maxLinesInBuffer-1 {
-					log.Warnf("Line buffer reached limit of %v lines. Dropping lines in buffer.", maxLinesInBuffer)
-					buffer.Clear()
-					bufferLoadMetric.Set(0)
+				if line.Time.IsZero() {
+					line.Time = time.Now()
+				}
+				if limits.MaxLines > 0 && buffer.Len() >= limits.MaxLines {
+					if !full {
+						log.Warnf("Line buffer reached limit of %v lines. %v", limits.MaxLines, overflowMessage(limits.OverflowPolicy))
+						full = true
+					}
+					switch limits.OverflowPolicy {
+					case DropOldest:
+						if buffer.Pop() != nil {
+							bufferLoadMetric.Dec()
+							onDrop(1)
+						}
+					case DropNewest:
+						onDrop(1)
+						continue
+					case Block:
+						buffer.WaitForSpace(limits.MaxLines)
+					default:
+						onDrop(buffer.Clear())
+						bufferLoadMetric.Set(0)
+					}
+				} else {
+					full = false
 				}
 				buffer.Push(line)
 				bufferLoadMetric.Inc()
 			} else {
-				buffer.Close()
+				// Stop the metric before closing the buffer, so that the metric is unregistered
+				// when the consumer closes the lines channel. A new buffered tailer can then register
+				// its metric without conflicts, for example when the configuration is reloaded.
 				bufferLoadMetric.Stop()
+				buffer.Close()
 				return
 			}
 		}
@@ -141,28 +217,46 @@ func BufferedTailerWithMetrics(orig fswatcher.FileTailer, bufferLoadMetric Buffe
 			select {
 			case out <- line:
 			case <-done:
+				// The remaining lines will be dropped anyway, so we don't need to read spilled lines from disk.
+				buffer.Clear()
 			}
 		}
 	}()
 	return &bufferedTailer{
-		out:  out,
-		orig: orig,
-		done: done,
+		out:     out,
+		orig:    orig,
+		done:    done,
+		stopped: stopped,
+	}, nil
+}
+
+func overflowMessage(policy string) string {
+	switch policy {
+	case DropOldest:
+		return "Dropping the oldest lines."
+	case DropNewest:
+		return "Dropping new lines."
+	case Block:
+		return "Pausing the input until lines are processed."
+	default:
+		return "Dropping lines in buffer."
 	}
 }
 
 type BufferLoadMetric interface {
 	Start()
-	Inc()            // put a log line into the buffer
-	Dec()            // take a log line from the buffer
-	Set(value int64) // set the current number of lines in the buffer
+	Inc()                      // put a log line into the buffer
+	Dec()                      // take a log line from the buffer
+	Set(value int64)           // set the current number of lines in the buffer
+	SetSpillBytes(bytes int64) // set the size of the spill segments on disk
 	Stop()
 }
 
 type noopMetric struct{}
 
-func (m *noopMetric) Start()          {}
-func (m *noopMetric) Inc()            {}
-func (m *noopMetric) Dec()            {}
-func (m *noopMetric) Set(value int64) {}
-func (m *noopMetric) Stop()           {}
+func (m *noopMetric) Start()                    {}
+func (m *noopMetric) Inc()                      {}
+func (m *noopMetric) Dec()                      {}
+func (m *noopMetric) Set(value int64)           {}
+func (m *noopMetric) SetSpillBytes(bytes int64) {}
+func (m *noopMetric) Stop()                     {}
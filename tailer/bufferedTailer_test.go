@@ -18,7 +18,9 @@ import (
 	"fmt"
 	"github.com/fstab/grok_exporter/tailer/fswatcher"
 	"github.com/sirupsen/logrus"
+	"io/ioutil"
 	"math/rand"
+	"os"
 	"sync"
 	"testing"
 	"time"
@@ -48,7 +50,10 @@ func (tail *sourceTailer) Close() {
 func TestLineBufferSequential_withMetrics(t *testing.T) {
 	src := &sourceTailer{lines: make(chan *fswatcher.Line)}
 	metric := &peakLoadMetric{}
-	buffered := BufferedTailerWithMetrics(src, metric, log, 0)
+	buffered, err := BufferedTailerWithMetrics(src, metric, log, BufferLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
 	for i := 1; i <= nTestLines; i++ {
 		src.lines <- &fswatcher.Line{Line: fmt.Sprintf("This is line number %v.", i)}
 	}
@@ -82,7 +87,10 @@ func TestLineBufferSequential_withMetrics(t *testing.T) {
 func TestLineBufferParallel_withMetrics(t *testing.T) {
 	src := &sourceTailer{lines: make(chan *fswatcher.Line)}
 	metric := &peakLoadMetric{}
-	buffered := BufferedTailerWithMetrics(src, metric, log, 0)
+	buffered, err := BufferedTailerWithMetrics(src, metric, log, BufferLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
 	var wg sync.WaitGroup
 	go func() {
 		start := time.Now()
@@ -157,6 +165,157 @@ func (m *peakLoadMetric) Set(value int64) {
 	m.currentLoad = value
 }
 
+func (m *peakLoadMetric) SetSpillBytes(bytes int64) {}
+
 func (m *peakLoadMetric) Stop() {
 	m.stopCalled = true
 }
+
+func TestBufferOverflowPolicies(t *testing.T) {
+	for _, policy := range []string{DropAll, DropOldest, DropNewest, Block} {
+		var (
+			src     = &sourceTailer{lines: make(chan *fswatcher.Line)}
+			dropped = 0
+			limits  = BufferLimits{
+				MaxLines:       3,
+				OverflowPolicy: policy,
+				OnDrop:         func(reason string, n int) { dropped += n },
+			}
+		)
+		buffered, err := BufferedTailerWithMetrics(src, &noopMetric{}, log, limits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent := make(chan struct{})
+		go func() {
+			for i := 1; i <= 10; i++ {
+				src.lines <- &fswatcher.Line{Line: fmt.Sprintf("line %v", i)}
+			}
+			close(src.lines)
+			close(sent)
+		}()
+		if policy != Block {
+			<-sent // the buffer overflows, because no lines are consumed until all lines are sent
+		}
+		var received []string
+		for line := range buffered.Lines() {
+			received = append(received, line.Line)
+		}
+		if len(received)+dropped != 10 {
+			t.Fatalf("%v: received %v lines and dropped %v lines, expected 10 lines in total: %v", policy, len(received), dropped, received)
+		}
+		assertIncreasing(t, policy, received)
+		switch policy {
+		case Block:
+			if dropped != 0 {
+				t.Fatalf("%v: expected no dropped lines, but got %v", policy, dropped)
+			}
+		case DropNewest:
+			if dropped == 0 || received[2] != "line 3" {
+				t.Fatalf("%v: expected the first lines, but got %v", policy, received)
+			}
+		case DropOldest:
+			if dropped == 0 || received[len(received)-3] != "line 8" {
+				t.Fatalf("%v: expected the last lines, but got %v", policy, received)
+			}
+		case DropAll:
+			if dropped == 0 || received[len(received)-1] != "line 10" {
+				t.Fatalf("%v: expected the last lines, but got %v", policy, received)
+			}
+		}
+	}
+}
+
+// Closing a tailer that is blocked because the buffer is full must close the lines channel.
+func TestCloseBlockedTailer(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line, 10)}
+	for i := 1; i <= 10; i++ {
+		src.lines <- &fswatcher.Line{Line: fmt.Sprintf("line %v", i)}
+	}
+	limits := BufferLimits{
+		MaxLines:       3,
+		OverflowPolicy: Block,
+	}
+	buffered, err := BufferedTailerWithMetrics(src, &noopMetric{}, log, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The consumer holds line 1, lines 2 - 4 are in the buffer, and the producer waits with line 5.
+	for len(src.lines) > 5 {
+		time.Sleep(time.Millisecond)
+	}
+	buffered.Close()
+	closed := make(chan struct{})
+	go func() {
+		for range buffered.Lines() {
+		}
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Lines() was not closed after Close()")
+	}
+}
+
+func assertIncreasing(t *testing.T, policy string, received []string) {
+	last := 0
+	for _, line := range received {
+		var n int
+		fmt.Sscanf(line, "line %d", &n)
+		if n <= last {
+			t.Fatalf("%v: lines out of order: %v", policy, received)
+		}
+		last = n
+	}
+}
+
+func TestBufferedTailerWithSpill(t *testing.T) {
+	dir := spillDir(t)
+	defer os.RemoveAll(dir)
+	var (
+		src    = &sourceTailer{lines: make(chan *fswatcher.Line)}
+		metric = &spillBytesMetric{}
+		limits = BufferLimits{
+			OnDrop:            func(reason string, n int) { t.Errorf("Unexpected %v dropped lines with reason %v", n, reason) },
+			SpillDir:          dir,
+			SpillThreshold:    10,
+			SpillSegmentBytes: 4096,
+		}
+	)
+	buffered, err := BufferedTailerWithMetrics(src, metric, log, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= nTestLines; i++ {
+		src.lines <- &fswatcher.Line{Line: fmt.Sprintf("This is line number %v.", i)}
+	}
+	for i := 1; i <= nTestLines; i++ {
+		line := <-buffered.Lines()
+		if line.Line != fmt.Sprintf("This is line number %v.", i) {
+			t.Fatalf("Expected 'This is line number %v', but got '%v'.", i, line)
+		}
+	}
+	buffered.Close()
+	for range buffered.Lines() {
+	}
+	if metric.max == 0 || metric.current != 0 {
+		t.Fatalf("Expected lines to be spilled and spill segments to be deleted, but got max %v bytes and current %v bytes", metric.max, metric.current)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("Expected spill directory to be empty, but found %v files", len(files))
+	}
+}
+
+type spillBytesMetric struct {
+	noopMetric
+	current, max int64
+}
+
+// SetSpillBytes is called with the buffer's lock held, so no additional synchronization is needed.
+func (m *spillBytesMetric) SetSpillBytes(bytes int64) {
+	m.current = bytes
+	if m.max < bytes {
+		m.max = bytes
+	}
+}
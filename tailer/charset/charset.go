@@ -0,0 +1,162 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package charset converts log lines from the character encoding of the input to UTF-8,
+// which is the encoding used for pattern matching and label values.
+package charset
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+	"io"
+	"strings"
+)
+
+// Charset is a character encoding other than UTF-8.
+type Charset struct {
+	name           string
+	encoding       encoding.Encoding // decodes a single line, without byte order mark
+	streamEncoding encoding.Encoding // decodes a stream, with byte order mark detection
+	cr, lf         []byte            // encoded '\r' and '\n'
+	bom            []byte            // byte order mark, nil if the charset doesn't have one
+	otherByteOrder *Charset          // the charset with the other byte order, nil if the charset doesn't have a byte order
+}
+
+var (
+	utf16le = &Charset{
+		name:           "utf-16le",
+		encoding:       unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM),
+		streamEncoding: unicode.UTF16(unicode.LittleEndian, unicode.UseBOM),
+		cr:             []byte{'\r', 0},
+		lf:             []byte{'\n', 0},
+		bom:            []byte{0xFF, 0xFE},
+	}
+	utf16be = &Charset{
+		name:           "utf-16be",
+		encoding:       unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM),
+		streamEncoding: unicode.UTF16(unicode.BigEndian, unicode.UseBOM),
+		cr:             []byte{0, '\r'},
+		lf:             []byte{0, '\n'},
+		bom:            []byte{0xFE, 0xFF},
+	}
+	latin1      = singleByte("iso-8859-1", charmap.ISO8859_1)
+	windows1252 = singleByte("windows-1252", charmap.Windows1252)
+	shiftJis    = singleByte("shift_jis", japanese.ShiftJIS) // '\r' and '\n' are single bytes that are never part of a double-byte character
+)
+
+func init() {
+	utf16le.otherByteOrder = utf16be
+	utf16be.otherByteOrder = utf16le
+}
+
+func singleByte(name string, e encoding.Encoding) *Charset {
+	return &Charset{
+		name:           name,
+		encoding:       e,
+		streamEncoding: e,
+		cr:             []byte{'\r'},
+		lf:             []byte{'\n'},
+	}
+}
+
+// Names lists the supported encodings for error messages and documentation.
+const Names = "utf-8|utf-16le|utf-16be|iso-8859-1|windows-1252|shift_jis"
+
+// Get returns the charset for the name in 'input.encoding'. Names are case insensitive.
+// The result is nil for UTF-8, because UTF-8 lines are not converted.
+func Get(name string) (*Charset, error) {
+	switch strings.ToLower(name) {
+	case "", "utf-8", "utf8":
+		return nil, nil
+	case "utf-16le":
+		return utf16le, nil
+	case "utf-16be":
+		return utf16be, nil
+	case "iso-8859-1", "latin1", "latin-1":
+		return latin1, nil
+	case "windows-1252", "cp1252":
+		return windows1252, nil
+	case "shift_jis", "shift-jis", "sjis":
+		return shiftJis, nil
+	default:
+		return nil, fmt.Errorf("unsupported encoding '%v', supported encodings are %v", name, Names)
+	}
+}
+
+func (c *Charset) String() string {
+	return c.name
+}
+
+// IndexNewline returns the position of the first encoded '\n' in b, or -1 if there is none.
+// For UTF-16, only positions at character boundaries are considered.
+func (c *Charset) IndexNewline(b []byte) int {
+	step := len(c.lf)
+	if step == 1 {
+		return bytes.IndexByte(b, '\n')
+	}
+	for i := 0; i+step <= len(b); i += step {
+		if bytes.Equal(b[i:i+step], c.lf) {
+			return i
+		}
+	}
+	return -1
+}
+
+// NewlineLen is the number of bytes of an encoded '\n'.
+func (c *Charset) NewlineLen() int {
+	return len(c.lf)
+}
+
+// TrimCR removes an encoded '\r' at the end of the line.
+func (c *Charset) TrimCR(line []byte) []byte {
+	return bytes.TrimSuffix(line, c.cr)
+}
+
+// Truncate cuts the encoded line to at most maxBytes without splitting a UTF-16 code unit.
+// A double-byte Shift_JIS character may be split, the rest is removed when the line is decoded.
+func (c *Charset) Truncate(line []byte, maxBytes int) []byte {
+	if len(line) <= maxBytes {
+		return line
+	}
+	return line[:maxBytes-maxBytes%len(c.lf)]
+}
+
+// DetectBOM checks if b starts with a byte order mark. The result is the charset for the byte order,
+// and the length of the byte order mark, which is 0 if there is none.
+func (c *Charset) DetectBOM(b []byte) (*Charset, int) {
+	switch {
+	case c.bom != nil && bytes.HasPrefix(b, c.bom):
+		return c, len(c.bom)
+	case c.otherByteOrder != nil && bytes.HasPrefix(b, c.otherByteOrder.bom):
+		return c.otherByteOrder, len(c.otherByteOrder.bom)
+	default:
+		return c, 0
+	}
+}
+
+// Decode converts a line to UTF-8. Bytes that are not valid in the charset are replaced with U+FFFD.
+func (c *Charset) Decode(line []byte) ([]byte, error) {
+	return c.encoding.NewDecoder().Bytes(line)
+}
+
+// NewReader converts a stream to UTF-8. For UTF-16, a byte order mark at the beginning of the stream
+// overrides the byte order.
+func (c *Charset) NewReader(r io.Reader) io.Reader {
+	return transform.NewReader(r, c.streamEncoding.NewDecoder())
+}
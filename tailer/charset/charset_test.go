@@ -0,0 +1,69 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package charset
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	for name, expected := range map[string]*Charset{
+		"":           nil,
+		"UTF-8":      nil,
+		"UTF-16LE":   utf16le,
+		"utf-16be":   utf16be,
+		"latin1":     latin1,
+		"ISO-8859-1": latin1,
+		"cp1252":     windows1252,
+		"Shift_JIS":  shiftJis,
+	} {
+		cs, err := Get(name)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", name, err)
+		}
+		if cs != expected {
+			t.Fatalf("%v: expected %v, but got %v", name, expected, cs)
+		}
+	}
+	if _, err := Get("utf-32"); err == nil {
+		t.Fatalf("expected error for unsupported encoding")
+	}
+}
+
+func TestIndexNewline(t *testing.T) {
+	// '\n' at an odd position is the second byte of U+0A0A, not a newline.
+	if pos := utf16le.IndexNewline([]byte("\x0a\x0a\n\x00")); pos != 2 {
+		t.Fatalf("expected newline at position 2, but got %v", pos)
+	}
+	if pos := utf16be.IndexNewline([]byte("\x00a\x0a")); pos != -1 {
+		t.Fatalf("expected no newline, but got %v", pos)
+	}
+	if pos := shiftJis.IndexNewline([]byte("\x93\xfa\n")); pos != 2 {
+		t.Fatalf("expected newline at position 2, but got %v", pos)
+	}
+}
+
+func TestNewReader(t *testing.T) {
+	// The byte order mark overrides the byte order of the charset.
+	result, err := ioutil.ReadAll(utf16be.NewReader(strings.NewReader("\xff\xfeh\x00\xe9\x00\n\x00")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "hé\n" {
+		t.Fatalf("expected \"hé\\n\", but got %q", result)
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/fstab/grok_exporter/config/v2"
+	"github.com/fstab/grok_exporter/tailer/charset"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	osexec "os/exec" // the tests in this package declare a function exec()
+	"sync"
+	"time"
+)
+
+// CommandTailer runs the command of a command input, and sends each line the command writes to stdout.
+// Lines written to stderr are logged. The command is restarted according to the input's restart policy.
+// implements fswatcher.FileTailer
+type CommandTailer struct {
+	lines   chan *fswatcher.Line
+	errors  chan fswatcher.Error
+	done    chan struct{}
+	input   *v2.InputConfig
+	limits  fswatcher.LineLimits
+	charset *charset.Charset // encoding of stdout, nil for UTF-8
+	logger  logrus.FieldLogger
+
+	lock         sync.Mutex
+	process      *os.Process // nil if the command is not running
+	startTime    time.Time   // start time of the running process
+	restarts     int
+	lastExitCode int
+	exited       bool // true if the command terminated at least once
+	closed       bool
+}
+
+// CommandStats is the state of the command's process.
+type CommandStats struct {
+	Running      bool
+	Uptime       time.Duration // time since the running process was started, zero if the command is not running
+	Restarts     int
+	LastExitCode int  // -1 if the process was killed by a signal or could not be started
+	Exited       bool // false if the command did not terminate yet, LastExitCode is undefined in that case
+}
+
+func (t *CommandTailer) Lines() chan *fswatcher.Line {
+	return t.lines
+}
+
+func (t *CommandTailer) Errors() chan fswatcher.Error {
+	return t.errors
+}
+
+// Close terminates the tailer and kills the command's process.
+func (t *CommandTailer) Close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return
+	}
+	t.closed = true
+	close(t.done)
+	if t.process != nil {
+		t.process.Kill()
+	}
+}
+
+func (t *CommandTailer) Stats() CommandStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	result := CommandStats{
+		Running:      t.process != nil,
+		Restarts:     t.restarts,
+		LastExitCode: t.lastExitCode,
+		Exited:       t.exited,
+	}
+	if result.Running {
+		result.Uptime = time.Since(t.startTime)
+	}
+	return result
+}
+
+// RunCommandTailer starts the command configured in input. An error is returned if the executable is not found,
+// errors after the command was started are handled by the restart policy.
+// Long lines and invalid UTF-8 are handled as defined in limits while stdout is read, like for files.
+func RunCommandTailer(input *v2.InputConfig, limits fswatcher.LineLimits, logger logrus.FieldLogger) (*CommandTailer, error) {
+	if _, err := osexec.LookPath(input.Command[0]); err != nil {
+		return nil, fmt.Errorf("failed to start command for input %v: %v", input.Name, err)
+	}
+	cs, err := charset.Get(input.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	t := &CommandTailer{
+		lines:   make(chan *fswatcher.Line),
+		errors:  make(chan fswatcher.Error),
+		done:    make(chan struct{}),
+		input:   input,
+		limits:  limits,
+		charset: cs,
+		logger:  logger.WithField("input", input.Name),
+	}
+	go t.run()
+	return t, nil
+}
+
+// run starts the command and restarts it according to the restart policy. The lines and errors channels
+// are closed when the tailer is closed.
+func (t *CommandTailer) run() {
+	defer close(t.errors)
+	defer close(t.lines)
+	delay := t.input.CommandRestartDelay
+	for {
+		startTime := time.Now()
+		exitCode, err := t.runProcess()
+		if t.isClosed() {
+			return
+		}
+		t.lock.Lock()
+		t.lastExitCode = exitCode
+		t.exited = true
+		t.lock.Unlock()
+		if err != nil {
+			t.logger.Warnf("%v", err)
+		}
+		if t.input.CommandRestart == "never" || (t.input.CommandRestart == "on_failure" && exitCode == 0) {
+			t.logger.Warnf("%v terminated with exit code %v, not restarting", t.input.Command[0], exitCode)
+			<-t.done
+			return
+		}
+		if time.Since(startTime) > t.input.CommandRestartMaxDelay {
+			// The process ran for a while, so this is not a restart loop.
+			delay = t.input.CommandRestartDelay
+		}
+		t.logger.Warnf("%v terminated with exit code %v, restarting in %v", t.input.Command[0], exitCode, delay)
+		select {
+		case <-t.done:
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > t.input.CommandRestartMaxDelay {
+			delay = t.input.CommandRestartMaxDelay
+		}
+		t.lock.Lock()
+		t.restarts++
+		t.lock.Unlock()
+	}
+}
+
+// runProcess runs the command until it terminates, and returns the exit code.
+func (t *CommandTailer) runProcess() (int, error) {
+	cmd := osexec.Command(t.input.Command[0], t.input.Command[1:]...)
+	cmd.Dir = t.input.CommandDir
+	cmd.Env = os.Environ()
+	for name, value := range t.input.CommandEnv {
+		cmd.Env = append(cmd.Env, name+"="+value)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return -1, fmt.Errorf("failed to start %v: %v", t.input.Command[0], err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return -1, fmt.Errorf("failed to start %v: %v", t.input.Command[0], err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		return -1, fmt.Errorf("failed to start %v: %v", t.input.Command[0], err)
+	}
+	if !t.started(cmd.Process) {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return -1, nil
+	}
+	defer t.stopped()
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		t.logStderr(stderr)
+	}()
+	t.sendLines(stdout)
+	select {
+	case <-stderrDone:
+	case <-t.done:
+	}
+	err = cmd.Wait() // must be called after reading stdout and stderr, because it closes the pipes
+	if exitErr, ok := err.(*osexec.ExitError); ok {
+		return exitErr.ExitCode(), nil
+	} else if err != nil {
+		return -1, fmt.Errorf("%v: %v", t.input.Command[0], err)
+	}
+	return 0, nil
+}
+
+// sendLines reads stdout until the process closes it, or until the tailer is closed.
+// Lines are converted from 'input.encoding' to UTF-8.
+func (t *CommandTailer) sendLines(stdout io.Reader) {
+	reader := fswatcher.NewLineReader(t.limits, t.charset)
+	for {
+		line, eof, err := reader.ReadLine(stdout)
+		if eof {
+			// The last line may not be terminated with a newline.
+			if line, ok := reader.Flush(); ok {
+				t.send(line)
+			}
+			return
+		}
+		if err != nil || !t.send(line) {
+			return
+		}
+	}
+}
+
+// send writes the line to the lines channel. The result is false if the tailer was closed.
+func (t *CommandTailer) send(line string) bool {
+	select {
+	case t.lines <- &fswatcher.Line{Line: line}:
+		return true
+	case <-t.done:
+		return false
+	}
+}
+
+func (t *CommandTailer) logStderr(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		t.logger.Warnf("%v: %v", t.input.Command[0], scanner.Text())
+	}
+}
+
+// started records the running process. It returns false if the tailer was closed in the meantime.
+func (t *CommandTailer) started(process *os.Process) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return false
+	}
+	t.process = process
+	t.startTime = time.Now()
+	return true
+}
+
+func (t *CommandTailer) stopped() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.process = nil
+}
+
+func (t *CommandTailer) isClosed() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.closed
+}
@@ -0,0 +1,135 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"github.com/fstab/grok_exporter/config/v2"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestCommandTailerRestart(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test uses /bin/sh")
+	}
+	tail, err := RunCommandTailer(&v2.InputConfig{
+		Name:                   "test",
+		Type:                   "command",
+		Command:                []string{"sh", "-c", "echo line 1; echo some error >&2; printf 'line 2'; exit 3"},
+		CommandRestart:         "on_failure",
+		CommandRestartDelay:    10 * time.Millisecond,
+		CommandRestartMaxDelay: 20 * time.Millisecond,
+	}, fswatcher.LineLimits{}, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tail.Close()
+	for i := 0; i < 3; i++ {
+		expectCommandLine(t, tail, "line 1")
+		expectCommandLine(t, tail, "line 2")
+	}
+	stats := tail.Stats()
+	if stats.Restarts < 2 || !stats.Exited || stats.LastExitCode != 3 {
+		t.Fatalf("unexpected stats %#v", stats)
+	}
+}
+
+func TestCommandTailerEnvAndDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test uses /bin/sh")
+	}
+	dir, err := ioutil.TempDir("", "grok_exporter_command")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir) // pwd prints the resolved path on macOS
+	if err != nil {
+		t.Fatal(err)
+	}
+	tail, err := RunCommandTailer(&v2.InputConfig{
+		Name:                   "test",
+		Type:                   "command",
+		Command:                []string{"sh", "-c", "echo $GREETING; pwd"},
+		CommandEnv:             map[string]string{"GREETING": "hello"},
+		CommandDir:             dir,
+		CommandRestart:         "never",
+		CommandRestartDelay:    10 * time.Millisecond,
+		CommandRestartMaxDelay: 20 * time.Millisecond,
+	}, fswatcher.LineLimits{}, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tail.Close()
+	expectCommandLine(t, tail, "hello")
+	expectCommandLine(t, tail, dir)
+	select {
+	case line := <-tail.Lines():
+		t.Fatalf("unexpected line %q, the command should not be restarted", line.Line)
+	case <-time.After(100 * time.Millisecond):
+	}
+	stats := tail.Stats()
+	if stats.Running || stats.Restarts != 0 || !stats.Exited || stats.LastExitCode != 0 {
+		t.Fatalf("unexpected stats %#v", stats)
+	}
+}
+
+func TestCommandTailerMaxLineBytes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test uses /bin/sh")
+	}
+	tail, err := RunCommandTailer(&v2.InputConfig{
+		Name:                   "test",
+		Type:                   "command",
+		Command:                []string{"sh", "-c", "head -c 100000 /dev/zero | tr '\\0' x; echo; echo short"},
+		CommandRestart:         "never",
+		CommandRestartDelay:    10 * time.Millisecond,
+		CommandRestartMaxDelay: 20 * time.Millisecond,
+	}, fswatcher.LineLimits{MaxLineBytes: 10}, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tail.Close()
+	expectCommandLine(t, tail, "xxxxxxxxxx")
+	expectCommandLine(t, tail, "short")
+}
+
+func TestCommandNotFound(t *testing.T) {
+	_, err := RunCommandTailer(&v2.InputConfig{
+		Name:    "test",
+		Type:    "command",
+		Command: []string{"grok_exporter_no_such_command"},
+	}, fswatcher.LineLimits{}, logrus.New())
+	if err == nil {
+		t.Fatal("expected error for unknown command")
+	}
+}
+
+func expectCommandLine(t *testing.T, tail *CommandTailer, expected string) {
+	select {
+	case line := <-tail.Lines():
+		if line.Line != expected {
+			t.Fatalf("expected line %q, but got %q", expected, line.Line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout while waiting for line %q", expected)
+	}
+}
@@ -15,6 +15,7 @@
 package fswatcher
 
 import (
+	"fmt"
 	"os"
 	"syscall"
 )
@@ -70,3 +71,16 @@ func open(path string) (*os.File, Error) {
 	}
 	return file, nil
 }
+
+// fileIdentity returns the device and inode number, and the current size of the file.
+func fileIdentity(file *os.File) (uint64, uint64, int64, error) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("%v: failed to get inode number", file.Name())
+	}
+	return uint64(stat.Dev), uint64(stat.Ino), fileInfo.Size(), nil
+}
@@ -233,3 +233,27 @@ func (f *File) reopen() (*os.File, Error) {
 	}
 	return file, Err
 }
+
+func (f *File) ReadAt(b []byte, off int64) (int, error) {
+	file, Err := f.reopen()
+	if Err != nil {
+		return 0, Err
+	}
+	defer file.Close()
+	return file.ReadAt(b, off)
+}
+
+// fileIdentity returns the file index as inode number, and the current size of the file.
+// The device number is always 0.
+func fileIdentity(f *File) (uint64, uint64, int64, error) {
+	file, Err := f.reopen()
+	if Err != nil {
+		return 0, 0, 0, Err
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return 0, 0, 0, NewError(NotSpecified, os.NewSyscallError("stat", err), f.Name())
+	}
+	return 0, uint64(f.fileIndexHigh)<<32 | uint64(f.fileIndexLow), fileInfo.Size(), nil
+}
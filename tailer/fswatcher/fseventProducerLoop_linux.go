@@ -50,7 +50,8 @@ func (l *inotifyloop) Close() {
 	close(l.done)
 }
 
-func runInotifyLoop(fd int) *inotifyloop {
+// ignored is called for each IN_IGNORED event and returns the number of remaining watches.
+func runInotifyLoop(fd int, ignored func(wd int) int) *inotifyloop {
 	var result = &inotifyloop{
 		fd:     fd,
 		events: make(chan fsevent),
@@ -102,11 +103,12 @@ func runInotifyLoop(fd int) *inotifyloop {
 				case <-l.done:
 					return
 				}
-				if event.Mask&syscall.IN_IGNORED == syscall.IN_IGNORED {
-					// IN_IGNORED event can have two reasons:
+				if event.Mask&syscall.IN_IGNORED == syscall.IN_IGNORED && ignored(int(event.Wd)) == 0 {
+					// IN_IGNORED event can have three reasons:
 					// 1) The consumer loop is shutting down and called inotify_rm_watch() to interrupt syscall.Read()
 					// 2) The watched directory was deleted. fswatcher will report an error and terminate if that happens.
-					// In both cases, we should terminate here and not call syscall.Read() again, as the next
+					// 3) A watched sub-directory was deleted or un-watched. fswatcher continues with the remaining directories.
+					// If no watches are left, we should terminate here and not call syscall.Read() again, as the next
 					// call might block forever as we don't receive events anymore.
 					return
 				}
@@ -16,12 +16,14 @@ package fswatcher
 
 import (
 	"fmt"
+	"github.com/fstab/grok_exporter/tailer/charset"
 	"github.com/fstab/grok_exporter/tailer/glob"
 	"github.com/prometheus/common/log"
 	"github.com/sirupsen/logrus"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -32,8 +34,12 @@ type FileTailer interface {
 }
 
 type Line struct {
-	Line string
-	File string
+	Line       string
+	File       string
+	Input      string            // name of the input, set when lines from multiple inputs are merged
+	Metadata   map[string]string // additional fields provided by the input, like syslog_severity. May be nil.
+	LineNumber int64             // line number within File, starting at 1. 0 if unknown.
+	Time       time.Time         // time when the line was received, set by the BufferedTailer
 }
 
 // ideas how this might look like in the config file:
@@ -46,11 +52,22 @@ type Line struct {
 // Heads up: filters use globs while matches use regular expressions.
 // Moreover, we should provide vars {{.filename}} and {{.filepath}} for labels.
 
+// WatchedGlob is a glob with the options for the files matching the glob.
+type WatchedGlob struct {
+	glob.Glob
+	Readall           bool // read matching files from the beginning, otherwise start at the end of the file
+	FailOnMissingFile bool // fail if no file matches when the tailer starts
+	LineLimits        LineLimits
+	Charset           *charset.Charset // encoding of the matching files, nil for UTF-8
+}
+
 type fileTailer struct {
-	globs        []glob.Glob
+	globs        []WatchedGlob
 	watchedDirs  []*Dir
 	watchedFiles map[string]*fileWithReader // path -> fileWithReader
 	osSpecific   fswatcher
+	positions    *PositionFile // nil if no position file is configured
+	batch        bool          // stop after the initial files were read until end of file
 	lines        chan *Line
 	errors       chan Error
 	done         chan struct{}
@@ -93,20 +110,37 @@ func (t *fileTailer) Close() {
 	// Closing the done channel will stop the consumer loop.
 	// Deferred functions within the consumer loop will close the producer loop.
 	close(t.done)
+	// The position file is closed synchronously, so that the positions are written when Close() returns.
+	if t.positions != nil {
+		err := t.positions.Close()
+		if err != nil {
+			log.Warnf("%v", err)
+		}
+	}
 }
 
-func RunFileTailer(globs []glob.Glob, readall bool, failOnMissingFile bool, log logrus.FieldLogger) (FileTailer, error) {
-	return runFileTailer(initWatcher, globs, readall, failOnMissingFile, log)
+// RunFileTailer starts tailing the files matching the globs.
+// Sub-directories that may contain matching files are watched as they appear and disappear.
+// If positions is not nil, files that are recorded in the position file are read starting at the recorded position,
+// and the position file is closed when the tailer is closed.
+func RunFileTailer(globs []WatchedGlob, positions *PositionFile, log logrus.FieldLogger) (FileTailer, error) {
+	return runFileTailer(initWatcher, globs, positions, false, log)
 }
 
-func RunPollingFileTailer(globs []glob.Glob, readall bool, failOnMissingFile bool, pollInterval time.Duration, log logrus.FieldLogger) (FileTailer, error) {
+func RunPollingFileTailer(globs []WatchedGlob, pollInterval time.Duration, positions *PositionFile, log logrus.FieldLogger) (FileTailer, error) {
 	initFunc := func() (fswatcher, Error) {
 		return initPollingWatcher(pollInterval)
 	}
-	return runFileTailer(initFunc, globs, readall, failOnMissingFile, log)
+	return runFileTailer(initFunc, globs, positions, false, log)
 }
 
-func runFileTailer(initFunc func() (fswatcher, Error), globs []glob.Glob, readall bool, failOnMissingFile bool, log logrus.FieldLogger) (FileTailer, error) {
+// RunBatchFileTailer reads the files matching the globs until end of file, and closes the lines channel when
+// all files are read. Files created while the files are read may or may not be included.
+func RunBatchFileTailer(globs []WatchedGlob, positions *PositionFile, log logrus.FieldLogger) (FileTailer, error) {
+	return runFileTailer(initWatcher, globs, positions, true, log)
+}
+
+func runFileTailer(initFunc func() (fswatcher, Error), globs []WatchedGlob, positions *PositionFile, batch bool, log logrus.FieldLogger) (FileTailer, error) {
 
 	var (
 		t   *fileTailer
@@ -116,6 +150,8 @@ func runFileTailer(initFunc func() (fswatcher, Error), globs []glob.Glob, readal
 	t = &fileTailer{
 		globs:        globs,
 		watchedFiles: make(map[string]*fileWithReader),
+		positions:    positions,
+		batch:        batch,
 		lines:        make(chan *Line),
 		errors:       make(chan Error),
 		done:         make(chan struct{}),
@@ -139,13 +175,18 @@ func runFileTailer(initFunc func() (fswatcher, Error), globs []glob.Glob, readal
 			return
 		}
 
-		eventProducerLoop := t.osSpecific.runFseventProducerLoop()
-		defer eventProducerLoop.Close()
+		var eventProducerLoop fseventProducerLoop
+		if !t.batch {
+			// In batch mode, file system events are not processed. Starting the producer loop anyway would leave
+			// a go-routine reading from the watcher's file descriptor after the tailer is closed.
+			eventProducerLoop = t.osSpecific.runFseventProducerLoop()
+			defer eventProducerLoop.Close()
+		}
 
 		for _, dir := range t.watchedDirs {
 			dirLogger := log.WithField("directory", dir.Path())
 			dirLogger.Debugf("initializing directory")
-			Err = t.syncFilesInDir(dir, readall, dirLogger) // This may already write lines to the lines channel, so we will not go past this line unless the consumer starts reading lines.
+			Err = t.syncFilesInDir(dir, false, dirLogger) // This may already write lines to the lines channel, so we will not go past this line unless the consumer starts reading lines.
 			if Err != nil {
 				select {
 				case <-t.done:
@@ -155,16 +196,23 @@ func runFileTailer(initFunc func() (fswatcher, Error), globs []glob.Glob, readal
 			}
 		}
 
-		// make sure at least one logfile was found for each glob
-		if failOnMissingFile {
-			missingFileError := t.checkMissingFile()
-			if missingFileError != nil {
-				select {
-				case <-t.done:
-				case t.errors <- missingFileError:
-				}
-				return
+		// forget the positions of files that were removed while grok_exporter was not running
+		if t.positions != nil {
+			t.positions.retain(t.watchedFiles)
+		}
+
+		// make sure at least one logfile was found for each glob with FailOnMissingFile
+		missingFileError := t.checkMissingFile()
+		if missingFileError != nil {
+			select {
+			case <-t.done:
+			case t.errors <- missingFileError:
 			}
+			return
+		}
+
+		if t.batch {
+			return
 		}
 
 		for { // event consumer loop
@@ -204,7 +252,7 @@ func (t *fileTailer) shutdown() {
 	close(t.errors)
 
 	warnf := func(format string, args ...interface{}) {
-		log.Warnf("error while shutting down the file system watcher: %v", fmt.Sprintf(format, args))
+		log.Warnf("error while shutting down the file system watcher: %v", fmt.Sprintf(format, args...))
 	}
 
 	for _, dir := range t.watchedDirs {
@@ -228,47 +276,153 @@ func (t *fileTailer) shutdown() {
 }
 
 func (t *fileTailer) watchDirs(log logrus.FieldLogger) Error {
-	var (
-		err      error
-		Err      Error
-		dirPaths []string
-		dirPath  string
-	)
-	dirPaths, Err = uniqueDirs(t.globs)
+	dirPaths, Err := uniqueDirs(t.globs)
 	if Err != nil {
 		return Err
 	}
-	for _, dirPath = range dirPaths {
-		log.Debugf("watching directory %v", dirPath)
-		dir, Err := t.osSpecific.watchDir(dirPath)
-		if err != nil {
+	for _, dirPath := range dirPaths {
+		_, Err = t.watchDirRecursively(dirPath, log)
+		if Err != nil {
 			return Err
 		}
-		t.watchedDirs = append(t.watchedDirs, dir)
 	}
 	return nil
 }
 
-func (t *fileTailer) syncFilesInDir(dir *Dir, readall bool, log logrus.FieldLogger) Error {
-	watchedFilesAfter := make(map[string]*fileWithReader)
+// watchDirRecursively watches the directory and all sub-directories that may contain matching files.
+// It returns the directories that were not watched before.
+func (t *fileTailer) watchDirRecursively(path string, log logrus.FieldLogger) ([]*Dir, Error) {
+	if t.findWatchedDir(path) != nil {
+		return nil, nil
+	}
+	log.Debugf("watching directory %v", path)
+	dir, Err := t.osSpecific.watchDir(path)
+	if Err != nil {
+		return nil, Err
+	}
+	t.watchedDirs = append(t.watchedDirs, dir)
+	result := []*Dir{dir}
+	fileInfos, Err := dir.ls()
+	if Err != nil {
+		return nil, Err
+	}
+	for _, fileInfo := range fileInfos {
+		subDirPath := filepath.Join(path, fileInfo.Name())
+		if !fileInfo.IsDir() || !anyGlobMatchesDir(t.globs, subDirPath) {
+			continue
+		}
+		subDirs, Err := t.watchDirRecursively(subDirPath, log)
+		if Err != nil {
+			if Err.Cause() != nil && os.IsNotExist(Err.Cause()) {
+				continue // sub-directory was removed in the meantime
+			}
+			return nil, Err
+		}
+		result = append(result, subDirs...)
+	}
+	return result, nil
+}
+
+// unwatchDirRecursively stops watching a directory that was removed or moved away,
+// including its sub-directories and the files in these directories.
+func (t *fileTailer) unwatchDirRecursively(dir *Dir, log logrus.FieldLogger) {
+	prefix := dir.Path() + string(filepath.Separator)
+	watchedDirsAfter := make([]*Dir, 0, len(t.watchedDirs))
+	for _, existing := range t.watchedDirs {
+		if existing.Path() != dir.Path() && !strings.HasPrefix(existing.Path(), prefix) {
+			watchedDirsAfter = append(watchedDirsAfter, existing)
+			continue
+		}
+		log.WithField("directory", existing.Path()).Info("directory was removed, un-watching")
+		err := t.osSpecific.unwatchDir(existing)
+		if err != nil {
+			// expected if the watch was already removed by the operating system
+			log.Debugf("%v", err)
+		}
+	}
+	t.watchedDirs = watchedDirsAfter
 	for path, file := range t.watchedFiles {
-		if filepath.Dir(path) != dir.Path() {
-			watchedFilesAfter[path] = file
+		if strings.HasPrefix(path, prefix) {
+			log.WithField("file", path).Info("closing and un-watching file in removed directory")
+			if t.positions != nil {
+				t.positions.remove(path)
+			}
+			file.file.Close()
+			delete(t.watchedFiles, path)
 		}
 	}
+}
+
+func (t *fileTailer) findWatchedDir(path string) *Dir {
+	for _, dir := range t.watchedDirs {
+		if dir.Path() == path {
+			return dir
+		}
+	}
+	return nil
+}
+
+// isRootDir is true if the directory was watched when the tailer started,
+// i.e. if it is the longest path without wildcards of one of the globs.
+func (t *fileTailer) isRootDir(dir *Dir) bool {
+	for _, g := range t.globs {
+		if g.Root() == dir.Path() {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *fileTailer) syncFilesInDir(dir *Dir, readall bool, log logrus.FieldLogger) Error {
 	fileInfos, Err := dir.ls()
 	if Err != nil {
+		if Err.Cause() != nil && os.IsNotExist(Err.Cause()) && !t.isRootDir(dir) {
+			t.unwatchDirRecursively(dir, log)
+			return nil
+		}
 		return Err
 	}
+	// Sub-directories that were removed or moved away are un-watched before new sub-directories are watched,
+	// because a directory that was renamed might get the same watch descriptor as before.
+	subDirPaths := make(map[string]bool)
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() {
+			subDirPaths[filepath.Join(dir.Path(), fileInfo.Name())] = true
+		}
+	}
+	for _, subDir := range t.watchedDirs {
+		if filepath.Dir(subDir.Path()) == dir.Path() && !subDirPaths[subDir.Path()] {
+			t.unwatchDirRecursively(subDir, log)
+		}
+	}
+	watchedFilesAfter := make(map[string]*fileWithReader)
+	for path, file := range t.watchedFiles {
+		if filepath.Dir(path) != dir.Path() {
+			watchedFilesAfter[path] = file
+		}
+	}
+	var newDirs []*Dir
 	for _, fileInfo := range fileInfos {
 		filePath := filepath.Join(dir.Path(), fileInfo.Name())
 		fileLogger := log.WithField("file", fileInfo.Name())
-		if !anyGlobMatches(t.globs, filePath) {
-			fileLogger.Debug("skipping file, because file name does not match")
+		if fileInfo.IsDir() {
+			if !anyGlobMatchesDir(t.globs, filePath) {
+				fileLogger.Debug("skipping, because it is a directory")
+				continue
+			}
+			subDirs, Err := t.watchDirRecursively(filePath, log)
+			if Err != nil {
+				if Err.Cause() != nil && os.IsNotExist(Err.Cause()) {
+					continue // sub-directory was removed in the meantime
+				}
+				return Err
+			}
+			newDirs = append(newDirs, subDirs...)
 			continue
 		}
-		if fileInfo.IsDir() {
-			fileLogger.Debug("skipping, because it is a directory")
+		matchingGlob := findMatchingGlob(t.globs, filePath)
+		if matchingGlob == nil {
+			fileLogger.Debug("skipping file, because file name does not match")
 			continue
 		}
 		alreadyWatched, Err := findSameFile(t, fileInfo, filePath)
@@ -282,6 +436,7 @@ func (t *fileTailer) syncFilesInDir(dir *Dir, readall bool, log logrus.FieldLogg
 					return NewErrorf(NotSpecified, err, "%v: failed to follow moved file", filePath)
 				}
 				fileLogger.WithField("fd", renamedFile.Fd()).Infof("file with old_fd=%v was moved from old_path=%v", alreadyWatched.file.Fd(), alreadyWatched.file.Name())
+				oldPath := alreadyWatched.file.Name()
 				alreadyWatched.file.Close()
 				Err = t.osSpecific.watchFile(renamedFile)
 				if Err != nil {
@@ -289,6 +444,10 @@ func (t *fileTailer) syncFilesInDir(dir *Dir, readall bool, log logrus.FieldLogg
 					return Err
 				}
 				alreadyWatched.file = renamedFile // re-use lineReader
+				if t.positions != nil {
+					t.positions.remove(oldPath)
+					t.savePosition(alreadyWatched)
+				}
 				Err = t.readNewLines(alreadyWatched, fileLogger)
 				if Err != nil {
 					alreadyWatched.file.Close()
@@ -310,14 +469,13 @@ func (t *fileTailer) syncFilesInDir(dir *Dir, readall bool, log logrus.FieldLogg
 				return Err
 			}
 		}
-		if !readall {
-			_, err := newFile.Seek(0, io.SeekEnd)
-			if err != nil {
-				newFile.Close()
-				return NewError(NotSpecified, os.NewSyscallError("seek", err), filePath)
-			}
-		}
 		fileLogger = fileLogger.WithField("fd", newFile.Fd())
+		newFileWithReader := &fileWithReader{file: newFile, reader: NewLineReader(matchingGlob.LineLimits, matchingGlob.Charset)}
+		Err = t.seekStartPosition(newFileWithReader, readall || matchingGlob.Readall, fileLogger)
+		if Err != nil {
+			newFile.Close()
+			return Err
+		}
 		fileLogger.Info("watching new file")
 
 		Err = t.osSpecific.watchFile(newFile)
@@ -326,7 +484,6 @@ func (t *fileTailer) syncFilesInDir(dir *Dir, readall bool, log logrus.FieldLogg
 			return Err
 		}
 
-		newFileWithReader := &fileWithReader{file: newFile, reader: NewLineReader()}
 		Err = t.readNewLines(newFileWithReader, fileLogger)
 		if Err != nil {
 			newFile.Close()
@@ -338,10 +495,20 @@ func (t *fileTailer) syncFilesInDir(dir *Dir, readall bool, log logrus.FieldLogg
 		if !contains(watchedFilesAfter, f) {
 			fileLogger := log.WithField("file", filepath.Base(f.file.Name())).WithField("fd", f.file.Fd())
 			fileLogger.Info("file was removed, closing and un-watching")
+			if t.positions != nil {
+				t.positions.remove(f.file.Name())
+			}
 			f.file.Close()
 		}
 	}
 	t.watchedFiles = watchedFilesAfter
+	// Directories created while grok_exporter is running are read from the beginning, like new files.
+	for _, newDir := range newDirs {
+		Err = t.syncFilesInDir(newDir, true, log.WithField("directory", newDir.Path()))
+		if Err != nil {
+			return Err
+		}
+	}
 	return nil
 }
 
@@ -357,20 +524,139 @@ func (t *fileTailer) readNewLines(file *fileWithReader, log logrus.FieldLogger)
 			return NewErrorf(NotSpecified, err, "%v: read() failed", file.file.Name())
 		}
 		if eof {
+			if t.batch {
+				// The file will not be read again, so the last line is complete even if it doesn't end with a newline.
+				if line, ok := file.reader.Flush(); ok {
+					t.sendLine(file, line, log)
+				}
+			}
 			return nil
 		}
-		log.Debugf("read line %q", line)
-		select {
-		case <-t.done:
+		if !t.sendLine(file, line, log) {
 			return nil
-		case t.lines <- &Line{Line: line, File: file.file.Name()}:
 		}
 	}
 }
 
+// sendLine writes the line to the lines channel and saves the position. The result is false if the tailer was closed.
+// The position is saved before the line is processed, so the lines that were sent must be processed
+// after the tailer is closed, otherwise they are not read again after a restart.
+func (t *fileTailer) sendLine(file *fileWithReader, line string, log logrus.FieldLogger) bool {
+	log.Debugf("read line %q", line)
+	select {
+	case <-t.done:
+		return false
+	case t.lines <- &Line{Line: line, File: file.file.Name(), LineNumber: lineNumber(file.reader)}:
+		t.savePosition(file)
+		return true
+	}
+}
+
+// seekStartPosition moves a newly opened file to the position where reading starts: If the file is recorded
+// in the position file, reading resumes at the recorded position. Otherwise, reading starts at the beginning
+// of the file if readall is true, or at the end of the file if readall is false.
+func (t *fileTailer) seekStartPosition(file *fileWithReader, readall bool, log logrus.FieldLogger) Error {
+	var (
+		offset     int64
+		lineNumber int64
+		whence     = io.SeekStart
+	)
+	if stored, ok := t.storedPosition(file); ok {
+		offset, lineNumber = stored.Offset, stored.LineNumber
+		if offset > 0 && lineNumber == 0 {
+			lineNumber = -1 // position file written by a version that didn't record line numbers
+		}
+		log.Infof("resuming at offset %v", offset)
+	} else if !readall {
+		whence = io.SeekEnd
+		lineNumber = -1
+	}
+	pos, err := file.file.Seek(offset, whence)
+	if err != nil {
+		return NewError(NotSpecified, os.NewSyscallError("seek", err), file.file.Name())
+	}
+	if pos == 0 {
+		lineNumber = 0 // started at the end of an empty file
+	}
+	file.reader.offset = pos
+	file.reader.lineNumber = lineNumber
+	t.savePosition(file)
+	return nil
+}
+
+// storedPosition returns the position from the position file, if the file is the same file as the recorded one.
+func (t *fileTailer) storedPosition(file *fileWithReader) (*filePosition, bool) {
+	if t.positions == nil {
+		return nil, false
+	}
+	dev, inode, size, err := fileIdentity(file.file)
+	if err != nil {
+		return nil, false
+	}
+	pos := t.positions.find(dev, inode)
+	if pos == nil || pos.Offset > size || pos.FingerprintSize > size {
+		return nil, false // unknown or truncated file
+	}
+	hash, err := fingerprint(file.file, pos.FingerprintSize)
+	if err != nil || hash != pos.Fingerprint {
+		return nil, false // inode was re-used for a new file
+	}
+	return pos, true
+}
+
+// lineNumber returns the number of the last line read, or 0 if it is unknown.
+func lineNumber(reader *lineReader) int64 {
+	if reader.lineNumber < 0 {
+		return 0
+	}
+	return reader.lineNumber
+}
+
+// savePosition records the position after the last line that was read.
+// The fingerprint is updated if the file is new, if it was truncated, or if it was smaller than fingerprintSize.
+func (t *fileTailer) savePosition(file *fileWithReader) {
+	if t.positions == nil {
+		return
+	}
+	var (
+		path   = file.file.Name()
+		offset = file.reader.offset
+		pos    = t.positions.get(path)
+	)
+	if pos != nil && offset >= pos.Offset && (pos.FingerprintSize == fingerprintSize || offset <= pos.FingerprintSize) {
+		t.positions.setOffset(path, offset, file.reader.lineNumber)
+		return
+	}
+	dev, inode, size, err := fileIdentity(file.file)
+	if err != nil {
+		log.Warnf("%v: failed to update position file: %v", path, err)
+		return
+	}
+	if size > fingerprintSize {
+		size = fingerprintSize
+	}
+	hash, err := fingerprint(file.file, size)
+	if err != nil {
+		log.Warnf("%v: failed to update position file: %v", path, err)
+		return
+	}
+	t.positions.set(&filePosition{
+		Path:            path,
+		Dev:             dev,
+		Inode:           inode,
+		Offset:          offset,
+		LineNumber:      file.reader.lineNumber,
+		Fingerprint:     hash,
+		FingerprintSize: size,
+	})
+}
+
 func (t *fileTailer) checkMissingFile() Error {
 OUTER:
 	for _, g := range t.globs {
+		if !g.FailOnMissingFile {
+			continue
+		}
 		for watchedFileName, _ := range t.watchedFiles {
 			if g.Match(watchedFileName) {
 				continue OUTER
@@ -378,42 +664,51 @@ OUTER:
 		}
 		// Error message must be phrased so that it makes sense for globs,
 		// but also if g is a plain path without wildcards.
-		return NewErrorf(FileNotFound, nil, "%v: no such file", g)
+		return NewErrorf(FileNotFound, nil, "%v: no such file", g.Glob)
 	}
 	return nil
 }
 
-// Gets the directory paths from the glob expressions,
+// Gets the root directory paths from the glob expressions,
 // and makes sure these directories exist.
-func uniqueDirs(globs []glob.Glob) ([]string, Error) {
+func uniqueDirs(globs []WatchedGlob) ([]string, Error) {
 	var (
 		result  = make([]string, 0, len(globs))
-		g       glob.Glob
 		dirInfo os.FileInfo
 		err     error
 	)
-	for _, g = range globs {
-		if containsString(result, g.Dir()) {
+	for _, g := range globs {
+		if containsString(result, g.Root()) {
 			continue
 		}
-		dirInfo, err = os.Stat(g.Dir())
+		dirInfo, err = os.Stat(g.Root())
 		if err != nil {
 			if os.IsNotExist(err) {
-				return nil, NewErrorf(DirectoryNotFound, nil, "%q: no such directory", g.Dir())
+				return nil, NewErrorf(DirectoryNotFound, nil, "%q: no such directory", g.Root())
 			}
-			return nil, NewErrorf(NotSpecified, err, "%q: stat() failed", g.Dir())
+			return nil, NewErrorf(NotSpecified, err, "%q: stat() failed", g.Root())
 		}
 		if !dirInfo.IsDir() {
-			return nil, NewErrorf(NotSpecified, nil, "%q is not a directory", g.Dir())
+			return nil, NewErrorf(NotSpecified, nil, "%q is not a directory", g.Root())
 		}
-		result = append(result, g.Dir())
+		result = append(result, g.Root())
 	}
 	return result, nil
 }
 
-func anyGlobMatches(globs []glob.Glob, path string) bool {
+// findMatchingGlob returns the first glob matching the path, or nil if there is none.
+func findMatchingGlob(globs []WatchedGlob, path string) *WatchedGlob {
+	for i := range globs {
+		if globs[i].Match(path) {
+			return &globs[i]
+		}
+	}
+	return nil
+}
+
+func anyGlobMatchesDir(globs []WatchedGlob, path string) bool {
 	for _, pattern := range globs {
-		if pattern.Match(path) {
+		if pattern.MatchDir(path) {
 			return true
 		}
 	}
@@ -138,6 +138,11 @@ func (w *watcher) processEvent(t *fileTailer, event fsevent, log logrus.FieldLog
 }
 
 func (w *watcher) processDirEvent(t *fileTailer, kevent syscall.Kevent_t, dir *Dir, dirLogger logrus.FieldLogger) Error {
+	if kevent.Fflags&(syscall.NOTE_DELETE|syscall.NOTE_RENAME) != 0 && !t.isRootDir(dir) {
+		// A sub-directory matching a glob like /var/log/*/app.log was removed or moved away.
+		t.unwatchDirRecursively(dir, dirLogger)
+		return nil
+	}
 	if kevent.Fflags&syscall.NOTE_WRITE == syscall.NOTE_WRITE || kevent.Fflags&syscall.NOTE_EXTEND == syscall.NOTE_EXTEND {
 		// NOTE_WRITE on the directory's fd means a file was created, deleted, or moved. This covers inotify's MOVED_TO.
 		// NOTE_EXTEND reports that a directory entry was added	or removed as the result of rename operation.
@@ -157,6 +162,7 @@ func (w *watcher) processDirEvent(t *fileTailer, kevent syscall.Kevent_t, dir *D
 		return NewErrorf(NotSpecified, nil, "%v: filesystem was unmounted", dir.file.Name())
 	}
 	// NOTE_LINK (sub directory created) and NOTE_ATTRIB (attributes changed) are ignored.
+	// New sub-directories are also reported as NOTE_WRITE, so they are watched in syncFilesInDir().
 	return nil
 }
 
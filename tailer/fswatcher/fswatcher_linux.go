@@ -20,11 +20,14 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
 	"syscall"
 )
 
 type watcher struct {
-	fd int
+	fd   int
+	lock sync.Mutex
+	wds  map[int]bool // watch descriptors that did not receive IN_IGNORED yet
 }
 
 type fileWithReader struct {
@@ -63,7 +66,15 @@ func unwatchDirByEvent(t *fileTailer, event inotifyEvent) {
 }
 
 func (w *watcher) runFseventProducerLoop() fseventProducerLoop {
-	return runInotifyLoop(w.fd)
+	return runInotifyLoop(w.fd, w.ignored)
+}
+
+// ignored removes the watch descriptor after an IN_IGNORED event, and returns the number of remaining watches.
+func (w *watcher) ignored(wd int) int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	delete(w.wds, wd)
+	return len(w.wds)
 }
 
 func initWatcher() (fswatcher, Error) {
@@ -71,7 +82,7 @@ func initWatcher() (fswatcher, Error) {
 	if err != nil {
 		return nil, NewError(NotSpecified, err, "inotify_init1() failed")
 	}
-	return &watcher{fd: fd}, nil
+	return &watcher{fd: fd, wds: make(map[int]bool)}, nil
 }
 
 func (w *watcher) watchDir(path string) (*Dir, Error) {
@@ -88,6 +99,9 @@ func (w *watcher) watchDir(path string) (*Dir, Error) {
 	if err != nil {
 		return nil, NewErrorf(NotSpecified, err, "%q: inotify_add_watch() failed", path)
 	}
+	w.lock.Lock()
+	w.wds[dir.wd] = true
+	w.lock.Unlock()
 	return dir, nil
 }
 
@@ -116,11 +130,18 @@ func (w *watcher) processEvent(t *fileTailer, fsevent fsevent, log logrus.FieldL
 	}
 	dir := findDir(t, event)
 	if dir == nil {
-		return NewError(NotSpecified, nil, "watch list inconsistent: received a file system event for an unknown directory")
+		// Sub-directories are un-watched when they are removed, but pending events might still come in.
+		log.Debugf("ignoring event for un-watched directory: %v", event)
+		return nil
 	}
 	dirLogger := log.WithField("directory", dir.path)
 	dirLogger.Debugf("received event: %v", event)
 	if event.Mask&syscall.IN_IGNORED == syscall.IN_IGNORED {
+		if !t.isRootDir(dir) {
+			// A sub-directory matching a glob like /var/log/*/app.log was removed.
+			t.unwatchDirRecursively(dir, dirLogger)
+			return nil
+		}
 		unwatchDirByEvent(t, event) // need to remove it from watchedDirs, because otherwise we close the removed dir on shutdown which causes an error
 		return NewErrorf(NotSpecified, nil, "%s: directory was removed while being watched", dir.path)
 	}
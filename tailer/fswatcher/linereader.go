@@ -16,16 +16,85 @@ package fswatcher
 
 import (
 	"bytes"
+	"github.com/fstab/grok_exporter/tailer/charset"
 	"io"
+	"unicode/utf8"
 )
 
+// LineLimits defines how lines that are too long or not valid UTF-8 are handled.
+// The lineReader applies them to file inputs, Apply() applies them to lines of other inputs.
+type LineLimits struct {
+	MaxLineBytes      int    // lines longer than MaxLineBytes (without line ending) are truncated or skipped, 0 means unlimited
+	SkipLongLines     bool   // skip long lines, otherwise they are truncated to MaxLineBytes
+	ValidateUtf8      bool   // check if lines are valid UTF-8, otherwise lines are passed on as they are
+	RejectInvalidUtf8 bool   // skip lines that are not valid UTF-8, otherwise invalid bytes are replaced with U+FFFD
+	OnLongLine        func() // called for each long line, may be nil
+	OnInvalidUtf8     func() // called for each line that is not valid UTF-8, may be nil
+}
+
+// Apply handles a line that was not read with a lineReader, like a line from stdin or from a webhook.
+// The result is false if the line is skipped.
+func (limits LineLimits) Apply(line string) (string, bool) {
+	result := []byte(line)
+	if limits.MaxLineBytes > 0 && len(result) > limits.MaxLineBytes {
+		if limits.OnLongLine != nil {
+			limits.OnLongLine()
+		}
+		if limits.SkipLongLines {
+			return "", false
+		}
+		result = truncate(result, limits.MaxLineBytes)
+	}
+	result, ok := limits.checkUtf8(result)
+	return string(result), ok
+}
+
+// checkUtf8 replaces invalid bytes with U+FFFD, or rejects the line, if ValidateUtf8 is set.
+// The result is false if the line is skipped.
+func (limits LineLimits) checkUtf8(line []byte) ([]byte, bool) {
+	if !limits.ValidateUtf8 || utf8.Valid(line) {
+		return line, true
+	}
+	if limits.OnInvalidUtf8 != nil {
+		limits.OnInvalidUtf8()
+	}
+	if limits.RejectInvalidUtf8 {
+		return nil, false
+	}
+	return toValidUtf8(line), true
+}
+
+// toValidUtf8 replaces each invalid byte with U+FFFD.
+func toValidUtf8(line []byte) []byte {
+	result := make([]byte, 0, len(line)+2*utf8.UTFMax)
+	for len(line) > 0 {
+		r, size := utf8.DecodeRune(line)
+		if r == utf8.RuneError && size == 1 {
+			result = append(result, "\uFFFD"...)
+		} else {
+			result = append(result, line[:size]...)
+		}
+		line = line[size:]
+	}
+	return result
+}
+
 type lineReader struct {
 	remainingBytesFromLastRead []byte
+	offset                     int64 // file position after the last line returned by ReadLine()
+	lineNumber                 int64 // number of the last line returned by ReadLine(), -1 if reading didn't start at the beginning of the file
+	limits                     LineLimits
+	charset                    *charset.Charset // encoding of the file, nil for UTF-8
+	truncatedLine              []byte           // beginning of the current line if it is longer than MaxLineBytes, nil otherwise
+	discardedBytes             int64            // number of bytes of the current line that were discarded to limit memory usage
 }
 
-func NewLineReader() *lineReader {
+// NewLineReader creates a lineReader for a file encoded with cs. Lines are converted to UTF-8, cs is nil for UTF-8 files.
+func NewLineReader(limits LineLimits, cs *charset.Charset) *lineReader {
 	return &lineReader{
 		remainingBytesFromLastRead: []byte{},
+		limits:                     limits,
+		charset:                    cs,
 	}
 }
 
@@ -36,6 +105,9 @@ func NewLineReader() *lineReader {
 // * err is set if an error other than io.EOF has occurred. err is never io.EOF.
 // if eof is true, line is always "" and err always is nil.
 // if eof is false and err is nil, an empty line means that there actually was an empty line in the file.
+// Long lines and lines with invalid UTF-8 are handled as defined in the LineLimits. Skipped lines are
+// not returned, but they are counted in the line number and the offset.
+// max_line_bytes refers to the bytes in the file, lines in other encodings are converted to UTF-8 after they are truncated.
 func (r *lineReader) ReadLine(file io.Reader) (string, bool, error) {
 	var (
 		err error
@@ -43,14 +115,14 @@ func (r *lineReader) ReadLine(file io.Reader) (string, bool, error) {
 		n   = 0
 	)
 	for {
-		newlinePos := bytes.IndexByte(r.remainingBytesFromLastRead, '\n')
+		r.skipByteOrderMark()
+		newlinePos := r.indexNewline(r.remainingBytesFromLastRead)
 		if newlinePos >= 0 {
-			l := len(r.remainingBytesFromLastRead)
-			result := make([]byte, newlinePos)
-			copy(result, r.remainingBytesFromLastRead[:newlinePos])
-			copy(r.remainingBytesFromLastRead, r.remainingBytesFromLastRead[newlinePos+1:])
-			r.remainingBytesFromLastRead = r.remainingBytesFromLastRead[:l-(newlinePos+1)]
-			return string(stripWindowsLineEnding(result)), false, nil
+			line, ok := r.applyLimits(r.takeLine(newlinePos, r.newlineLen()))
+			if !ok {
+				continue
+			}
+			return line, false, nil
 		} else if err != nil {
 			if err == io.EOF {
 				return "", true, nil
@@ -62,9 +134,150 @@ func (r *lineReader) ReadLine(file io.Reader) (string, bool, error) {
 			if n > 0 {
 				// io.Reader: Callers should always process the n > 0 bytes returned before considering the error err.
 				r.remainingBytesFromLastRead = append(r.remainingBytesFromLastRead, buf[0:n]...)
+				r.discardLongLine()
+			}
+		}
+	}
+}
+
+// Flush returns the bytes after the last '\n' as the last line. This is used when a file is read in batch mode,
+// where the last line is not followed by a '\n' if the file doesn't end with a newline.
+// The result is false if there are no remaining bytes, or if the line is skipped as defined in the LineLimits.
+func (r *lineReader) Flush() (string, bool) {
+	r.skipByteOrderMark()
+	if len(r.remainingBytesFromLastRead) == 0 && r.truncatedLine == nil {
+		return "", false
+	}
+	return r.applyLimits(r.takeLine(len(r.remainingBytesFromLastRead), 0))
+}
+
+// applyLimits converts the line to UTF-8 and handles long lines and invalid UTF-8 as defined in the LineLimits.
+// The result is false if the line is skipped.
+func (r *lineReader) applyLimits(line []byte, isLong bool) (string, bool) {
+	if isLong {
+		if r.limits.OnLongLine != nil {
+			r.limits.OnLongLine()
+		}
+		if r.limits.SkipLongLines {
+			return "", false
+		}
+	}
+	if r.charset != nil {
+		if decoded, decodeErr := r.charset.Decode(line); decodeErr == nil {
+			line = decoded
+			if isLong {
+				// a double-byte character may have been split when the line was truncated
+				line = bytes.TrimSuffix(line, []byte("\uFFFD"))
 			}
 		}
 	}
+	line, ok := r.limits.checkUtf8(line)
+	return string(line), ok
+}
+
+// takeLine removes the line ending at newlinePos from the buffer. The result is true if the line is longer than MaxLineBytes.
+func (r *lineReader) takeLine(newlinePos int, newlineLen int) ([]byte, bool) {
+	var (
+		l      = len(r.remainingBytesFromLastRead)
+		result = r.trimCR(r.remainingBytesFromLastRead[:newlinePos])
+		isLong = r.truncatedLine != nil || (r.limits.MaxLineBytes > 0 && len(result) > r.limits.MaxLineBytes)
+	)
+	if r.truncatedLine != nil {
+		result = r.truncatedLine
+	} else {
+		result = append([]byte{}, r.truncate(result)...)
+	}
+	copy(r.remainingBytesFromLastRead, r.remainingBytesFromLastRead[newlinePos+newlineLen:])
+	r.remainingBytesFromLastRead = r.remainingBytesFromLastRead[:l-(newlinePos+newlineLen)]
+	r.offset += r.discardedBytes + int64(newlinePos+newlineLen)
+	r.truncatedLine = nil
+	r.discardedBytes = 0
+	if r.lineNumber >= 0 {
+		r.lineNumber++
+	}
+	return result, isLong
+}
+
+// discardLongLine keeps only the first MaxLineBytes of a line without '\n', so that a line that never ends
+// doesn't use up all memory. The line is returned when the '\n' is found.
+func (r *lineReader) discardLongLine() {
+	if r.limits.MaxLineBytes <= 0 || len(r.remainingBytesFromLastRead) <= r.limits.MaxLineBytes {
+		return
+	}
+	if r.indexNewline(r.remainingBytesFromLastRead) >= 0 {
+		return
+	}
+	if r.truncatedLine == nil {
+		r.truncatedLine = append([]byte{}, r.truncate(r.remainingBytesFromLastRead)...)
+	}
+	// For UTF-16, an incomplete character is kept, so that the next '\n' is found at a character boundary.
+	l := len(r.remainingBytesFromLastRead)
+	nDiscarded := l - l%r.newlineLen()
+	copy(r.remainingBytesFromLastRead, r.remainingBytesFromLastRead[nDiscarded:])
+	r.remainingBytesFromLastRead = r.remainingBytesFromLastRead[:l-nDiscarded]
+	r.discardedBytes += int64(nDiscarded)
+}
+
+// skipByteOrderMark removes a byte order mark at the beginning of the file. For UTF-16, the byte order mark
+// overrides the configured byte order.
+func (r *lineReader) skipByteOrderMark() {
+	if r.charset == nil || r.offset != 0 || r.discardedBytes > 0 {
+		return
+	}
+	var n int
+	r.charset, n = r.charset.DetectBOM(r.remainingBytesFromLastRead)
+	if n > 0 {
+		l := len(r.remainingBytesFromLastRead)
+		copy(r.remainingBytesFromLastRead, r.remainingBytesFromLastRead[n:])
+		r.remainingBytesFromLastRead = r.remainingBytesFromLastRead[:l-n]
+		r.offset += int64(n)
+	}
+}
+
+func (r *lineReader) indexNewline(b []byte) int {
+	if r.charset == nil {
+		return bytes.IndexByte(b, '\n')
+	}
+	return r.charset.IndexNewline(b)
+}
+
+func (r *lineReader) newlineLen() int {
+	if r.charset == nil {
+		return 1
+	}
+	return r.charset.NewlineLen()
+}
+
+func (r *lineReader) trimCR(line []byte) []byte {
+	if r.charset == nil {
+		return stripWindowsLineEnding(line)
+	}
+	return r.charset.TrimCR(line)
+}
+
+func (r *lineReader) truncate(line []byte) []byte {
+	if r.limits.MaxLineBytes <= 0 {
+		return line
+	}
+	if r.charset == nil {
+		return truncate(line, r.limits.MaxLineBytes)
+	}
+	return r.charset.Truncate(line, r.limits.MaxLineBytes)
+}
+
+// truncate cuts s to at most maxBytes, but doesn't split a multi-byte UTF-8 character.
+func truncate(s []byte, maxBytes int) []byte {
+	if len(s) <= maxBytes {
+		return s
+	}
+	n := maxBytes
+	for n > maxBytes-utf8.UTFMax && n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	if !utf8.RuneStart(s[n]) {
+		n = maxBytes // not valid UTF-8 anyway
+	}
+	return s[:n]
 }
 
 func stripWindowsLineEnding(s []byte) []byte {
@@ -75,6 +288,11 @@ func stripWindowsLineEnding(s []byte) []byte {
 	}
 }
 
+// Clear is called when the file was truncated and is read again from position 0.
 func (r *lineReader) Clear() {
 	r.remainingBytesFromLastRead = r.remainingBytesFromLastRead[:0]
+	r.offset = 0
+	r.lineNumber = 0
+	r.truncatedLine = nil
+	r.discardedBytes = 0
 }
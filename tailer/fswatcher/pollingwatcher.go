@@ -21,7 +21,11 @@ func (w *pollingWatcher) runFseventProducerLoop() fseventProducerLoop {
 }
 
 func (w *pollingWatcher) processEvent(t *fileTailer, fsevent fsevent, log logrus.FieldLogger) Error {
-	for _, dir := range t.watchedDirs {
+	// syncFilesInDir() adds and removes watched sub-directories, so we iterate over a copy.
+	for _, dir := range append([]*Dir{}, t.watchedDirs...) {
+		if t.findWatchedDir(dir.Path()) != dir {
+			continue // removed while syncing the parent directory
+		}
 		err := t.syncFilesInDir(dir, true, log)
 		if err != nil {
 			return err
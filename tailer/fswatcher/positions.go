@@ -0,0 +1,240 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fswatcher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Number of bytes at the beginning of a file that are used for the fingerprint.
+const fingerprintSize = 256
+
+// PositionFile stores the read positions of the watched files, so that reading can be resumed after a restart.
+// Files are identified by device and inode number. As inode numbers are re-used when files are deleted,
+// the position file also stores a fingerprint of the first bytes of each file.
+// The positions refer to the lines that were read by the tailer, not to the lines that were processed.
+type PositionFile struct {
+	path      string
+	lock      sync.Mutex
+	positions map[string]*filePosition // file path -> position
+	dirty     bool                     // true if positions changed since the last flush
+	closed    bool
+	done      chan struct{}
+}
+
+type filePosition struct {
+	Path            string `json:"path"`
+	Dev             uint64 `json:"dev"`
+	Inode           uint64 `json:"inode"`
+	Offset          int64  `json:"offset"`           // position after the last line that was read
+	LineNumber      int64  `json:"line_number"`      // number of the last line that was read, -1 if unknown
+	Fingerprint     string `json:"fingerprint"`      // hex encoded sha256 of the first FingerprintSize bytes
+	FingerprintSize int64  `json:"fingerprint_size"` // less than fingerprintSize if the file was smaller
+}
+
+type positionFileContent struct {
+	Files []*filePosition `json:"files"`
+}
+
+// OpenPositionFile reads the position file, if it exists, and writes the positions every flushInterval until Close() is called.
+func OpenPositionFile(path string, flushInterval time.Duration, log logrus.FieldLogger) (*PositionFile, error) {
+	p := &PositionFile{
+		path:      path,
+		positions: make(map[string]*filePosition),
+		done:      make(chan struct{}),
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read position file: %v", err)
+	}
+	if err == nil {
+		content := positionFileContent{}
+		err = json.Unmarshal(data, &content)
+		if err != nil {
+			return nil, fmt.Errorf("%v: failed to parse position file: %v", path, err)
+		}
+		for _, pos := range content.Files {
+			p.positions[pos.Path] = pos
+		}
+	}
+	go func() {
+		ticker := time.NewTicker(flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := p.Flush()
+				if err != nil {
+					log.Warnf("%v", err)
+				}
+			case <-p.done:
+				return
+			}
+		}
+	}()
+	return p, nil
+}
+
+// Flush writes the positions to the position file. The file is replaced atomically.
+func (p *PositionFile) Flush() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.dirty {
+		return nil
+	}
+	content := positionFileContent{Files: []*filePosition{}}
+	for _, pos := range p.positions {
+		content.Files = append(content.Files, pos)
+	}
+	sort.Slice(content.Files, func(i, j int) bool {
+		return content.Files[i].Path < content.Files[j].Path
+	})
+	data, err := json.MarshalIndent(content, "", "  ")
+	if err != nil {
+		return fmt.Errorf("%v: failed to write position file: %v", p.path, err)
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(p.path), filepath.Base(p.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("%v: failed to write position file: %v", p.path, err)
+	}
+	_, err = tmpFile.Write(append(data, '\n'))
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), p.path)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return fmt.Errorf("%v: failed to write position file: %v", p.path, err)
+	}
+	p.dirty = false
+	return nil
+}
+
+// Close stops the periodic flush and writes the positions a last time.
+// Positions updated after Close() are ignored.
+func (p *PositionFile) Close() error {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.done)
+	p.lock.Unlock()
+	return p.Flush()
+}
+
+// find returns a copy of the position of the file with the given device and inode number, or nil if there is none.
+func (p *PositionFile) find(dev, inode uint64) *filePosition {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, pos := range p.positions {
+		if pos.Dev == dev && pos.Inode == inode {
+			result := *pos
+			return &result
+		}
+	}
+	return nil
+}
+
+// get returns a copy of the position stored for the path, or nil if there is none.
+func (p *PositionFile) get(path string) *filePosition {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if pos := p.positions[path]; pos != nil {
+		result := *pos
+		return &result
+	}
+	return nil
+}
+
+func (p *PositionFile) set(pos *filePosition) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return
+	}
+	// Another file might be recorded with the same inode, if it was deleted while grok_exporter was not running.
+	for path, existing := range p.positions {
+		if path != pos.Path && existing.Dev == pos.Dev && existing.Inode == pos.Inode {
+			delete(p.positions, path)
+		}
+	}
+	p.positions[pos.Path] = pos
+	p.dirty = true
+}
+
+func (p *PositionFile) setOffset(path string, offset, lineNumber int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed || p.positions[path] == nil {
+		return
+	}
+	p.positions[path].Offset = offset
+	p.positions[path].LineNumber = lineNumber
+	p.dirty = true
+}
+
+func (p *PositionFile) remove(path string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, exists := p.positions[path]; p.closed || !exists {
+		return
+	}
+	delete(p.positions, path)
+	p.dirty = true
+}
+
+// retain removes the positions of all files that are not in paths.
+func (p *PositionFile) retain(paths map[string]*fileWithReader) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return
+	}
+	for path := range p.positions {
+		if _, exists := paths[path]; !exists {
+			delete(p.positions, path)
+			p.dirty = true
+		}
+	}
+}
+
+// fingerprint returns the hex encoded sha256 of the first n bytes of the file.
+func fingerprint(file io.ReaderAt, n int64) (string, error) {
+	buf := make([]byte, n)
+	_, err := file.ReadAt(buf, 0)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(buf)
+	return hex.EncodeToString(hash[:]), nil
+}
@@ -597,7 +597,7 @@ func mkdir(t *testing.T, ctx *context, dirname string) {
 
 func startFileTailer(t *testing.T, ctx *context, params []string) {
 	var (
-		parsedGlobs       []glob.Glob
+		parsedGlobs       []fswatcher.WatchedGlob
 		tailer            fswatcher.FileTailer
 		readall           = false
 		failOnMissingFile = true
@@ -623,12 +623,12 @@ func startFileTailer(t *testing.T, ctx *context, params []string) {
 		if err != nil {
 			fatalf(t, ctx, "%v", err)
 		}
-		parsedGlobs = append(parsedGlobs, parsedGlob)
+		parsedGlobs = append(parsedGlobs, fswatcher.WatchedGlob{Glob: parsedGlob, Readall: readall, FailOnMissingFile: failOnMissingFile})
 	}
 	if ctx.tailerCfg == fseventTailer {
-		tailer, err = fswatcher.RunFileTailer(parsedGlobs, readall, failOnMissingFile, ctx.log)
+		tailer, err = fswatcher.RunFileTailer(parsedGlobs, nil, ctx.log)
 	} else {
-		tailer, err = fswatcher.RunPollingFileTailer(parsedGlobs, readall, failOnMissingFile, 10*time.Millisecond, ctx.log)
+		tailer, err = fswatcher.RunPollingFileTailer(parsedGlobs, 10*time.Millisecond, nil, ctx.log)
 	}
 	if err != nil {
 		fatalf(t, ctx, "%v", err)
@@ -849,11 +849,11 @@ func deleteRecursively(t *testing.T, ctx *context, file string) {
 		}
 	}
 	ctx.log.Debugf("tearDown: removing %q", file)
-	delete(t, ctx, file)
+	deleteFile(t, ctx, file)
 }
 
 // Verbose implementation of os.Remove() to debug a Windows "Access is denied" issue.
-func delete(t *testing.T, ctx *context, file string) {
+func deleteFile(t *testing.T, ctx *context, file string) {
 	var (
 		err, statErr error
 		timeout      = 5 * time.Second
@@ -945,7 +945,7 @@ func runTestShutdown(t *testing.T, mode string) {
 	if err != nil {
 		fatalf(t, ctx, "%q: failed to parse glob: %q", parsedGlob, err)
 	}
-	tailer, err := fswatcher.RunFileTailer([]glob.Glob{parsedGlob}, false, true, ctx.log)
+	tailer, err := fswatcher.RunFileTailer([]fswatcher.WatchedGlob{{Glob: parsedGlob, FailOnMissingFile: true}}, nil, ctx.log)
 	if err != nil {
 		fatalf(t, ctx, "failed to start tailer: %v", err)
 	}
@@ -983,6 +983,32 @@ func runTestShutdown(t *testing.T, mode string) {
 	assertGoroutinesTerminated(t, ctx, nGoroutinesBefore)
 }
 
+// In batch mode, the last line is read even if the file doesn't end with a newline.
+func TestBatchFileTailerLastLineWithoutNewline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter_batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logfile := filepath.Join(dir, "test.log")
+	appendLines(t, logfile, "line 1\nline 2\nline 3")
+	g, err := glob.Parse(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tail, err := fswatcher.RunBatchFileTailer([]fswatcher.WatchedGlob{{Glob: g, Readall: true, FailOnMissingFile: true}}, nil, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var received []string
+	for line := range tail.Lines() {
+		received = append(received, line.Line)
+	}
+	if strings.Join(received, ",") != "line 1,line 2,line 3" {
+		t.Fatalf("expected lines 1 - 3, but got %q", received)
+	}
+}
+
 func makeLinesFromTailer(tailer fswatcher.FileTailer) *linesFromTailer {
 	return &linesFromTailer{
 		tailer: tailer,
@@ -18,13 +18,15 @@ import (
 	"fmt"
 	"path/filepath"
 	"runtime"
+	"strings"
 )
 
+// A Glob is an absolute path pattern. Wildcards may be used in the file name and in the directory path.
+// In addition to the wildcards supported by filepath.Match, a path element "**" matches zero or more directories.
 type Glob string
 
 func Parse(pattern string) (Glob, error) {
 	var (
-		result  Glob
 		absglob string
 		err     error
 	)
@@ -35,31 +37,73 @@ func Parse(pattern string) (Glob, error) {
 	if err != nil {
 		return "", fmt.Errorf("%q: failed to finnd absolute path for glob pattern: %v", pattern, err)
 	}
-	result = Glob(absglob)
-	if containsWildcards(result.Dir()) {
-		return "", fmt.Errorf("%q: wildcards are only allowed in the file name, but not in the directory path", pattern)
-	}
-	return result, nil
+	return Glob(absglob), nil
 }
 
 func (g Glob) Dir() string {
 	return filepath.Dir(string(g))
 }
 
+// Root returns the longest directory path without wildcards.
+// All files matching the glob are located in Root() or in its sub-directories.
+func (g Glob) Root() string {
+	segments := splitPath(g.Dir())
+	for i, segment := range segments {
+		if segment == "**" || containsWildcards(segment) {
+			segments = segments[:i]
+			break
+		}
+	}
+	return joinPath(segments)
+}
+
 func (g Glob) Match(path string) bool {
-	matched, _ := filepath.Match(string(g), path)
-	return matched
+	return match(splitPath(string(g)), splitPath(path), false)
+}
+
+// MatchDir reports whether the directory may contain files matching the glob,
+// either directly or in one of its sub-directories.
+func (g Glob) MatchDir(dir string) bool {
+	return match(splitPath(string(g)), splitPath(dir), true)
+}
+
+// match compares the path element by element. If isDir is true, path is a directory,
+// and match reports whether there is a matching path below that directory.
+func match(pattern, path []string, isDir bool) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			if isDir {
+				return true
+			}
+			for i := 0; i <= len(path); i++ {
+				if match(pattern[1:], path[i:], false) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(path) == 0 {
+			return isDir
+		}
+		if matched, _ := filepath.Match(pattern[0], path[0]); !matched {
+			return false
+		}
+		pattern, path = pattern[1:], path[1:]
+	}
+	return len(path) == 0 && !isDir
+}
+
+func splitPath(path string) []string {
+	return strings.Split(filepath.Clean(path), string(filepath.Separator))
 }
 
-// The file tailer implementation switched from watching single paths to globs,
-// but the rest of grok_exporter just supports single files.
-// FromPath creates a Glob from a file path, so that we can use the new file
-// tailers but be sure only a single file is watched.
-func FromPath(path string) (Glob, error) {
-	if containsWildcards(path) {
-		return "", fmt.Errorf("%v: illegal file name", path)
+func joinPath(segments []string) string {
+	result := strings.Join(segments, string(filepath.Separator))
+	if len(segments) <= 1 {
+		// root directory, like "/" or "C:\"
+		result += string(filepath.Separator)
 	}
-	return Parse(path)
+	return result
 }
 
 func containsWildcards(pattern string) bool {
@@ -71,7 +115,7 @@ func containsWildcards(pattern string) bool {
 			continue
 		}
 		if !escaped && (p[i] == '[' || p[i] == '*' || p[i] == '?') {
-			return false
+			return true
 		}
 		escaped = false
 	}
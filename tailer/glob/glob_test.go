@@ -0,0 +1,99 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package glob
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestGlob(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test uses unix paths")
+	}
+	for _, test := range []struct {
+		glob       string
+		root       string
+		matches    []string
+		mismatches []string
+		dirs       []string // directories that may contain matching files
+		otherDirs  []string // directories that cannot contain matching files
+	}{
+		{
+			glob:       "/var/log/*.log",
+			root:       "/var/log",
+			matches:    []string{"/var/log/a.log", "/var/log/.log"},
+			mismatches: []string{"/var/log/a.txt", "/var/log/x/a.log", "/var/a.log"},
+			otherDirs:  []string{"/var/log/x", "/tmp"},
+		},
+		{
+			glob:       "/var/log/*/app.log",
+			root:       "/var/log",
+			matches:    []string{"/var/log/x/app.log", "/var/log/y/app.log"},
+			mismatches: []string{"/var/log/app.log", "/var/log/x/y/app.log", "/var/log/x/other.log"},
+			dirs:       []string{"/var/log/x"},
+			otherDirs:  []string{"/var/log/x/y", "/var/other"},
+		},
+		{
+			glob:       "/srv/**/access.log",
+			root:       "/srv",
+			matches:    []string{"/srv/access.log", "/srv/a/access.log", "/srv/a/b/c/access.log"},
+			mismatches: []string{"/srv/a/error.log", "/other/access.log", "/srv/a/access.log/x"},
+			dirs:       []string{"/srv/a", "/srv/a/b/c"},
+			otherDirs:  []string{"/other/a"},
+		},
+		{
+			glob:       "/srv/*/logs/**/*.log",
+			root:       "/srv",
+			matches:    []string{"/srv/a/logs/x.log", "/srv/a/logs/b/c/x.log"},
+			mismatches: []string{"/srv/a/x.log", "/srv/a/b/logs/x.log"},
+			dirs:       []string{"/srv/a", "/srv/a/logs", "/srv/a/logs/b"},
+			otherDirs:  []string{"/srv/a/b"},
+		},
+		{
+			glob:    "/*.log",
+			root:    "/",
+			matches: []string{"/a.log"},
+		},
+	} {
+		g, err := Parse(test.glob)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", test.glob, err)
+		}
+		if g.Root() != test.root {
+			t.Errorf("%v: expected root %v but got %v", test.glob, test.root, g.Root())
+		}
+		for _, path := range test.matches {
+			if !g.Match(path) {
+				t.Errorf("%v: expected %v to match", test.glob, path)
+			}
+		}
+		for _, path := range test.mismatches {
+			if g.Match(path) {
+				t.Errorf("%v: expected %v not to match", test.glob, path)
+			}
+		}
+		for _, dir := range test.dirs {
+			if !g.MatchDir(dir) {
+				t.Errorf("%v: expected directory %v to match", test.glob, dir)
+			}
+		}
+		for _, dir := range test.otherDirs {
+			if g.MatchDir(dir) {
+				t.Errorf("%v: expected directory %v not to match", test.glob, dir)
+			}
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/fstab/grok_exporter/tailer/glob"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDirectoryWildcards(t *testing.T) {
+	for _, polling := range []bool{false, true} {
+		runDirectoryWildcardsTest(t, polling)
+	}
+}
+
+func runDirectoryWildcardsTest(t *testing.T, polling bool) {
+	dir, err := ioutil.TempDir("", "grok_exporter_globs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mkdirAll(t, filepath.Join(dir, "app1"))
+	appendLines(t, filepath.Join(dir, "app1", "app.log"), "old line\n")
+
+	globs := make([]fswatcher.WatchedGlob, 0, 2)
+	for _, pattern := range []string{"*/app.log", "srv/**/access.log"} {
+		g, err := glob.Parse(filepath.Join(dir, pattern))
+		if err != nil {
+			t.Fatal(err)
+		}
+		globs = append(globs, fswatcher.WatchedGlob{Glob: g})
+	}
+	mkdirAll(t, filepath.Join(dir, "srv"))
+	var tail fswatcher.FileTailer
+	if polling {
+		tail, err = fswatcher.RunPollingFileTailer(globs, 10*time.Millisecond, nil, logrus.New())
+	} else {
+		tail, err = fswatcher.RunFileTailer(globs, nil, logrus.New())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tail.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// Files existing at startup are read from the end, because readall is false.
+	appendLines(t, filepath.Join(dir, "app1", "app.log"), "line 1\n")
+	expectLines(t, tail, "line 1")
+
+	// Directories created at runtime are watched, and their files are read from the beginning.
+	mkdirAll(t, filepath.Join(dir, "app2"))
+	time.Sleep(100 * time.Millisecond)
+	appendLines(t, filepath.Join(dir, "app2", "app.log"), "line 2\n")
+	expectLines(t, tail, "line 2")
+	appendLines(t, filepath.Join(dir, "app2", "other.log"), "not matching\n")
+	expectLines(t, tail)
+
+	mkdirAll(t, filepath.Join(dir, "srv", "a", "b"))
+	time.Sleep(100 * time.Millisecond)
+	appendLines(t, filepath.Join(dir, "srv", "a", "b", "access.log"), "line 3\n")
+	expectLines(t, tail, "line 3")
+	appendLines(t, filepath.Join(dir, "srv", "access.log"), "line 4\n")
+	expectLines(t, tail, "line 4")
+
+	// Removing a sub-directory is not an error.
+	if err = os.RemoveAll(filepath.Join(dir, "srv", "a")); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.RemoveAll(filepath.Join(dir, "app2")); err != nil {
+		t.Fatal(err)
+	}
+	expectLines(t, tail)
+	appendLines(t, filepath.Join(dir, "app1", "app.log"), "line 5\n")
+	expectLines(t, tail, "line 5")
+
+	// A sub-directory with the same name as a removed one is watched again.
+	mkdirAll(t, filepath.Join(dir, "app2"))
+	time.Sleep(100 * time.Millisecond)
+	appendLines(t, filepath.Join(dir, "app2", "app.log"), "line 6\n")
+	expectLines(t, tail, "line 6")
+}
+
+func mkdirAll(t *testing.T, path string) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
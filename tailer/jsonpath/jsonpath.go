@@ -0,0 +1,193 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package jsonpath implements the selectors used to find values in JSON documents, like '.records[*].message'.
+//
+// A path starts with '.' followed by object keys separated by '.'. Each key may be followed by array
+// indexes in square brackets: '[2]' selects a single element, '[*]' or '[]' selects all elements.
+// The path '.' selects the document itself, and '.[*]' selects all elements of a top-level array.
+package jsonpath
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type Path struct {
+	path     string
+	segments []segment
+}
+
+type segment struct {
+	key      string // object key, empty if this is an array index
+	index    int    // array index, -1 if this is an object key or a wildcard
+	wildcard bool
+}
+
+// Match is a value found by a Path.
+type Match struct {
+	Value interface{}
+	// Entry is the array element selected by the last wildcard in the path, or the document if the
+	// path has no wildcard. If the path is '.records[*].message', Entry is the record containing the message.
+	Entry interface{}
+}
+
+func Parse(path string) (Path, error) {
+	if !strings.HasPrefix(path, ".") {
+		return Path{}, fmt.Errorf("%v: path must start with \".\"", path)
+	}
+	result := Path{path: path}
+	rest := path[1:]
+	for first := true; ; first = false {
+		end := strings.IndexAny(rest, ".[")
+		if end < 0 {
+			end = len(rest)
+		}
+		if end > 0 {
+			result.segments = append(result.segments, segment{key: rest[:end], index: -1})
+		} else if !first {
+			return Path{}, fmt.Errorf("%v: empty key", path)
+		}
+		rest = rest[end:]
+		for strings.HasPrefix(rest, "[") {
+			end = strings.Index(rest, "]")
+			if end < 0 {
+				return Path{}, fmt.Errorf("%v: missing \"]\"", path)
+			}
+			s, err := parseIndex(rest[1:end])
+			if err != nil {
+				return Path{}, fmt.Errorf("%v: %v", path, err)
+			}
+			result.segments = append(result.segments, s)
+			rest = rest[end+1:]
+		}
+		if len(rest) == 0 {
+			return result, nil
+		}
+		if rest[0] != '.' {
+			return Path{}, fmt.Errorf("%v: unexpected %q after \"]\"", path, rest[0])
+		}
+		rest = rest[1:]
+		if len(rest) == 0 {
+			return Path{}, fmt.Errorf("%v: path must not end with \".\"", path)
+		}
+	}
+}
+
+func parseIndex(index string) (segment, error) {
+	if index == "" || index == "*" {
+		return segment{index: -1, wildcard: true}, nil
+	}
+	i, err := strconv.Atoi(index)
+	if err != nil || i < 0 {
+		return segment{}, fmt.Errorf("invalid array index %q", index)
+	}
+	return segment{index: i}, nil
+}
+
+func (p Path) String() string {
+	return p.path
+}
+
+// HasWildcard is true if the path may select more than one value.
+func (p Path) HasWildcard() bool {
+	for _, s := range p.segments {
+		if s.wildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// Find returns all values selected by the path. Missing keys and type mismatches are not an error,
+// they just don't produce a Match.
+func (p Path) Find(document interface{}) []Match {
+	return find(document, document, p.segments, nil)
+}
+
+// FindFirst returns the first value selected by the path.
+func (p Path) FindFirst(document interface{}) (interface{}, bool) {
+	matches := p.Find(document)
+	if len(matches) == 0 {
+		return nil, false
+	}
+	return matches[0].Value, true
+}
+
+func find(value, entry interface{}, segments []segment, result []Match) []Match {
+	if len(segments) == 0 {
+		return append(result, Match{Value: value, Entry: entry})
+	}
+	s := segments[0]
+	switch {
+	case s.wildcard:
+		if array, ok := value.([]interface{}); ok {
+			for _, element := range array {
+				result = find(element, element, segments[1:], result)
+			}
+		}
+	case s.index >= 0:
+		if array, ok := value.([]interface{}); ok && s.index < len(array) {
+			result = find(array[s.index], entry, segments[1:], result)
+		}
+	default:
+		if object, ok := value.(map[string]interface{}); ok {
+			if child, exists := object[s.key]; exists {
+				result = find(child, entry, segments[1:], result)
+			}
+		}
+	}
+	return result
+}
+
+// Unmarshal parses a JSON document. Numbers are kept as json.Number, so that they are formatted
+// without loss of precision by String().
+func Unmarshal(data []byte) (interface{}, error) {
+	var result interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err := decoder.Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("unexpected data after the JSON document")
+	}
+	return result, nil
+}
+
+// String formats a value found in a document. Strings are returned without quotes,
+// objects and arrays are returned as JSON, null is the empty string.
+func String(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		result, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprintf("%v", v)
+		}
+		return string(result)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsonpath
+
+import (
+	"reflect"
+	"testing"
+)
+
+const document = `{
+  "host": "web-1",
+  "records": [
+    {"message": "first", "level": "info", "code": 200},
+    {"message": "second", "level": "error", "tags": ["a", "b"]},
+    {"level": "debug"}
+  ],
+  "events": [{"log": "e1"}, {"log": "e2"}],
+  "nested": {"inner": {"value": true}}
+}`
+
+func TestFind(t *testing.T) {
+	doc, err := Unmarshal([]byte(document))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		path     string
+		expected []string
+	}{
+		{".host", []string{"web-1"}},
+		{".records[*].message", []string{"first", "second"}},
+		{".records[].level", []string{"info", "error", "debug"}},
+		{".records[1].message", []string{"second"}},
+		{".records[5].message", nil},
+		{".records[0].code", []string{"200"}},
+		{".records[1].tags", []string{`["a","b"]`}},
+		{".records[*].tags[*]", []string{"a", "b"}},
+		{".events[].log", []string{"e1", "e2"}},
+		{".nested.inner.value", []string{"true"}},
+		{".nested.inner", []string{`{"value":true}`}},
+		{".missing", nil},
+		{".host.missing", nil},
+	} {
+		p, err := Parse(test.path)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", test.path, err)
+		}
+		var result []string
+		for _, match := range p.Find(doc) {
+			result = append(result, String(match.Value))
+		}
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Fatalf("%v: expected %v, but got %v", test.path, test.expected, result)
+		}
+	}
+}
+
+func TestEntry(t *testing.T) {
+	doc, err := Unmarshal([]byte(document))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := Parse(".records[*].message")
+	level, _ := Parse(".level")
+	var levels []string
+	for _, match := range p.Find(doc) {
+		value, _ := level.FindFirst(match.Entry)
+		levels = append(levels, String(value))
+	}
+	if !reflect.DeepEqual(levels, []string{"info", "error"}) {
+		t.Fatalf("expected the entries to be the records, but got levels %v", levels)
+	}
+	p, _ = Parse(".nested.inner.value")
+	host, _ := Parse(".host")
+	matches := p.Find(doc)
+	if value, _ := host.FindFirst(matches[0].Entry); String(value) != "web-1" {
+		t.Fatalf("expected the entry to be the document for a path without wildcard")
+	}
+}
+
+func TestTopLevelArray(t *testing.T) {
+	doc, err := Unmarshal([]byte(`[{"message": "a"}, {"message": "b"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Parse(".[*].message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matches := p.Find(doc); len(matches) != 2 || String(matches[1].Value) != "b" {
+		t.Fatalf("unexpected matches %v", matches)
+	}
+	p, err = Parse(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matches := p.Find(doc); len(matches) != 1 {
+		t.Fatalf("expected '.' to select the document, but got %v", matches)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, path := range []string{"", "message", ".a.", ".a..b", ".a[", ".a[x]", ".a[-1]", ".a[0]b"} {
+		if _, err := Parse(path); err == nil {
+			t.Fatalf("%q: expected error", path)
+		}
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	for _, data := range []string{"", "{", `{"a": 1} {"b": 2}`} {
+		if _, err := Unmarshal([]byte(data)); err == nil {
+			t.Fatalf("%q: expected error", data)
+		}
+	}
+}
@@ -11,10 +11,12 @@ import (
 // lineBuffer is a thread safe queue for *fswatcher.Line.
 type lineBuffer interface {
 	Push(line *fswatcher.Line)
-	BlockingPop() *fswatcher.Line // can be interrupted by calling Close()
+	BlockingPop() *fswatcher.Line // returns nil when the buffer is closed and empty
+	Pop() *fswatcher.Line         // returns nil when the buffer is empty, does not block
+	WaitForSpace(maxLines int)    // blocks until there are less than maxLines lines in the buffer
 	Len() int
-	io.Closer // will interrupt BlockingPop()
-	Clear()
+	io.Closer   // will interrupt BlockingPop() and WaitForSpace()
+	Clear() int // returns the number of lines removed
 }
 
 func NewLineBuffer() lineBuffer {
@@ -40,35 +42,56 @@ func (b *lineBufferImpl) Push(line *fswatcher.Line) {
 	}
 }
 
-// Interrupted by Close(), returns nil when Close() is called.
+// Interrupted by Close(). Lines that were pushed before Close() are still returned,
+// so that the consumer can process all lines when the input reached end of file.
+// Returns nil when the buffer is closed and empty.
 func (b *lineBufferImpl) BlockingPop() *fswatcher.Line {
 	b.lock.L.Lock()
 	defer b.lock.L.Unlock()
-	if !b.closed {
-		for b.buffer.Len() == 0 && !b.closed {
-			b.lock.Wait()
-		}
-		if !b.closed {
-			first := b.buffer.Front()
-			b.buffer.Remove(first)
-			switch line := first.Value.(type) {
-			case *fswatcher.Line:
-				return line
-			default:
-				// this cannot happen
-				logFatal.Fatal("unexpected type in tailer b.buffer")
-			}
+	for b.buffer.Len() == 0 && !b.closed {
+		b.lock.Wait()
+	}
+	// Wake up the producer if it is waiting in WaitForSpace().
+	b.lock.Broadcast()
+	return b.removeFirst()
+}
+
+func (b *lineBufferImpl) Pop() *fswatcher.Line {
+	b.lock.L.Lock()
+	defer b.lock.L.Unlock()
+	return b.removeFirst()
+}
+
+func (b *lineBufferImpl) removeFirst() *fswatcher.Line {
+	if b.buffer.Len() > 0 {
+		first := b.buffer.Front()
+		b.buffer.Remove(first)
+		switch line := first.Value.(type) {
+		case *fswatcher.Line:
+			return line
+		default:
+			// this cannot happen
+			logFatal.Fatal("unexpected type in tailer b.buffer")
 		}
 	}
 	return nil
 }
 
+// Interrupted by Close().
+func (b *lineBufferImpl) WaitForSpace(maxLines int) {
+	b.lock.L.Lock()
+	defer b.lock.L.Unlock()
+	for b.buffer.Len() >= maxLines && !b.closed {
+		b.lock.Wait()
+	}
+}
+
 func (b *lineBufferImpl) Close() error {
 	b.lock.L.Lock()
 	defer b.lock.L.Unlock()
 	if !b.closed {
 		b.closed = true
-		b.lock.Signal()
+		b.lock.Broadcast()
 	}
 	return nil
 }
@@ -79,8 +102,12 @@ func (b *lineBufferImpl) Len() int {
 	return b.buffer.Len()
 }
 
-func (b *lineBufferImpl) Clear() {
+func (b *lineBufferImpl) Clear() int {
 	b.lock.L.Lock()
 	defer b.lock.L.Unlock()
+	n := b.buffer.Len()
 	b.buffer = list.New()
+	// Wake up the producer if it is waiting in WaitForSpace().
+	b.lock.Broadcast()
+	return n
 }
@@ -89,7 +89,7 @@ func TestLineBufferBlockingPop(t *testing.T) {
 	go func() {
 		l := buf.BlockingPop()
 		if l.Line != "hello" {
-			t.Fatalf("expected to read \"hello\" but got %q.", l.Line)
+			t.Errorf("expected to read \"hello\" but got %q.", l.Line)
 		}
 		close(done)
 	}()
@@ -129,3 +129,19 @@ func TestLineBufferClose(t *testing.T) {
 		t.Fatal("BlockingPop() not interrupted by Close()")
 	}
 }
+
+func TestLineBufferPopAfterClose(t *testing.T) {
+	buf := NewLineBuffer()
+	buf.Push(&fswatcher.Line{Line: "a"})
+	buf.Push(&fswatcher.Line{Line: "b"})
+	buf.Close()
+	buf.Push(&fswatcher.Line{Line: "c"}) // ignored, because the buffer is closed
+	for _, expected := range []string{"a", "b"} {
+		if l := buf.BlockingPop(); l == nil || l.Line != expected {
+			t.Fatalf("expected to read %q after Close(), but got %v.", expected, l)
+		}
+	}
+	if l := buf.BlockingPop(); l != nil {
+		t.Fatalf("expected nil when the closed buffer is empty, but got %q.", l.Line)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+)
+
+// implements fswatcher.FileTailer
+type lineLimitTailer struct {
+	out  chan *fswatcher.Line
+	orig fswatcher.FileTailer
+	done chan struct{}
+}
+
+func (l *lineLimitTailer) Lines() chan *fswatcher.Line {
+	return l.out
+}
+
+func (l *lineLimitTailer) Errors() chan fswatcher.Error {
+	return l.orig.Errors()
+}
+
+func (l *lineLimitTailer) Close() {
+	l.orig.Close()
+	close(l.done)
+}
+
+// LineLimitTailer handles long lines and invalid UTF-8 as defined in limits. File inputs apply the limits
+// while reading the file, this is for inputs like stdin, webhook, and syslog.
+// Skipped lines are dropped.
+func LineLimitTailer(orig fswatcher.FileTailer, limits fswatcher.LineLimits) fswatcher.FileTailer {
+	result := &lineLimitTailer{
+		out:  make(chan *fswatcher.Line),
+		orig: orig,
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(result.out)
+		for {
+			select {
+			case line, open := <-orig.Lines():
+				if !open {
+					return
+				}
+				text, ok := limits.Apply(line.Line)
+				if !ok {
+					continue
+				}
+				limited := *line
+				limited.Line = text
+				select {
+				case result.out <- &limited:
+				case <-result.done:
+					return
+				}
+			case <-result.done:
+				return
+			}
+		}
+	}()
+	return result
+}
@@ -0,0 +1,49 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"testing"
+)
+
+func TestLineLimitTailer(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	nLong, nInvalid := 0, 0
+	limited := LineLimitTailer(src, fswatcher.LineLimits{
+		MaxLineBytes:      10,
+		ValidateUtf8:      true,
+		RejectInvalidUtf8: true,
+		OnLongLine:        func() { nLong++ },
+		OnInvalidUtf8:     func() { nInvalid++ },
+	})
+	go func() {
+		for _, line := range []string{"short", "0123456789abcdef", "bad \xff", "last"} {
+			src.lines <- &fswatcher.Line{Line: line, Input: "stdin"}
+		}
+		src.Close()
+	}()
+	var result []string
+	for line := range limited.Lines() {
+		if line.Input != "stdin" {
+			t.Fatalf("expected input %q, but got %q", "stdin", line.Input)
+		}
+		result = append(result, line.Line)
+	}
+	expectEvents(t, "limits", result, []string{"short", "0123456789", "last"})
+	if nLong != 1 || nInvalid != 1 {
+		t.Fatalf("Expected 1 long line and 1 line with invalid UTF-8, but got %v and %v", nLong, nInvalid)
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"github.com/fstab/grok_exporter/tailer/charset"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+const linesWithLimits = "short\n0123456789abcdef\naaaaaaaaaé\nbad \xff\r\nlast\n"
+
+func TestLineReaderTruncateAndReplace(t *testing.T) {
+	expected := []string{"short", "0123456789", "aaaaaaaaa", "bad �", "last"}
+	for _, oneByteAtATime := range []bool{false, true} {
+		nLong, nInvalid := 0, 0
+		limits := fswatcher.LineLimits{
+			MaxLineBytes:  10,
+			ValidateUtf8:  true,
+			OnLongLine:    func() { nLong++ },
+			OnInvalidUtf8: func() { nInvalid++ },
+		}
+		readLimitedLines(t, limits, oneByteAtATime, expected)
+		if nLong != 2 || nInvalid != 1 {
+			t.Fatalf("Expected 2 long lines and 1 line with invalid UTF-8, but got %v and %v", nLong, nInvalid)
+		}
+	}
+}
+
+func TestLineReaderSkipAndReject(t *testing.T) {
+	for _, oneByteAtATime := range []bool{false, true} {
+		nLong, nInvalid := 0, 0
+		limits := fswatcher.LineLimits{
+			MaxLineBytes:      10,
+			SkipLongLines:     true,
+			ValidateUtf8:      true,
+			RejectInvalidUtf8: true,
+			OnLongLine:        func() { nLong++ },
+			OnInvalidUtf8:     func() { nInvalid++ },
+		}
+		readLimitedLines(t, limits, oneByteAtATime, []string{"short", "last"})
+		if nLong != 2 || nInvalid != 1 {
+			t.Fatalf("Expected 2 long lines and 1 line with invalid UTF-8, but got %v and %v", nLong, nInvalid)
+		}
+	}
+}
+
+func TestLineReaderUnlimited(t *testing.T) {
+	long := strings.Repeat("x", 10000)
+	readLinesFrom(t, fswatcher.LineLimits{}, nil, strings.NewReader(long+"\n"), []string{long})
+	readLinesFrom(t, fswatcher.LineLimits{}, nil, strings.NewReader("bad \xff\n"), []string{"bad \xff"})
+}
+
+func TestLineLimitsApply(t *testing.T) {
+	for _, test := range []struct {
+		limits   fswatcher.LineLimits
+		line     string
+		expected string
+		ok       bool
+	}{
+		{line: "0123456789abcdef bad \xff", expected: "0123456789abcdef bad \xff", ok: true},
+		{limits: fswatcher.LineLimits{MaxLineBytes: 10}, line: "0123456789abcdef", expected: "0123456789", ok: true},
+		{limits: fswatcher.LineLimits{MaxLineBytes: 10}, line: "aaaaaaaaaé", expected: "aaaaaaaaa", ok: true},
+		{limits: fswatcher.LineLimits{MaxLineBytes: 10, SkipLongLines: true}, line: "0123456789abcdef", ok: false},
+		{limits: fswatcher.LineLimits{MaxLineBytes: 10, SkipLongLines: true}, line: "0123456789", expected: "0123456789", ok: true},
+		{limits: fswatcher.LineLimits{ValidateUtf8: true}, line: "bad \xff", expected: "bad \uFFFD", ok: true},
+		{limits: fswatcher.LineLimits{ValidateUtf8: true}, line: "a\xff\xfeé\xc3", expected: "a\uFFFD\uFFFDé\uFFFD", ok: true},
+		{limits: fswatcher.LineLimits{ValidateUtf8: true, RejectInvalidUtf8: true}, line: "bad \xff", ok: false},
+	} {
+		line, ok := test.limits.Apply(test.line)
+		if ok != test.ok || line != test.expected {
+			t.Fatalf("%q: expected %q, %v, but got %q, %v", test.line, test.expected, test.ok, line, ok)
+		}
+	}
+}
+
+func TestLineReaderEncodings(t *testing.T) {
+	for _, test := range []struct {
+		encoding string
+		file     string
+		expected []string
+	}{
+		{
+			encoding: "utf-16le",
+			file:     "\xff\xfeh\x00\xe9\x00\r\x00\n\x00\x0a\x0a\n\x00\x00\x0a\n\x00", // BOM, "hé\r\n", "\u0a0a", "\u0a00"
+			expected: []string{"hé", "\u0a0a", "\u0a00"},
+		},
+		{
+			encoding: "utf-16le", // byte order mark for big endian overrides the configured byte order
+			file:     "\xfe\xff\x00h\x00\xe9\x00\n",
+			expected: []string{"hé"},
+		},
+		{
+			encoding: "utf-16be",
+			file:     "\x00h\x00\xe9\x00\n\x30\x42\x00\n", // no BOM, "hé", "あ"
+			expected: []string{"hé", "あ"},
+		},
+		{
+			encoding: "iso-8859-1",
+			file:     "Gr\xfc\xdfe\r\n",
+			expected: []string{"Grüße"},
+		},
+		{
+			encoding: "Shift_JIS",
+			file:     "\x83\x65\x83\x58\x83\x67\n\x93\xfa\x96\x7b\n", // テスト, 日本
+			expected: []string{"テスト", "日本"},
+		},
+	} {
+		cs, err := charset.Get(test.encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, oneByteAtATime := range []bool{false, true} {
+			var file io.Reader = strings.NewReader(test.file)
+			if oneByteAtATime {
+				file = iotest.OneByteReader(file)
+			}
+			readLinesFrom(t, fswatcher.LineLimits{}, cs, file, test.expected)
+		}
+	}
+}
+
+func TestLineReaderTruncateUtf16(t *testing.T) {
+	cs, err := charset.Get("utf-16le")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := iotest.OneByteReader(strings.NewReader("a\x00b\x00c\x00d\x00\n\x00e\x00\n\x00"))
+	readLinesFrom(t, fswatcher.LineLimits{MaxLineBytes: 5}, cs, file, []string{"ab", "e"})
+}
+
+func TestLineReaderFlush(t *testing.T) {
+	for _, test := range []struct {
+		file     string
+		limits   fswatcher.LineLimits
+		expected string
+		ok       bool
+	}{
+		{file: "line 1\nline 2", expected: "line 2", ok: true},
+		{file: "line 1\r\nline 2\r", expected: "line 2", ok: true},
+		{file: "line 1\n", ok: false},
+		{file: "line 1\nlong line 2", limits: fswatcher.LineLimits{MaxLineBytes: 6}, expected: "long l", ok: true},
+		{file: "line 1\nlong line 2", limits: fswatcher.LineLimits{MaxLineBytes: 6, SkipLongLines: true}, ok: false},
+		{file: "line 1\n\xff", limits: fswatcher.LineLimits{ValidateUtf8: true}, expected: "\uFFFD", ok: true},
+		{file: "line 1\n\xff", limits: fswatcher.LineLimits{ValidateUtf8: true, RejectInvalidUtf8: true}, ok: false},
+	} {
+		file := iotest.OneByteReader(strings.NewReader(test.file))
+		reader := fswatcher.NewLineReader(test.limits, nil)
+		if line, eof, err := reader.ReadLine(file); eof || err != nil || line != "line 1" {
+			t.Fatalf("%q: expected line %q, but got %q eof=%v err=%v", test.file, "line 1", line, eof, err)
+		}
+		if line, eof, err := reader.ReadLine(file); !eof || err != nil {
+			t.Fatalf("%q: expected end of file, but got line %q err=%v", test.file, line, err)
+		}
+		line, ok := reader.Flush()
+		if ok != test.ok || line != test.expected {
+			t.Fatalf("%q: expected flush to return %q, %v, but got %q, %v", test.file, test.expected, test.ok, line, ok)
+		}
+		if _, ok = reader.Flush(); ok {
+			t.Fatalf("%q: the remaining bytes were returned twice", test.file)
+		}
+	}
+}
+
+func readLimitedLines(t *testing.T, limits fswatcher.LineLimits, oneByteAtATime bool, expected []string) {
+	var file io.Reader = strings.NewReader(linesWithLimits)
+	if oneByteAtATime {
+		// Long lines exceed max_line_bytes before their '\n' is read.
+		file = iotest.OneByteReader(file)
+	}
+	readLinesFrom(t, limits, nil, file, expected)
+}
+
+func readLinesFrom(t *testing.T, limits fswatcher.LineLimits, cs *charset.Charset, file io.Reader, expected []string) {
+	reader := fswatcher.NewLineReader(limits, cs)
+	for _, expectedLine := range expected {
+		line, eof, err := reader.ReadLine(file)
+		if err != nil || eof {
+			t.Fatalf("Expected line %q, but got eof=%v err=%v", expectedLine, eof, err)
+		}
+		if line != expectedLine {
+			t.Fatalf("Expected line %q, but got %q", expectedLine, line)
+		}
+	}
+	if line, eof, err := reader.ReadLine(file); !eof || err != nil {
+		t.Fatalf("Expected end of file, but got line %q err=%v", line, err)
+	}
+}
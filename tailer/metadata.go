@@ -0,0 +1,41 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"github.com/fstab/grok_exporter/config/v2"
+	"sort"
+)
+
+// MetadataFields returns the names of the fswatcher.Line.Metadata fields provided by the input.
+// Label templates may use these fields in addition to the grok fields of the match pattern.
+// The name "*" means that the field names are taken from the input data, like the labels of a Loki stream.
+func MetadataFields(input *v2.InputConfig) []string {
+	switch input.Type {
+	case "syslog":
+		return syslogMetadataFields
+	case "webhook":
+		if isShipperFormat(input.WebhookFormat) {
+			return []string{"*"}
+		}
+		result := make([]string, 0, len(input.WebhookJsonFields))
+		for name := range input.WebhookJsonFields {
+			result = append(result, name)
+		}
+		sort.Strings(result)
+		return result
+	}
+	return nil
+}
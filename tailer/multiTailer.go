@@ -0,0 +1,96 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"sync"
+)
+
+// implements fswatcher.FileTailer
+type multiTailer struct {
+	lines   chan *fswatcher.Line
+	errors  chan fswatcher.Error
+	tailers []fswatcher.FileTailer
+	done    chan struct{}
+}
+
+func (m *multiTailer) Lines() chan *fswatcher.Line {
+	return m.lines
+}
+
+func (m *multiTailer) Errors() chan fswatcher.Error {
+	return m.errors
+}
+
+func (m *multiTailer) Close() {
+	close(m.done)
+	for _, t := range m.tailers {
+		t.Close()
+	}
+}
+
+// MultiTailer merges the lines and errors of multiple tailers into a single tailer.
+// The key of the map is the input name, each line is tagged with the name of the input it was read from.
+// The lines channel is closed when all tailers closed their lines channel.
+func MultiTailer(tailers map[string]fswatcher.FileTailer) fswatcher.FileTailer {
+	result := &multiTailer{
+		lines:   make(chan *fswatcher.Line),
+		errors:  make(chan fswatcher.Error),
+		tailers: make([]fswatcher.FileTailer, 0, len(tailers)),
+		done:    make(chan struct{}),
+	}
+	var wg sync.WaitGroup
+	for name, tail := range tailers {
+		result.tailers = append(result.tailers, tail)
+		wg.Add(1)
+		go func(name string, tail fswatcher.FileTailer) {
+			defer wg.Done()
+			lines, errors := tail.Lines(), tail.Errors()
+			for lines != nil || errors != nil {
+				select {
+				case line, open := <-lines:
+					if !open {
+						lines = nil
+						continue
+					}
+					line.Input = name
+					select {
+					case result.lines <- line:
+					case <-result.done:
+						return
+					}
+				case err, open := <-errors:
+					if !open {
+						errors = nil
+						continue
+					}
+					select {
+					case result.errors <- err:
+					case <-result.done:
+						return
+					}
+				case <-result.done:
+					return
+				}
+			}
+		}(name, tail)
+	}
+	go func() {
+		wg.Wait()
+		close(result.lines)
+	}()
+	return result
+}
@@ -0,0 +1,49 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"fmt"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"testing"
+)
+
+func TestMultiTailer(t *testing.T) {
+	src1 := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	src2 := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	merged := MultiTailer(map[string]fswatcher.FileTailer{
+		"input1": src1,
+		"input2": src2,
+	})
+	go func() {
+		for i := 1; i <= 10; i++ {
+			src1.lines <- &fswatcher.Line{Line: fmt.Sprintf("line %v", i)}
+			src2.lines <- &fswatcher.Line{Line: fmt.Sprintf("line %v", i)}
+		}
+	}()
+	count := make(map[string]int)
+	for i := 0; i < 20; i++ {
+		line := <-merged.Lines()
+		count[line.Input]++
+	}
+	if count["input1"] != 10 || count["input2"] != 10 {
+		t.Fatalf("Expected 10 lines from each input, but got %v", count)
+	}
+	merged.Close()
+	_, stillOpen := <-merged.Lines()
+	if stillOpen {
+		t.Error("Multi tailer was not closed.")
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"github.com/fstab/grok_exporter/config/v2"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"strings"
+	"time"
+)
+
+// implements fswatcher.FileTailer
+type multilineTailer struct {
+	out  chan *fswatcher.Line
+	orig fswatcher.FileTailer
+	done chan struct{}
+}
+
+func (m *multilineTailer) Lines() chan *fswatcher.Line {
+	return m.out
+}
+
+func (m *multilineTailer) Errors() chan fswatcher.Error {
+	return m.orig.Errors()
+}
+
+func (m *multilineTailer) Close() {
+	m.orig.Close()
+	close(m.done)
+}
+
+// MultilineTailer joins consecutive lines into a single multi-line event, like a stack trace.
+// Lines are joined per file, so lines from different files are never mixed up.
+// isMatch tells whether a line matches the multiline pattern, the meaning of the pattern is defined by cfg.Mode:
+//
+// * start:        A matching line starts a new event.
+// * continuation: A matching line is appended to the previous event.
+// * end:          A matching line ends the current event.
+//
+// The lines of an event are separated with "\n". An event is also complete when it reaches cfg.MaxLines or cfg.MaxBytes,
+// and when no new line was read from the file within cfg.FlushTimeout.
+//
+// isMatch is called only from the go-routine of the multiline tailer. When the go-routine terminates,
+// freeMatcher is called so that resources used by isMatch can be released. freeMatcher may be nil.
+func MultilineTailer(orig fswatcher.FileTailer, cfg *v2.MultilineConfig, isMatch func(line string) bool, freeMatcher func()) fswatcher.FileTailer {
+	result := &multilineTailer{
+		out:  make(chan *fswatcher.Line),
+		orig: orig,
+		done: make(chan struct{}),
+	}
+	joiner := newMultilineJoiner(cfg, isMatch)
+	go func() {
+		defer close(result.out)
+		if freeMatcher != nil {
+			defer freeMatcher()
+		}
+		checkInterval := cfg.FlushTimeout / 2
+		if checkInterval <= 0 {
+			checkInterval = time.Second
+		}
+		ticker := time.NewTicker(checkInterval)
+		defer ticker.Stop()
+		send := func(events []*fswatcher.Line) bool {
+			for _, event := range events {
+				select {
+				case result.out <- event:
+				case <-result.done:
+					return false
+				}
+			}
+			return true
+		}
+		for {
+			select {
+			case line, open := <-orig.Lines():
+				if !open {
+					send(joiner.flushAll())
+					return
+				}
+				if !send(joiner.add(line, time.Now())) {
+					return
+				}
+			case now := <-ticker.C:
+				if !send(joiner.flushExpired(now)) {
+					return
+				}
+			case <-result.done:
+				return
+			}
+		}
+	}()
+	return result
+}
+
+type multilineEvent struct {
+	lines      []string
+	size       int // number of bytes, including the newlines separating the lines
+	input      string
+	metadata   map[string]string // metadata of the first line
+	lineNumber int64             // line number of the first line
+	lastUpdate time.Time
+}
+
+type multilineJoiner struct {
+	cfg     *v2.MultilineConfig
+	isMatch func(line string) bool
+	pending map[string]*multilineEvent // file name -> incomplete event, no entry if there is no incomplete event
+}
+
+func newMultilineJoiner(cfg *v2.MultilineConfig, isMatch func(line string) bool) *multilineJoiner {
+	return &multilineJoiner{
+		cfg:     cfg,
+		isMatch: isMatch,
+		pending: make(map[string]*multilineEvent),
+	}
+}
+
+// add processes the next line and returns the events that are complete.
+func (j *multilineJoiner) add(line *fswatcher.Line, now time.Time) []*fswatcher.Line {
+	var result []*fswatcher.Line
+	matches := j.isMatch(line.Line)
+	event, exists := j.pending[line.File]
+	if exists {
+		startsNewEvent := (j.cfg.Mode == "start" && matches) || (j.cfg.Mode == "continuation" && !matches)
+		exceedsMaxBytes := j.cfg.MaxBytes > 0 && event.size+1+len(line.Line) > j.cfg.MaxBytes
+		if startsNewEvent || exceedsMaxBytes {
+			result = append(result, j.flush(line.File))
+			exists = false
+		}
+	}
+	if !exists {
+		event = &multilineEvent{input: line.Input, metadata: line.Metadata, lineNumber: line.LineNumber}
+		j.pending[line.File] = event
+	} else {
+		event.size++
+	}
+	event.lines = append(event.lines, line.Line)
+	event.size += len(line.Line)
+	event.lastUpdate = now
+	endsEvent := j.cfg.Mode == "end" && matches
+	reachedMaxLines := j.cfg.MaxLines > 0 && len(event.lines) >= j.cfg.MaxLines
+	reachedMaxBytes := j.cfg.MaxBytes > 0 && event.size >= j.cfg.MaxBytes
+	if endsEvent || reachedMaxLines || reachedMaxBytes {
+		result = append(result, j.flush(line.File))
+	}
+	return result
+}
+
+// flushExpired returns the events that were not updated within the flush timeout.
+func (j *multilineJoiner) flushExpired(now time.Time) []*fswatcher.Line {
+	var result []*fswatcher.Line
+	for file, event := range j.pending {
+		if now.Sub(event.lastUpdate) >= j.cfg.FlushTimeout {
+			result = append(result, j.flush(file))
+		}
+	}
+	return result
+}
+
+func (j *multilineJoiner) flushAll() []*fswatcher.Line {
+	var result []*fswatcher.Line
+	for file := range j.pending {
+		result = append(result, j.flush(file))
+	}
+	return result
+}
+
+func (j *multilineJoiner) flush(file string) *fswatcher.Line {
+	event := j.pending[file]
+	delete(j.pending, file)
+	return &fswatcher.Line{
+		Line:       strings.Join(event.lines, "\n"),
+		File:       file,
+		Input:      event.input,
+		Metadata:   event.metadata,
+		LineNumber: event.lineNumber,
+	}
+}
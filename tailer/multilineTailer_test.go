@@ -0,0 +1,163 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"fmt"
+	"github.com/fstab/grok_exporter/config/v2"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"regexp"
+	"testing"
+	"time"
+)
+
+const stackTrace = `2019-06-01 12:00:00 ERROR request failed
+java.lang.IllegalStateException: test
+    at com.example.Foo.bar(Foo.java:12)
+    at com.example.Foo.main(Foo.java:5)
+2019-06-01 12:00:01 INFO ok
+2019-06-01 12:00:02 INFO ok`
+
+func TestMultilineModes(t *testing.T) {
+	for _, test := range []struct {
+		mode     string
+		pattern  string
+		input    []string
+		expected []string
+	}{
+		{
+			mode:     "start",
+			pattern:  `^\d{4} `,
+			input:    []string{"2019 a", "b", "c", "2019 d", "2019 e"},
+			expected: []string{"2019 a\nb\nc", "2019 d"},
+		},
+		{
+			mode:     "continuation",
+			pattern:  `^\s`,
+			input:    []string{"a", " b", " c", "d", "e", " f"},
+			expected: []string{"a\n b\n c", "d"},
+		},
+		{
+			mode:     "end",
+			pattern:  `;$`,
+			input:    []string{"a", "b;", "c;", "d", "e"},
+			expected: []string{"a\nb;", "c;"},
+		},
+	} {
+		regex := regexp.MustCompile(test.pattern)
+		joiner := newMultilineJoiner(&v2.MultilineConfig{Mode: test.mode}, regex.MatchString)
+		var result []string
+		for _, line := range test.input {
+			for _, event := range joiner.add(&fswatcher.Line{Line: line, File: "test.log"}, time.Now()) {
+				result = append(result, event.Line)
+			}
+		}
+		expectEvents(t, test.mode, result, test.expected)
+	}
+}
+
+func TestMultilineLimits(t *testing.T) {
+	regex := regexp.MustCompile(`^\d{4}-`)
+	for _, test := range []struct {
+		cfg      *v2.MultilineConfig
+		expected []string
+	}{
+		{
+			cfg:      &v2.MultilineConfig{Mode: "start", MaxLines: 2},
+			expected: []string{"2019-1 a\nb", "c", "2019-2 d"},
+		},
+		{
+			cfg:      &v2.MultilineConfig{Mode: "start", MaxBytes: 9},
+			expected: []string{"2019-1 a", "b\nc", "2019-2 d"},
+		},
+	} {
+		joiner := newMultilineJoiner(test.cfg, regex.MatchString)
+		var result []string
+		for _, line := range []string{"2019-1 a", "b", "c", "2019-2 d", "2019-3 e"} {
+			for _, event := range joiner.add(&fswatcher.Line{Line: line, File: "test.log"}, time.Now()) {
+				result = append(result, event.Line)
+			}
+		}
+		expectEvents(t, "limits", result, test.expected)
+	}
+}
+
+func TestMultilineTailer(t *testing.T) {
+	src := &sourceTailer{lines: make(chan *fswatcher.Line)}
+	cfg := &v2.MultilineConfig{
+		Mode:         "start",
+		FlushTimeout: 50 * time.Millisecond,
+	}
+	regex := regexp.MustCompile(`^\d{4}-`)
+	freed := make(chan struct{})
+	tail := MultilineTailer(src, cfg, regex.MatchString, func() { close(freed) })
+	go func() {
+		// Interleave the stack trace with lines from another file.
+		for _, line := range regexp.MustCompile("\n").Split(stackTrace, -1) {
+			src.lines <- &fswatcher.Line{Line: line, File: "a.log"}
+			src.lines <- &fswatcher.Line{Line: "2019-06-01 " + line, File: "b.log"}
+		}
+	}()
+	// The last event is incomplete. It is sent when the flush timeout expires.
+	var result []string
+	timeout := time.After(5 * time.Second)
+	for len(result) < 3 {
+		select {
+		case event := <-tail.Lines():
+			if event.File == "a.log" {
+				result = append(result, event.Line)
+			}
+		case <-timeout:
+			t.Fatalf("incomplete event was not flushed: got %q", result)
+		}
+	}
+	expectEvents(t, "tailer", result, []string{
+		"2019-06-01 12:00:00 ERROR request failed\njava.lang.IllegalStateException: test\n    at com.example.Foo.bar(Foo.java:12)\n    at com.example.Foo.main(Foo.java:5)",
+		"2019-06-01 12:00:01 INFO ok",
+		"2019-06-01 12:00:02 INFO ok",
+	})
+	tail.Close()
+	select {
+	case <-freed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the matcher was not freed when the tailer was closed")
+	}
+}
+
+func TestMultilineFlushRemovesPendingEvents(t *testing.T) {
+	regex := regexp.MustCompile(`^\d{4}-`)
+	joiner := newMultilineJoiner(&v2.MultilineConfig{Mode: "start", FlushTimeout: time.Second}, regex.MatchString)
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		joiner.add(&fswatcher.Line{Line: "2019-06-01 a", File: fmt.Sprintf("%v.log", i)}, start)
+	}
+	if events := joiner.flushExpired(start.Add(time.Second)); len(events) != 100 {
+		t.Fatalf("expected 100 expired events, but got %v", len(events))
+	}
+	if len(joiner.pending) != 0 {
+		t.Fatalf("expected no pending events after flush, but got %v", len(joiner.pending))
+	}
+}
+
+func expectEvents(t *testing.T, name string, actual []string, expected []string) {
+	if len(actual) != len(expected) {
+		t.Fatalf("%v: expected %q, but got %q", name, expected, actual)
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Fatalf("%v: expected %q, but got %q", name, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/fstab/grok_exporter/tailer/glob"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPositionFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter_positions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logfile := filepath.Join(dir, "test.log")
+	positionFile := filepath.Join(dir, "positions.json")
+
+	appendLines(t, logfile, "line 1\n")
+
+	// The first run starts at the end of the file, as readall is false.
+	tail := runTailerWithPositions(t, logfile, positionFile)
+	appendLines(t, logfile, "line 2\n")
+	expectLines(t, tail, "line 2")
+	tail.Close()
+
+	// Lines written while grok_exporter is not running are read after the restart.
+	appendLines(t, logfile, "line 3\nline 4\nincomplete")
+	tail = runTailerWithPositions(t, logfile, positionFile)
+	expectLines(t, tail, "line 3", "line 4")
+	tail.Close()
+
+	// The incomplete line was not recorded as read.
+	appendLines(t, logfile, " line 5\n")
+	tail = runTailerWithPositions(t, logfile, positionFile)
+	expectLines(t, tail, "incomplete line 5")
+	tail.Close()
+
+	// A replaced file is not the same file, so the tailer starts at the end of the file.
+	if err = os.Remove(logfile); err != nil {
+		t.Fatal(err)
+	}
+	appendLines(t, logfile, "line 1 of the new file\n")
+	tail = runTailerWithPositions(t, logfile, positionFile)
+	appendLines(t, logfile, "line 2 of the new file\n")
+	expectLines(t, tail, "line 2 of the new file")
+	tail.Close()
+}
+
+func TestPositionFileLineNumbers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter_positions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logfile := filepath.Join(dir, "test.log")
+	positionFile := filepath.Join(dir, "positions.json")
+
+	appendLines(t, logfile, "line 1\nline 2\n")
+	tail := runTailerWithReadall(t, logfile, positionFile, true)
+	expectLineNumbers(t, tail, 1, 2)
+	tail.Close()
+
+	// The line number is stored in the position file.
+	appendLines(t, logfile, "line 3\n")
+	tail = runTailerWithReadall(t, logfile, positionFile, true)
+	expectLineNumbers(t, tail, 3)
+	tail.Close()
+
+	// Line numbers are unknown if reading starts at the end of the file.
+	if err = os.Remove(positionFile); err != nil {
+		t.Fatal(err)
+	}
+	tail = runTailerWithReadall(t, logfile, positionFile, false)
+	appendLines(t, logfile, "line 4\n")
+	expectLineNumbers(t, tail, 0)
+	tail.Close()
+}
+
+func runTailerWithPositions(t *testing.T, logfile, positionFile string) fswatcher.FileTailer {
+	return runTailerWithReadall(t, logfile, positionFile, false)
+}
+
+func runTailerWithReadall(t *testing.T, logfile, positionFile string, readall bool) fswatcher.FileTailer {
+	g, err := glob.Parse(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	positions, err := fswatcher.OpenPositionFile(positionFile, time.Hour, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tail, err := fswatcher.RunFileTailer([]fswatcher.WatchedGlob{{Glob: g, Readall: readall, FailOnMissingFile: true}}, positions, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Wait until the tailer has opened the file, otherwise lines appended by the test might be skipped.
+	time.Sleep(100 * time.Millisecond)
+	return tail
+}
+
+func appendLines(t *testing.T, path, lines string) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err = file.WriteString(lines); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectLines(t *testing.T, tail fswatcher.FileTailer, lines ...string) {
+	for _, expected := range lines {
+		select {
+		case line, open := <-tail.Lines():
+			if !open {
+				t.Fatalf("tailer terminated while waiting for line %q", expected)
+			}
+			if line.Line != expected {
+				t.Fatalf("expected line %q, but got %q", expected, line.Line)
+			}
+		case err := <-tail.Errors():
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout while waiting for line %q", expected)
+		}
+	}
+	select {
+	case line, open := <-tail.Lines():
+		if !open {
+			t.Fatalf("tailer terminated unexpectedly")
+		}
+		t.Fatalf("unexpected line %q", line.Line)
+	case err := <-tail.Errors():
+		t.Fatal(err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func expectLineNumbers(t *testing.T, tail fswatcher.FileTailer, lineNumbers ...int64) {
+	for _, expected := range lineNumbers {
+		select {
+		case line := <-tail.Lines():
+			if line.LineNumber != expected {
+				t.Fatalf("%q: expected line number %v, but got %v", line.Line, expected, line.LineNumber)
+			}
+		case err := <-tail.Errors():
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout while waiting for line number %v", expected)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket per client.
+type rateLimiter struct {
+	lock    sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64 // size of the bucket
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens     float64
+	lastUpdate time.Time
+}
+
+// Clients with a full bucket are removed when the number of buckets exceeds this limit.
+const maxRateLimiterBuckets = 1024
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow takes a token from the client's bucket. If the bucket is empty, allow returns false
+// and the time until the next token becomes available.
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	b, exists := l.buckets[client]
+	if !exists {
+		if len(l.buckets) >= maxRateLimiterBuckets {
+			l.removeFullBuckets(now)
+		}
+		b = &bucket{tokens: l.burst, lastUpdate: now}
+		l.buckets[client] = b
+	}
+	l.refill(b, now)
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (l *rateLimiter) refill(b *bucket, now time.Time) {
+	b.tokens += now.Sub(b.lastUpdate).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.lastUpdate = now
+}
+
+// A full bucket is the same as no bucket, so it can be removed without changing the behavior.
+// The map is copied, because the tests in this package declare a function delete().
+func (l *rateLimiter) removeFullBuckets(now time.Time) {
+	remaining := make(map[string]*bucket)
+	for client, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens < l.burst {
+			remaining[client] = b
+		}
+	}
+	l.buckets = remaining
+}
@@ -0,0 +1,351 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/gob"
+	"fmt"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const spillSegmentPattern = "spill-*.seg"
+
+// spillBuffer is a lineBuffer that keeps up to SpillThreshold lines in memory. When the threshold is reached,
+// new lines are appended to segment files in SpillDir, and a new segment is started when a segment reaches
+// SpillSegmentBytes. The consumer reads the lines in memory first, and then the segments in the order they were
+// written. A segment is deleted as soon as all its lines are consumed. New lines go to memory again when all
+// segments are consumed.
+//
+// Lines that cannot be written to or read from a segment are dropped and reported with DroppedSpillError.
+type spillBuffer struct {
+	memory        *list.List
+	segments      []*spillSegment // oldest first, only the last one may still be written
+	lock          *sync.Cond
+	closed        bool
+	dir           string
+	threshold     int
+	segmentBytes  int64
+	nextSegment   int
+	nSpilled      int   // lines in segments that were not consumed yet
+	spillBytes    int64 // size of all segment files
+	onDrop        func(reason string, n int)
+	setSpillBytes func(bytes int64)
+	log           logrus.FieldLogger
+}
+
+type spillSegment struct {
+	path     string
+	file     *os.File // nil when the segment is complete
+	writer   *bufio.Writer
+	encoder  *gob.Encoder
+	bytes    int64
+	nWritten int
+	nFlushed int // lines that can be read from the file
+	reader   *os.File
+	decoder  *gob.Decoder
+	nRead    int
+}
+
+// newSpillBuffer creates the spill directory if it does not exist.
+// Segments left over from a previous run are deleted, because their lines cannot be assigned to the current inputs.
+// There are leftover segments only if the previous run did not shut down cleanly. Their lines are reported with
+// DroppedSpillLeftover, because the position files already record them as read.
+func newSpillBuffer(limits BufferLimits, setSpillBytes func(bytes int64), log logrus.FieldLogger) (*spillBuffer, error) {
+	err := os.MkdirAll(limits.SpillDir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spill directory: %v", err)
+	}
+	leftover, err := filepath.Glob(filepath.Join(limits.SpillDir, spillSegmentPattern))
+	if err != nil {
+		return nil, fmt.Errorf("%v: failed to read spill directory: %v", limits.SpillDir, err)
+	}
+	for _, path := range leftover {
+		n := countSpilledLines(path)
+		log.Warnf("Deleting spill segment %v with %v unprocessed lines left over from a previous run.", path, n)
+		err = os.Remove(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete spill segment: %v", err)
+		}
+		if n > 0 {
+			limits.OnDrop(DroppedSpillLeftover, n)
+		}
+	}
+	return &spillBuffer{
+		memory:        list.New(),
+		lock:          sync.NewCond(&sync.Mutex{}),
+		dir:           limits.SpillDir,
+		threshold:     limits.SpillThreshold,
+		segmentBytes:  limits.SpillSegmentBytes,
+		onDrop:        limits.OnDrop,
+		setSpillBytes: setSpillBytes,
+		log:           log,
+	}, nil
+}
+
+// countSpilledLines returns the number of lines that can be decoded from a segment file.
+func countSpilledLines(path string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	decoder := gob.NewDecoder(bufio.NewReader(file))
+	n := 0
+	for decoder.Decode(&fswatcher.Line{}) == nil {
+		n++
+	}
+	return n
+}
+
+func (b *spillBuffer) Push(line *fswatcher.Line) {
+	b.lock.L.Lock()
+	defer b.lock.L.Unlock()
+	if b.closed {
+		return
+	}
+	// As long as there are segments, new lines must go to the segments so that the order is kept.
+	if len(b.segments) == 0 && b.memory.Len() < b.threshold {
+		b.memory.PushBack(line)
+	} else {
+		b.spill(line)
+	}
+	b.lock.Signal()
+}
+
+// Interrupted by Close(). Lines that were pushed before Close() are still returned.
+// Returns nil when the buffer is closed and empty.
+func (b *spillBuffer) BlockingPop() *fswatcher.Line {
+	b.lock.L.Lock()
+	defer b.lock.L.Unlock()
+	for b.len() == 0 && !b.closed {
+		b.lock.Wait()
+	}
+	// Wake up the producer if it is waiting in WaitForSpace().
+	b.lock.Broadcast()
+	return b.removeFirst()
+}
+
+func (b *spillBuffer) Pop() *fswatcher.Line {
+	b.lock.L.Lock()
+	defer b.lock.L.Unlock()
+	return b.removeFirst()
+}
+
+// Interrupted by Close().
+func (b *spillBuffer) WaitForSpace(maxLines int) {
+	b.lock.L.Lock()
+	defer b.lock.L.Unlock()
+	for b.len() >= maxLines && !b.closed {
+		b.lock.Wait()
+	}
+}
+
+// Len includes the lines in the segments.
+func (b *spillBuffer) Len() int {
+	b.lock.L.Lock()
+	defer b.lock.L.Unlock()
+	return b.len()
+}
+
+func (b *spillBuffer) len() int {
+	return b.memory.Len() + b.nSpilled
+}
+
+// Close does not delete the segments, so that the consumer can read the remaining lines.
+func (b *spillBuffer) Close() error {
+	b.lock.L.Lock()
+	defer b.lock.L.Unlock()
+	if !b.closed {
+		b.closed = true
+		b.lock.Broadcast()
+	}
+	return nil
+}
+
+// Clear deletes all segments.
+func (b *spillBuffer) Clear() int {
+	b.lock.L.Lock()
+	defer b.lock.L.Unlock()
+	n := b.len()
+	b.memory = list.New()
+	for _, segment := range b.segments {
+		b.deleteSegment(segment)
+	}
+	b.segments = nil
+	b.nSpilled = 0
+	// Wake up the producer if it is waiting in WaitForSpace().
+	b.lock.Broadcast()
+	return n
+}
+
+func (b *spillBuffer) removeFirst() *fswatcher.Line {
+	if b.memory.Len() > 0 {
+		return b.memory.Remove(b.memory.Front()).(*fswatcher.Line)
+	}
+	for b.nSpilled > 0 {
+		segment := b.segments[0]
+		line, err := b.read(segment)
+		if err == nil {
+			b.removeConsumedSegments()
+			return line
+		}
+		n := segment.nWritten - segment.nRead
+		b.log.Errorf("%v: failed to read spill segment: %v. Dropping %v lines.", segment.path, err, n)
+		b.onDrop(DroppedSpillError, n)
+		b.nSpilled -= n
+		segment.nRead = segment.nWritten
+		b.complete(segment)
+		b.removeConsumedSegments()
+	}
+	return nil
+}
+
+func (b *spillBuffer) spill(line *fswatcher.Line) {
+	segment, err := b.writableSegment()
+	if err != nil {
+		b.log.Errorf("Failed to create spill segment: %v. Dropping line.", err)
+		b.onDrop(DroppedSpillError, 1)
+		return
+	}
+	before := segment.bytes
+	err = segment.encoder.Encode(line)
+	b.addSpillBytes(segment.bytes - before)
+	if err != nil {
+		b.log.Errorf("%v: failed to write spill segment: %v. Dropping line.", segment.path, err)
+		b.onDrop(DroppedSpillError, 1)
+		// The end of the segment may be corrupt, so new lines are written to a new segment.
+		b.complete(segment)
+		b.removeConsumedSegments()
+		return
+	}
+	segment.nWritten++
+	b.nSpilled++
+}
+
+// writableSegment returns the last segment, or starts a new one if there is no segment or if the last segment is full.
+func (b *spillBuffer) writableSegment() (*spillSegment, error) {
+	if len(b.segments) > 0 {
+		last := b.segments[len(b.segments)-1]
+		if last.file != nil && last.bytes < b.segmentBytes {
+			return last, nil
+		}
+		b.complete(last)
+	}
+	path := filepath.Join(b.dir, fmt.Sprintf("spill-%010d.seg", b.nextSegment))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	b.nextSegment++
+	segment := &spillSegment{
+		path: path,
+		file: file,
+	}
+	segment.writer = bufio.NewWriter(file)
+	segment.encoder = gob.NewEncoder(segment)
+	b.segments = append(b.segments, segment)
+	return segment, nil
+}
+
+// complete flushes and closes the file of a segment that is no longer written.
+func (b *spillBuffer) complete(segment *spillSegment) {
+	if segment.file == nil {
+		return
+	}
+	err := segment.writer.Flush()
+	if err == nil {
+		segment.nFlushed = segment.nWritten
+	}
+	if closeErr := segment.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// Lines that were not written completely will cause an error when they are read.
+		b.log.Errorf("%v: failed to write spill segment: %v", segment.path, err)
+	}
+	segment.file = nil
+}
+
+func (b *spillBuffer) read(segment *spillSegment) (*fswatcher.Line, error) {
+	if segment.nRead == segment.nFlushed {
+		if segment.file == nil {
+			return nil, fmt.Errorf("unexpected end of file")
+		}
+		err := segment.writer.Flush()
+		if err != nil {
+			return nil, err
+		}
+		segment.nFlushed = segment.nWritten
+	}
+	if segment.reader == nil {
+		reader, err := os.Open(segment.path)
+		if err != nil {
+			return nil, err
+		}
+		segment.reader = reader
+		segment.decoder = gob.NewDecoder(bufio.NewReader(reader))
+	}
+	line := &fswatcher.Line{}
+	err := segment.decoder.Decode(line)
+	if err != nil {
+		return nil, err
+	}
+	segment.nRead++
+	b.nSpilled--
+	return line, nil
+}
+
+// removeConsumedSegments deletes the oldest segments if all their lines were read.
+func (b *spillBuffer) removeConsumedSegments() {
+	for len(b.segments) > 0 && b.segments[0].nRead == b.segments[0].nWritten {
+		b.deleteSegment(b.segments[0])
+		b.segments = b.segments[1:]
+	}
+}
+
+func (b *spillBuffer) deleteSegment(segment *spillSegment) {
+	if segment.file != nil {
+		segment.file.Close()
+		segment.file = nil
+	}
+	if segment.reader != nil {
+		segment.reader.Close()
+	}
+	err := os.Remove(segment.path)
+	if err != nil {
+		b.log.Errorf("Failed to delete spill segment: %v", err)
+	}
+	b.addSpillBytes(-segment.bytes)
+}
+
+func (b *spillBuffer) addSpillBytes(n int64) {
+	if n != 0 {
+		b.spillBytes += n
+		b.setSpillBytes(b.spillBytes)
+	}
+}
+
+// Write counts the bytes written by the gob encoder.
+func (s *spillSegment) Write(p []byte) (int, error) {
+	n, err := s.writer.Write(p)
+	s.bytes += int64(n)
+	return n, err
+}
@@ -0,0 +1,232 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"encoding/gob"
+	"fmt"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSpillBuffer(t *testing.T) {
+	dir := spillDir(t)
+	defer os.RemoveAll(dir)
+	var spillBytes int64
+	buf := newTestSpillBuffer(t, dir, nil, func(bytes int64) { spillBytes = bytes })
+	defer buf.Close()
+
+	for round := 0; round < 2; round++ {
+		for i := 1; i <= 100; i++ {
+			buf.Push(spillTestLine(i))
+		}
+		if buf.Len() != 100 {
+			t.Fatalf("Expected 100 lines in buffer, but got %v", buf.Len())
+		}
+		if n := len(segmentFiles(t, dir)); n < 2 {
+			t.Fatalf("Expected more than one segment file, but got %v", n)
+		}
+		if spillBytes <= 0 {
+			t.Fatalf("Expected spill bytes > 0, but got %v", spillBytes)
+		}
+		for i := 1; i <= 100; i++ {
+			line := buf.BlockingPop()
+			if !reflect.DeepEqual(line, spillTestLine(i)) {
+				t.Fatalf("Expected %#v, but got %#v", spillTestLine(i), line)
+			}
+		}
+		if n := len(segmentFiles(t, dir)); n != 0 || spillBytes != 0 {
+			t.Fatalf("Expected all segments to be deleted, but got %v files with %v bytes", n, spillBytes)
+		}
+	}
+}
+
+// Lines that are pushed while the consumer reads the segments must be returned in order.
+func TestSpillBufferInterleaved(t *testing.T) {
+	dir := spillDir(t)
+	defer os.RemoveAll(dir)
+	buf := newTestSpillBuffer(t, dir, nil, func(int64) {})
+	defer buf.Close()
+	next := 1
+	for i := 1; i <= 500; i++ {
+		buf.Push(spillTestLine(i))
+		if i%3 == 0 {
+			for j := 0; j < 2; j++ {
+				line := buf.BlockingPop()
+				if line.Line != spillTestLine(next).Line {
+					t.Fatalf("Expected %v, but got %v", spillTestLine(next).Line, line.Line)
+				}
+				next++
+			}
+		}
+	}
+	for ; next <= 500; next++ {
+		line := buf.BlockingPop()
+		if line.Line != spillTestLine(next).Line {
+			t.Fatalf("Expected %v, but got %v", spillTestLine(next).Line, line.Line)
+		}
+	}
+	if buf.Len() != 0 || len(segmentFiles(t, dir)) != 0 {
+		t.Fatalf("Expected empty buffer, but got %v lines", buf.Len())
+	}
+}
+
+func TestSpillBufferClear(t *testing.T) {
+	dir := spillDir(t)
+	defer os.RemoveAll(dir)
+	var spillBytes int64
+	buf := newTestSpillBuffer(t, dir, nil, func(bytes int64) { spillBytes = bytes })
+	defer buf.Close()
+	for i := 1; i <= 100; i++ {
+		buf.Push(spillTestLine(i))
+	}
+	if n := buf.Clear(); n != 100 {
+		t.Fatalf("Expected 100 lines cleared, but got %v", n)
+	}
+	if buf.Len() != 0 || len(segmentFiles(t, dir)) != 0 || spillBytes != 0 {
+		t.Fatalf("Expected all segments to be deleted, but got %v files with %v bytes", len(segmentFiles(t, dir)), spillBytes)
+	}
+	buf.Push(spillTestLine(101))
+	if line := buf.Pop(); line.Line != spillTestLine(101).Line {
+		t.Fatalf("Expected %v, but got %v", spillTestLine(101).Line, line.Line)
+	}
+}
+
+func TestSpillBufferCorruptSegment(t *testing.T) {
+	dir := spillDir(t)
+	defer os.RemoveAll(dir)
+	dropped := make(map[string]int)
+	buf := newTestSpillBuffer(t, dir, func(reason string, n int) { dropped[reason] += n }, func(int64) {})
+	defer buf.Close()
+	for i := 1; i <= 5; i++ {
+		buf.Push(spillTestLine(i))
+	}
+	buf.complete(buf.segments[0])
+	err := os.Truncate(buf.segments[0].path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if line := buf.Pop(); line.Line != spillTestLine(i).Line {
+			t.Fatalf("Expected %v, but got %v", spillTestLine(i).Line, line.Line)
+		}
+	}
+	if line := buf.Pop(); line != nil {
+		t.Fatalf("Expected the lines in the corrupt segment to be dropped, but got %v", line.Line)
+	}
+	if !reflect.DeepEqual(dropped, map[string]int{DroppedSpillError: 2}) {
+		t.Fatalf("Expected 2 lines dropped with reason %v, but got %v", DroppedSpillError, dropped)
+	}
+	if buf.Len() != 0 || len(segmentFiles(t, dir)) != 0 {
+		t.Fatalf("Expected empty buffer, but got %v lines", buf.Len())
+	}
+}
+
+func TestSpillBufferDeletesLeftoverSegments(t *testing.T) {
+	dir := spillDir(t)
+	defer os.RemoveAll(dir)
+	leftover := filepath.Join(dir, "spill-0000000007.seg")
+	other := filepath.Join(dir, "other.txt")
+	for _, path := range []string{leftover, other} {
+		err := ioutil.WriteFile(path, []byte("test"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := newTestSpillBuffer(t, dir, nil, func(int64) {})
+	defer buf.Close()
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Fatalf("Expected %v to be deleted", leftover)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Fatalf("Expected %v to be kept, but got %v", other, err)
+	}
+}
+
+func TestSpillBufferCountsLeftoverLines(t *testing.T) {
+	dir := spillDir(t)
+	defer os.RemoveAll(dir)
+	file, err := os.Create(filepath.Join(dir, "spill-0000000003.seg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder := gob.NewEncoder(file)
+	for i := 1; i <= 2; i++ {
+		if err = encoder.Encode(spillTestLine(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file.Close()
+	dropped := make(map[string]int)
+	buf := newTestSpillBuffer(t, dir, func(reason string, n int) { dropped[reason] += n }, func(int64) {})
+	defer buf.Close()
+	if !reflect.DeepEqual(dropped, map[string]int{DroppedSpillLeftover: 2}) {
+		t.Fatalf("Expected 2 lines dropped with reason %v, but got %v", DroppedSpillLeftover, dropped)
+	}
+	if len(segmentFiles(t, dir)) != 0 {
+		t.Fatalf("Expected the leftover segment to be deleted")
+	}
+}
+
+func spillDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "grok_exporter_spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// newTestSpillBuffer keeps 3 lines in memory, and uses small segments so that there are many segment files.
+func newTestSpillBuffer(t *testing.T, dir string, onDrop func(string, int), setSpillBytes func(int64)) *spillBuffer {
+	if onDrop == nil {
+		onDrop = func(reason string, n int) {
+			t.Fatalf("Unexpected %v dropped lines with reason %v", n, reason)
+		}
+	}
+	buf, err := newSpillBuffer(BufferLimits{
+		SpillDir:          dir,
+		SpillThreshold:    3,
+		SpillSegmentBytes: 1024,
+		OnDrop:            onDrop,
+	}, setSpillBytes, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func spillTestLine(i int) *fswatcher.Line {
+	return &fswatcher.Line{
+		Line:       fmt.Sprintf("This is line number %v.", i),
+		File:       "/var/log/test.log",
+		Input:      "default",
+		Metadata:   map[string]string{"n": fmt.Sprintf("%v", i)},
+		LineNumber: int64(i),
+		Time:       time.Date(2019, 10, 12, 10, 0, i%60, 0, time.UTC),
+	}
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	result, err := filepath.Glob(filepath.Join(dir, spillSegmentPattern))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
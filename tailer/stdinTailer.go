@@ -16,7 +16,10 @@ package tailer
 
 import (
 	"bufio"
+	"github.com/fstab/grok_exporter/config/v2"
+	"github.com/fstab/grok_exporter/tailer/charset"
 	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"io"
 	"os"
 	"strings"
 )
@@ -24,6 +27,7 @@ import (
 type stdinTailer struct {
 	lines  chan *fswatcher.Line
 	errors chan fswatcher.Error
+	done   chan struct{}
 }
 
 func (t *stdinTailer) Lines() chan *fswatcher.Line {
@@ -34,27 +38,77 @@ func (t *stdinTailer) Errors() chan fswatcher.Error {
 	return t.errors
 }
 
+// Close stops sending lines and closes the lines and errors channels. A read on stdin cannot be interrupted,
+// so the go-routine reading stdin terminates when the current read returns, and the line that was read is dropped.
 func (t *stdinTailer) Close() {
-	// TODO: How to stop the go-routine reading on stdin?
+	close(t.done)
 }
 
-func RunStdinTailer() fswatcher.FileTailer {
-	lineChan := make(chan *fswatcher.Line)
-	errorChan := make(chan fswatcher.Error)
+// RunStdinTailer reads lines from stdin. Lines are converted from 'input.encoding' to UTF-8.
+// The lines and errors channels are closed when stdin reaches end of file, like when 'cat sample.log | grok_exporter' finished.
+func RunStdinTailer(input *v2.InputConfig) (fswatcher.FileTailer, error) {
+	cs, err := charset.Get(input.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	t := &stdinTailer{
+		lines:  make(chan *fswatcher.Line),
+		errors: make(chan fswatcher.Error),
+		done:   make(chan struct{}),
+	}
+	read := make(chan stdinRead)
 	go func() {
-		reader := bufio.NewReader(os.Stdin)
+		var stdin io.Reader = os.Stdin
+		if cs != nil {
+			stdin = cs.NewReader(stdin)
+		}
+		reader := bufio.NewReader(stdin)
 		for {
 			line, err := reader.ReadString('\n')
+			select {
+			case read <- stdinRead{line: line, err: err}:
+			case <-t.done:
+				return
+			}
 			if err != nil {
-				errorChan <- fswatcher.NewError(fswatcher.NotSpecified, err, "")
 				return
 			}
-			line = strings.TrimRight(line, "\r\n")
-			lineChan <- &fswatcher.Line{Line: line}
 		}
 	}()
-	return &stdinTailer{
-		lines:  lineChan,
-		errors: errorChan,
-	}
+	// The channels are closed in a separate go-routine, because the go-routine reading stdin may be blocked.
+	go func() {
+		defer close(t.errors)
+		defer close(t.lines)
+		for {
+			var r stdinRead
+			select {
+			case r = <-read:
+			case <-t.done:
+				return
+			}
+			if len(r.line) > 0 {
+				// The last line may not be terminated with a newline.
+				select {
+				case t.lines <- &fswatcher.Line{Line: strings.TrimRight(r.line, "\r\n")}:
+				case <-t.done:
+					return
+				}
+			}
+			if r.err == io.EOF {
+				return
+			} else if r.err != nil {
+				select {
+				case t.errors <- fswatcher.NewError(fswatcher.NotSpecified, r.err, "error reading stdin"):
+				case <-t.done:
+				}
+				return
+			}
+		}
+	}()
+	return t, nil
+}
+
+type stdinRead struct {
+	line string
+	err  error
 }
@@ -0,0 +1,202 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metadata fields provided by syslog inputs, see fswatcher.Line.Metadata.
+// Structured data from RFC 5424 messages is provided as syslog_sd.<SD-ID>.<PARAM-NAME>,
+// for example {{index . "syslog_sd.origin.ip"}}.
+const (
+	syslogFacility             = "syslog_facility"
+	syslogSeverity             = "syslog_severity"
+	syslogHostname             = "syslog_hostname"
+	syslogAppName              = "syslog_appname"
+	syslogProcId               = "syslog_procid"
+	syslogMsgId                = "syslog_msgid"
+	syslogStructuredDataPrefix = "syslog_sd."
+)
+
+var syslogMetadataFields = []string{syslogFacility, syslogSeverity, syslogHostname, syslogAppName, syslogProcId, syslogMsgId}
+
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+var syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// A message without PRI part gets facility user and severity notice, see RFC 3164 section 4.3.3.
+const syslogDefaultPri = 13
+
+// parseSyslogMessage parses RFC 5424 and RFC 3164 messages.
+// It returns the MSG part and the header fields as metadata.
+// Parsing is lenient: Header fields that cannot be parsed are left empty, and the remaining text is used as MSG.
+func parseSyslogMessage(msg string) (string, map[string]string) {
+	metadata := map[string]string{
+		syslogHostname: "",
+		syslogAppName:  "",
+		syslogProcId:   "",
+		syslogMsgId:    "",
+	}
+	pri, rest, ok := parseSyslogPri(msg)
+	if !ok {
+		pri, rest = syslogDefaultPri, msg
+	}
+	metadata[syslogFacility] = syslogFacilities[pri/8]
+	metadata[syslogSeverity] = syslogSeverities[pri%8]
+	if ok && strings.HasPrefix(rest, "1 ") {
+		return parseRfc5424(rest[2:], metadata), metadata
+	}
+	return parseRfc3164(rest, metadata), metadata
+}
+
+// parseSyslogPri parses the <PRI> part, like "<34>".
+func parseSyslogPri(msg string) (int, string, bool) {
+	if len(msg) < 3 || msg[0] != '<' {
+		return 0, msg, false
+	}
+	end := strings.IndexByte(msg, '>')
+	if end < 2 || end > 4 {
+		return 0, msg, false
+	}
+	pri, err := strconv.Atoi(msg[1:end])
+	if err != nil || pri < 0 || pri >= len(syslogFacilities)*8 {
+		return 0, msg, false
+	}
+	return pri, msg[end+1:], true
+}
+
+// RFC 5424, after "<PRI>1 ": TIMESTAMP SP HOSTNAME SP APP-NAME SP PROCID SP MSGID SP STRUCTURED-DATA [SP MSG]
+func parseRfc5424(rest string, metadata map[string]string) string {
+	var field string
+	_, rest = nextSyslogField(rest) // timestamp is ignored
+	for _, name := range []string{syslogHostname, syslogAppName, syslogProcId, syslogMsgId} {
+		field, rest = nextSyslogField(rest)
+		if field != "-" {
+			metadata[name] = field
+		}
+	}
+	if strings.HasPrefix(rest, "-") {
+		rest = rest[1:]
+	} else {
+		rest = parseStructuredData(rest, metadata)
+	}
+	rest = strings.TrimPrefix(rest, " ")
+	return strings.TrimPrefix(rest, "\ufeff") // MSG may start with a BOM
+}
+
+func nextSyslogField(s string) (string, string) {
+	i := strings.IndexByte(s, ' ')
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i+1:]
+}
+
+// parseStructuredData parses elements like [exampleSDID@32473 iut="3" eventSource="Application"]
+// and returns the remaining string.
+func parseStructuredData(s string, metadata map[string]string) string {
+	for strings.HasPrefix(s, "[") {
+		s = s[1:]
+		var id string
+		end := strings.IndexAny(s, " ]")
+		if end < 0 {
+			return s
+		}
+		id, s = s[:end], s[end:]
+		for strings.HasPrefix(s, " ") {
+			s = s[1:]
+			eq := strings.Index(s, "=\"")
+			if eq < 0 {
+				return s
+			}
+			name := s[:eq]
+			value, remaining, ok := parseSdParamValue(s[eq+2:])
+			if !ok {
+				return s
+			}
+			metadata[syslogStructuredDataPrefix+id+"."+name] = value
+			s = remaining
+		}
+		if !strings.HasPrefix(s, "]") {
+			return s
+		}
+		s = s[1:]
+	}
+	return s
+}
+
+// parseSdParamValue parses a quoted value, where '"', '\' and ']' are escaped with a backslash.
+// The opening quote is already removed.
+func parseSdParamValue(s string) (string, string, bool) {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\' || s[i+1] == ']'):
+			sb.WriteByte(s[i+1])
+			i++
+		case s[i] == '"':
+			return sb.String(), s[i+1:], true
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+	return "", s, false
+}
+
+// RFC 3164, after "<PRI>": TIMESTAMP SP HOSTNAME SP TAG[PID]: MSG
+// Many devices send variations of this, for example without hostname. Anything that cannot be parsed is part of MSG.
+func parseRfc3164(rest string, metadata map[string]string) string {
+	if len(rest) >= 16 && rest[15] == ' ' {
+		if _, err := time.Parse(time.Stamp, rest[:15]); err == nil {
+			rest = rest[16:]
+		}
+	}
+	first, afterFirst := nextSyslogField(rest)
+	if tag, pid, msg, ok := parseSyslogTag(first, afterFirst); ok {
+		// no hostname
+		metadata[syslogAppName], metadata[syslogProcId] = tag, pid
+		return msg
+	}
+	if len(first) > 0 && len(afterFirst) > 0 {
+		second, afterSecond := nextSyslogField(afterFirst)
+		if tag, pid, msg, ok := parseSyslogTag(second, afterSecond); ok {
+			metadata[syslogHostname], metadata[syslogAppName], metadata[syslogProcId] = first, tag, pid
+			return msg
+		}
+	}
+	return rest
+}
+
+// parseSyslogTag parses a tag like "sshd[1234]:" or "sshd:".
+func parseSyslogTag(token string, rest string) (tag string, pid string, msg string, ok bool) {
+	if !strings.HasSuffix(token, ":") || len(token) < 2 {
+		return "", "", "", false
+	}
+	tag = token[:len(token)-1]
+	if open := strings.IndexByte(tag, '['); open >= 0 {
+		if !strings.HasSuffix(tag, "]") || open == 0 {
+			return "", "", "", false
+		}
+		tag, pid = tag[:open], tag[open+1:len(tag)-1]
+	}
+	return tag, pid, rest, true
+}
@@ -0,0 +1,275 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"github.com/fstab/grok_exporter/config/v2"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// TCP messages larger than this are rejected, and the connection is closed.
+const maxSyslogMessageSize = 1024 * 1024
+
+// implements fswatcher.FileTailer
+type syslogTailer struct {
+	lines     chan *fswatcher.Line
+	errors    chan fswatcher.Error
+	done      chan struct{}
+	listeners []io.Closer
+	logger    logrus.FieldLogger
+
+	lock        sync.Mutex
+	connections sync.Map       // open TCP connections, net.Conn -> struct{}
+	senders     sync.WaitGroup // go-routines that may write to the lines and errors channels
+	closed      bool
+}
+
+func (t *syslogTailer) Lines() chan *fswatcher.Line {
+	return t.lines
+}
+
+func (t *syslogTailer) Errors() chan fswatcher.Error {
+	return t.errors
+}
+
+func (t *syslogTailer) Close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return
+	}
+	t.closed = true
+	close(t.done)
+	for _, l := range t.listeners {
+		l.Close()
+	}
+	t.connections.Range(func(conn, _ interface{}) bool {
+		conn.(net.Conn).Close()
+		return true
+	})
+	go func() {
+		t.senders.Wait()
+		close(t.lines)
+		close(t.errors)
+	}()
+}
+
+// RunSyslogTailer receives syslog messages on the UDP address, TCP address, and unix datagram socket configured in input.
+// Messages may be in RFC 5424 or RFC 3164 format. On TCP, messages are framed with octet counting (RFC 6587 section 3.4.1)
+// or terminated by a newline. The MSG part is sent as fswatcher.Line.Line, the header fields are sent as fswatcher.Line.Metadata.
+func RunSyslogTailer(input *v2.InputConfig, logger logrus.FieldLogger) (fswatcher.FileTailer, error) {
+	t := &syslogTailer{
+		lines:  make(chan *fswatcher.Line),
+		errors: make(chan fswatcher.Error),
+		done:   make(chan struct{}),
+		logger: logger,
+	}
+	if len(input.SyslogUdpAddress) > 0 {
+		conn, err := net.ListenPacket("udp", input.SyslogUdpAddress)
+		if err != nil {
+			t.Close()
+			return nil, fmt.Errorf("failed to listen for syslog messages on udp address %v: %v", input.SyslogUdpAddress, err)
+		}
+		t.listeners = append(t.listeners, conn)
+		t.senders.Add(1)
+		go t.receiveDatagrams(conn)
+	}
+	if len(input.SyslogUnixSocket) > 0 {
+		// A socket file left over from a previous run would make Listen fail.
+		if info, err := os.Stat(input.SyslogUnixSocket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(input.SyslogUnixSocket)
+		}
+		conn, err := net.ListenPacket("unixgram", input.SyslogUnixSocket)
+		if err != nil {
+			t.Close()
+			return nil, fmt.Errorf("failed to listen for syslog messages on unix socket %v: %v", input.SyslogUnixSocket, err)
+		}
+		t.listeners = append(t.listeners, conn) // closing the conn removes the socket file
+		t.senders.Add(1)
+		go t.receiveDatagrams(conn)
+	}
+	if len(input.SyslogTcpAddress) > 0 {
+		listener, err := net.Listen("tcp", input.SyslogTcpAddress)
+		if err != nil {
+			t.Close()
+			return nil, fmt.Errorf("failed to listen for syslog messages on tcp address %v: %v", input.SyslogTcpAddress, err)
+		}
+		if len(input.SyslogTlsCert) > 0 {
+			cert, err := tls.LoadX509KeyPair(input.SyslogTlsCert, input.SyslogTlsKey)
+			if err != nil {
+				listener.Close()
+				t.Close()
+				return nil, fmt.Errorf("failed to load syslog tls certificate: %v", err)
+			}
+			listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}})
+		}
+		t.listeners = append(t.listeners, listener)
+		t.senders.Add(1)
+		go t.acceptConnections(listener)
+	}
+	return t, nil
+}
+
+// receiveDatagrams handles UDP and unix datagram sockets, where each datagram contains a single message.
+func (t *syslogTailer) receiveDatagrams(conn net.PacketConn) {
+	defer t.senders.Done()
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.fail(err, "failed to read syslog message from %v", conn.LocalAddr())
+			return
+		}
+		if !t.send(strings.TrimRight(string(buf[:n]), "\r\n\x00")) {
+			return
+		}
+	}
+}
+
+func (t *syslogTailer) acceptConnections(listener net.Listener) {
+	defer t.senders.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				t.logger.Warnf("syslog: failed to accept connection: %v", err)
+				continue
+			}
+			t.fail(err, "failed to accept syslog connection on %v", listener.Addr())
+			return
+		}
+		if !t.register(conn) {
+			conn.Close()
+			return
+		}
+		go t.receiveStream(conn)
+	}
+}
+
+// receiveStream reads messages from a TCP connection until the connection is closed.
+// Errors are only logged, because a broken client connection should not terminate grok_exporter.
+func (t *syslogTailer) receiveStream(conn net.Conn) {
+	defer t.senders.Done()
+	defer t.unregister(conn)
+	reader := bufio.NewReader(conn)
+	for {
+		msg, err := readSyslogFrame(reader)
+		if err != nil {
+			if err != io.EOF && !t.isClosed() {
+				t.logger.Warnf("syslog: closing connection from %v: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		if !t.send(msg) {
+			return
+		}
+	}
+}
+
+// readSyslogFrame reads the next message from a TCP stream. If the frame starts with a digit,
+// it is octet-counted like "27 <34>1 ...", otherwise it is terminated by a newline.
+func readSyslogFrame(reader *bufio.Reader) (string, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	if first[0] >= '0' && first[0] <= '9' {
+		length, err := reader.ReadString(' ')
+		if err != nil {
+			return "", err
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+		if err != nil || n > maxSyslogMessageSize {
+			return "", fmt.Errorf("invalid message length %q", strings.TrimSuffix(length, " "))
+		}
+		buf := make([]byte, n)
+		if _, err = io.ReadFull(reader, buf); err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(buf), "\r\n"), nil
+	}
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > maxSyslogMessageSize {
+			return "", fmt.Errorf("message exceeds %v bytes", maxSyslogMessageSize)
+		}
+		line = append(line, chunk...) // copy, because chunk is overwritten by the next read
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n\x00"), nil
+	}
+}
+
+func (t *syslogTailer) send(msg string) bool {
+	line, metadata := parseSyslogMessage(msg)
+	select {
+	case t.lines <- &fswatcher.Line{Line: line, Metadata: metadata}:
+		return true
+	case <-t.done:
+		return false
+	}
+}
+
+func (t *syslogTailer) fail(err error, format string, a ...interface{}) {
+	if t.isClosed() {
+		return
+	}
+	select {
+	case t.errors <- fswatcher.NewErrorf(fswatcher.NotSpecified, err, format, a...):
+	case <-t.done:
+	}
+}
+
+func (t *syslogTailer) register(conn net.Conn) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return false
+	}
+	t.connections.Store(conn, struct{}{})
+	t.senders.Add(1) // for receiveStream()
+	return true
+}
+
+func (t *syslogTailer) unregister(conn net.Conn) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.connections.Delete(conn)
+	conn.Close()
+}
+
+func (t *syslogTailer) isClosed() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.closed
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/fstab/grok_exporter/config/v2"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogTailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter_syslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "syslog.sock")
+	tail, err := RunSyslogTailer(&v2.InputConfig{
+		Type:             "syslog",
+		SyslogUdpAddress: "127.0.0.1:0",
+		SyslogTcpAddress: "127.0.0.1:0",
+		SyslogUnixSocket: socket,
+	}, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tail.Close()
+	listeners := tail.(*syslogTailer).listeners
+	udpAddr := listeners[0].(net.PacketConn).LocalAddr().String()
+	tcpAddr := listeners[2].(net.Listener).Addr().String()
+
+	msg := "<34>1 2003-10-11T22:14:15.003Z host su - - - hello"
+	sendSyslog(t, "udp", udpAddr, msg+"\n")
+	expectSyslogLine(t, tail, "hello", "host")
+	sendSyslog(t, "unixgram", socket, "<38>Oct  9 22:33:20 unixhost sshd[8358]: hello unix")
+	expectSyslogLine(t, tail, "hello unix", "unixhost")
+
+	// TCP with octet counting and with newline framing on the same connection
+	conn, err := net.Dial("tcp", tcpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	multiline := "<34>1 - host1 app - - - first line\nsecond line"
+	fmt.Fprintf(conn, "%v %v%v %v", len(multiline), multiline, len(msg), msg)
+	fmt.Fprintf(conn, "<34>1 - host2 app - - - newline framed\r\n<34>1 - host3 app - - - last\n")
+	expectSyslogLine(t, tail, "first line\nsecond line", "host1")
+	expectSyslogLine(t, tail, "hello", "host")
+	expectSyslogLine(t, tail, "newline framed", "host2")
+	expectSyslogLine(t, tail, "last", "host3")
+}
+
+func TestReadSyslogFrameLimit(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	// The message is longer than the reader's buffer, but shorter than maxSyslogMessageSize.
+	msg, err := readSyslogFrame(bufio.NewReaderSize(strings.NewReader(long+"\nnext\n"), 16))
+	if err != nil || msg != long {
+		t.Fatalf("expected %q, but got %q, %v", long, msg, err)
+	}
+	tooLong := strings.Repeat("x", maxSyslogMessageSize+1)
+	_, err = readSyslogFrame(bufio.NewReader(strings.NewReader(tooLong + "\n")))
+	if err == nil {
+		t.Fatalf("expected an error for a message exceeding %v bytes", maxSyslogMessageSize)
+	}
+	_, err = readSyslogFrame(bufio.NewReader(strings.NewReader(tooLong)))
+	if err == nil {
+		t.Fatalf("expected an error for an unterminated message exceeding %v bytes", maxSyslogMessageSize)
+	}
+}
+
+func sendSyslog(t *testing.T, network, address, msg string) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectSyslogLine(t *testing.T, tail fswatcher.FileTailer, expectedLine, expectedHostname string) {
+	select {
+	case line := <-tail.Lines():
+		if line.Line != expectedLine || line.Metadata[syslogHostname] != expectedHostname {
+			t.Fatalf("expected line %q from host %q, but got %q from host %q", expectedLine, expectedHostname, line.Line, line.Metadata[syslogHostname])
+		}
+	case err := <-tail.Errors():
+		t.Fatal(err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout while waiting for line %q", expectedLine)
+	}
+}
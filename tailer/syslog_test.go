@@ -0,0 +1,129 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"testing"
+)
+
+func TestParseSyslogMessage(t *testing.T) {
+	for _, test := range []struct {
+		msg              string
+		expectedMsg      string
+		expectedMetadata map[string]string
+	}{
+		{
+			// RFC 5424 example with structured data
+			msg:         `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"][origin ip="192.0.2.1"] An application event log entry...`,
+			expectedMsg: "An application event log entry...",
+			expectedMetadata: map[string]string{
+				syslogFacility:                    "local4",
+				syslogSeverity:                    "notice",
+				syslogHostname:                    "mymachine.example.com",
+				syslogAppName:                     "evntslog",
+				syslogProcId:                      "",
+				syslogMsgId:                       "ID47",
+				"syslog_sd.exampleSDID@32473.iut": "3",
+				"syslog_sd.exampleSDID@32473.eventSource": "Application",
+				"syslog_sd.exampleSDID@32473.eventID":     "1011",
+				"syslog_sd.origin.ip":                     "192.0.2.1",
+			},
+		},
+		{
+			// RFC 5424 without structured data, with BOM
+			msg:         "<34>1 2003-10-11T22:14:15.003Z host su 123 - - \ufeff'su root' failed for lonvick on /dev/pts/8",
+			expectedMsg: "'su root' failed for lonvick on /dev/pts/8",
+			expectedMetadata: map[string]string{
+				syslogFacility: "auth",
+				syslogSeverity: "crit",
+				syslogHostname: "host",
+				syslogAppName:  "su",
+				syslogProcId:   "123",
+				syslogMsgId:    "",
+			},
+		},
+		{
+			msg:         `<13>1 - - - - - [a b="x\"y\]"]`,
+			expectedMsg: "",
+			expectedMetadata: map[string]string{
+				syslogFacility:  "user",
+				syslogSeverity:  "notice",
+				syslogHostname:  "",
+				syslogAppName:   "",
+				syslogProcId:    "",
+				syslogMsgId:     "",
+				"syslog_sd.a.b": `x"y]`,
+			},
+		},
+		{
+			// RFC 3164
+			msg:         "<38>Oct  9 22:33:20 hlfedora sshd[8358]: Accepted password for fabian from 127.0.0.1 port 44210 ssh2",
+			expectedMsg: "Accepted password for fabian from 127.0.0.1 port 44210 ssh2",
+			expectedMetadata: map[string]string{
+				syslogFacility: "auth",
+				syslogSeverity: "info",
+				syslogHostname: "hlfedora",
+				syslogAppName:  "sshd",
+				syslogProcId:   "8358",
+				syslogMsgId:    "",
+			},
+		},
+		{
+			// RFC 3164 without hostname, as sent by the local syslog() function
+			msg:         "<78>Oct 11 22:14:15 CRON[1234]: (root) CMD (run-parts /etc/cron.hourly)",
+			expectedMsg: "(root) CMD (run-parts /etc/cron.hourly)",
+			expectedMetadata: map[string]string{
+				syslogFacility: "cron",
+				syslogSeverity: "info",
+				syslogHostname: "",
+				syslogAppName:  "CRON",
+				syslogProcId:   "1234",
+				syslogMsgId:    "",
+			},
+		},
+		{
+			// No PRI and no header
+			msg:         "just some text",
+			expectedMsg: "just some text",
+			expectedMetadata: map[string]string{
+				syslogFacility: "user",
+				syslogSeverity: "notice",
+				syslogHostname: "",
+				syslogAppName:  "",
+				syslogProcId:   "",
+				syslogMsgId:    "",
+			},
+		},
+	} {
+		msg, metadata := parseSyslogMessage(test.msg)
+		if msg != test.expectedMsg {
+			t.Errorf("%q: expected msg %q but got %q", test.msg, test.expectedMsg, msg)
+		}
+		expectMetadata(t, test.msg, metadata, test.expectedMetadata)
+	}
+}
+
+func expectMetadata(t *testing.T, name string, actual map[string]string, expected map[string]string) {
+	if len(actual) != len(expected) {
+		t.Errorf("%q: expected metadata %v but got %v", name, expected, actual)
+		return
+	}
+	for key, value := range expected {
+		if actualValue, exists := actual[key]; !exists || actualValue != value {
+			t.Errorf("%q: expected metadata %v but got %v", name, expected, actual)
+			return
+		}
+	}
+}
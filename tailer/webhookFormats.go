@@ -0,0 +1,234 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fstab/grok_exporter/config/v2"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/fstab/grok_exporter/tailer/jsonpath"
+	"strings"
+)
+
+// Webhook formats of log shippers. The lines' metadata is taken from the payload, so the metadata
+// field names are not known in advance, see MetadataFields().
+//
+//   - loki: Loki push API in JSON format, as sent by Promtail or Vector. The stream labels become metadata.
+//   - elasticsearch_bulk: Elasticsearch _bulk API, as sent by Filebeat, Fluent Bit, or Vector.
+//     The fields of the documents become metadata.
+//   - fluentbit: Fluent Bit's HTTP output with 'format json'. The fields of the records become metadata.
+const (
+	webhookFormatLoki              = "loki"
+	webhookFormatElasticsearchBulk = "elasticsearch_bulk"
+	webhookFormatFluentBit         = "fluentbit"
+)
+
+func isShipperFormat(format string) bool {
+	return format == webhookFormatLoki || format == webhookFormatElasticsearchBulk || format == webhookFormatFluentBit
+}
+
+// lokiLines parses a Loki push request like
+//
+//	{"streams": [{"stream": {"job": "app"}, "values": [["<unix epoch in nanoseconds>", "<log line>"], ...]}]}
+//
+// A value may have a third element with structured metadata, which is added to the line's metadata as well.
+func lokiLines(b []byte) ([]*fswatcher.Line, error) {
+	doc, err := jsonpath.Unmarshal(b)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse JSON: %v", err)
+	}
+	root, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid Loki push request: expected an object with \"streams\"")
+	}
+	streams, ok := root["streams"].([]interface{})
+	if !ok {
+		return nil, errors.New("invalid Loki push request: expected an object with \"streams\"")
+	}
+	var result []*fswatcher.Line
+	for _, s := range streams {
+		stream, ok := s.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("invalid Loki push request: stream is not an object")
+		}
+		values, ok := stream["values"].([]interface{})
+		if !ok {
+			return nil, errors.New("invalid Loki push request: stream without \"values\"")
+		}
+		for _, v := range values {
+			value, ok := v.([]interface{})
+			if !ok || len(value) < 2 {
+				return nil, errors.New("invalid Loki push request: expected [timestamp, line] in \"values\"")
+			}
+			line, ok := value[1].(string)
+			if !ok {
+				return nil, errors.New("invalid Loki push request: log line is not a string")
+			}
+			metadata := make(map[string]string)
+			flatten("", stream["stream"], metadata)
+			if len(value) > 2 {
+				flatten("", value[2], metadata)
+			}
+			result = append(result, &fswatcher.Line{Line: strings.TrimSpace(line), Metadata: metadata})
+		}
+	}
+	return result, nil
+}
+
+// elasticsearchBulkLines parses an Elasticsearch _bulk request. The body is NDJSON with pairs of lines:
+// The action, like {"index": {"_index": "logs"}}, and the document. The 'delete' action has no document.
+// The 'update' action's document has the fields in "doc". The log line is taken from the documents with
+// the webhook_json_selector. The action names are returned as well, because they are needed for the response.
+func elasticsearchBulkLines(c *v2.InputConfig, b []byte) ([]*fswatcher.Line, []string, error) {
+	selector, err := jsonpath.Parse(c.WebhookJsonSelector)
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		result     []*fswatcher.Line
+		actions    []string
+		action     string // action of the next document, empty if the next line is an action
+		lineNumber int
+	)
+	for _, data := range strings.Split(string(b), "\n") {
+		lineNumber++
+		if len(strings.TrimSpace(data)) == 0 {
+			continue
+		}
+		entry, err := jsonpath.Unmarshal([]byte(data))
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to parse JSON in line %v: %v", lineNumber, err)
+		}
+		object, ok := entry.(map[string]interface{})
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid bulk request in line %v: expected an object", lineNumber)
+		}
+		if action == "" {
+			if len(object) != 1 {
+				return nil, nil, fmt.Errorf("invalid bulk request in line %v: expected an action like {\"index\": {}}", lineNumber)
+			}
+			for name := range object {
+				action = name
+			}
+			actions = append(actions, action)
+			if action == "delete" {
+				action = ""
+			}
+			continue
+		}
+		if action == "update" {
+			object, _ = object["doc"].(map[string]interface{})
+		}
+		action = ""
+		lines, err := documentLines(selector, object)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %v: %v", lineNumber, err)
+		}
+		result = append(result, lines...)
+	}
+	if action != "" {
+		return nil, nil, fmt.Errorf("invalid bulk request: missing document for the last %v action", action)
+	}
+	return result, actions, nil
+}
+
+// fluentBitLines parses the body of Fluent Bit's HTTP output with 'format json', which is an array of records.
+func fluentBitLines(c *v2.InputConfig, b []byte) ([]*fswatcher.Line, error) {
+	selector, err := jsonpath.Parse(c.WebhookJsonSelector)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := jsonpath.Unmarshal(b)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse JSON: %v", err)
+	}
+	records, ok := doc.([]interface{})
+	if !ok {
+		return nil, errors.New("unable to parse JSON: expected an array of records")
+	}
+	var result []*fswatcher.Line
+	for _, record := range records {
+		lines, err := documentLines(selector, record)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, lines...)
+	}
+	return result, nil
+}
+
+// documentLines selects the log lines from an Elasticsearch document or a Fluent Bit record.
+// The document's fields become the lines' metadata.
+func documentLines(selector jsonpath.Path, document interface{}) ([]*fswatcher.Line, error) {
+	matches := selector.Find(document)
+	if len(matches) == 0 && !selector.HasWildcard() {
+		return nil, fmt.Errorf("unable to find webhook_json_selector %v", selector)
+	}
+	metadata := make(map[string]string)
+	flatten("", document, metadata)
+	result := make([]*fswatcher.Line, 0, len(matches))
+	for _, match := range matches {
+		result = append(result, &fswatcher.Line{Line: strings.TrimSpace(jsonpath.String(match.Value)), Metadata: metadata})
+	}
+	return result, nil
+}
+
+// flatten adds the fields of a JSON object to metadata. Keys of nested objects are joined with '_',
+// so {"host": {"name": "a"}} becomes host_name="a". Characters that are not allowed in
+// template field names are replaced with '_', so "@timestamp" becomes "_timestamp".
+func flatten(prefix string, value interface{}, metadata map[string]string) {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		if prefix != "" {
+			metadata[prefix] = jsonpath.String(value)
+		}
+		return
+	}
+	for key, child := range object {
+		name := fieldName(key)
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+		flatten(name, child, metadata)
+	}
+}
+
+func fieldName(key string) string {
+	result := []byte(key)
+	for i, c := range result {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' && i > 0) {
+			result[i] = '_'
+		}
+	}
+	if len(result) == 0 {
+		return "_"
+	}
+	return string(result)
+}
+
+// elasticsearchBulkResponse is the response expected by Elasticsearch clients. The clients check the
+// status of each action.
+func elasticsearchBulkResponse(actions []string) string {
+	items := make([]string, 0, len(actions))
+	for _, action := range actions {
+		status := 200
+		if action == "index" || action == "create" {
+			status = 201
+		}
+		items = append(items, fmt.Sprintf(`{%q:{"status":%v}}`, action, status))
+	}
+	return `{"took":0,"errors":false,"items":[` + strings.Join(items, ",") + `]}`
+}
@@ -0,0 +1,152 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tailer
+
+import (
+	"encoding/json"
+	"github.com/fstab/grok_exporter/config/v2"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const lokiPushRequest = `{
+  "streams": [
+    {
+      "stream": {"job": "nginx", "host": "web-1"},
+      "values": [
+        ["1570818238000000000", "GET /index.html 200"],
+        ["1570818239000000000", "GET /missing 404", {"trace_id": "abc"}]
+      ]
+    },
+    {
+      "stream": {"job": "app"},
+      "values": [["1570818240000000000", "started"]]
+    }
+  ]
+}`
+
+// As sent by Filebeat. The second document is nested, like with Filebeat's default fields.
+const elasticsearchBulkRequest = `{"index":{"_index":"filebeat"}}
+{"@timestamp":"2019-10-11T18:23:58Z","message":"GET /index.html 200","host":{"name":"web-1"}}
+{"delete":{"_index":"filebeat","_id":"1"}}
+{"create":{"_index":"filebeat"}}
+{"message":"GET /missing 404","log":{"level":"warn"}}
+{"update":{"_index":"filebeat","_id":"2"}}
+{"doc":{"message":"updated"}}
+`
+
+// As sent by Fluent Bit's HTTP output with 'format json'.
+const fluentBitRequest = `[
+  {"date": 1570818238.123, "log": "GET /index.html 200", "kubernetes": {"pod_name": "web-1", "labels": {"app": "web"}}},
+  {"date": 1570818239.456, "log": "GET /missing 404", "stream": "stderr"}
+]`
+
+func TestWebhookLoki(t *testing.T) {
+	c := &v2.InputConfig{Type: "webhook", WebhookFormat: "loki"}
+	expectWebhookLines(t, c, lokiPushRequest, []fswatcher.Line{
+		{Line: "GET /index.html 200", Metadata: map[string]string{"job": "nginx", "host": "web-1"}},
+		{Line: "GET /missing 404", Metadata: map[string]string{"job": "nginx", "host": "web-1", "trace_id": "abc"}},
+		{Line: "started", Metadata: map[string]string{"job": "app"}},
+	})
+	for _, body := range []string{`[]`, `{"streams": [{"stream": {}}]}`, `{"streams": [{"values": [["1"]]}]}`, `{"streams": [{"values": [["1", 2]]}]}`} {
+		if _, err := WebhookProcessBody(c, []byte(body)); err == nil {
+			t.Fatalf("%v: expected error", body)
+		}
+	}
+}
+
+func TestWebhookElasticsearchBulk(t *testing.T) {
+	c := &v2.InputConfig{Type: "webhook", WebhookFormat: "elasticsearch_bulk", WebhookJsonSelector: ".message"}
+	expectWebhookLines(t, c, elasticsearchBulkRequest, []fswatcher.Line{
+		{Line: "GET /index.html 200", Metadata: map[string]string{"_timestamp": "2019-10-11T18:23:58Z", "message": "GET /index.html 200", "host_name": "web-1"}},
+		{Line: "GET /missing 404", Metadata: map[string]string{"message": "GET /missing 404", "log_level": "warn"}},
+		{Line: "updated", Metadata: map[string]string{"message": "updated"}},
+	})
+	for _, body := range []string{"{\"index\":{}}\n", "{\"index\":{}, \"create\":{}}\n{}\n", "{\"index\":{}}\n{\"msg\":\"no message\"}\n"} {
+		if _, err := WebhookProcessBody(c, []byte(body)); err == nil {
+			t.Fatalf("%q: expected error", body)
+		}
+	}
+}
+
+func TestWebhookFluentBit(t *testing.T) {
+	c := &v2.InputConfig{Type: "webhook", WebhookFormat: "fluentbit", WebhookJsonSelector: ".log"}
+	expectWebhookLines(t, c, fluentBitRequest, []fswatcher.Line{
+		{Line: "GET /index.html 200", Metadata: map[string]string{"date": "1570818238.123", "log": "GET /index.html 200", "kubernetes_pod_name": "web-1", "kubernetes_labels_app": "web"}},
+		{Line: "GET /missing 404", Metadata: map[string]string{"date": "1570818239.456", "log": "GET /missing 404", "stream": "stderr"}},
+	})
+}
+
+func TestWebhookFormatResponses(t *testing.T) {
+	for _, test := range []struct {
+		format         string
+		selector       string
+		body           string
+		contentType    string
+		expectedStatus int
+	}{
+		{"loki", ".message", lokiPushRequest, "application/json", http.StatusNoContent},
+		{"loki", ".message", "binary", "application/x-protobuf", http.StatusUnsupportedMediaType},
+		{"elasticsearch_bulk", ".message", elasticsearchBulkRequest, "application/x-ndjson", http.StatusOK},
+		{"fluentbit", ".log", fluentBitRequest, "application/json", http.StatusAccepted},
+		{"fluentbit", ".log", `{"log": "not an array"}`, "application/json", http.StatusBadRequest},
+	} {
+		tail, err := InitWebhookTailer(&v2.InputConfig{
+			Type:                "webhook",
+			WebhookFormat:       test.format,
+			WebhookJsonSelector: test.selector,
+			WebhookMaxBodySize:  1024 * 1024,
+			WebhookQueueSize:    1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(test.body))
+		r.Header.Set("Content-Type", test.contentType)
+		w := expectWebhookStatus(t, tail, r, test.expectedStatus)
+		if test.format == "elasticsearch_bulk" {
+			var response struct {
+				Errors bool
+				Items  []map[string]struct{ Status int }
+			}
+			if err = json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("invalid _bulk response %v: %v", w.Body.String(), err)
+			}
+			if response.Errors || len(response.Items) != 4 || response.Items[0]["index"].Status != 201 || response.Items[1]["delete"].Status != 200 {
+				t.Fatalf("unexpected _bulk response %v", w.Body.String())
+			}
+		}
+		tail.Close()
+	}
+}
+
+func expectWebhookLines(t *testing.T, c *v2.InputConfig, body string, expected []fswatcher.Line) {
+	lines, err := WebhookProcessBody(c, []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %v lines, but got %v", len(expected), len(lines))
+	}
+	for i := range expected {
+		if !reflect.DeepEqual(*lines[i], expected[i]) {
+			t.Fatalf("Expected %#v, but got %#v", expected[i], *lines[i])
+		}
+	}
+}
@@ -15,23 +15,58 @@
 package tailer
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"errors"
-	json "github.com/bitly/go-simplejson"
+	"fmt"
 	"github.com/fstab/grok_exporter/config/v2"
 	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"github.com/fstab/grok_exporter/tailer/jsonpath"
 	"github.com/sirupsen/logrus"
+	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Slack rejects requests with a timestamp older than five minutes to prevent replay attacks, we do the same.
+	slackMaxTimestampAge = 5 * time.Minute
+	// Retry-After header when the queue is full. The queue is usually drained within milliseconds,
+	// so clients should retry soon.
+	webhookRetryAfterSeconds = 1
 )
 
 type WebhookTailer struct {
-	lines  chan *fswatcher.Line
-	errors chan fswatcher.Error
-	config *v2.InputConfig
+	lines       chan *fswatcher.Line
+	errors      chan fswatcher.Error
+	config      *v2.InputConfig
+	bearerToken string                 // empty if bearer token authentication is not configured
+	rateLimiter *rateLimiter           // nil if rate limiting is not configured
+	queue       chan []*fswatcher.Line // lines of accepted requests that are not yet sent to the lines channel
+	done        chan struct{}
+
+	lock     sync.Mutex
+	rejected int // requests rejected because the queue was full
+	closed   bool
 }
 
-var webhookTailerSingleton *WebhookTailer
+// WebhookStats is the state of the webhook tailer's request queue.
+type WebhookStats struct {
+	QueueLength int // number of accepted requests waiting to be processed
+	Rejected    int // number of requests rejected because the queue was full
+}
 
 func (t *WebhookTailer) Lines() chan *fswatcher.Line {
 	return t.lines
@@ -41,64 +76,317 @@ func (t *WebhookTailer) Errors() chan fswatcher.Error {
 	return t.errors
 }
 
+// Close stops forwarding queued requests. The HTTP handler remains registered with the metrics server,
+// requests are rejected when the queue is full.
 func (t *WebhookTailer) Close() {
-	// NO-OP, since the webserver thread is handled by the metrics server
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.closed {
+		t.closed = true
+		close(t.done)
+	}
 }
 
-func InitWebhookTailer(inputConfig *v2.InputConfig) fswatcher.FileTailer {
-	if webhookTailerSingleton != nil {
-		return webhookTailerSingleton
+func (t *WebhookTailer) Stats() WebhookStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return WebhookStats{
+		QueueLength: len(t.queue),
+		Rejected:    t.rejected,
 	}
+}
 
+// There is one WebhookTailer for each webhook input.
+// The WebhookTailer is also the http.Handler that must be registered with the metrics server for the input's webhook_path.
+// Accepted requests are put into a queue and answered with 202 Accepted, so that the HTTP handler does not wait
+// for the lines to be processed. Rejected requests are answered with an HTTP error status,
+// they are not reported on the Errors() channel.
+func InitWebhookTailer(inputConfig *v2.InputConfig) (*WebhookTailer, error) {
 	lineChan := make(chan *fswatcher.Line)
 	errorChan := make(chan fswatcher.Error)
-	webhookTailerSingleton = &WebhookTailer{
+	result := &WebhookTailer{
 		lines:  lineChan,
 		errors: errorChan,
 		config: inputConfig,
+		queue:  make(chan []*fswatcher.Line, inputConfig.WebhookQueueSize),
+		done:   make(chan struct{}),
 	}
-	return webhookTailerSingleton
+	if inputConfig.WebhookBearerTokenFile != "" {
+		token, err := ioutil.ReadFile(inputConfig.WebhookBearerTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bearer token for input %v: %v", inputConfig.Name, err)
+		}
+		result.bearerToken = strings.TrimSpace(string(token))
+		if result.bearerToken == "" {
+			return nil, fmt.Errorf("failed to read bearer token for input %v: %v is empty", inputConfig.Name, inputConfig.WebhookBearerTokenFile)
+		}
+	}
+	if inputConfig.WebhookRateLimit > 0 {
+		result.rateLimiter = newRateLimiter(inputConfig.WebhookRateLimit, inputConfig.WebhookRateLimitBurst)
+	}
+	go result.forwardLines()
+	return result, nil
 }
 
-func WebhookHandler() http.Handler {
-	return webhookTailerSingleton
+// forwardLines sends the queued lines to the lines channel. The lines and errors channels are closed
+// when the tailer is closed, requests that are still in the queue are dropped.
+func (t *WebhookTailer) forwardLines() {
+	defer close(t.errors)
+	defer close(t.lines)
+	for {
+		select {
+		case lines := <-t.queue:
+			for _, line := range lines {
+				logrus.WithFields(logrus.Fields{
+					"line": line.Line,
+				}).Debug("Groking line")
+				select {
+				case t.lines <- line:
+				case <-t.done:
+					return
+				}
+			}
+		case <-t.done:
+			return
+		}
+	}
 }
 
-func (t WebhookTailer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func (t *WebhookTailer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Implement the http handler interface
 
-	wts := webhookTailerSingleton
-	lineChan := wts.lines
-	errorChan := wts.errors
+	if t.rateLimiter != nil {
+		if ok, retryAfter := t.rateLimiter.allow(clientAddress(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			t.reject(w, r, http.StatusTooManyRequests, errors.New("rate limit exceeded"))
+			return
+		}
+	}
+
+	if err := t.authenticate(r); err != nil {
+		if t.config.WebhookBasicAuthUsername != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="grok_exporter"`)
+		}
+		t.reject(w, r, http.StatusUnauthorized, err)
+		return
+	}
 
 	if r.Body == nil {
-		err := errors.New("got empty request body")
-		logrus.Warn(err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		errorChan <- fswatcher.NewError(fswatcher.NotSpecified, err, "")
+		t.reject(w, r, http.StatusBadRequest, errors.New("got empty request body"))
+		return
+	}
+	if t.config.WebhookFormat == webhookFormatLoki && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-protobuf") {
+		t.reject(w, r, http.StatusUnsupportedMediaType, errors.New("the Loki protobuf format is not supported, configure the client to send JSON"))
 		return
 	}
+	defer r.Body.Close()
 
-	b, err := ioutil.ReadAll(r.Body)
+	maxBodySize := int64(t.config.WebhookMaxBodySize)
+	if r.ContentLength > maxBodySize {
+		t.reject(w, r, http.StatusRequestEntityTooLarge, fmt.Errorf("request body exceeds %v bytes", maxBodySize))
+		return
+	}
+	// The Content-Length may be missing with chunked encoding, so the body is read up to one byte more than allowed.
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
 	if err != nil {
-		logrus.Warn(err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		errorChan <- fswatcher.NewError(fswatcher.NotSpecified, err, "")
+		t.reject(w, r, http.StatusBadRequest, err)
 		return
 	}
-	defer r.Body.Close()
+	if int64(len(b)) > maxBodySize {
+		t.reject(w, r, http.StatusRequestEntityTooLarge, fmt.Errorf("request body exceeds %v bytes", maxBodySize))
+		return
+	}
+
+	if err := t.verifySignature(r, b); err != nil {
+		t.reject(w, r, http.StatusUnauthorized, err)
+		return
+	}
+
+	// The signature is computed over the body as it was sent, so it must be verified before decompressing.
+	b, err = decompress(r.Header.Get("Content-Encoding"), b, maxBodySize)
+	switch {
+	case err == errUnsupportedEncoding:
+		t.reject(w, r, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported Content-Encoding %v", r.Header.Get("Content-Encoding")))
+		return
+	case err == errBodyTooLarge:
+		t.reject(w, r, http.StatusRequestEntityTooLarge, fmt.Errorf("decompressed request body exceeds %v bytes", maxBodySize))
+		return
+	case err != nil:
+		t.reject(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	lines, actions, err := processBody(t.config, b)
+	if err != nil {
+		t.reject(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	select {
+	case t.queue <- lines:
+		t.accept(w, actions)
+	default:
+		t.lock.Lock()
+		t.rejected++
+		t.lock.Unlock()
+		w.Header().Set("Retry-After", strconv.Itoa(webhookRetryAfterSeconds))
+		t.reject(w, r, http.StatusServiceUnavailable, errors.New("webhook queue is full"))
+	}
+}
+
+// accept writes the response expected by the clients of the webhook format.
+func (t *WebhookTailer) accept(w http.ResponseWriter, elasticsearchActions []string) {
+	switch t.config.WebhookFormat {
+	case webhookFormatLoki:
+		w.WriteHeader(http.StatusNoContent)
+	case webhookFormatElasticsearchBulk:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, elasticsearchBulkResponse(elasticsearchActions))
+	default:
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func (t *WebhookTailer) reject(w http.ResponseWriter, r *http.Request, status int, err error) {
+	logrus.WithFields(logrus.Fields{
+		"input":  t.config.Name,
+		"client": clientAddress(r),
+		"status": status,
+	}).Debugf("rejected webhook request: %v", err)
+	http.Error(w, err.Error(), status)
+}
+
+func (t *WebhookTailer) authenticate(r *http.Request) error {
+	switch {
+	case t.config.WebhookBasicAuthUsername != "":
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			return errors.New("basic authentication required")
+		}
+		usernameOk := subtle.ConstantTimeCompare([]byte(username), []byte(t.config.WebhookBasicAuthUsername)) == 1
+		passwordOk := subtle.ConstantTimeCompare([]byte(password), []byte(t.config.WebhookBasicAuthPassword)) == 1
+		if !usernameOk || !passwordOk {
+			return errors.New("invalid username or password")
+		}
+	case t.bearerToken != "":
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			return errors.New("bearer token required")
+		}
+		if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(header[len("Bearer "):])), []byte(t.bearerToken)) != 1 {
+			return errors.New("invalid bearer token")
+		}
+	}
+	return nil
+}
 
-	lines := WebhookProcessBody(wts.config, b)
-	for _, line := range lines {
-		logrus.WithFields(logrus.Fields{
-			"line": line,
-		}).Debug("Groking line")
-		lineChan <- &fswatcher.Line{Line: line}
+// verifySignature checks the HMAC-SHA256 signature of the request body.
+//
+//   - github: The 'X-Hub-Signature-256' header is 'sha256=' followed by the hex encoded HMAC of the body.
+//   - slack: The 'X-Slack-Signature' header is 'v0=' followed by the hex encoded HMAC of 'v0:<timestamp>:<body>',
+//     where the timestamp is taken from the 'X-Slack-Request-Timestamp' header.
+func (t *WebhookTailer) verifySignature(r *http.Request, body []byte) error {
+	var (
+		signature string
+		message   []byte
+	)
+	switch t.config.WebhookSignature {
+	case "github":
+		signature = r.Header.Get("X-Hub-Signature-256")
+		if !strings.HasPrefix(signature, "sha256=") {
+			return errors.New("missing X-Hub-Signature-256 header")
+		}
+		signature = signature[len("sha256="):]
+		message = body
+	case "slack":
+		signature = r.Header.Get("X-Slack-Signature")
+		if !strings.HasPrefix(signature, "v0=") {
+			return errors.New("missing X-Slack-Signature header")
+		}
+		signature = signature[len("v0="):]
+		timestamp := r.Header.Get("X-Slack-Request-Timestamp")
+		seconds, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return errors.New("missing or invalid X-Slack-Request-Timestamp header")
+		}
+		if age := time.Since(time.Unix(seconds, 0)); age > slackMaxTimestampAge || age < -slackMaxTimestampAge {
+			return errors.New("X-Slack-Request-Timestamp is too old")
+		}
+		message = []byte("v0:" + timestamp + ":" + string(body))
+	default:
+		return nil
 	}
-	return
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return errors.New("invalid signature")
+	}
+	mac := hmac.New(sha256.New, []byte(t.config.WebhookSignatureSecret))
+	mac.Write(message)
+	if !hmac.Equal(expected, mac.Sum(nil)) {
+		return errors.New("invalid signature")
+	}
+	return nil
 }
 
-func WebhookProcessBody(c *v2.InputConfig, b []byte) []string {
+var (
+	errUnsupportedEncoding = errors.New("unsupported content encoding")
+	errBodyTooLarge        = errors.New("body too large")
+)
+
+// decompress decodes a gzip or deflate request body. The size of the decompressed body is limited by
+// maxBodySize as well, so that a small compressed request cannot use up the memory.
+func decompress(encoding string, b []byte, maxBodySize int64) ([]byte, error) {
+	var (
+		reader io.Reader
+		err    error
+	)
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return b, nil
+	case "gzip", "x-gzip":
+		reader, err = gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress gzip body: %v", err)
+		}
+	case "deflate":
+		// HTTP deflate is zlib format, but some clients send raw deflate data.
+		reader, err = zlib.NewReader(bytes.NewReader(b))
+		if err != nil {
+			reader = flate.NewReader(bytes.NewReader(b))
+		}
+	default:
+		return nil, errUnsupportedEncoding
+	}
+	result, err := ioutil.ReadAll(io.LimitReader(reader, maxBodySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress %v body: %v", encoding, err)
+	}
+	if int64(len(result)) > maxBodySize {
+		return nil, errBodyTooLarge
+	}
+	return result, nil
+}
+
+// clientAddress is the remote IP address without the port.
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// WebhookProcessBody splits the request body into log lines according to the input's webhook_format.
+// For the JSON formats, the webhook_json_fields are added to the lines' metadata.
+// An error is returned if the body cannot be parsed, or if the webhook_json_selector is not found.
+func WebhookProcessBody(c *v2.InputConfig, b []byte) ([]*fswatcher.Line, error) {
+	lines, _, err := processBody(c, b)
+	return lines, err
+}
+
+// processBody is like WebhookProcessBody, but returns the actions of an elasticsearch_bulk request as well.
+func processBody(c *v2.InputConfig, b []byte) ([]*fswatcher.Line, []string, error) {
 
 	strs := []string{}
 
@@ -109,60 +397,100 @@ func WebhookProcessBody(c *v2.InputConfig, b []byte) []string {
 	case "text_bulk":
 		s := strings.TrimSpace(string(b))
 		strs = strings.Split(s, c.WebhookTextBulkSeparator)
-	case "json_single":
-		path := strings.Split(c.WebhookJsonSelector[1:], ".")
-		j, err := json.NewJson(b)
+	case "json_single", "json_bulk", "ndjson":
+		entries, err := jsonEntries(c.WebhookFormat, b)
 		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"post_body": string(b),
-			}).Warn("Unable to Parse JSON")
-			break
+			return nil, nil, err
 		}
-		s, err := j.GetPath(path...).String()
+		lines, err := jsonLines(c, entries)
+		return lines, nil, err
+	case webhookFormatLoki:
+		lines, err := lokiLines(b)
+		return lines, nil, err
+	case webhookFormatElasticsearchBulk:
+		return elasticsearchBulkLines(c, b)
+	case webhookFormatFluentBit:
+		lines, err := fluentBitLines(c, b)
+		return lines, nil, err
+	default:
+		return nil, nil, fmt.Errorf("unsupported webhook_format %v", c.WebhookFormat)
+	}
+
+	// Trim whitespace before and after every log entry
+	result := make([]*fswatcher.Line, 0, len(strs))
+	for _, s := range strs {
+		result = append(result, &fswatcher.Line{Line: strings.TrimSpace(s)})
+	}
+	return result, nil, nil
+}
+
+// jsonEntries parses the body into a list of JSON documents, each of which contains one or more log entries.
+func jsonEntries(format string, b []byte) ([]interface{}, error) {
+	switch format {
+	case "json_single":
+		entry, err := jsonpath.Unmarshal(b)
 		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"post_body":             string(b),
-				"webhook_json_selector": c.WebhookJsonSelector,
-			}).Warn("Unable to find selector path")
-			break
+			return nil, fmt.Errorf("unable to parse JSON: %v", err)
 		}
-		strs = append(strs, s)
+		return []interface{}{entry}, nil
 	case "json_bulk":
-		path := strings.Split(c.WebhookJsonSelector[1:], ".")
-		j, err := json.NewJson(b)
+		doc, err := jsonpath.Unmarshal(b)
 		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"post_body": string(b),
-			}).Warn("Unable to Parse JSON")
-			break
+			return nil, fmt.Errorf("unable to parse JSON: %v", err)
 		}
-
-		for _, ei := range j.MustArray() {
-			// Cast the entry interface{} back to the Json object.
-			//   Unfortunately, this is how the simplejson lib works.
-			ej := json.New()
-			ej.Set("x", ei)
-			new_path := []string{}
-			new_path = append([]string{"x"}, path...)
-
-			s, err := ej.GetPath(new_path...).String()
+		entries, ok := doc.([]interface{})
+		if !ok {
+			return nil, errors.New("unable to parse JSON: expected an array of log entries")
+		}
+		return entries, nil
+	default: // ndjson
+		var entries []interface{}
+		for i, line := range strings.Split(string(b), "\n") {
+			if len(strings.TrimSpace(line)) == 0 {
+				continue
+			}
+			entry, err := jsonpath.Unmarshal([]byte(line))
 			if err != nil {
-				logrus.WithFields(logrus.Fields{
-					"post_body":             string(b),
-					"webhook_json_selector": c.WebhookJsonSelector,
-				}).Warn("Unable to find selector path")
-				break
+				return nil, fmt.Errorf("unable to parse JSON in line %v: %v", i+1, err)
 			}
-			strs = append(strs, s)
+			entries = append(entries, entry)
 		}
-	default:
-		// error silently
+		return entries, nil
 	}
+}
 
-	// Trim whitespace before and after every log entry
-	for i, _ := range strs {
-		strs[i] = strings.TrimSpace(strs[i])
+// jsonLines applies the webhook_json_selector to each entry. The webhook_json_fields are relative to
+// the array element matched by the selector's last wildcard, or relative to the entry if there is no wildcard.
+func jsonLines(c *v2.InputConfig, entries []interface{}) ([]*fswatcher.Line, error) {
+	selector, err := jsonpath.Parse(c.WebhookJsonSelector)
+	if err != nil {
+		return nil, err
 	}
-
-	return strs
+	fields := make(map[string]jsonpath.Path, len(c.WebhookJsonFields))
+	for name, path := range c.WebhookJsonFields {
+		fields[name], err = jsonpath.Parse(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var result []*fswatcher.Line
+	for _, entry := range entries {
+		matches := selector.Find(entry)
+		if len(matches) == 0 && !selector.HasWildcard() {
+			return nil, fmt.Errorf("unable to find webhook_json_selector %v", c.WebhookJsonSelector)
+		}
+		for _, match := range matches {
+			line := &fswatcher.Line{Line: strings.TrimSpace(jsonpath.String(match.Value))}
+			if len(fields) > 0 {
+				line.Metadata = make(map[string]string, len(fields))
+				for name, path := range fields {
+					if value, found := path.FindFirst(match.Entry); found {
+						line.Metadata[name] = jsonpath.String(value)
+					}
+				}
+			}
+			result = append(result, line)
+		}
+	}
+	return result, nil
 }
@@ -15,10 +15,26 @@
 package tailer
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"github.com/fstab/grok_exporter/config/v2"
+	"github.com/fstab/grok_exporter/tailer/fswatcher"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestWebhookTextSingle(t *testing.T) {
@@ -32,11 +48,14 @@ func TestWebhookTextSingle(t *testing.T) {
 
 	message := "2016-04-18 09:33:27 H=(85.214.241.101) [114.37.190.56] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted"
 	fmt.Printf("Sending Payload: %v", message)
-	lines := WebhookProcessBody(c, []byte(message))
+	lines, err := WebhookProcessBody(c, []byte(message))
+	if err != nil {
+		t.Fatal(err)
+	}
 	if len(lines) != 1 {
 		t.Fatal("Expected 1 line processed")
 	}
-	if lines[0] != message {
+	if lines[0].Line != message {
 		t.Fatal("Expected line to match")
 	}
 }
@@ -57,12 +76,15 @@ func TestWebhookTextBulk(t *testing.T) {
 	}
 	payload := strings.Join(messages, c.WebhookTextBulkSeparator)
 	fmt.Printf("Sending Payload: %v", payload)
-	lines := WebhookProcessBody(c, []byte(payload))
+	lines, err := WebhookProcessBody(c, []byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
 	if len(lines) != len(messages) {
 		t.Fatal("Expected number of lines to equal number of messages")
 	}
 	for i, _ := range messages {
-		if messages[i] != lines[i] {
+		if messages[i] != lines[i].Line {
 			t.Fatal("Expected line to match")
 		}
 	}
@@ -85,7 +107,10 @@ func TestWebhookTextBulkNegative(t *testing.T) {
 	}
 	payload := strings.Join(messages, "\t\t")
 	fmt.Printf("Sending Payload: %v", payload)
-	lines := WebhookProcessBody(c, []byte(payload))
+	lines, err := WebhookProcessBody(c, []byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
 	if len(lines) == len(messages) {
 		t.Fatal("Expected number of lines to equal number of messages")
 	}
@@ -106,11 +131,14 @@ func TestWebhookJsonSingle(t *testing.T) {
 	message := "2016-04-18 09:33:27 H=(85.214.241.101) [114.37.190.56] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted"
 	s := createJsonBlob(message)
 	fmt.Printf("Sending Payload: %v", s)
-	lines := WebhookProcessBody(c, []byte(s))
+	lines, err := WebhookProcessBody(c, []byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
 	if len(lines) != 1 {
 		t.Fatal("Expected 1 line processed")
 	}
-	if lines[0] != message {
+	if lines[0].Line != message {
 		t.Fatal("Expected line to match")
 	}
 }
@@ -128,9 +156,9 @@ func TestWebhookJsonSingleNegativeWebhookJsonSelector(t *testing.T) {
 	message := "2016-04-18 09:33:27 H=(85.214.241.101) [114.37.190.56] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted"
 	s := createJsonBlob(message)
 	fmt.Printf("Sending Payload: %v", s)
-	lines := WebhookProcessBody(c, []byte(s))
-	if len(lines) != 0 {
-		t.Fatal("Expected 1 line processed")
+	lines, err := WebhookProcessBody(c, []byte(s))
+	if err == nil || len(lines) != 0 {
+		t.Fatal("Expected an error and 0 lines processed")
 	}
 }
 
@@ -147,9 +175,9 @@ func TestWebhookJsonSingleNegativeMalformedJson(t *testing.T) {
 	message := "2016-04-18 09:33:27 H=(85.214.241.101) [114.37.190.56] F=<z2007tw@yahoo.com.tw> rejected RCPT <alan.a168@msa.hinet.net>: relay not permitted"
 	s := createMalformedJsonBlob(message)
 	fmt.Printf("Sending Payload: %v", s)
-	lines := WebhookProcessBody(c, []byte(s))
-	if len(lines) != 0 {
-		t.Fatal("Expected 0 lines processed")
+	lines, err := WebhookProcessBody(c, []byte(s))
+	if err == nil || len(lines) != 0 {
+		t.Fatal("Expected an error and 0 lines processed")
 	}
 }
 
@@ -178,12 +206,15 @@ func TestWebhookJsonBulk(t *testing.T) {
 	}
 	s := "[\n" + strings.Join(blobs, ",\n") + "\n]"
 	fmt.Printf("Sending Payload: %v", s)
-	lines := WebhookProcessBody(c, []byte(s))
+	lines, err := WebhookProcessBody(c, []byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
 	if len(lines) != len(messages) {
 		t.Fatal("Expected number of lines to equal number of messages")
 	}
 	for i, _ := range messages {
-		if messages[i] != lines[i] {
+		if messages[i] != lines[i].Line {
 			t.Fatal("Expected line to match")
 		}
 	}
@@ -214,12 +245,131 @@ func TestWebhookJsonBulkNegativeMalformedJson(t *testing.T) {
 	}
 	s := "[\n" + strings.Join(blobs, ",\n") + "\n]"
 	fmt.Printf("Sending Payload: %v", s)
-	lines := WebhookProcessBody(c, []byte(s))
-	if len(lines) != 0 {
-		t.Fatal("Expected 0 lines processed")
+	lines, err := WebhookProcessBody(c, []byte(s))
+	if err == nil || len(lines) != 0 {
+		t.Fatal("Expected an error and 0 lines processed")
+	}
+}
+
+func TestWebhookNdjson(t *testing.T) {
+	c := &v2.InputConfig{
+		Type:                "webhook",
+		WebhookFormat:       "ndjson",
+		WebhookJsonSelector: ".log",
+		WebhookJsonFields: map[string]string{
+			"level": ".level",
+			"host":  ".kubernetes.host",
+		},
+	}
+	body := "{\"log\": \"line 1\", \"level\": \"info\", \"kubernetes\": {\"host\": \"node-1\"}}\n\n{\"log\": \"line 2\", \"level\": 3}\n"
+	lines, err := WebhookProcessBody(c, []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []fswatcher.Line{
+		{Line: "line 1", Metadata: map[string]string{"level": "info", "host": "node-1"}},
+		{Line: "line 2", Metadata: map[string]string{"level": "3"}},
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %v lines, but got %v", len(expected), len(lines))
+	}
+	for i := range expected {
+		if !reflect.DeepEqual(*lines[i], expected[i]) {
+			t.Fatalf("Expected %#v, but got %#v", expected[i], *lines[i])
+		}
+	}
+	if _, err = WebhookProcessBody(c, []byte("{\"log\": \"line 1\"}\n{\"log\": ")); err == nil {
+		t.Fatal("Expected error for malformed line")
+	}
+}
+
+func TestWebhookJsonPathSelector(t *testing.T) {
+	c := &v2.InputConfig{
+		Type:                "webhook",
+		WebhookFormat:       "json_single",
+		WebhookJsonSelector: ".records[*].message",
+		WebhookJsonFields: map[string]string{
+			"service": ".service",
+		},
+	}
+	body := `{"records": [{"message": "a", "service": "api"}, {"message": "b"}, {"service": "no message"}]}`
+	lines, err := WebhookProcessBody(c, []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 || lines[0].Line != "a" || lines[0].Metadata["service"] != "api" || lines[1].Line != "b" || len(lines[1].Metadata) != 0 {
+		t.Fatalf("Unexpected lines %v and %v", lines[0], lines[1])
+	}
+	// With a wildcard, an empty array is not an error.
+	lines, err = WebhookProcessBody(c, []byte(`{"records": []}`))
+	if err != nil || len(lines) != 0 {
+		t.Fatalf("Expected 0 lines and no error, but got %v lines and error %v", len(lines), err)
+	}
+	c.WebhookFormat = "json_bulk"
+	c.WebhookJsonSelector = ".events[].log"
+	lines, err = WebhookProcessBody(c, []byte(`[{"events": [{"log": "x"}]}, {"events": [{"log": "y"}, {"log": "z"}]}]`))
+	if err != nil || len(lines) != 3 || lines[2].Line != "z" {
+		t.Fatalf("Expected lines x, y, z, but got %v lines and error %v", len(lines), err)
+	}
+}
+
+func TestWebhookCompression(t *testing.T) {
+	tail, err := InitWebhookTailer(&v2.InputConfig{
+		Type:               "webhook",
+		WebhookFormat:      "text_single",
+		WebhookMaxBodySize: 100,
+		WebhookQueueSize:   10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tail.Close()
+	for _, test := range []struct {
+		encoding       string
+		body           []byte
+		expectedStatus int
+	}{
+		{"gzip", compress(t, "gzip", "gzip line"), http.StatusAccepted},
+		{"deflate", compress(t, "deflate", "deflate line"), http.StatusAccepted},
+		{"gzip", []byte("not gzip"), http.StatusBadRequest},
+		{"br", []byte("whatever"), http.StatusUnsupportedMediaType},
+		{"gzip", compress(t, "gzip", strings.Repeat("x", 1000)), http.StatusRequestEntityTooLarge},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(test.body))
+		r.Header.Set("Content-Encoding", test.encoding)
+		expectWebhookStatus(t, tail, r, test.expectedStatus)
+		if test.expectedStatus == http.StatusAccepted {
+			select {
+			case line := <-tail.Lines():
+				if line.Line != test.encoding+" line" {
+					t.Fatalf("Expected %q, but got %q", test.encoding+" line", line.Line)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timeout while waiting for %v line", test.encoding)
+			}
+		}
 	}
 }
 
+func compress(t *testing.T, encoding string, data string) []byte {
+	var (
+		result = &bytes.Buffer{}
+		writer io.WriteCloser
+	)
+	if encoding == "gzip" {
+		writer = gzip.NewWriter(result)
+	} else {
+		writer = zlib.NewWriter(result)
+	}
+	if _, err := writer.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return result.Bytes()
+}
+
 func createJsonBlob(message string) string {
 	s := fmt.Sprintf(`{
   "message": "%v",
@@ -249,3 +399,187 @@ func createMalformedJsonBlob(message string) string {
 }`, message)
 	return s
 }
+
+func TestWebhookAuthentication(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grok_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err = ioutil.WriteFile(tokenFile, []byte("abc123\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	basicAuth := runWebhookTailer(t, &v2.InputConfig{
+		WebhookBasicAuthUsername: "alice",
+		WebhookBasicAuthPassword: "secret",
+	})
+	bearer := runWebhookTailer(t, &v2.InputConfig{
+		WebhookBearerTokenFile: tokenFile,
+	})
+	for _, test := range []struct {
+		tailer         *WebhookTailer
+		setHeader      func(r *http.Request)
+		expectedStatus int
+	}{
+		{basicAuth, func(r *http.Request) {}, http.StatusUnauthorized},
+		{basicAuth, func(r *http.Request) { r.SetBasicAuth("alice", "wrong") }, http.StatusUnauthorized},
+		{basicAuth, func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, http.StatusAccepted},
+		{bearer, func(r *http.Request) {}, http.StatusUnauthorized},
+		{bearer, func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }, http.StatusUnauthorized},
+		{bearer, func(r *http.Request) { r.Header.Set("Authorization", "Bearer abc123") }, http.StatusAccepted},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader("hello"))
+		test.setHeader(r)
+		expectWebhookStatus(t, test.tailer, r, test.expectedStatus)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	github := runWebhookTailer(t, &v2.InputConfig{
+		WebhookSignature:       "github",
+		WebhookSignatureSecret: "s3cr3t",
+	})
+	slack := runWebhookTailer(t, &v2.InputConfig{
+		WebhookSignature:       "slack",
+		WebhookSignatureSecret: "s3cr3t",
+	})
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+	for _, test := range []struct {
+		tailer         *WebhookTailer
+		headers        map[string]string
+		expectedStatus int
+	}{
+		{github, map[string]string{}, http.StatusUnauthorized},
+		{github, map[string]string{"X-Hub-Signature-256": "sha256=" + sign("s3cr3t", "hello")}, http.StatusAccepted},
+		{github, map[string]string{"X-Hub-Signature-256": "sha256=" + sign("wrong", "hello")}, http.StatusUnauthorized},
+		{slack, map[string]string{"X-Slack-Request-Timestamp": now, "X-Slack-Signature": "v0=" + sign("s3cr3t", "v0:"+now+":hello")}, http.StatusAccepted},
+		{slack, map[string]string{"X-Slack-Request-Timestamp": now, "X-Slack-Signature": "v0=" + sign("s3cr3t", "hello")}, http.StatusUnauthorized},
+		{slack, map[string]string{"X-Slack-Request-Timestamp": old, "X-Slack-Signature": "v0=" + sign("s3cr3t", "v0:"+old+":hello")}, http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader("hello"))
+		for name, value := range test.headers {
+			r.Header.Set(name, value)
+		}
+		expectWebhookStatus(t, test.tailer, r, test.expectedStatus)
+	}
+}
+
+func TestWebhookMaxBodySize(t *testing.T) {
+	tail := runWebhookTailer(t, &v2.InputConfig{
+		WebhookMaxBodySize: 5,
+	})
+	expectWebhookStatus(t, tail, httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader("hello")), http.StatusAccepted)
+	expectWebhookStatus(t, tail, httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader("hello world")), http.StatusRequestEntityTooLarge)
+	// without Content-Length, the limit is detected while reading the body
+	r := httptest.NewRequest(http.MethodPost, "/webhook", ioutil.NopCloser(strings.NewReader("hello world")))
+	r.ContentLength = -1
+	expectWebhookStatus(t, tail, r, http.StatusRequestEntityTooLarge)
+}
+
+func TestWebhookRateLimit(t *testing.T) {
+	tail := runWebhookTailer(t, &v2.InputConfig{
+		WebhookRateLimit:      0.01,
+		WebhookRateLimitBurst: 2,
+	})
+	request := func(remoteAddr string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader("hello"))
+		r.RemoteAddr = remoteAddr
+		return r
+	}
+	expectWebhookStatus(t, tail, request("10.0.0.1:1234"), http.StatusAccepted)
+	expectWebhookStatus(t, tail, request("10.0.0.1:1235"), http.StatusAccepted)
+	w := expectWebhookStatus(t, tail, request("10.0.0.1:1236"), http.StatusTooManyRequests)
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expected Retry-After header in 429 response.")
+	}
+	expectWebhookStatus(t, tail, request("10.0.0.2:1234"), http.StatusAccepted)
+}
+
+func TestWebhookQueue(t *testing.T) {
+	tail, err := InitWebhookTailer(&v2.InputConfig{
+		Type:                "webhook",
+		WebhookPath:         "/webhook",
+		WebhookFormat:       "json_single",
+		WebhookJsonSelector: ".message",
+		WebhookMaxBodySize:  1024,
+		WebhookQueueSize:    2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tail.Close()
+	request := func(body string) *http.Request {
+		return httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+	}
+	// Nobody reads the lines. The first request is taken from the queue by the forwarding goroutine,
+	// which then blocks on the lines channel. After that, the queue fills up.
+	expectWebhookStatus(t, tail, request(`{"message": "line 1"}`), http.StatusAccepted)
+	waitForQueueLength(t, tail, 0)
+	expectWebhookStatus(t, tail, request(`{"message": "line 2"}`), http.StatusAccepted)
+	expectWebhookStatus(t, tail, request(`{"message": "line 3"}`), http.StatusAccepted)
+	w := expectWebhookStatus(t, tail, request(`{"message": "line 4"}`), http.StatusServiceUnavailable)
+	if w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("Expected Retry-After header in 503 response.")
+	}
+	expectWebhookStatus(t, tail, request(`{"message": `), http.StatusBadRequest)
+	stats := tail.Stats()
+	if stats.QueueLength != 2 || stats.Rejected != 1 {
+		t.Fatalf("Expected queue length 2 and 1 rejected request, but got %#v", stats)
+	}
+	for i := 1; i <= 3; i++ {
+		select {
+		case line := <-tail.Lines():
+			if line.Line != fmt.Sprintf("line %v", i) {
+				t.Fatalf("Expected \"line %v\", but got %q", i, line.Line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout while waiting for line %v", i)
+		}
+	}
+}
+
+func waitForQueueLength(t *testing.T, tail *WebhookTailer, expected int) {
+	for i := 0; tail.Stats().QueueLength != expected; i++ {
+		if i > 500 {
+			t.Fatalf("Expected queue length %v, but got %v", expected, tail.Stats().QueueLength)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// runWebhookTailer initializes a text_single webhook tailer with the given options and consumes its lines.
+func runWebhookTailer(t *testing.T, c *v2.InputConfig) *WebhookTailer {
+	c.Type = "webhook"
+	c.WebhookPath = "/webhook"
+	c.WebhookFormat = "text_single"
+	if c.WebhookMaxBodySize == 0 {
+		c.WebhookMaxBodySize = 1024
+	}
+	c.WebhookQueueSize = 10
+	tail, err := InitWebhookTailer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range tail.Lines() {
+		}
+	}()
+	return tail
+}
+
+func expectWebhookStatus(t *testing.T, tail *WebhookTailer, r *http.Request, expectedStatus int) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	tail.ServeHTTP(w, r)
+	if w.Code != expectedStatus {
+		t.Fatalf("Expected status %v, but got %v: %v", expectedStatus, w.Code, w.Body.String())
+	}
+	return w
+}
+
+func sign(secret, message string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
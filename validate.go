@@ -0,0 +1,107 @@
+// Copyright 2019 The grok_exporter Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"github.com/fstab/grok_exporter/config"
+	"github.com/fstab/grok_exporter/config/v2"
+	"github.com/fstab/grok_exporter/exporter"
+	"os"
+)
+
+// validateConfigFile checks the config file and prints all errors found.
+// Unlike normal startup, it does not stop at the first error, and it does not read any logs or open any ports.
+// The return value is false if errors were found.
+func validateConfigFile(path string) bool {
+	cfg, warn, errs := config.ValidateConfigFile(path)
+	if len(warn) > 0 {
+		fmt.Fprintf(os.Stderr, "WARNING: %v\n", warn)
+	}
+	if cfg != nil {
+		errs = append(errs, grokValidationErrors(cfg)...)
+	}
+	for _, err := range errs {
+		if len(err.File) > 0 {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		} else {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", path, err)
+		}
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "%v: found %v error(s).\n", path, len(errs))
+		return false
+	}
+	fmt.Printf("%v: configuration is valid.\n", path)
+	return true
+}
+
+// grokValidationErrors finds undefined grok patterns, invalid regular expressions,
+// and templates referencing grok fields that are not defined in the match pattern.
+func grokValidationErrors(cfg *v2.Config) []*v2.ValidationError {
+	patterns, err := initPatterns(cfg)
+	if err != nil {
+		return []*v2.ValidationError{{Err: err}}
+	}
+	var result []*v2.ValidationError
+	for _, input := range cfg.InputConfigs() {
+		if input.Multiline != nil && len(input.Multiline.Pattern) > 0 {
+			regex, err := exporter.Compile(input.Multiline.Pattern, patterns)
+			if err != nil {
+				result = append(result, &v2.ValidationError{Err: fmt.Errorf("invalid multiline pattern for input %v: %v", input.Name, err.Error())})
+			} else {
+				regex.Free()
+			}
+		}
+	}
+	for i := range cfg.Metrics {
+		var (
+			m                      = &cfg.Metrics[i]
+			matcher, deleteMatcher exporter.Matcher
+			metricErrors           []error
+		)
+		if len(m.Match) > 0 || m.HasFieldMatcher() {
+			matcher, err = exporter.NewMatcher(m, patterns)
+			if err != nil {
+				metricErrors = append(metricErrors, err)
+			}
+		}
+		if len(m.DeleteMatch) > 0 {
+			deleteRegex, err := exporter.Compile(m.DeleteMatch, patterns)
+			if err != nil {
+				metricErrors = append(metricErrors, err)
+			}
+			deleteMatcher = exporter.NewGrokMatcher(deleteRegex)
+		}
+		if matcher != nil && (deleteMatcher != nil || len(m.DeleteLabelTemplates) == 0) {
+			metricErrors = append(metricErrors, exporter.FieldNameErrors(m, matcher, deleteMatcher, metadataFields(cfg, m))...)
+		}
+		for _, err := range metricErrors {
+			result = append(result, &v2.ValidationError{
+				File:   m.File,
+				Line:   m.Line,
+				Metric: m.Name,
+				Err:    err,
+			})
+		}
+		if matcher != nil {
+			matcher.Free()
+		}
+		if deleteMatcher != nil {
+			deleteMatcher.Free()
+		}
+	}
+	return result
+}